@@ -2,48 +2,264 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc64"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// fsync policies, same as the appendfsync option of Redis
+const (
+	FsyncAlways = "always"
+	FsyncEverysec = "everysec"
+	FsyncNo = "no"
+)
+
 type Aof struct {
-	file *os.File
+	file *os.File // the last incr file, commands are appended to it
 	rd *bufio.Reader
 	mu sync.Mutex
+	dir string
+	name string
+	manifest *aofManifest
+	l *Log
+	fsync string
+	loadTruncated bool
+	usePreamble bool
+	stop chan struct{}
+	done chan struct{}
+
+	// size and CRC64 of the base and incr files as if they were one file,
+	// they let a snapshot find its place in the AOF
+	size int64
+	crc uint64
+	baseSize int64 // size right after the last rewrite or at startup
+	rewriting bool
+	rewriteIncr int64 // seq of the incr file opened when the rewrite started
+	rewrites sync.WaitGroup // the running rewrite goroutine, AofClose waits for it
+
+	autoRewritePercentage int64
+	autoRewriteMinSize int64
 }
 
-func NewAof(path string) (*Aof, error) {
-	f, err := os.OpenFile(path, os.O_CREATE | os.O_RDWR, 0666)
-	if err != nil {
+// NewAof opens the AOF called name in dir. A single file AOF of an older
+// version next to dir becomes the base file of the new layout.
+func NewAof(dir string, name string, l *Log) (*Aof, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
 	aof := &Aof{
-		file: f,
-		rd: bufio.NewReader(f),
+		dir: dir,
+		name: name,
+		l: l,
+		fsync: FsyncEverysec,
+		loadTruncated: true,
+		usePreamble: true,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		autoRewritePercentage: 100,
+		autoRewriteMinSize: 64 * 1024 * 1024,
+	}
+
+	manifest, err := loadManifest(aof.manifestPath())
+	if err != nil {
+		return nil, err
 	}
 
-	go func() {
-		for {
+	if manifest == nil {
+		manifest = &aofManifest{}
+		base := &aofFile{name: aofBaseName(name, 1, false), seq: 1, typ: aofTypeBase}
+
+		legacy := filepath.Join(filepath.Dir(dir), name)
+		if _, err := os.Stat(legacy); err == nil {
+			if err := os.Rename(legacy, aof.filePath(base.name)); err != nil {
+				return nil, err
+			}
+			l.Info("Moved " + legacy + " to " + aof.filePath(base.name))
+		}
+
+		// a base file without a manifest is a legacy file moved right before
+		// a crash, the manifest listing it was never written
+		if _, err := os.Stat(aof.filePath(base.name)); err == nil {
+			manifest.baseSeq = 1
+			manifest.base = base
+		}
+	}
+
+	if len(manifest.incrs) == 0 {
+		manifest.incrSeq++
+		manifest.incrs = append(manifest.incrs, &aofFile{name: aofIncrName(name, manifest.incrSeq), seq: manifest.incrSeq, typ: aofTypeIncr})
+	}
+
+	if err := aof.commitManifest(manifest); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(aof.filePath(manifest.incrs[len(manifest.incrs) - 1].name), os.O_CREATE | os.O_RDWR | os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	aof.file = f
+	aof.rd = bufio.NewReader(f)
+
+	for _, file := range manifest.files() {
+		info, err := os.Stat(aof.filePath(file.name))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		aof.size += info.Size()
+	}
+	aof.baseSize = aof.size
+
+	go aof.syncer()
+
+	return aof, nil
+}
+
+func (aof *Aof) manifestPath() string {
+	return filepath.Join(aof.dir, aof.name + ".manifest")
+}
+
+func (aof *Aof) filePath(name string) string {
+	return filepath.Join(aof.dir, name)
+}
+
+// commitManifest persists m and deletes the files it no longer lists.
+func (aof *Aof) commitManifest(m *aofManifest) error {
+	history := m.history
+	m.history = nil
+
+	if err := m.save(aof.manifestPath()); err != nil {
+		m.history = history
+		return err
+	}
+
+	if aof.manifest != nil {
+		history = append(history, aof.manifest.files()...)
+	}
+	aof.manifest = m
+
+	listed := make(map[string]bool)
+	for _, file := range m.files() {
+		listed[file.name] = true
+	}
+
+	for _, file := range history {
+		if !listed[file.name] {
+			os.Remove(aof.filePath(file.name))
+		}
+	}
+
+	return nil
+}
+
+// syncer flushes the file once per second while the policy is everysec.
+func (aof *Aof) syncer() {
+	defer close(aof.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-aof.stop:
+			return
+		case <-ticker.C:
 			aof.mu.Lock()
 
-			aof.file.Sync()
+			if aof.fsync == FsyncEverysec {
+				aof.file.Sync()
+			}
 
 			aof.mu.Unlock()
+		}
+	}
+}
 
-			time.Sleep(time.Second)
+// SetFsync changes the fsync policy at runtime.
+func (aof *Aof) SetFsync(policy string) error {
+	if policy != FsyncAlways && policy != FsyncEverysec && policy != FsyncNo {
+		return errors.New("invalid appendfsync value, must be always, everysec or no")
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.fsync != policy && policy == FsyncAlways {
+		if err := aof.file.Sync(); err != nil {
+			return err
 		}
-	} ()
+	}
+	aof.fsync = policy
 
-	return aof, nil
+	return nil
+}
+
+func (aof *Aof) Fsync() string {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.fsync
+}
+
+// SetLoadTruncated decides whether AofRead accepts a file whose last command
+// is incomplete.
+func (aof *Aof) SetLoadTruncated(on bool) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.loadTruncated = on
+}
+
+func (aof *Aof) LoadTruncated() bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.loadTruncated
+}
+
+// SetUsePreamble decides whether rewrites start the file with a snapshot
+// of the data instead of commands.
+func (aof *Aof) SetUsePreamble(on bool) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.usePreamble = on
+}
+
+func (aof *Aof) UsePreamble() bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.usePreamble
 }
 
+// AofClose stops the background syncer, waits for a running rewrite to
+// switch the files over, then flushes and closes the file.
 func (aof *Aof) AofClose() error {
+	close(aof.stop)
+	<-aof.done
+
+	// the rewrite takes aof.mu to finish, it can't be held while waiting
+	aof.rewrites.Wait()
+
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
+	if aof.fsync != FsyncNo {
+		aof.file.Sync()
+	}
+
 	return aof.file.Close()
 }
 
@@ -51,32 +267,671 @@ func (aof *Aof) AofWrite(value Value) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	if _, err := aof.file.Write(value.replyValue()); err != nil {
-		return err
+	return aof.write(value)
+}
+
+func (aof *Aof) write(value Value) error {
+	bytes := value.replyValue()
+
+	n, err := aof.file.Write(bytes)
+	aof.size += int64(n)
+	aof.crc = crc64.Update(aof.crc, crcTable, bytes[:n])
+
+	return err
+}
+
+// AofExec runs a write command and appends it to the file under the same lock,
+// so the order of commands in the file is the order they were executed in.
+func (aof *Aof) AofExec(dt *DataType, handler func(*DataType, []Value) Value, command string, args []Value) Value {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	result := handler(dt, args)
+
+	// the keys the command, or reads before it, found expired are missing
+	// to clients, but the replay doesn't expire keys. Like Redis, DEL them
+	// in front of the command.
+	var values []Value
+	for _, key := range dt.takeLazyExpired() {
+		values = append(values, commandValue("DEL", key))
+	}
+
+	if result.typ != "error" {
+		values = append(values, aofCommands(dt, command, args, result)...)
+	} else if len(values) == 0 {
+		return result
+	}
+
+	for _, value := range values {
+		if err := aof.write(value); err != nil {
+			return Value{typ: "error", str: "failed to append to AOF: " + err.Error()}
+		}
+	}
+
+	if aof.fsync == FsyncAlways {
+		if err := aof.file.Sync(); err != nil {
+			return Value{typ: "error", str: "failed to fsync AOF: " + err.Error()}
+		}
+	}
+
+	if aof.needsRewrite() {
+		if err := aof.startRewrite(dt); err != nil {
+			aof.l.Error(err)
+		}
+	}
+
+	return result
+}
+
+// AofPropagate runs fn, which changes the data on behalf of the server
+// itself rather than a client, and appends the commands it returns. Holding
+// the lock keeps them in order with the commands of clients.
+func (aof *Aof) AofPropagate(fn func() []Value) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	values := fn()
+	if len(values) == 0 {
+		return nil
+	}
+
+	for _, value := range values {
+		if err := aof.write(value); err != nil {
+			return errors.New("failed to append to AOF: " + err.Error())
+		}
+	}
+
+	if aof.fsync == FsyncAlways {
+		if err := aof.file.Sync(); err != nil {
+			return errors.New("failed to fsync AOF: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// aofCommands returns the commands that reproduce an executed write command.
+// Relative expirations are turned into PEXPIREAT with the absolute deadline,
+// so replaying the file later does not give keys a fresh TTL. Commands with
+// a random outcome are logged as what they did, SPOP becomes SREM of the
+// members it returned and XADD gets the ID it generated. Consumer group
+// commands log the state they left the group in.
+func aofCommands(dt *DataType, command string, args []Value, result Value) []Value {
+	switch command {
+	case "SETEX", "PSETEX":
+		return []Value{
+			commandValue("SET", args[0].bulk, args[2].bulk),
+			expireCommand(dt, args[0].bulk),
+		}
+	case "SET":
+		opts, _ := parseSetOptions(args[2:])
+
+		// with GET the reply is the old value, which tells whether the key
+		// existed and so whether NX or XX let it be set
+		set := result.typ != "null"
+		if opts.get {
+			existed := result.typ == "bulk"
+			set = !(opts.nx && existed || opts.xx && !existed)
+		}
+
+		if !set {
+			return nil
+		}
+
+		return []Value{setCommand(dt, args[0].bulk, args[1].bulk)}
+	case "GETEX":
+		if len(args) == 1 || result.typ == "null" {
+			return nil
+		}
+
+		if len(args) == 2 {
+			return []Value{commandValue("PERSIST", args[0].bulk)}
+		}
+
+		return []Value{expireCommand(dt, args[0].bulk)}
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		// nothing changed if a condition failed
+		if result.num == 0 {
+			return nil
+		}
+
+		return []Value{expireCommand(dt, args[0].bulk)}
+	case "PERSIST":
+		if result.num == 0 {
+			return nil
+		}
+	case "RESTORE":
+		return []Value{restoreCommand(dt, args[0].bulk, args[2].bulk)}
+	case "SPOP":
+		cmd := commandValue("SREM", args[0].bulk)
+		if result.typ == "bulk" {
+			cmd.array = append(cmd.array, result)
+		} else {
+			cmd.array = append(cmd.array, result.array...)
+		}
+
+		if len(cmd.array) == 2 {
+			return nil
+		}
+
+		return []Value{cmd}
+	case "XADD":
+		return xaddCommands(dt, args, result)
+	case "XTRIM":
+		return []Value{streamTrimCommand(dt, args[0].bulk)}
+	case "PFCOUNT":
+		// like Redis, only when it updated the cached count
+		if !dt.hllCacheWritten {
+			return nil
+		}
+		dt.hllCacheWritten = false
+	case "BITFIELD":
+		// nothing to log if it only read
+		if ops, _ := parseBitfield(args[1:]); !bitfieldWrites(ops) {
+			return nil
+		}
+	case "XGROUP":
+		if cmds := xgroupCommands(dt, args); cmds != nil {
+			return cmds
+		}
+	case "XREADGROUP":
+		return xreadgroupCommands(dt, args, result)
+	case "XCLAIM":
+		var ids []StreamID
+		for _, arg := range args[4:] {
+			id, err := parseStreamID(arg.bulk, 0)
+			if err != nil {
+				break
+			}
+			ids = append(ids, id)
+		}
+
+		return streamGroupCommands(dt, args[0].bulk, args[1].bulk, args[2].bulk, ids, true)
+	case "XAUTOCLAIM":
+		var ids []StreamID
+		for _, item := range append(result.array[1].array, result.array[2].array...) {
+			if item.typ == "array" {
+				item = item.array[0]
+			}
+
+			id, _ := parseStreamID(item.bulk, 0)
+			ids = append(ids, id)
+		}
+
+		return streamGroupCommands(dt, args[0].bulk, args[1].bulk, args[2].bulk, ids, true)
+	}
+
+	value := commandValue(command)
+	value.array = append(value.array, args...)
+
+	return []Value{value}
+}
+
+// expireCommand builds PEXPIREAT for the current deadline of key. A key that
+// is already gone by now is logged as DEL.
+func expireCommand(dt *DataType, key string) Value {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	obj := dt.lookup(key)
+	if obj == nil || obj.ExpireAt.IsZero() {
+		return commandValue("DEL", key)
+	}
+
+	return commandValue("PEXPIREAT", key, strconv.FormatInt(obj.ExpireAt.UnixMilli(), 10))
+}
+
+// setCommand builds SET with the absolute deadline key got, or DEL if it
+// expired right away.
+func setCommand(dt *DataType, key string, val string) Value {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	obj := dt.lookup(key)
+	if obj == nil {
+		return commandValue("DEL", key)
+	}
+
+	if obj.ExpireAt.IsZero() {
+		return commandValue("SET", key, val)
 	}
 
+	return commandValue("SET", key, val, "PXAT", strconv.FormatInt(obj.ExpireAt.UnixMilli(), 10))
+}
+
+// restoreCommand builds RESTORE with the absolute deadline of key, or DEL if
+// the key expired right away.
+func restoreCommand(dt *DataType, key string, payload string) Value {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	obj := dt.lookup(key)
+	if obj == nil {
+		return commandValue("DEL", key)
+	}
+
+	ttl := "0"
+	if !obj.ExpireAt.IsZero() {
+		ttl = strconv.FormatInt(obj.ExpireAt.UnixMilli(), 10)
+	}
+
+	return commandValue("RESTORE", key, ttl, payload, "REPLACE", "ABSTTL")
+}
+
+// xaddCommands logs XADD with the ID it generated. Trimming depends on how
+// entries are laid out in memory, which a replay does not reproduce, so it is
+// logged as an exact XTRIM to the resulting length.
+func xaddCommands(dt *DataType, args []Value, result Value) []Value {
+	if result.typ == "null" {
+		return nil
+	}
+
+	x, _ := parseXadd(args)
+
+	cmd := commandValue("XADD", args[0].bulk, result.bulk)
+	cmd.array = append(cmd.array, args[x.id + 1:]...)
+
+	if x.trim == nil {
+		return []Value{cmd}
+	}
+
+	return []Value{cmd, streamTrimCommand(dt, args[0].bulk)}
+}
+
+// streamTrimCommand builds XTRIM to the current length of the stream at key.
+func streamTrimCommand(dt *DataType, key string) Value {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	stream, _ := lookupStream(dt, key)
+	if stream == nil {
+		return commandValue("DEL", key)
+	}
+
+	return commandValue("XTRIM", key, "MAXLEN", "=", strconv.Itoa(stream.Len()))
+}
+
+// xgroupCommands logs XGROUP CREATE and SETID with the ID and read counter
+// the group ended up with, "$" depends on the stream at the time. Other
+// subcommands are logged as they are, nil is returned for them.
+func xgroupCommands(dt *DataType, args []Value) []Value {
+	sub := strings.ToUpper(args[0].bulk)
+	if sub != "CREATE" && sub != "SETID" {
+		return nil
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	key, name := args[1].bulk, args[2].bulk
+
+	_, group, _ := lookupStreamGroup(dt, key, name)
+	if group == nil {
+		return nil
+	}
+
+	if sub == "CREATE" {
+		return []Value{groupCreateCommand(key, group, true)}
+	}
+
+	return []Value{groupSetIDCommand(key, group)}
+}
+
+// xreadgroupCommands logs the entries XREADGROUP delivered, or delivered
+// again from the history of the consumer, as claimed by it. A stream it
+// delivered nothing from may still have got the consumer.
+func xreadgroupCommands(dt *DataType, args []Value, result Value) []Value {
+	x, _ := parseXreadgroup(args)
+
+	delivered := make(map[string][]StreamID)
+	if result.typ == "array" {
+		for _, stream := range result.array {
+			var ids []StreamID
+			for _, entry := range stream.array[1].array {
+				id, _ := parseStreamID(entry.array[0].bulk, 0)
+				ids = append(ids, id)
+			}
+
+			delivered[stream.array[0].bulk] = ids
+		}
+	}
+
+	var cmds []Value
+	for _, key := range x.keys {
+		ids, ok := delivered[key]
+		if !ok {
+			cmds = append(cmds, consumerCommands(dt, key, x.group, x.consumer)...)
+			continue
+		}
+
+		cmds = append(cmds, streamGroupCommands(dt, key, x.group, x.consumer, ids, false)...)
+		delete(delivered, key)
+	}
+
+	return cmds
+}
+
+// consumerCommands logs the consumer of the group, if there is one.
+func consumerCommands(dt *DataType, key string, name string, consumer string) []Value {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	_, group, _ := lookupStreamGroup(dt, key, name)
+	if group == nil {
+		return nil
+	}
+
+	if _, exist := group.Consumers[consumer]; !exist {
+		return nil
+	}
+
+	return []Value{commandValue("XGROUP", "CREATECONSUMER", key, name, consumer)}
+}
+
+// streamGroupCommands logs the state a command left the group and the
+// pending entries ids in: the consumer, an XCLAIM with the delivery time and
+// count of each entry still pending and, with ackMissing, an XACK of those
+// no longer pending. The position of the group comes last. Entries deleted
+// from the stream are left out, an XCLAIM would drop them.
+func streamGroupCommands(dt *DataType, key string, name string, consumer string, ids []StreamID, ackMissing bool) []Value {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	stream, group, _ := lookupStreamGroup(dt, key, name)
+	if group == nil {
+		return nil
+	}
+
+	var cmds []Value
+	if _, exist := group.Consumers[consumer]; exist {
+		cmds = append(cmds, commandValue("XGROUP", "CREATECONSUMER", key, name, consumer))
+	}
+
+	ack := commandValue("XACK", key, name)
+	for _, id := range ids {
+		nack := group.Pending.get(id)
+		if nack == nil {
+			if ackMissing {
+				ack.array = append(ack.array, Value{typ: "bulk", bulk: id.String()})
+			}
+			continue
+		}
+
+		if _, exist := stream.Get(id); exist {
+			cmds = append(cmds, nackCommand(key, name, nack))
+		}
+	}
+
+	if len(ack.array) > 3 {
+		cmds = append(cmds, ack)
+	}
+
+	return append(cmds, groupSetIDCommand(key, group))
+}
+
+// nackCommand builds the XCLAIM that makes an entry pending for its
+// consumer with the same delivery time and count.
+func nackCommand(key string, group string, nack *StreamNack) Value {
+	return commandValue("XCLAIM", key, group, nack.Consumer.Name, "0", nack.ID.String(),
+		"TIME", strconv.FormatInt(nack.DeliveryTime.UnixMilli(), 10),
+		"RETRYCOUNT", strconv.FormatInt(nack.DeliveryCount, 10),
+		"FORCE", "JUSTID")
+}
+
+func groupCreateCommand(key string, group *StreamGroup, mkStream bool) Value {
+	cmd := commandValue("XGROUP", "CREATE", key, group.Name, group.LastID.String())
+	if mkStream {
+		cmd.array = append(cmd.array, Value{typ: "bulk", bulk: "MKSTREAM"})
+	}
+
+	cmd.array = append(cmd.array,
+		Value{typ: "bulk", bulk: "ENTRIESREAD"},
+		Value{typ: "bulk", bulk: strconv.FormatInt(group.EntriesRead, 10)})
+
+	return cmd
+}
+
+func groupSetIDCommand(key string, group *StreamGroup) Value {
+	return commandValue("XGROUP", "SETID", key, group.Name, group.LastID.String(),
+		"ENTRIESREAD", strconv.FormatInt(group.EntriesRead, 10))
+}
+
+func commandValue(args ...string) Value {
+	value := Value{typ: "array", array: make([]Value, 0, len(args))}
+	for _, arg := range args {
+		value.array = append(value.array, Value{typ: "bulk", bulk: arg})
+	}
+
+	return value
+}
+
+// AofError describes an AOF that can not be loaded as it is. Truncated is
+// set when only the last command of the file is incomplete.
+type AofError struct {
+	File string
+	Offset int64 // position of the first bad command in File
+	Truncated bool
+	Err error
+}
+
+func (e *AofError) Error() string {
+	if e.Truncated {
+		return fmt.Sprintf("AOF file %s is truncated at offset %d: %v", e.File, e.Offset, e.Err)
+	}
+
+	return fmt.Sprintf("bad command in AOF file %s at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+// AofRead loads the base and incr files into dt: a snapshot at the start of
+// the base file is loaded directly, callback is called for every command.
+// The first from bytes are skipped, fromCRC is their checksum (see
+// HasPrefix). If the last incr file ends with an incomplete command and
+// aof-load-truncated is on, the tail is cut off and loading succeeds, any
+// other damage is returned as *AofError.
+func (aof *Aof) AofRead(dt *DataType, from int64, fromCRC uint64, callback func(value Value)) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	sum := &crc64Writer{sum: fromCRC}
+	files := aof.manifest.files()
+	var start int64 // offset of the current file in the whole AOF
+
+	for i, file := range files {
+		last := i == len(files) - 1
+
+		size, err := aof.readFile(dt, file, max(from - start, 0), sum, last, callback)
+		if err != nil {
+			return err
+		}
+
+		start += size
+	}
+
+	aof.crc = sum.sum
+
 	return nil
 }
 
-func (aof *Aof) AofRead(callback func(value Value)) error {
+// readFile loads one file of the AOF from offset on, the checksum of what it
+// reads is added to sum. It returns the size of the file.
+func (aof *Aof) readFile(dt *DataType, file *aofFile, from int64, sum *crc64Writer, last bool, callback func(value Value)) (int64, error) {
+	f, err := os.OpenFile(aof.filePath(file.name), os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if from >= info.Size() {
+		return info.Size(), nil
+	}
+
+	if from == 0 && file.typ == aofTypeBase {
+		preamble, err := readPreamble(f, dt)
+		if err != nil {
+			err.(*AofError).File = file.name
+			return 0, err
+		}
+
+		if _, err := io.Copy(sum, io.NewSectionReader(f, 0, preamble)); err != nil {
+			return 0, err
+		}
+		from = preamble
+	}
+
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	err = scanAof(io.TeeReader(f, sum), callback)
+
+	var aofErr *AofError
+	if !errors.As(err, &aofErr) {
+		return info.Size(), err
+	}
+	aofErr.File = file.name
+	aofErr.Offset += from
+
+	if !aofErr.Truncated || !last || !aof.loadTruncated {
+		return 0, err
+	}
+
+	aof.l.Info(fmt.Sprintf("AOF file %s is truncated at offset %d, dropping the incomplete command at the end", file.name, aofErr.Offset))
+
+	if err := f.Truncate(aofErr.Offset); err != nil {
+		return 0, err
+	}
+	aof.size -= info.Size() - aofErr.Offset
+	aof.baseSize = aof.size
+
+	// sum has seen the dropped bytes too, hash the truncated AOF again
+	sum.sum, err = aof.prefixCRC(aof.size)
+
+	return aofErr.Offset, err
+}
+
+// readPreamble loads the snapshot at the start of f into dt if the file has
+// one and returns its size.
+func readPreamble(f *os.File, dt *DataType) (int64, error) {
+	magic := make([]byte, len(rdbMagic))
+	if n, _ := f.ReadAt(magic, 0); n < len(magic) || string(magic) != rdbMagic {
+		return 0, nil
+	}
+
+	_, size, err := readSnapshot(io.NewSectionReader(f, 0, math.MaxInt64), dt)
+	if err != nil {
+		return 0, &AofError{Offset: 0, Err: errors.New("bad snapshot preamble: " + err.Error())}
+	}
+
+	return size, nil
+}
+
+// HasPrefix reports whether the first size bytes of the AOF still have the
+// checksum crc, i.e. it was only appended to since they were written.
+func (aof *Aof) HasPrefix(size int64, crc uint64) bool {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	reader := NewRespReader(aof.file)
+	if aof.size < size {
+		return false
+	}
+
+	sum, err := aof.prefixCRC(size)
+
+	return err == nil && sum == crc
+}
+
+// prefixCRC returns the CRC64 of the first size bytes of the base and incr
+// files taken as one file.
+func (aof *Aof) prefixCRC(size int64) (uint64, error) {
+	sum := &crc64Writer{}
+
+	for _, file := range aof.manifest.files() {
+		if size == 0 {
+			break
+		}
+
+		f, err := os.Open(aof.filePath(file.name))
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := io.Copy(sum, io.LimitReader(f, size))
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		size -= n
+	}
+
+	if size > 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	return sum.sum, nil
+}
+
+// CloneAt copies dt together with the size and checksum of the AOF at that
+// moment. No write command can run in between since they hold aof.mu.
+func (aof *Aof) CloneAt(dt *DataType) (clone *DataType, size int64, crc uint64) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return dt.clone(), aof.size, aof.crc
+}
+
+func (aof *Aof) Size() int64 {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.size
+}
+
+type crc64Writer struct {
+	sum uint64
+}
+
+func (w *crc64Writer) Write(p []byte) (int, error) {
+	w.sum = crc64.Update(w.sum, crcTable, p)
+	return len(p), nil
+}
+
+// scanAof calls callback for every command in r. It returns *AofError if r
+// contains anything but complete commands.
+func scanAof(r io.Reader, callback func(value Value)) error {
+	reader := NewRespReader(r)
 
 	for {
+		start := reader.Offset()
+
 		value, err := reader.Read()
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 
-			return err
+			if err == io.ErrUnexpectedEOF {
+				return &AofError{Offset: start, Truncated: true, Err: err}
+			}
+
+			return &AofError{Offset: start, Err: err}
+		}
+
+		if value.typ != "array" || len(value.array) == 0 {
+			return &AofError{Offset: start, Err: errors.New("expected a command")}
+		}
+
+		for _, arg := range value.array {
+			if arg.typ != "bulk" {
+				return &AofError{Offset: start, Err: errors.New("command arguments must be bulk strings")}
+			}
 		}
 
 		callback(value)
-		
 	}
-
-	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An AOF is a directory with one base file, the incremental files written
+// after it and a manifest listing them in order:
+//
+//	file database.aof.2.base.rdb seq 2 type b
+//	file database.aof.3.incr.aof seq 3 type i
+//
+// A rewrite creates a new base and incr pair, the files they replace are
+// marked as history and deleted once the new manifest is in place.
+const (
+	aofTypeBase = "b"
+	aofTypeHistory = "h"
+	aofTypeIncr = "i"
+)
+
+type aofFile struct {
+	name string
+	seq int64
+	typ string
+}
+
+type aofManifest struct {
+	base *aofFile
+	incrs []*aofFile
+	history []*aofFile
+	baseSeq int64 // highest sequence numbers handed out so far
+	incrSeq int64
+}
+
+// loadManifest reads the manifest at path, nil if it does not exist.
+func loadManifest(path string) (*aofManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &aofManifest{}
+	scanner := bufio.NewScanner(f)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		file, err := parseManifestLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %v", line, err)
+		}
+
+		switch file.typ {
+		case aofTypeBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("invalid AOF manifest line %d: more than one base file", line)
+			}
+
+			m.base = file
+			m.baseSeq = max(m.baseSeq, file.seq)
+		case aofTypeIncr:
+			if len(m.incrs) > 0 && m.incrs[len(m.incrs) - 1].seq >= file.seq {
+				return nil, fmt.Errorf("invalid AOF manifest line %d: incr files out of order", line)
+			}
+
+			m.incrs = append(m.incrs, file)
+			m.incrSeq = max(m.incrSeq, file.seq)
+		case aofTypeHistory:
+			m.history = append(m.history, file)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// parseManifestLine parses "file <name> seq <n> type <b|h|i>".
+func parseManifestLine(line string) (*aofFile, error) {
+	fields := strings.Fields(line)
+	if len(fields) % 2 != 0 {
+		return nil, errors.New("expected key value pairs")
+	}
+
+	file := &aofFile{}
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i] {
+		case "file":
+			if strings.ContainsAny(fields[i + 1], "/\\") {
+				return nil, errors.New("file names can't contain a path")
+			}
+			file.name = fields[i + 1]
+		case "seq":
+			seq, err := strconv.ParseInt(fields[i + 1], 10, 64)
+			if err != nil || seq < 1 {
+				return nil, errors.New("invalid seq '" + fields[i + 1] + "'")
+			}
+			file.seq = seq
+		case "type":
+			file.typ = fields[i + 1]
+		}
+	}
+
+	if file.name == "" || file.seq == 0 {
+		return nil, errors.New("missing file or seq")
+	}
+
+	if file.typ != aofTypeBase && file.typ != aofTypeHistory && file.typ != aofTypeIncr {
+		return nil, errors.New("invalid type '" + file.typ + "'")
+	}
+
+	return file, nil
+}
+
+func (m *aofManifest) String() string {
+	var b strings.Builder
+
+	write := func(file *aofFile) {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", file.name, file.seq, file.typ)
+	}
+
+	if m.base != nil {
+		write(m.base)
+	}
+
+	for _, file := range m.history {
+		write(file)
+	}
+
+	for _, file := range m.incrs {
+		write(file)
+	}
+
+	return b.String()
+}
+
+// save atomically replaces the manifest at path.
+func (m *aofManifest) save(path string) error {
+	tmp := filepath.Join(filepath.Dir(path), "temp-" + filepath.Base(path))
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(m.String()); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(path)
+
+	return nil
+}
+
+// files returns the base and incr files in the order they are loaded.
+func (m *aofManifest) files() []*aofFile {
+	files := make([]*aofFile, 0, len(m.incrs) + 1)
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+
+	return append(files, m.incrs...)
+}
+
+// copy returns a manifest that can be changed without affecting m.
+func (m *aofManifest) copy() *aofManifest {
+	c := *m
+	c.incrs = append([]*aofFile(nil), m.incrs...)
+	c.history = append([]*aofFile(nil), m.history...)
+
+	return &c
+}
+
+func aofBaseName(name string, seq int64, snapshot bool) string {
+	if snapshot {
+		return fmt.Sprintf("%s.%d.base.rdb", name, seq)
+	}
+
+	return fmt.Sprintf("%s.%d.base.aof", name, seq)
+}
+
+func aofIncrName(name string, seq int64) string {
+	return fmt.Sprintf("%s.%d.incr.aof", name, seq)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// items per RPUSH/HSET command emitted by a rewrite, same as Redis
+const aofRewriteItemsPerCmd = 64
+
+// BgRewrite starts rewriting the AOF from the current contents of dt. New
+// commands go to a fresh incr file right away, the rewrite writes a new base
+// file in the background and then the manifest is switched to the new base
+// and the incr files written since. With aof-use-rdb-preamble the base file
+// is a snapshot of dt instead of the commands that rebuild it.
+func (aof *Aof) BgRewrite(dt *DataType) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.rewriting {
+		return errors.New("background append only file rewriting already in progress")
+	}
+
+	return aof.startRewrite(dt)
+}
+
+func (aof *Aof) AutoRewrite() (percentage int64, minSize int64) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.autoRewritePercentage, aof.autoRewriteMinSize
+}
+
+// SetAutoRewrite configures the automatic rewrite, a percentage of 0
+// disables it.
+func (aof *Aof) SetAutoRewrite(percentage int64, minSize int64) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.autoRewritePercentage = percentage
+	aof.autoRewriteMinSize = minSize
+}
+
+// needsRewrite reports whether the AOF grew enough since the last rewrite
+// to trigger an automatic one. aof.mu must be held.
+func (aof *Aof) needsRewrite() bool {
+	if aof.rewriting || aof.autoRewritePercentage <= 0 || aof.size < aof.autoRewriteMinSize {
+		return false
+	}
+
+	base := aof.baseSize
+	if base == 0 {
+		base = 1
+	}
+
+	return (aof.size - base) * 100 / base >= aof.autoRewritePercentage
+}
+
+// startRewrite switches to a new incr file, copies dt and hands the copy to
+// a background goroutine. aof.mu must be held, so the copy has exactly the
+// commands written to the files before the new incr file.
+func (aof *Aof) startRewrite(dt *DataType) error {
+	if err := aof.openIncr(); err != nil {
+		return err
+	}
+
+	snapshot := dt.clone()
+
+	aof.rewriting = true
+	aof.rewriteIncr = aof.manifest.incrSeq
+	preamble := aof.usePreamble
+
+	aof.rewrites.Add(1)
+	go func() {
+		defer aof.rewrites.Done()
+
+		if err := aof.rewrite(snapshot, preamble); err != nil {
+			aof.abortRewrite()
+			aof.l.Error(err)
+			return
+		}
+
+		aof.l.Info("Background AOF rewrite finished successfully")
+	}()
+
+	return nil
+}
+
+// openIncr starts a new incr file and makes it the one commands are
+// appended to. aof.mu must be held.
+func (aof *Aof) openIncr() error {
+	m := aof.manifest.copy()
+	m.incrSeq++
+	incr := &aofFile{name: aofIncrName(aof.name, m.incrSeq), seq: m.incrSeq, typ: aofTypeIncr}
+	m.incrs = append(m.incrs, incr)
+
+	f, err := os.OpenFile(aof.filePath(incr.name), os.O_CREATE | os.O_RDWR | os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	if err := aof.commitManifest(m); err != nil {
+		f.Close()
+		os.Remove(aof.filePath(incr.name))
+		return err
+	}
+
+	if aof.fsync != FsyncNo {
+		aof.file.Sync()
+	}
+	aof.file.Close()
+	aof.file = f
+
+	return nil
+}
+
+func (aof *Aof) rewrite(snapshot *DataType, preamble bool) error {
+	tmp := aof.filePath("temp-rewriteaof-bg-" + strconv.Itoa(os.Getpid()) + ".aof")
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	sum := &crc64Writer{}
+
+	if preamble {
+		err = writeSnapshot(io.MultiWriter(w, sum), snapshot, map[string]string{"aof-base": "1"})
+	} else {
+		err = rewriteCommands(snapshot, func(value Value) error {
+			_, err := io.MultiWriter(w, sum).Write(value.replyValue())
+			return err
+		})
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := aof.finishRewrite(tmp, preamble, size, sum); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// finishRewrite makes the new base file and the incr files written since
+// the rewrite started the AOF, the old files are deleted.
+func (aof *Aof) finishRewrite(tmp string, preamble bool, baseSize int64, sum *crc64Writer) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	m := aof.manifest.copy()
+	m.baseSeq++
+	m.base = &aofFile{name: aofBaseName(aof.name, m.baseSeq, preamble), seq: m.baseSeq, typ: aofTypeBase}
+
+	for i, incr := range m.incrs {
+		if incr.seq == aof.rewriteIncr {
+			m.incrs = m.incrs[i:]
+			break
+		}
+	}
+
+	if err := os.Rename(tmp, aof.filePath(m.base.name)); err != nil {
+		return err
+	}
+
+	// size and checksum of the new base file followed by the incr files
+	size := baseSize
+	for _, incr := range m.incrs {
+		f, err := os.Open(aof.filePath(incr.name))
+		if err != nil {
+			return err
+		}
+
+		n, err := io.Copy(sum, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		size += n
+	}
+
+	if err := aof.commitManifest(m); err != nil {
+		os.Remove(aof.filePath(m.base.name))
+		return err
+	}
+
+	aof.size = size
+	aof.baseSize = size
+	aof.crc = sum.sum
+	aof.rewriting = false
+
+	return nil
+}
+
+func (aof *Aof) abortRewrite() {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.rewriting = false
+}
+
+// rewriteCommands emits the shortest list of commands that rebuilds dt.
+// Expired keys are skipped, deadlines are written as PEXPIREAT.
+func rewriteCommands(dt *DataType, emit func(Value) error) error {
+	now := time.Now()
+
+	for key, obj := range dt.Keys.All() {
+		if obj.expired(now) {
+			continue
+		}
+
+		if err := rewriteObject(key, obj, emit); err != nil {
+			return err
+		}
+
+		if obj.ExpireAt.IsZero() {
+			continue
+		}
+
+		if err := emit(commandValue("PEXPIREAT", key, strconv.FormatInt(obj.ExpireAt.UnixMilli(), 10))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewriteObject emits the commands that create key with the value of obj.
+// Collections are split into commands of aofRewriteItemsPerCmd items.
+func rewriteObject(key string, obj *Object, emit func(Value) error) error {
+	switch obj.Type {
+	case TypeString:
+		return emit(commandValue("SET", key, obj.Value.(string)))
+	case TypeList:
+		list := obj.Value.([]string)
+		for i := 0; i < len(list); i += aofRewriteItemsPerCmd {
+			cmd := commandValue("RPUSH", key)
+			for _, item := range list[i:min(i + aofRewriteItemsPerCmd, len(list))] {
+				cmd.array = append(cmd.array, Value{typ: "bulk", bulk: item})
+			}
+
+			if err := emit(cmd); err != nil {
+				return err
+			}
+		}
+	case TypeHash:
+		cmd := commandValue("HSET", key)
+		for field, val := range obj.Value.(*Dict[string]).All() {
+			cmd.array = append(cmd.array, Value{typ: "bulk", bulk: field}, Value{typ: "bulk", bulk: val})
+
+			if len(cmd.array) == 2 + aofRewriteItemsPerCmd * 2 {
+				if err := emit(cmd); err != nil {
+					return err
+				}
+				cmd = commandValue("HSET", key)
+			}
+		}
+
+		if len(cmd.array) > 2 {
+			return emit(cmd)
+		}
+	case TypeSet:
+		members := obj.Value.(*Set).Members()
+		for i := 0; i < len(members); i += aofRewriteItemsPerCmd {
+			cmd := commandValue("SADD", key)
+			for _, member := range members[i:min(i + aofRewriteItemsPerCmd, len(members))] {
+				cmd.array = append(cmd.array, Value{typ: "bulk", bulk: member})
+			}
+
+			if err := emit(cmd); err != nil {
+				return err
+			}
+		}
+	case TypeStream:
+		return rewriteStream(key, obj.Value.(*Stream), emit)
+	case TypeJSON:
+		return emit(commandValue("JSON.SET", key, "$", formatJSON(obj.Value.(*JSONDoc).Root)))
+	case TypeZSet:
+		nodes := obj.Value.(*ZSet).All()
+		for i := 0; i < len(nodes); i += aofRewriteItemsPerCmd {
+			cmd := commandValue("ZADD", key)
+			for _, node := range nodes[i:min(i + aofRewriteItemsPerCmd, len(nodes))] {
+				cmd.array = append(cmd.array, Value{typ: "bulk", bulk: formatScore(node.score)}, Value{typ: "bulk", bulk: node.member})
+			}
+
+			if err := emit(cmd); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rewriteStream emits one XADD per entry, then each consumer group with its
+// consumers and an XCLAIM per pending entry, then XSETID to restore the IDs
+// entries that are gone left behind. An empty stream is created by adding
+// an entry and trimming it right away. An entry deleted while pending is
+// added back with no real fields for XCLAIM and deleted again afterwards.
+func rewriteStream(key string, stream *Stream, emit func(Value) error) error {
+	var deleted []StreamID
+	for _, group := range stream.Groups() {
+		for _, nack := range group.Pending {
+			if _, exist := stream.Get(nack.ID); !exist {
+				deleted = append(deleted, nack.ID)
+			}
+		}
+	}
+
+	slices.SortFunc(deleted, StreamID.Compare)
+	deleted = slices.Compact(deleted)
+
+	entries := stream.Entries()
+	for _, id := range deleted {
+		entries = append(entries, StreamEntry{ID: id, Fields: []string{"x", "y"}})
+	}
+
+	slices.SortFunc(entries, func(a, b StreamEntry) int {
+		return a.ID.Compare(b.ID)
+	})
+
+	if len(entries) == 0 {
+		// XADD refuses 0-0, which the final XSETID restores anyway
+		id := stream.LastID
+		if id.IsZero() {
+			id = StreamID{0, 1}
+		}
+
+		if err := emit(commandValue("XADD", key, "MAXLEN", "0", id.String(), "x", "y")); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		cmd := commandValue("XADD", key, entry.ID.String())
+		for _, field := range entry.Fields {
+			cmd.array = append(cmd.array, Value{typ: "bulk", bulk: field})
+		}
+
+		if err := emit(cmd); err != nil {
+			return err
+		}
+	}
+
+	for _, group := range stream.Groups() {
+		if err := emit(groupCreateCommand(key, group, false)); err != nil {
+			return err
+		}
+
+		for _, consumer := range group.SortedConsumers() {
+			if err := emit(commandValue("XGROUP", "CREATECONSUMER", key, group.Name, consumer.Name)); err != nil {
+				return err
+			}
+		}
+
+		for _, nack := range group.Pending {
+			if err := emit(nackCommand(key, group.Name, nack)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(deleted) > 0 {
+		cmd := commandValue("XDEL", key)
+		for _, id := range deleted {
+			cmd.array = append(cmd.array, Value{typ: "bulk", bulk: id.String()})
+		}
+
+		if err := emit(cmd); err != nil {
+			return err
+		}
+	}
+
+	return emit(commandValue("XSETID", key, stream.LastID.String(),
+		"ENTRIESADDED", strconv.FormatUint(stream.EntriesAdded, 10),
+		"MAXDELETEDID", stream.MaxDeletedID.String()))
+}
+
+// syncDir makes a rename inside the directory of path durable.
+func syncDir(path string) {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	dir.Sync()
+}
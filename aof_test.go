@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openServer starts a server on the files in dir and loads them.
+func openServer(t *testing.T, dir string) *Server {
+	t.Helper()
+
+	l, err := NewLogger(filepath.Join(dir, "server.log"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	aof, err := NewAof(filepath.Join(dir, "appendonlydir"), "database.aof", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{dt: createDT(), aof: aof, rdb: NewRdb(filepath.Join(dir, "dump.rdb"), l), l: l}
+	if err := srv.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	return srv
+}
+
+func exec(t *testing.T, srv *Server, args ...string) Value {
+	t.Helper()
+
+	values := make([]Value, 0, len(args) - 1)
+	for _, arg := range args[1:] {
+		values = append(values, Value{typ: "bulk", bulk: arg})
+	}
+
+	res, ok := srv.execute(args[0], values)
+	if !ok {
+		t.Fatalf("unknown command %s", args[0])
+	}
+
+	return res
+}
+
+// TestLazyExpireReplay runs write commands on keys that expired and were
+// not removed yet, then checks that replaying the AOF gives the same data.
+func TestLazyExpireReplay(t *testing.T) {
+	dir := t.TempDir()
+	srv := openServer(t, dir)
+
+	exec(t, srv, "HSET", "lost", "f", "1")
+	exec(t, srv, "PEXPIRE", "lost", "50")
+	exec(t, srv, "SET", "cnt", "100", "PX", "50")
+	exec(t, srv, "SADD", "src", "a", "b")
+	exec(t, srv, "PEXPIRE", "src", "50")
+	exec(t, srv, "SADD", "read", "a")
+	exec(t, srv, "PEXPIRE", "read", "50")
+
+	time.Sleep(100 * time.Millisecond)
+
+	exec(t, srv, "HSET", "lost", "f", "2")
+	exec(t, srv, "INCR", "cnt")
+	exec(t, srv, "SUNIONSTORE", "dst", "src")
+
+	// a read finds the key expired first, the write then finds it missing
+	exec(t, srv, "SCARD", "read")
+	exec(t, srv, "SADD", "read", "b")
+
+	srv = restart(t, srv, dir,
+		[]string{"HGETALL", "lost"},
+		[]string{"GET", "cnt"},
+		[]string{"EXISTS", "src"},
+		[]string{"EXISTS", "dst"},
+		[]string{"SMEMBERS", "read"},
+		[]string{"DBSIZE"},
+	)
+	srv.aof.AofClose()
+}
+
+// restart closes srv, opens a new server on its files in dir and checks
+// that checks reply the same on both.
+func restart(t *testing.T, srv *Server, dir string, checks ...[]string) *Server {
+	t.Helper()
+
+	want := make([]string, len(checks))
+	for i, check := range checks {
+		want[i] = fmt.Sprint(exec(t, srv, check...))
+	}
+
+	if err := srv.aof.AofClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv = openServer(t, dir)
+
+	for i, check := range checks {
+		if got := fmt.Sprint(exec(t, srv, check...)); got != want[i] {
+			t.Errorf("%v after a restart = %s, want %s", check, got, want[i])
+		}
+	}
+
+	return srv
+}
+
+// TestPfcountReplay checks that the count PFCOUNT caches in a HyperLogLog
+// is in the AOF too, so the key has the same bytes after a restart.
+func TestPfcountReplay(t *testing.T) {
+	dir := t.TempDir()
+	srv := openServer(t, dir)
+
+	exec(t, srv, "PFADD", "h", "a", "b", "c")
+	exec(t, srv, "PFCOUNT", "h")
+	exec(t, srv, "PFADD", "h2", "x")
+	exec(t, srv, "PFCOUNT", "h", "h2")
+	exec(t, srv, "PFADD", "h3", "y")
+	exec(t, srv, "PFCOUNT", "h3")
+	exec(t, srv, "PFADD", "h3", "z")
+
+	srv = restart(t, srv, dir,
+		[]string{"GET", "h"},
+		[]string{"GET", "h2"},
+		[]string{"GET", "h3"},
+		[]string{"DUMP", "h"},
+	)
+
+	// and after a rewrite
+	exec(t, srv, "PFCOUNT", "h3")
+	if res := exec(t, srv, "BGREWRITEAOF"); res.typ == "error" {
+		t.Fatal(res.str)
+	}
+	srv = restart(t, srv, dir, []string{"GET", "h3"}, []string{"PFCOUNT", "h", "h2", "h3"})
+	srv.aof.AofClose()
+}
+
+// TestCloseWaitsForRewrite closes the AOF while a rewrite runs. The rewrite
+// must be done by the time AofClose returns, not switch files after it.
+func TestCloseWaitsForRewrite(t *testing.T) {
+	dir := t.TempDir()
+	srv := openServer(t, dir)
+
+	for i := 0; i < 20000; i++ {
+		exec(t, srv, "SET", "key:" + strconv.Itoa(i), strings.Repeat("v", 100))
+	}
+
+	if res := exec(t, srv, "BGREWRITEAOF"); res.typ == "error" {
+		t.Fatal(res.str)
+	}
+	if err := srv.aof.AofClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := func() string {
+		entries, err := os.ReadDir(filepath.Join(dir, "appendonlydir"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, e := range entries {
+			info, _ := e.Info()
+			names = append(names, fmt.Sprint(e.Name(), info.Size()))
+		}
+		return strings.Join(names, " ")
+	}
+
+	before := files()
+	time.Sleep(200 * time.Millisecond)
+	if after := files(); after != before {
+		t.Fatalf("files changed after AofClose:\n%s\n%s", before, after)
+	}
+
+	srv = openServer(t, dir)
+	defer srv.aof.AofClose()
+
+	if res := exec(t, srv, "DBSIZE"); res.num != 20000 {
+		t.Errorf("DBSIZE after a restart = %d, want 20000", res.num)
+	}
+}
+
+// TestXreadgroupConsumerReplay checks that the consumers XREADGROUP creates
+// are in the AOF even when the read delivers nothing.
+func TestXreadgroupConsumerReplay(t *testing.T) {
+	dir := t.TempDir()
+	srv := openServer(t, dir)
+
+	exec(t, srv, "XADD", "s", "1-1", "f", "v")
+	exec(t, srv, "XADD", "other", "1-1", "f", "v")
+	exec(t, srv, "XGROUP", "CREATE", "s", "g", "$")
+	exec(t, srv, "XGROUP", "CREATE", "other", "g", "0")
+
+	// nothing new for idle, nothing in its history for history
+	exec(t, srv, "XREADGROUP", "GROUP", "g", "idle", "STREAMS", "s", ">")
+	exec(t, srv, "XREADGROUP", "GROUP", "g", "history", "STREAMS", "s", "0")
+
+	// entries from one stream but not from the other
+	exec(t, srv, "XREADGROUP", "GROUP", "g", "both", "STREAMS", "s", "other", ">", ">")
+
+	consumers := func(srv *Server, key string) []string {
+		var names []string
+		for _, c := range exec(t, srv, "XINFO", "CONSUMERS", key, "g").array {
+			for i := 0; i + 1 < len(c.array); i += 2 {
+				if c.array[i].bulk == "name" {
+					names = append(names, c.array[i + 1].bulk)
+				}
+			}
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	if got := consumers(srv, "s"); !slices.Equal(got, []string{"both", "history", "idle"}) {
+		t.Fatalf("consumers of s = %v", got)
+	}
+
+	srv = restart(t, srv, dir, []string{"XPENDING", "other", "g"})
+	defer srv.aof.AofClose()
+
+	if got := consumers(srv, "s"); !slices.Equal(got, []string{"both", "history", "idle"}) {
+		t.Errorf("consumers of s after a restart = %v", got)
+	}
+	if got := consumers(srv, "other"); !slices.Equal(got, []string{"both"}) {
+		t.Errorf("consumers of other after a restart = %v", got)
+	}
+}
+
+// checkReplay runs commands, split on spaces, on a new server, restarts it
+// and checks that checks reply the same before and after, and after an AOF
+// rewrite.
+func checkReplay(t *testing.T, commands []string, checks []string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	srv := openServer(t, dir)
+
+	for _, command := range commands {
+		if res := exec(t, srv, strings.Fields(command)...); res.typ == "error" {
+			t.Fatalf("%s: %s", command, res.str)
+		}
+	}
+
+	var args [][]string
+	for _, check := range checks {
+		args = append(args, strings.Fields(check))
+	}
+
+	srv = restart(t, srv, dir, args...)
+
+	if res := exec(t, srv, "BGREWRITEAOF"); res.typ == "error" {
+		t.Fatal(res.str)
+	}
+	srv = restart(t, srv, dir, args...)
+	srv.aof.AofClose()
+}
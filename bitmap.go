@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Bitmaps are plain strings addressed bit by bit, the most significant bit
+// of the first byte is bit 0. Strings are grown with zero bytes as needed.
+
+// bitmapMaxBits is one past the largest bit offset, bitmaps are capped at
+// the size of the largest bulk string.
+const bitmapMaxBits = maxBulkLen * 8
+
+var errBitOffset = errors.New("bit offset is not an integer or out of range")
+
+// parseBitOffset parses a bit offset. With hashMul, "#n" stands for n times
+// hashMul, which BITFIELD uses to address the n-th field of a given width.
+func parseBitOffset(arg string, hashMul int64) (int64, error) {
+	mul := int64(1)
+	if hashMul > 0 && strings.HasPrefix(arg, "#") {
+		arg, mul = arg[1:], hashMul
+	}
+
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 || n > bitmapMaxBits / mul - 1 {
+		return 0, errBitOffset
+	}
+
+	return n * mul, nil
+}
+
+func getBit(data string, offset int64) int {
+	i := offset >> 3
+	if i >= int64(len(data)) {
+		return 0
+	}
+
+	return int(data[i] >> (7 - offset & 7)) & 1
+}
+
+// growBitmap returns data as a byte slice holding at least bits bits.
+func growBitmap(data string, bits int64) []byte {
+	buf := []byte(data)
+	if need := int((bits + 7) >> 3); need > len(buf) {
+		buf = append(buf, make([]byte, need - len(buf))...)
+	}
+
+	return buf
+}
+
+func setBit(buf []byte, offset int64, bit int) {
+	mask := byte(1) << (7 - offset & 7)
+	if bit == 1 {
+		buf[offset >> 3] |= mask
+	} else {
+		buf[offset >> 3] &^= mask
+	}
+}
+
+// bitRange turns start and end, which count from the end of a value of
+// length units when negative, into a range inside it. ok is false if the
+// range is empty.
+func bitRange(start int64, end int64, length int64) (int64, int64, bool) {
+	if start < 0 {
+		start = max(length + start, 0)
+	}
+
+	if end < 0 {
+		end = max(length + end, 0)
+	}
+
+	end = min(end, length - 1)
+
+	return start, end, start <= end
+}
+
+// bitCount returns the number of set bits from bit start to bit end, both
+// included.
+func bitCount(data string, start int64, end int64) int {
+	first, last := start >> 3, end >> 3
+
+	n := 0
+	for i := first; i <= last; i++ {
+		n += bits.OnesCount8(data[i])
+	}
+
+	// leave out the bits of the first and last bytes outside the range
+	n -= bits.OnesCount8(data[first] >> (8 - start & 7))
+	n -= bits.OnesCount8(data[last] << (1 + end & 7))
+
+	return n
+}
+
+// bitPos returns the offset of the first bit set to bit from bit start to
+// bit end, both included, or -1 if there is none.
+func bitPos(data string, bit int, start int64, end int64) int64 {
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+
+	for offset := start; offset <= end; {
+		// whole bytes without a match are skipped at once
+		if offset & 7 == 0 && offset + 7 <= end && data[offset >> 3] == skip {
+			offset += 8
+			continue
+		}
+
+		if getBit(data, offset) == bit {
+			return offset
+		}
+		offset++
+	}
+
+	return -1
+}
+
+// bitop applies AND, OR, XOR or NOT to srcs, shorter values are padded with
+// zero bytes.
+func bitop(op string, srcs []string) string {
+	length := 0
+	for _, src := range srcs {
+		length = max(length, len(src))
+	}
+
+	res := make([]byte, length)
+	for i := range res {
+		b := byteAt(srcs[0], i)
+		for _, src := range srcs[1:] {
+			switch op {
+			case "AND":
+				b &= byteAt(src, i)
+			case "OR":
+				b |= byteAt(src, i)
+			case "XOR":
+				b ^= byteAt(src, i)
+			}
+		}
+
+		if op == "NOT" {
+			b = ^b
+		}
+		res[i] = b
+	}
+
+	return string(res)
+}
+
+func byteAt(s string, i int) byte {
+	if i >= len(s) {
+		return 0
+	}
+
+	return s[i]
+}
+
+// bitfieldType is the type of a BITFIELD field, i1 to i64 or u1 to u63.
+type bitfieldType struct {
+	signed bool
+	bits int
+}
+
+func parseBitfieldType(arg string) (bitfieldType, error) {
+	err := errors.New("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u') {
+		return bitfieldType{}, err
+	}
+
+	t := bitfieldType{signed: arg[0] == 'i'}
+
+	n, convErr := strconv.Atoi(arg[1:])
+	if convErr != nil || n < 1 || (t.signed && n > 64) || (!t.signed && n > 63) {
+		return bitfieldType{}, err
+	}
+	t.bits = n
+
+	return t, nil
+}
+
+// get reads the field at offset, buf is zero padded.
+func (t bitfieldType) get(buf []byte, offset int64) int64 {
+	var u uint64
+	for i := offset; i < offset + int64(t.bits); i++ {
+		bit := byte(0)
+		if i >> 3 < int64(len(buf)) {
+			bit = buf[i >> 3] >> (7 - i & 7) & 1
+		}
+		u = u << 1 | uint64(bit)
+	}
+
+	// extend the sign bit
+	if t.signed && t.bits < 64 && u >> (t.bits - 1) & 1 == 1 {
+		u |= math.MaxUint64 << t.bits
+	}
+
+	return int64(u)
+}
+
+// set writes the low bits of val at offset, buf must be large enough.
+func (t bitfieldType) set(buf []byte, offset int64, val int64) {
+	u := uint64(val)
+	for i := 0; i < t.bits; i++ {
+		setBit(buf, offset + int64(i), int(u >> (t.bits - 1 - i)) & 1)
+	}
+}
+
+// Overflow behaviours of BITFIELD SET and INCRBY.
+const (
+	bitfieldWrap = "WRAP"
+	bitfieldSat = "SAT"
+	bitfieldFail = "FAIL"
+)
+
+// add returns val + incr for a field of type t, handling an overflow as
+// overflow says. ok is false if the result overflows with FAIL.
+func (t bitfieldType) add(val int64, incr int64, overflow string) (int64, bool) {
+	if t.signed {
+		maxVal := int64(math.MaxInt64)
+		if t.bits < 64 {
+			maxVal = 1 << (t.bits - 1) - 1
+		}
+		minVal := -maxVal - 1
+
+		// computed on uint64 so that it wraps instead of being undefined
+		sum := int64(uint64(val) + uint64(incr))
+
+		switch {
+		case val > maxVal || incr > 0 && sum > maxVal || incr > 0 && sum < val:
+			if overflow == bitfieldSat {
+				return maxVal, true
+			}
+		case val < minVal || incr < 0 && sum < minVal || incr < 0 && sum > val:
+			if overflow == bitfieldSat {
+				return minVal, true
+			}
+		default:
+			return sum, true
+		}
+
+		if overflow == bitfieldFail {
+			return 0, false
+		}
+
+		// keep the low bits and extend the sign bit
+		u := uint64(sum)
+		if t.bits < 64 {
+			if u >> (t.bits - 1) & 1 == 1 {
+				u |= math.MaxUint64 << t.bits
+			} else {
+				u &^= math.MaxUint64 << t.bits
+			}
+		}
+
+		return int64(u), true
+	}
+
+	maxVal := uint64(1) << t.bits - 1
+	u := uint64(val)
+
+	switch {
+	case u > maxVal || incr > 0 && uint64(incr) > maxVal - u:
+		if overflow == bitfieldSat {
+			return int64(maxVal), true
+		}
+	case incr < 0 && uint64(-incr) > u:
+		if overflow == bitfieldSat {
+			return 0, true
+		}
+	default:
+		return int64(u + uint64(incr)), true
+	}
+
+	if overflow == bitfieldFail {
+		return 0, false
+	}
+
+	return int64((u + uint64(incr)) & maxVal), true
+}
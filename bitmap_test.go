@@ -0,0 +1,224 @@
+package main
+
+import "testing"
+
+func TestSetbitGetbit(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"SETBIT b 7 1", "0"},
+		{"GET b", `"\x01"`},
+		{"SETBIT b 7 0", "1"},
+		{"SETBIT b 7 0", "0"},
+		{"SETBIT b 0 1", "0"},
+		{"SETBIT b 20 1", "0"},
+		{"GET b", `"\x80\x00\b"`},
+		{"GETBIT b 0", "1"},
+		{"GETBIT b 20", "1"},
+		{"GETBIT b 21", "0"},
+		{"GETBIT b 100", "0"},
+		{"STRLEN b", "3"},
+		{"GETBIT missing 0", "0"},
+
+		// clearing a bit past the end still grows the string
+		{"SETBIT z 9 0", "0"},
+		{"GET z", `"\x00\x00"`},
+
+		{"SETBIT b -1 1", "error: bit offset is not an integer or out of range"},
+		{"SETBIT b 4294967296 1", "error: bit offset is not an integer or out of range"},
+		{"SETBIT b x 1", "error: bit offset is not an integer or out of range"},
+		{"SETBIT b 0 2", "error: bit is not an integer or out of range"},
+		{"GETBIT b x", "error: bit offset is not an integer or out of range"},
+		{"SETBIT b 0", "error: wrong number of arguments for 'setbit' command"},
+		{"GETBIT b", "error: wrong number of arguments for 'getbit' command"},
+
+		{"LPUSH l a", "1"},
+		{"SETBIT l 0 1", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"GETBIT l 0", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+
+func TestBitcount(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"SET s foobar", "OK"},
+		{"BITCOUNT s", "26"},
+		{"BITCOUNT s 0 0", "4"},
+		{"BITCOUNT s 1 1", "6"},
+		{"BITCOUNT s 1 1 BYTE", "6"},
+		{"BITCOUNT s 5 30 BIT", "17"},
+		{"BITCOUNT s -2 -1", "7"},
+		{"BITCOUNT s 0 -100", "4"},
+		{"BITCOUNT s -100 -90", "4"},
+		{"BITCOUNT s -100 100", "26"},
+		{"BITCOUNT s 5 1", "0"},
+		{"BITCOUNT missing", "0"},
+		{"BITCOUNT missing 0 -1 BIT", "0"},
+
+		{"BITCOUNT s 0", "error: syntax error"},
+		{"BITCOUNT s 0 1 WORD", "error: syntax error"},
+		{"BITCOUNT s x 1", "error: value is not an integer or out of range"},
+		{"BITCOUNT", "error: wrong number of arguments for 'bitcount' command"},
+		{"LPUSH l a", "1"},
+		{"BITCOUNT l", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+
+func TestBitop(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"SET a foobar", "OK"},
+		{"SET b abcdef", "OK"},
+		{"SET short xy", "OK"},
+
+		{"BITOP AND dest a b", "6"},
+		{"GET dest", "\"`bc`ab\""},
+		{"BITOP OR dest a b", "6"},
+		{"GET dest", `"goofev"`},
+		{"BITOP XOR dest a b", "6"},
+		{"GET dest", `"\a\r\f\x06\x04\x14"`},
+		{"BITOP NOT dest short", "2"},
+		{"GET dest", `"\x87\x86"`},
+
+		// shorter strings and missing keys are padded with zeros
+		{"BITOP OR dest a short", "6"},
+		{"GET dest", `"~\x7fobar"`},
+		{"BITOP AND dest a missing", "6"},
+		{"GET dest", `"\x00\x00\x00\x00\x00\x00"`},
+		{"BITOP XOR dest a", "6"},
+		{"GET dest", `"foobar"`},
+
+		// an empty result deletes the destination
+		{"BITOP AND dest missing other", "0"},
+		{"EXISTS dest", "0"},
+
+		{"BITOP NOT dest a b", "error: BITOP NOT must be called with a single source key."},
+		{"BITOP FOO dest a", "error: syntax error"},
+		{"BITOP AND dest", "error: wrong number of arguments for 'bitop' command"},
+		{"LPUSH l a", "1"},
+		{"BITOP AND dest a l", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+
+func TestBitfield(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"BITFIELD f SET u8 0 255 GET u8 0", "[0 255]"},
+		{"BITFIELD f INCRBY u8 0 10", "[9]"},
+		{"BITFIELD f OVERFLOW SAT INCRBY u8 0 300", "[255]"},
+		{"BITFIELD f OVERFLOW FAIL INCRBY u8 0 1", "[nil]"},
+		{"BITFIELD f GET u8 0", "[255]"},
+
+		{"BITFIELD f SET i8 8 -128 GET i8 8 GET u8 8", "[0 -128 128]"},
+		{"BITFIELD f INCRBY i8 8 -1", "[127]"},
+		{"BITFIELD f OVERFLOW SAT INCRBY i8 8 1000 INCRBY i8 8 -1000", "[127 -128]"},
+		{"BITFIELD f OVERFLOW FAIL INCRBY i8 8 -1 INCRBY i8 8 1", "[nil -127]"},
+
+		// OVERFLOW applies to the operations after it
+		{"BITFIELD g SET u2 0 3 INCRBY u2 0 1 OVERFLOW SAT INCRBY u2 0 5", "[0 0 3]"},
+
+		// #n offsets count in fields of the type
+		{"BITFIELD h SET u4 #1 15 GET u4 4 GET u8 0", "[0 15 15]"},
+		{"BITFIELD h SET i64 0 -1 GET i64 0 GET u63 1", "[1080863910568919040 -1 9223372036854775807]"},
+
+		// GET never grows the string, nor creates the key
+		{"BITFIELD f GET u8 100", "[0]"},
+		{"STRLEN f", "2"},
+		{"BITFIELD missing GET u8 0", "[0]"},
+		{"EXISTS missing", "0"},
+		{"BITFIELD f", "[]"},
+
+		{"BITFIELD f GET u64 0", "error: Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."},
+		{"BITFIELD f GET i65 0", "error: Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."},
+		{"BITFIELD f GET u8 -1", "error: bit offset is not an integer or out of range"},
+		{"BITFIELD f GET u8", "error: syntax error"},
+		{"BITFIELD f OVERFLOW FOO GET u8 0", "error: Invalid OVERFLOW type specified"},
+		{"BITFIELD f SET u8 0 x", "error: value is not an integer or out of range"},
+		{"BITFIELD f FOO u8 0", "error: syntax error"},
+		{"BITFIELD", "error: wrong number of arguments for 'bitfield' command"},
+		{"LPUSH l a", "1"},
+		{"BITFIELD l GET u8 0", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+
+func TestBitmapReplay(t *testing.T) {
+	checkReplay(t, []string{
+		"SETBIT b 7 1",
+		"SETBIT b 20 1",
+		"SETBIT b 7 0",
+		"SETBIT z 9 0",
+		"SET a foobar",
+		"SET s xy",
+		"BITOP XOR x a s",
+		"BITOP NOT n s",
+		"BITOP AND gone missing",
+		"BITFIELD f SET u8 0 200 INCRBY i16 8 -5",
+		"BITFIELD f OVERFLOW SAT INCRBY u8 0 100",
+		"BITFIELD f OVERFLOW FAIL INCRBY u8 0 1",
+		"BITFIELD f GET u8 200",
+		"BITFIELD read GET u8 0",
+	}, []string{
+		"GET b",
+		"GET z",
+		"GET x",
+		"GET n",
+		"EXISTS gone",
+		"GET f",
+		"EXISTS read",
+	})
+}
+
+func TestBitpos(t *testing.T) {
+	dt := createDT()
+	run(t, dt, "SET", "ones", "\xff\xff\xff")
+	run(t, dt, "SET", "zeros", "\x00\x00\x00")
+	run(t, dt, "SET", "mixed", "\x00\xff\xf0")
+	run(t, dt, "SET", "head", "\xff\xf0\x00")
+	run(t, dt, "SET", "empty", "")
+
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		// a missing key is all clear bits
+		{[]string{"missing", "0"}, 0},
+		{[]string{"missing", "1"}, -1},
+		{[]string{"missing", "0", "5"}, 0},
+		{[]string{"missing", "1", "0", "-1", "BIT"}, -1},
+		{[]string{"empty", "0"}, -1},
+		{[]string{"empty", "1"}, -1},
+
+		// the examples of the Redis documentation
+		{[]string{"head", "0"}, 12},
+		{[]string{"mixed", "1", "0"}, 8},
+		{[]string{"mixed", "1", "2"}, 16},
+		{[]string{"mixed", "1", "2", "-1", "BYTE"}, 16},
+		{[]string{"mixed", "1", "7", "15", "BIT"}, 8},
+		{[]string{"mixed", "1", "7", "-3", "BIT"}, 8},
+		{[]string{"zeros", "1"}, -1},
+
+		// without an end, the string is followed by clear bits
+		{[]string{"ones", "0"}, 24},
+		{[]string{"ones", "0", "1"}, 24},
+		{[]string{"ones", "0", "0", "-1"}, -1},
+		{[]string{"ones", "0", "0", "-1", "BIT"}, -1},
+		{[]string{"zeros", "0"}, 0},
+		{[]string{"zeros", "0", "1"}, 8},
+		{[]string{"mixed", "0", "1"}, 20},
+
+		{[]string{"ones", "1", "5", "2"}, -1},
+		{[]string{"ones", "1", "-1"}, 16},
+		{[]string{"ones", "1", "-100", "-100"}, 0},
+	} {
+		res := run(t, dt, "BITPOS", tc.args...)
+		if res.typ != "integer" || res.num != tc.want {
+			t.Errorf("BITPOS %v = %s %q %d, want %d", tc.args, res.typ, res.str, res.num, tc.want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"ones", "2"},
+		{"ones", "1", "x"},
+		{"ones", "1", "0", "1", "WORD"},
+		{"ones"},
+	} {
+		if res := run(t, dt, "BITPOS", args...); res.typ != "error" {
+			t.Errorf("BITPOS %v = %s %d, want an error", args, res.typ, res.num)
+		}
+	}
+}
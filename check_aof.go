@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkAof implements the check-aof subcommand: it validates an AOF offline
+// and with -fix truncates it to the last complete command. The AOF is given
+// as its directory, its manifest or a single file. It returns the exit code
+// of the process.
+func checkAof(args []string) int {
+	fs := flag.NewFlagSet("check-aof", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "truncate the last file to the last valid command")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: check-aof [-fix] <appendonlydir|file.manifest|file.aof>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	path := fs.Arg(0)
+
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		manifests, _ := filepath.Glob(filepath.Join(path, "*.manifest"))
+		if len(manifests) != 1 {
+			fmt.Printf("Expected one manifest in %s, found %d\n", path, len(manifests))
+			return 1
+		}
+		path = manifests[0]
+	}
+
+	if !strings.HasSuffix(path, ".manifest") {
+		return checkAofFile(path, *fix, true)
+	}
+
+	m, err := loadManifest(path)
+	if err != nil || m == nil {
+		fmt.Println("Can't read the manifest:", err)
+		return 1
+	}
+
+	files := m.files()
+	for i, file := range files {
+		last := i == len(files) - 1
+
+		fmt.Println("Checking", file.name)
+		if code := checkAofFile(filepath.Join(filepath.Dir(path), file.name), *fix && last, last); code != 0 {
+			return code
+		}
+	}
+
+	return 0
+}
+
+// checkAofFile checks a single file, only the last file of an AOF may be
+// fixed.
+func checkAofFile(path string, fix bool, last bool) int {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	size := info.Size()
+
+	preamble, err := readPreamble(f, createDT())
+	if err == nil {
+		if preamble > 0 {
+			fmt.Printf("The AOF starts with a snapshot preamble of %d bytes\n", preamble)
+		}
+
+		_, err = f.Seek(preamble, io.SeekStart)
+	}
+
+	commands := 0
+	if err == nil {
+		err = scanAof(f, func(value Value) {
+			commands++
+		})
+
+		var aofErr *AofError
+		if errors.As(err, &aofErr) {
+			aofErr.File = filepath.Base(path)
+			aofErr.Offset += preamble
+		}
+	}
+
+	var aofErr *AofError
+	if err != nil && !errors.As(err, &aofErr) {
+		fmt.Println(err)
+		return 1
+	}
+
+	valid := size
+	if aofErr != nil {
+		valid = aofErr.Offset
+	}
+
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, ok_up_to_command=%d, diff=%d\n", path, size, valid, commands, size - valid)
+
+	if aofErr == nil {
+		fmt.Println("AOF is valid")
+		return 0
+	}
+
+	fmt.Println(aofErr)
+
+	if !last {
+		fmt.Println("AOF is not valid. Only the last file of an AOF can be fixed.")
+		return 1
+	}
+
+	if !fix {
+		fmt.Println("AOF is not valid. Use the -fix option to try fixing it.")
+		return 1
+	}
+
+	if !aofErr.Truncated {
+		fmt.Printf("Dropping %d bytes after the first bad command, including any valid commands after it\n", size - valid)
+	}
+
+	if err := f.Truncate(valid); err != nil {
+		fmt.Println("Failed to truncate AOF:", err)
+		return 1
+	}
+
+	if err := f.Sync(); err != nil {
+		fmt.Println("Failed to fsync AOF:", err)
+		return 1
+	}
+
+	fmt.Printf("Successfully truncated AOF to %d bytes\n", valid)
+
+	return 0
+}
@@ -1,35 +1,22 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
-type DataType struct {
-	Strings map[string]string
-	Lists map[string][]string
-	Hashes map[string]map[string]string
-	ExpireTime map[string]time.Time
-	Mu sync.RWMutex
-}
-
-func createDT() *DataType {
-	return &DataType{
-		Strings: make(map[string]string),
-		Lists: make(map[string][]string),
-		Hashes: make(map[string]map[string]string),
-		ExpireTime: make(map[string]time.Time),
-	}
-}
-
 var Handlers = map[string]func(*DataType, []Value) Value {
 	"PING": ping, // connection commands //
 	"SET": set, // string commands //
 	"GET": get,
 	"SETNX": setnx,
 	"SETEX": setex,
+	"PSETEX": psetex,
 	"GETEX": getex,
 	"STRLEN": strlen,
 	"GETRANGE": getrange,
@@ -46,6 +33,7 @@ var Handlers = map[string]func(*DataType, []Value) Value {
 	"HLEN":  hlen,
 	"HKEYS": hkeys,
 	"HVALS": hvals,
+	"HSCAN": hscan,
 	"RPUSH": rpush, // list commands //
 	"LPUSH": lpush,
 	"RPOP": rpop,
@@ -54,27 +42,420 @@ var Handlers = map[string]func(*DataType, []Value) Value {
 	"LPUSHX": lpushx,
 	"RPUSHX": rpushx,
 	"LLEN": llen,
+	"SADD": sadd, // set commands //
+	"SREM": srem,
+	"SMEMBERS": smembers,
+	"SSCAN": sscan,
+	"SISMEMBER": sismember,
+	"SMISMEMBER": smismember,
+	"SCARD": scard,
+	"SPOP": spop,
+	"SRANDMEMBER": srandmember,
+	"SMOVE": smove,
+	"SINTER": sinter,
+	"SUNION": sunion,
+	"SDIFF": sdiff,
+	"SINTERSTORE": sinterstore,
+	"SUNIONSTORE": sunionstore,
+	"SDIFFSTORE": sdiffstore,
+	"SINTERCARD": sintercard,
+	"ZADD": zadd, // sorted set commands //
+	"ZINCRBY": zincrby,
+	"ZREM": zrem,
+	"ZSCORE": zscore,
+	"ZSCAN": zscan,
+	"ZCARD": zcard,
+	"ZRANK": zrank,
+	"ZREVRANK": zrevrank,
+	"ZRANGE": zrange,
+	"ZCOUNT": zcount,
+	"ZPOPMIN": zpopmin,
+	"ZPOPMAX": zpopmax,
+	"ZREMRANGEBYSCORE": zremrangebyscore,
+	"ZUNION": zunion,
+	"ZINTER": zinter,
+	"ZDIFF": zdiff,
+	"ZUNIONSTORE": zunionstore,
+	"ZINTERSTORE": zinterstore,
+	"ZDIFFSTORE": zdiffstore,
+	"ZRANGESTORE": zrangestore,
+	"XADD": xadd, // stream commands //
+	"XTRIM": xtrim,
+	"XLEN": xlen,
+	"XDEL": xdel,
+	"XRANGE": xrange,
+	"XREVRANGE": xrevrange,
+	"XREAD": xread,
+	"XSETID": xsetid,
+	"XGROUP": xgroup,
+	"XREADGROUP": xreadgroup,
+	"XACK": xack,
+	"XPENDING": xpending,
+	"XCLAIM": xclaim,
+	"XAUTOCLAIM": xautoclaim,
+	"XINFO": xinfo,
+	"SETBIT": setbit, // bitmap commands //
+	"GETBIT": getbit,
+	"BITCOUNT": bitcount,
+	"BITPOS": bitpos,
+	"BITOP": bitopCommand,
+	"BITFIELD": bitfield,
+	"PFADD": pfadd, // hyperloglog commands //
+	"PFCOUNT": pfcount,
+	"PFMERGE": pfmerge,
+	"GEOADD": geoadd, // geo commands //
+	"GEODIST": geodist,
+	"GEOHASH": geohash,
+	"GEOPOS": geopos,
+	"GEOSEARCH": geosearch,
+	"GEOSEARCHSTORE": geosearchstore,
+	"JSON.SET": jsonSet, // json commands //
+	"JSON.GET": jsonGet,
+	"JSON.DEL": jsonDel,
+	"JSON.TYPE": jsonType,
+	"JSON.NUMINCRBY": jsonNumincrby,
+	"JSON.ARRAPPEND": jsonArrappend,
+	"JSON.ARRLEN": jsonArrlen,
+	"JSON.OBJKEYS": jsonObjkeys,
+	"JSON.MGET": jsonMget,
 	"DEL": del, // generic commands //
+	"EXISTS": exists,
+	"TYPE": typeCommand,
+	"KEYS": keys,
+	"RANDOMKEY": randomkey,
+	"DBSIZE": dbsize,
+	"SCAN": scan,
 	"EXPIRE": expire,
+	"PEXPIRE": pexpire,
+	"EXPIREAT": expireat,
+	"PEXPIREAT": pexpireat,
+	"PERSIST": persist,
 	"TTL": ttl,
+	"PTTL": pttl,
+	"EXPIRETIME": expiretime,
+	"PEXPIRETIME": pexpiretime,
+	"DUMP": dump,
+	"RESTORE": restore,
+}
+
+type CommandMeta struct {
+	Write bool
+}
+
+// Commands describes every entry of Handlers. Write commands that succeed
+// are appended to the AOF, read-only commands are never logged.
+var Commands = map[string]CommandMeta {
+	"PING": {Write: false}, // connection commands //
+	"SET": {Write: true}, // string commands //
+	"GET": {Write: false},
+	"SETNX": {Write: true},
+	"SETEX": {Write: true},
+	"PSETEX": {Write: true},
+	"GETEX": {Write: true},
+	"STRLEN": {Write: false},
+	"GETRANGE": {Write: false},
+	"MSET": {Write: true},
+	"MGET": {Write: false},
+	"INCR": {Write: true},
+	"DECR": {Write: true},
+	"HSET": {Write: true}, // hash commands //
+	"HGET": {Write: false},
+	"HDEL": {Write: true},
+	"HEXISTS": {Write: false},
+	"HMGET": {Write: false},
+	"HGETALL": {Write: false},
+	"HLEN": {Write: false},
+	"HKEYS": {Write: false},
+	"HVALS": {Write: false},
+	"HSCAN": {Write: false},
+	"RPUSH": {Write: true}, // list commands //
+	"LPUSH": {Write: true},
+	"RPOP": {Write: true},
+	"LPOP": {Write: true},
+	"LRANGE": {Write: false},
+	"LPUSHX": {Write: true},
+	"RPUSHX": {Write: true},
+	"LLEN": {Write: false},
+	"SADD": {Write: true}, // set commands //
+	"SREM": {Write: true},
+	"SMEMBERS": {Write: false},
+	"SSCAN": {Write: false},
+	"SISMEMBER": {Write: false},
+	"SMISMEMBER": {Write: false},
+	"SCARD": {Write: false},
+	"SPOP": {Write: true},
+	"SRANDMEMBER": {Write: false},
+	"SMOVE": {Write: true},
+	"SINTER": {Write: false},
+	"SUNION": {Write: false},
+	"SDIFF": {Write: false},
+	"SINTERSTORE": {Write: true},
+	"SUNIONSTORE": {Write: true},
+	"SDIFFSTORE": {Write: true},
+	"SINTERCARD": {Write: false},
+	"ZADD": {Write: true}, // sorted set commands //
+	"ZINCRBY": {Write: true},
+	"ZREM": {Write: true},
+	"ZSCORE": {Write: false},
+	"ZSCAN": {Write: false},
+	"ZCARD": {Write: false},
+	"ZRANK": {Write: false},
+	"ZREVRANK": {Write: false},
+	"ZRANGE": {Write: false},
+	"ZCOUNT": {Write: false},
+	"ZPOPMIN": {Write: true},
+	"ZPOPMAX": {Write: true},
+	"ZREMRANGEBYSCORE": {Write: true},
+	"ZUNION": {Write: false},
+	"ZINTER": {Write: false},
+	"ZDIFF": {Write: false},
+	"ZUNIONSTORE": {Write: true},
+	"ZINTERSTORE": {Write: true},
+	"ZDIFFSTORE": {Write: true},
+	"ZRANGESTORE": {Write: true},
+	"XADD": {Write: true}, // stream commands //
+	"XTRIM": {Write: true},
+	"XLEN": {Write: false},
+	"XDEL": {Write: true},
+	"XRANGE": {Write: false},
+	"XREVRANGE": {Write: false},
+	"XREAD": {Write: false},
+	"XSETID": {Write: true},
+	"XGROUP": {Write: true},
+	"XREADGROUP": {Write: true},
+	"XACK": {Write: true},
+	"XPENDING": {Write: false},
+	"XCLAIM": {Write: true},
+	"XAUTOCLAIM": {Write: true},
+	"XINFO": {Write: false},
+	"SETBIT": {Write: true}, // bitmap commands //
+	"GETBIT": {Write: false},
+	"BITCOUNT": {Write: false},
+	"BITPOS": {Write: false},
+	"BITOP": {Write: true},
+	"BITFIELD": {Write: true},
+	"PFADD": {Write: true}, // hyperloglog commands //
+	"PFCOUNT": {Write: true}, // caches the count in the key
+	"PFMERGE": {Write: true},
+	"GEOADD": {Write: true}, // geo commands //
+	"GEODIST": {Write: false},
+	"GEOHASH": {Write: false},
+	"GEOPOS": {Write: false},
+	"GEOSEARCH": {Write: false},
+	"GEOSEARCHSTORE": {Write: true},
+	"JSON.SET": {Write: true}, // json commands //
+	"JSON.GET": {Write: false},
+	"JSON.DEL": {Write: true},
+	"JSON.TYPE": {Write: false},
+	"JSON.NUMINCRBY": {Write: true},
+	"JSON.ARRAPPEND": {Write: true},
+	"JSON.ARRLEN": {Write: false},
+	"JSON.OBJKEYS": {Write: false},
+	"JSON.MGET": {Write: false},
+	"DEL": {Write: true}, // generic commands //
+	"EXISTS": {Write: false},
+	"TYPE": {Write: false},
+	"KEYS": {Write: false},
+	"RANDOMKEY": {Write: false},
+	"DBSIZE": {Write: false},
+	"SCAN": {Write: false},
+	"EXPIRE": {Write: true},
+	"PEXPIRE": {Write: true},
+	"EXPIREAT": {Write: true},
+	"PEXPIREAT": {Write: true},
+	"PERSIST": {Write: true},
+	"TTL": {Write: false},
+	"PTTL": {Write: false},
+	"EXPIRETIME": {Write: false},
+	"PEXPIRETIME": {Write: false},
+	"DUMP": {Write: false},
+	"RESTORE": {Write: true},
+	"BGREWRITEAOF": {Write: false}, // server commands //
+	"SAVE": {Write: false},
+	"BGSAVE": {Write: false},
+	"LASTSAVE": {Write: false},
+	"CONFIG": {Write: false},
 }
 
+
 // helpers //
-func checkExpireTime(dt *DataType, key string) bool {
-	if _, exist := dt.ExpireTime[key]; !exist {
-		return false
+
+// setString stores val at key, replacing whatever the key held along with
+// its deadline.
+func setString(dt *DataType, key string, val string) {
+	dt.Keys.Set(key, &Object{Type: TypeString, Value: val})
+}
+
+// parseExpireOption parses the time given to the EX, PX, EXAT or PXAT option
+// of SET and GETEX into a deadline.
+func parseExpireOption(opt string, arg string, name string) (time.Time, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("value is not an integer or out of range")
 	}
 
-	if time.Now().After(dt.ExpireTime[key]) {
-		delete(dt.Strings, key)
-		delete(dt.Lists, key)
-		delete(dt.Hashes, key)
-		delete(dt.ExpireTime, key)
+	unit := time.Second
+	if opt == "PX" || opt == "PXAT" {
+		unit = time.Millisecond
+	}
 
-		return true
+	deadline, ok := expireDeadline(n, unit, opt == "EXAT" || opt == "PXAT")
+	if n <= 0 || !ok {
+		return time.Time{}, errors.New("invalid expire time in '" + name + "' command")
 	}
 
-	return false
+	return deadline, nil
+}
+
+// setOptions are the options of SET.
+type setOptions struct {
+	nx, xx bool
+	get bool
+	keepTTL bool
+	deadline time.Time // zero if the key gets no deadline
+}
+
+func parseSetOptions(args []Value) (setOptions, error) {
+	var opts setOptions
+	var expire string
+
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i].bulk); opt {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GET":
+			opts.get = true
+		case "KEEPTTL":
+			opts.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expire != "" || i + 1 == len(args) {
+				return setOptions{}, errors.New("syntax error")
+			}
+			expire = opt
+
+			deadline, err := parseExpireOption(opt, args[i + 1].bulk, "set")
+			if err != nil {
+				return setOptions{}, err
+			}
+			opts.deadline = deadline
+			i++
+		default:
+			return setOptions{}, errors.New("syntax error")
+		}
+	}
+
+	if opts.nx && opts.xx || opts.keepTTL && expire != "" {
+		return setOptions{}, errors.New("syntax error")
+	}
+
+	return opts, nil
+}
+
+// expireDeadline turns an expire time in units of unit, relative to now
+// unless absolute, into a deadline. ok is false if it overflows.
+func expireDeadline(n int64, unit time.Duration, absolute bool) (deadline time.Time, ok bool) {
+	ms := int64(unit / time.Millisecond)
+	if n > math.MaxInt64 / ms || n < math.MinInt64 / ms {
+		return time.Time{}, false
+	}
+	n *= ms
+
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if n > math.MaxInt64 - now {
+			return time.Time{}, false
+		}
+		n += now
+	}
+
+	return time.UnixMilli(n), true
+}
+
+// ttlMillis returns the time left before deadline in milliseconds, never
+// less than 0.
+func ttlMillis(deadline time.Time) int64 {
+	return max(time.Until(deadline).Milliseconds(), 0)
+}
+
+// scanOptions are the arguments of SCAN, HSCAN, SSCAN and ZSCAN after the
+// key: the cursor, then MATCH, COUNT and the options of each command.
+type scanOptions struct {
+	cursor uint64
+	pattern string
+	count int
+	typ string // SCAN only, empty to return keys of every type
+	novalues bool // HSCAN only
+}
+
+func parseScanOptions(command string, args []Value) (scanOptions, error) {
+	opts := scanOptions{pattern: "*", count: 10}
+
+	cursor, err := strconv.ParseUint(args[0].bulk, 10, 64)
+	if err != nil {
+		return scanOptions{}, errors.New("invalid cursor")
+	}
+	opts.cursor = cursor
+
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+
+		if opt == "NOVALUES" && command == "HSCAN" {
+			opts.novalues = true
+			continue
+		}
+
+		if i + 1 == len(args) {
+			return scanOptions{}, errors.New("syntax error")
+		}
+		arg := args[i + 1].bulk
+		i++
+
+		switch {
+		case opt == "MATCH":
+			opts.pattern = arg
+		case opt == "COUNT":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return scanOptions{}, errors.New("value is not an integer or out of range")
+			}
+
+			if n < 1 {
+				return scanOptions{}, errors.New("syntax error")
+			}
+			opts.count = n
+		case opt == "TYPE" && command == "SCAN":
+			switch typ := strings.ToLower(arg); typ {
+			case TypeString, TypeList, TypeHash, TypeSet, TypeZSet, TypeStream, strings.ToLower(TypeJSON):
+				opts.typ = typ
+			default:
+				return scanOptions{}, errors.New("unknown type name '" + arg + "'")
+			}
+		default:
+			return scanOptions{}, errors.New("syntax error")
+		}
+	}
+
+	return opts, nil
+}
+
+// scanReply is the reply of the SCAN commands: the next cursor and the items
+// found.
+func scanReply(cursor uint64, items []Value) Value {
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatUint(cursor, 10)},
+		{typ: "array", array: items},
+	}}
+}
+
+func bulkArray(items []string) Value {
+	res := make([]Value, 0, len(items))
+	for _, item := range items {
+		res = append(res, Value{typ: "bulk", bulk: item})
+	}
+
+	return Value{typ: "array", array: res}
 }
 
 // CONECTION COMMANDS //
@@ -87,20 +468,55 @@ func ping(_ *DataType, args []Value) Value {
 }
 
 // STRING COMMANDS //
+// set stores a string, dropping the deadline of the key unless KEEPTTL is
+// given. NX and XX only set it if the key doesn't exist or does, GET replies
+// with the old value instead of OK.
 func set(dt *DataType, args []Value) Value {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return Value{typ: "error", str: "wrong number of arguments for 'set' command"}
 	}
 
 	key := args[0].bulk
 	val := args[1].bulk
 
+	opts, err := parseSetOptions(args[2:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	dt.Strings[key] = val
+	obj := dt.lookupWrite(key)
 
-	return Value{typ: "string", str: "OK"}
+	reply := Value{typ: "string", str: "OK"}
+	if opts.get {
+		reply = Value{typ: "null"}
+		if obj != nil {
+			if obj.Type != TypeString {
+				return wrongType()
+			}
+
+			reply = Value{typ: "bulk", bulk: obj.Value.(string)}
+		}
+	}
+
+	if opts.nx && obj != nil || opts.xx && obj == nil {
+		if opts.get {
+			return reply
+		}
+
+		return Value{typ: "null"}
+	}
+
+	deadline := opts.deadline
+	if opts.keepTTL && obj != nil {
+		deadline = obj.ExpireAt
+	}
+
+	dt.Keys.Set(key, &Object{Type: TypeString, Value: val, ExpireAt: deadline})
+
+	return reply
 }
 
 func get(dt *DataType, args []Value) Value {
@@ -113,21 +529,21 @@ func get(dt *DataType, args []Value) Value {
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	val, ok := dt.Strings[key]
-	if !ok {
-		return Value{typ: "null"}
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if checkExpireTime(dt, key) {
+	if obj == nil {
 		return Value{typ: "null"}
 	}
 
-	return Value{typ: "bulk", bulk: val}
+	return Value{typ: "bulk", bulk: obj.Value.(string)}
 }
 
 func setnx(dt *DataType, args []Value) Value {
 	if len(args) != 2 {
-		return Value{typ: "error", str: "wrong number of arguments for 'set' command"}
+		return Value{typ: "error", str: "wrong number of arguments for 'setnx' command"}
 	}
 
 	key := args[0].bulk
@@ -136,8 +552,8 @@ func setnx(dt *DataType, args []Value) Value {
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	if _, exist := dt.Strings[key]; !exist {
-		dt.Strings[key] = val
+	if dt.lookupWrite(key) == nil {
+		dt.Keys.Set(key, &Object{Type: TypeString, Value: val})
 		return Value{typ: "integer", num: 1}
 	}
 
@@ -145,55 +561,97 @@ func setnx(dt *DataType, args []Value) Value {
 }
 
 func setex(dt *DataType, args []Value) Value {
+	return setexGeneric(dt, args, "setex", time.Second)
+}
+
+func psetex(dt *DataType, args []Value) Value {
+	return setexGeneric(dt, args, "psetex", time.Millisecond)
+}
+
+// setexGeneric implements SETEX and PSETEX, which take the expire time in
+// units of unit.
+func setexGeneric(dt *DataType, args []Value, name string, unit time.Duration) Value {
 	if len(args) != 3 {
-		return Value{typ: "error", str: "wrong number of arguments for 'setex' command"}
+		return Value{typ: "error", str: "wrong number of arguments for '" + name + "' command"}
 	}
 
 	key := args[0].bulk
-	t, err := strconv.Atoi(args[1].bulk)	
+	t, err := strconv.ParseInt(args[1].bulk, 10, 64)
 	if err != nil {
 		return Value{typ: "error", str: "value is not an integer or out of range"}
 	}
 	val := args[2].bulk
 
+	deadline, ok := expireDeadline(t, unit, false)
+	if t <= 0 || !ok {
+		return Value{typ: "error", str: "invalid expire time in '" + name + "' command"}
+	}
+
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	dt.Strings[key] = val
-	dt.ExpireTime[key] = time.Now().Add(time.Duration(t) * time.Second)
+	dt.Keys.Set(key, &Object{
+		Type: TypeString,
+		Value: val,
+		ExpireAt: deadline,
+	})
 
 	return Value{typ: "string", str: "OK"}
 }
 
+// getex is GET that also sets the deadline of the key with EX, PX, EXAT or
+// PXAT, or drops it with PERSIST.
 func getex(dt *DataType, args []Value) Value {
-	if len(args) < 1 || len(args) > 3 {
-		return Value{typ: "error", str: "wrong number of arguments for 'get' command"}
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'getex' command"}
 	}
 
 	key := args[0].bulk
 
-	dt.Mu.RLock()
-	defer dt.Mu.RUnlock()
+	var deadline time.Time
+	var persist bool
+
+	switch {
+	case len(args) == 1:
+	case len(args) == 2 && strings.EqualFold(args[1].bulk, "PERSIST"):
+		persist = true
+	case len(args) == 3:
+		opt := strings.ToUpper(args[1].bulk)
+		if opt != "EX" && opt != "PX" && opt != "EXAT" && opt != "PXAT" {
+			return Value{typ: "error", str: "syntax error"}
+		}
 
-	val, ok := dt.Strings[key]
-	if !ok {
-		return Value{typ: "null"}
+		var err error
+		deadline, err = parseExpireOption(opt, args[2].bulk, "getex")
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+	default:
+		return Value{typ: "error", str: "syntax error"}
 	}
 
-	if checkExpireTime(dt, key) {
-		return Value{typ: "null"}
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if len(args) == 3 {
-		t, err := strconv.Atoi(args[2].bulk)
-		if err != nil {
-			return Value{typ: "error", str: "value is not an integer or out of range"}
-		}
+	if obj == nil {
+		return Value{typ: "null"}
+	}
 
-		dt.ExpireTime[key] = time.Now().Add(time.Duration(t) * time.Second)
+	switch {
+	case persist:
+		obj.ExpireAt = time.Time{}
+	case !deadline.IsZero():
+		obj.ExpireAt = deadline
 	}
 
-	return Value{typ: "bulk", bulk: val}
+	return Value{typ: "bulk", bulk: obj.Value.(string)}
 }
 
 func strlen(dt *DataType, args []Value) Value {
@@ -203,19 +661,19 @@ func strlen(dt *DataType, args []Value) Value {
 
 	key := args[0].bulk
 
-	dt.Mu.Lock()
-	defer dt.Mu.Unlock()
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
 
-	val, ok := dt.Strings[key]
-	if !ok {
-		return Value{typ: "integer", num: 0}
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if checkExpireTime(dt, key) {
+	if obj == nil {
 		return Value{typ: "integer", num: 0}
 	}
 
-	return Value{typ: "integer", num: len(val)}
+	return Value{typ: "integer", num: len(obj.Value.(string))}
 }
 
 func getrange(dt *DataType, args []Value) Value {
@@ -236,11 +694,16 @@ func getrange(dt *DataType, args []Value) Value {
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	data, exist := dt.Strings[key]
-	if len(data) == 0 || !exist || checkExpireTime(dt, key){
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil || len(obj.Value.(string)) == 0 {
 		return Value{typ: "array", array: []Value{}}
 	}
-	length := len(data) 
+	data := obj.Value.(string)
+	length := len(data)
 
 	if startInt < 0 {
 		startInt = length + startInt
@@ -262,7 +725,7 @@ func getrange(dt *DataType, args []Value) Value {
 		endInt = length - 1
 	}
 
-	val := dt.Strings[key][startInt:endInt + 1]
+	val := data[startInt:endInt + 1]
 
 	return Value{typ: "bulk", bulk: val}
 }
@@ -278,7 +741,7 @@ func mset(dt *DataType, args []Value) Value {
 	for i := 0; i < len(args); i += 2 {
 		key := args[i].bulk
 		val := args[i+1].bulk
-		dt.Strings[key] = val
+		setString(dt, key, val)
 	}
 
 	return Value{typ: "string", str: "OK"}
@@ -295,13 +758,10 @@ func mget(dt *DataType, args []Value) Value {
 
 	for i := 0; i < len(args); i += 1 {
 		key := args[i].bulk
-		
-		if checkExpireTime(dt, key) {
-			return Value{typ: "null"}
-		}
-		
-		if val, exist := dt.Strings[key]; exist {
-			res = append(res, Value{typ: "bulk", bulk: val})
+
+		// keys of other types read as nil, MGET never fails on them
+		if obj := dt.lookup(key); obj != nil && obj.Type == TypeString {
+			res = append(res, Value{typ: "bulk", bulk: obj.Value.(string)})
 		} else {
 			res = append(res, Value{typ: "null"})
 		}
@@ -315,25 +775,7 @@ func incr(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'incr' command"}
 	}
 
-	key := args[0].bulk
-
-	dt.Mu.Lock()
-	defer dt.Mu.Unlock()
-
-	if _, exist := dt.Strings[key]; !exist || checkExpireTime(dt, key) {
-		dt.Strings[key] = "1"
-		return Value{typ: "integer", num: 1}
-	}
-
-	n, err := strconv.Atoi(dt.Strings[key])
-	if err != nil {
-		return Value{typ: "error", str: "value is not an integer or out of range"}
-	}
-	n++
-
-	dt.Strings[key] = strconv.Itoa(n)
-
-	return Value{typ: "integer", num: n}
+	return incrBy(dt, args[0].bulk, 1)
 }
 
 func decr(dt *DataType, args []Value) Value {
@@ -341,52 +783,77 @@ func decr(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'decr' command"}
 	}
 
-	key := args[0].bulk
+	return incrBy(dt, args[0].bulk, -1)
+}
 
+func incrBy(dt *DataType, key string, by int) Value {
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	if _, exist := dt.Strings[key]; !exist || checkExpireTime(dt, key) {
-		dt.Strings[key] = "-1"
-		return Value{typ: "integer", num: -1}
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
 	}
 
-	n, err := strconv.Atoi(dt.Strings[key])
+	if obj == nil {
+		dt.Keys.Set(key, &Object{Type: TypeString, Value: strconv.Itoa(by)})
+		return Value{typ: "integer", num: by}
+	}
+
+	n, err := strconv.Atoi(obj.Value.(string))
 	if err != nil {
 		return Value{typ: "error", str: "value is not an integer or out of range"}
 	}
-	n--
+	n += by
 
-	dt.Strings[key] = strconv.Itoa(n)
+	obj.Value = strconv.Itoa(n)
 
 	return Value{typ: "integer", num: n}
 }
 
 // HASH COMMAND //
+
+// lookupHash returns the hash at key, nil if the key does not exist.
+func lookupHash(dt *DataType, key string) (*Dict[string], *Value) {
+	obj, errVal := dt.lookupType(key, TypeHash)
+	if obj == nil {
+		return nil, errVal
+	}
+
+	return obj.Value.(*Dict[string]), nil
+}
+
 func hset(dt *DataType, args []Value) Value {
-	if len(args) < 3 {
+	if len(args) < 3 || len(args) % 2 == 0 {
 		return Value{typ: "error", str: "wrong number of arguments for 'hset' command"}
 	}
 
 	var n int
-	hash := args[0].bulk
+	key := args[0].bulk
 
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	if dt.Hashes[hash] == nil {
-		dt.Hashes[hash] = make(map[string]string)
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeHash)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if len(args) % 2 != 0 {
-		for i := 1; i < len(args); i += 2 {
-			key := args[i].bulk
-			val := args[i + 1].bulk
-			dt.Hashes[hash][key] = val
-			n++
-		}
-	} else {
-		return Value{typ: "error", str: "wrong number of arguments for 'hset' command"}
+	if obj == nil {
+		obj = &Object{Type: TypeHash, Value: NewDict[string]()}
+		dt.Keys.Set(key, obj)
+	}
+	hash := obj.Value.(*Dict[string])
+
+	for i := 1; i < len(args); i += 2 {
+		field := args[i].bulk
+		val := args[i + 1].bulk
+		hash.Set(field, val)
+		n++
 	}
 
 	return Value{typ: "integer", num: n}
@@ -397,17 +864,18 @@ func hget(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'hget' command"}
 	}
 
-	hash := args[0].bulk
-	key := args[1].bulk
+	key := args[0].bulk
+	field := args[1].bulk
 
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	if checkExpireTime(dt, hash) {
-		return Value{typ: "null"}
+	hash, errVal := lookupHash(dt, key)
+	if errVal != nil {
+		return *errVal
 	}
 
-	val, exist := dt.Hashes[hash][key]; 
+	val, exist := hash.Get(field)
 	if !exist {
 		return Value{typ: "null"}
 	}
@@ -417,51 +885,56 @@ func hget(dt *DataType, args []Value) Value {
 
 func hdel(dt *DataType, args []Value) Value {
 	if len(args) < 2 {
-		return Value{typ: "error", str: "wrong number of arguments for 'hget' command"}
+		return Value{typ: "error", str: "wrong number of arguments for 'hdel' command"}
 	}
 
 	var n int
-	hash := args[0].bulk
-	key := args[1].bulk
-
-	if _, exist := dt.Hashes[hash][key]; !exist {
-		return Value{typ: "integer", num: 0}
-	}
+	key := args[0].bulk
 
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	if dt.Hashes[hash] == nil {
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeHash)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil {
 		return Value{typ: "integer", num: 0}
 	}
+	hash := obj.Value.(*Dict[string])
 
 	for i := 1; i < len(args); i++ {
-		key := args[i].bulk
-		if _, exist := dt.Hashes[hash][key]; exist {
-			delete(dt.Hashes[hash], key)
+		field := args[i].bulk
+		if hash.Delete(field) {
 			n++
 		}
 	}
 
+	dt.deleteIfEmpty(key, obj)
+
 	return Value{typ: "integer", num: n}
 }
 
 func hexists(dt *DataType, args []Value) Value {
-	if len(args) < 2 {
-		return Value{typ: "error", str: "wrong number of arguments for 'hget' command"}
+	if len(args) != 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'hexists' command"}
 	}
 
-	hash := args[0].bulk
-	key := args[1].bulk
+	key := args[0].bulk
+	field := args[1].bulk
 
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	if checkExpireTime(dt, hash) {
-		return Value{typ: "integer", num: 0}
+	hash, errVal := lookupHash(dt, key)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if _, exist := dt.Hashes[hash][key]; !exist {
+	if _, exist := hash.Get(field); !exist {
 		return Value{typ: "integer", num: 0}
 	}
 
@@ -474,19 +947,20 @@ func hmget(dt *DataType, args []Value) Value {
 	}
 
 	var res []Value
-	hash := args[0].bulk
+	key := args[0].bulk
 
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	if checkExpireTime(dt, hash) {
-			return Value{typ: "null"}
-		}
+	hash, errVal := lookupHash(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
 
 	for i := 1; i < len(args); i++ {
-		key := args[i].bulk
-		
-		if val, exist := dt.Hashes[hash][key]; exist {
+		field := args[i].bulk
+
+		if val, exist := hash.Get(field); exist {
 			res = append(res, Value{typ: "bulk", bulk: val})
 		} else {
 			res = append(res, Value{typ: "null"})
@@ -501,22 +975,19 @@ func hgetall(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'hgetall' command"}
 	}
 
-	var res []Value
-	hash := args[0].bulk
+	res := []Value{}
+	key := args[0].bulk
 
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	if _, exist := dt.Hashes[hash]; !exist {
-		return Value{typ: "array", array: []Value{}}
+	hash, errVal := lookupHash(dt, key)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if checkExpireTime(dt, hash) {
-			return Value{typ: "array", array: []Value{}}
-		}
-
-	for key, val := range dt.Hashes[hash] {
-		res = append(res, Value{typ: "bulk", bulk: key}, Value{typ: "bulk", bulk: val})
+	for field, val := range hash.All() {
+		res = append(res, Value{typ: "bulk", bulk: field}, Value{typ: "bulk", bulk: val})
 	}
 
 	return Value{typ: "array", array: res}
@@ -527,21 +998,17 @@ func hlen(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'hlen' command"}
 	}
 
-	hash := args[0].bulk
-
-	dt.Mu.Lock()
-	defer dt.Mu.Unlock()
+	key := args[0].bulk
 
-	val, ok := dt.Hashes[hash]
-	if !ok {
-		return Value{typ: "integer", num: 0}
-	}
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
 
-	if checkExpireTime(dt, hash) {
-		return Value{typ: "integer", num: 0}
+	hash, errVal := lookupHash(dt, key)
+	if errVal != nil {
+		return *errVal
 	}
 
-	return Value{typ: "integer", num: len(val)}
+	return Value{typ: "integer", num: hash.Len()}
 }
 
 func hkeys(dt *DataType, args []Value) Value {
@@ -549,22 +1016,19 @@ func hkeys(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'hkeys' command"}
 	}
 
-	var res []Value
-	hash := args[0].bulk
+	res := []Value{}
+	key := args[0].bulk
 
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	if _, exist := dt.Hashes[hash]; !exist {
-		return Value{typ: "array", array: []Value{}}
+	hash, errVal := lookupHash(dt, key)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if checkExpireTime(dt, hash) {
-			return Value{typ: "array", array: []Value{}}
-		}
-
-	for key := range dt.Hashes[hash] {
-		res = append(res, Value{typ: "bulk", bulk: key})
+	for field := range hash.All() {
+		res = append(res, Value{typ: "bulk", bulk: field})
 	}
 
 	return Value{typ: "array", array: res}
@@ -575,92 +1039,139 @@ func hvals(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'hvals' command"}
 	}
 
-	var res []Value
-	hash := args[0].bulk
+	res := []Value{}
+	key := args[0].bulk
 
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	if _, exist := dt.Hashes[hash]; !exist {
-		return Value{typ: "array", array: []Value{}}
+	hash, errVal := lookupHash(dt, key)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if checkExpireTime(dt, hash) {
-			return Value{typ: "array", array: []Value{}}
-		}
-
-	for _, val := range dt.Hashes[hash] {
+	for _, val := range hash.All() {
 		res = append(res, Value{typ: "bulk", bulk: val})
 	}
 
 	return Value{typ: "array", array: res}
 }
 
-// LIST COMMAND //
-func rpush(dt *DataType, args []Value) Value {
+// hscan walks the fields of a hash like SCAN, with their values unless
+// NOVALUES is given.
+func hscan(dt *DataType, args []Value) Value {
 	if len(args) < 2 {
-		return Value{typ: "error", str: "wrong number of arguments for 'rpush' command"}
+		return Value{typ: "error", str: "wrong number of arguments for 'hscan' command"}
 	}
 
 	key := args[0].bulk
-	length := len(args)
-
-	dt.Mu.Lock()
-	defer dt.Mu.Unlock()
 
-	if _, exist := dt.Lists[key]; !exist || checkExpireTime(dt, key) {
-		dt.Lists[key] = make([]string, 0)
+	opts, err := parseScanOptions("HSCAN", args[1:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
 	}
 
-	for i := 1; i < length; i++ {
-		dt.Lists[key] = append(dt.Lists[key], args[i].bulk)
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	hash, errVal := lookupHash(dt, key)
+	if errVal != nil {
+		return *errVal
 	}
 
-	n := len(dt.Lists[key])
+	res := []Value{}
+	cursor := hash.ScanCount(opts.cursor, opts.count, func(field string, val string) {
+		if !globMatch(opts.pattern, field) {
+			return
+		}
 
-	return Value{typ: "integer", num: n}
+		res = append(res, Value{typ: "bulk", bulk: field})
+		if !opts.novalues {
+			res = append(res, Value{typ: "bulk", bulk: val})
+		}
+	})
+
+	return scanReply(cursor, res)
 }
 
-func lpush(dt *DataType, args []Value) Value {
-	if len(args) < 2 {
-		return Value{typ: "error", str: "wrong number of arguments for 'lpush' command"}
-	}
+// LIST COMMAND //
 
+// push adds the values in args to the list at key, creating it unless
+// onlyExisting is set.
+func push(dt *DataType, args []Value, left bool, onlyExisting bool) Value {
 	key := args[0].bulk
-	length := len(args)
 
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	if _, exist := dt.Lists[key]; !exist || checkExpireTime(dt, key) {
-		dt.Lists[key] = make([]string, 0)
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeList)
+	if errVal != nil {
+		return *errVal
 	}
 
-	for i := 1; i < length; i++ {
-		dt.Lists[key] = append([]string{args[i].bulk}, dt.Lists[key]...)
+	if obj == nil {
+		if onlyExisting {
+			return Value{typ: "integer", num: 0}
+		}
+
+		obj = &Object{Type: TypeList, Value: make([]string, 0)}
+		dt.Keys.Set(key, obj)
 	}
 
-	n := len(dt.Lists[key])
+	list := obj.Value.([]string)
+	for i := 1; i < len(args); i++ {
+		if left {
+			list = append([]string{args[i].bulk}, list...)
+		} else {
+			list = append(list, args[i].bulk)
+		}
+	}
+	obj.Value = list
 
-	return Value{typ: "integer", num: n}
+	return Value{typ: "integer", num: len(list)}
 }
 
-func rpop(dt *DataType, args []Value) Value {
-	if len(args) < 1 {
-		return Value{typ: "error", str: "wrong number of arguments for 'rpop' command"}
+func rpush(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'rpush' command"}
 	}
 
-	var res []Value
-	key := args[0].bulk
-
-	dt.Mu.Lock()
-	defer dt.Mu.Unlock()
+	return push(dt, args, false, false)
+}
 
-	data, exist := dt.Lists[key]
-	if len(data) == 0 || !exist || checkExpireTime(dt, key) {
+func lpush(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'lpush' command"}
+	}
+
+	return push(dt, args, true, false)
+}
+
+func rpop(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'rpop' command"}
+	}
+
+	var res []Value
+	key := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeList)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil || len(obj.Value.([]string)) == 0 {
 		return Value{typ: "null"}
 	}
-	length := len(data) 
+	data := obj.Value.([]string)
+	length := len(data)
 
 	if len(args) > 1 {
 		val, err := strconv.Atoi(args[1].bulk)
@@ -673,15 +1184,17 @@ func rpop(dt *DataType, args []Value) Value {
 		}
 
 		for i := 0; i < val; i++ {
-			res = append(res, Value{typ: "bulk", bulk: dt.Lists[key][length - 1 - i]})
+			res = append(res, Value{typ: "bulk", bulk: data[length - 1 - i]})
 		}
 
-		dt.Lists[key] = dt.Lists[key][:length - val]	
+		obj.Value = data[:length - val]
+		dt.deleteIfEmpty(key, obj)
 		return Value{typ: "array", array: res}
-	} 
+	}
 
-	val := dt.Lists[key][length - 1]
-	dt.Lists[key] = dt.Lists[key][:length - 1]
+	val := data[length - 1]
+	obj.Value = data[:length - 1]
+	dt.deleteIfEmpty(key, obj)
 	return Value{typ: "bulk", bulk: val}
 }
 
@@ -696,13 +1209,18 @@ func lpop(dt *DataType, args []Value) Value {
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
+	checkExpireTime(dt, key)
 
+	obj, errVal := dt.lookupType(key, TypeList)
+	if errVal != nil {
+		return *errVal
+	}
 
-	data, exist := dt.Lists[key]
-	if len(data) == 0 || !exist || checkExpireTime(dt, key){
+	if obj == nil || len(obj.Value.([]string)) == 0 {
 		return Value{typ: "array", array: []Value{}}
 	}
-	length := len(data) 
+	data := obj.Value.([]string)
+	length := len(data)
 
 	if len(args) > 1 {
 		val, err := strconv.Atoi(args[1].bulk)
@@ -715,15 +1233,17 @@ func lpop(dt *DataType, args []Value) Value {
 		}
 
 		for i := 0; i < val; i++ {
-			res = append(res, Value{typ: "bulk", bulk: dt.Lists[key][i]})
+			res = append(res, Value{typ: "bulk", bulk: data[i]})
 		}
 
-		dt.Lists[key] = dt.Lists[key][val:]
+		obj.Value = data[val:]
+		dt.deleteIfEmpty(key, obj)
 		return Value{typ: "array", array: res}
 	}
 
-	val := dt.Lists[key][0]
-	dt.Lists[key] = dt.Lists[key][1:]
+	val := data[0]
+	obj.Value = data[1:]
+	dt.deleteIfEmpty(key, obj)
 	return Value{typ: "bulk", bulk: val}
 }
 
@@ -746,11 +1266,16 @@ func lrange(dt *DataType, args []Value) Value {
 	dt.Mu.RLock()
 	defer dt.Mu.RUnlock()
 
-	data, exist := dt.Lists[key]
-	if len(data) == 0 || !exist || checkExpireTime(dt, key){
+	obj, errVal := dt.lookupType(key, TypeList)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil || len(obj.Value.([]string)) == 0 {
 		return Value{typ: "array", array: []Value{}}
 	}
-	length := len(data) 
+	data := obj.Value.([]string)
+	length := len(data)
 
 	if startInt < 0 {
 		startInt = length + startInt
@@ -772,7 +1297,7 @@ func lrange(dt *DataType, args []Value) Value {
 		endInt = length - 1
 	}
 
-	val := dt.Lists[key][startInt:endInt + 1]
+	val := data[startInt:endInt + 1]
 	for i := 0; i < len(val); i++ {
 		res = append(res, Value{typ: "bulk", bulk: val[i]})
 	}
@@ -785,25 +1310,7 @@ func lpushx(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'lpushx' command"}
 	}
 
-	key := args[0].bulk
-	length := len(args)
-
-	dt.Mu.Lock()
-	defer dt.Mu.Unlock()
-
-	if _, exist := dt.Lists[key]; !exist || checkExpireTime(dt, key) {
-		return Value{typ: "integer", num: 0}
-	}
-
-	for i := 1; i < length; i++ {
-		dt.Lists[key] = append([]string{args[i].bulk}, dt.Lists[key]...)
-	}
-
-	n := len(dt.Lists[key])
-
-	fmt.Println(dt.Lists[key][0])
-
-	return Value{typ: "integer", num: n}
+	return push(dt, args, true, true)
 }
 
 func rpushx(dt *DataType, args []Value) Value {
@@ -811,23 +1318,7 @@ func rpushx(dt *DataType, args []Value) Value {
 		return Value{typ: "error", str: "wrong number of arguments for 'rpushx' command"}
 	}
 
-	key := args[0].bulk
-	length := len(args)
-
-	dt.Mu.Lock()
-	defer dt.Mu.Unlock()
-
-	if _, exist := dt.Lists[key]; !exist || checkExpireTime(dt, key) {
-		return Value{typ: "integer", num: 0}
-	}
-
-	for i := 1; i < length; i++ {
-		dt.Lists[key] = append(dt.Lists[key], args[i].bulk)
-	}
-
-	n := len(dt.Lists[key])
-
-	return Value{typ: "integer", num: n}
+	return push(dt, args, false, true)
 }
 
 func llen(dt *DataType, args []Value) Value {
@@ -837,124 +1328,4746 @@ func llen(dt *DataType, args []Value) Value {
 
 	key := args[0].bulk
 
-	dt.Mu.Lock()
-	defer dt.Mu.Unlock()
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
 
-	val, ok := dt.Lists[key]
-	if !ok {
-		return Value{typ: "integer", num: 0}
+	obj, errVal := dt.lookupType(key, TypeList)
+	if errVal != nil {
+		return *errVal
 	}
 
-	if checkExpireTime(dt, key) {
+	if obj == nil {
 		return Value{typ: "integer", num: 0}
 	}
 
-	return Value{typ: "integer", num: len(val)}
+	return Value{typ: "integer", num: len(obj.Value.([]string))}
 }
 
 // GENERIC COMMANDS //
 func del(dt *DataType, args []Value) Value {
 	if len(args) < 1 {
-		return Value{typ: "error", str: "wrong number of arguments for 'DEL' command"}
+		return Value{typ: "error", str: "wrong number of arguments for 'del' command"}
 	}
 
-	length := len(args)
 	n := 0
 
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	for i := 0; i < length; i++ {
+	for i := 0; i < len(args); i++ {
 		key := args[i].bulk
 
-		if _, exist := dt.Strings[key]; exist {
-			delete(dt.Strings, key)
+		if dt.lookupWrite(key) != nil {
+			dt.Keys.Delete(key)
 			n++
 		}
+	}
+
+	return Value{typ: "integer", num: n}
+}
+
+// exists counts the given keys that exist, a key given twice counts twice.
+func exists(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'exists' command"}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
 
-		if _, exist := dt.Lists[key]; exist {
-			delete(dt.Lists, key)
+	n := 0
+	for _, arg := range args {
+		if dt.lookup(arg.bulk) != nil {
 			n++
 		}
+	}
 
-		if _, exist := dt.Hashes[key]; exist {
-			delete(dt.Hashes, key)
-			n++
+	return Value{typ: "integer", num: n}
+}
+
+func typeCommand(dt *DataType, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'type' command"}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	obj := dt.lookup(args[0].bulk)
+	if obj == nil {
+		return Value{typ: "string", str: "none"}
+	}
+
+	return Value{typ: "string", str: obj.Type}
+}
+
+func keys(dt *DataType, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'keys' command"}
+	}
+
+	pattern := args[0].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	now := time.Now()
+	res := []Value{}
+	for key, obj := range dt.Keys.All() {
+		if !obj.expired(now) && globMatch(pattern, key) {
+			res = append(res, Value{typ: "bulk", bulk: key})
+		}
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+const randomkeyMaxTries = 100
+
+// randomkey returns a random key that has not expired. After
+// randomkeyMaxTries expired keys in a row it looks for one in order, so a
+// keyspace of mostly expired keys doesn't keep it going.
+func randomkey(dt *DataType, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "wrong number of arguments for 'randomkey' command"}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	now := time.Now()
+	for i := 0; i < randomkeyMaxTries; i++ {
+		key, obj, ok := dt.Keys.Random()
+		if !ok {
+			return Value{typ: "null"}
+		}
+
+		if !obj.expired(now) {
+			return Value{typ: "bulk", bulk: key}
 		}
+	}
+
+	for key, obj := range dt.Keys.All() {
+		if !obj.expired(now) {
+			return Value{typ: "bulk", bulk: key}
+		}
+	}
+
+	return Value{typ: "null"}
+}
+
+// dbsize counts the keys that have not expired.
+func dbsize(dt *DataType, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "wrong number of arguments for 'dbsize' command"}
+	}
 
-		delete(dt.ExpireTime, key)
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	now := time.Now()
+	n := 0
+	for _, obj := range dt.Keys.All() {
+		if !obj.expired(now) {
+			n++
+		}
 	}
 
 	return Value{typ: "integer", num: n}
 }
 
+// scan walks the keyspace with a cursor a few keys at a time, so that going
+// through all of it doesn't hold the lock like KEYS does. Keys that exist
+// for the whole walk are returned at least once, maybe more. MATCH and TYPE
+// filter the keys after they were picked, so a call can return fewer than
+// COUNT keys or none while the walk isn't over.
+func scan(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'scan' command"}
+	}
+
+	opts, err := parseScanOptions("SCAN", args)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	now := time.Now()
+	res := []Value{}
+	cursor := dt.Keys.ScanCount(opts.cursor, opts.count, func(key string, obj *Object) {
+		if obj.expired(now) || !globMatch(opts.pattern, key) {
+			return
+		}
+
+		if opts.typ != "" && strings.ToLower(obj.Type) != opts.typ {
+			return
+		}
+
+		res = append(res, Value{typ: "bulk", bulk: key})
+	})
+
+	return scanReply(cursor, res)
+}
+
 func expire(dt *DataType, args []Value) Value {
+	return expireGeneric(dt, args, "expire", time.Second, false)
+}
+
+func pexpire(dt *DataType, args []Value) Value {
+	return expireGeneric(dt, args, "pexpire", time.Millisecond, false)
+}
+
+func expireat(dt *DataType, args []Value) Value {
+	return expireGeneric(dt, args, "expireat", time.Second, true)
+}
+
+func pexpireat(dt *DataType, args []Value) Value {
+	return expireGeneric(dt, args, "pexpireat", time.Millisecond, true)
+}
+
+// expireGeneric implements the EXPIRE family. The time is in units of unit,
+// a Unix time if absolute. The deadline is only set if the NX (no deadline
+// yet), XX (has one), GT (later than the current one) or LT (earlier)
+// conditions hold, a key without a deadline counts as never expiring. A
+// deadline in the past deletes the key right away.
+func expireGeneric(dt *DataType, args []Value, name string, unit time.Duration, absolute bool) Value {
 	if len(args) < 2 {
-		return Value{typ: "error", str: "wrong number of arguments for 'expire' command"}
+		return Value{typ: "error", str: "wrong number of arguments for '" + name + "' command"}
 	}
 
 	key := args[0].bulk
-	n, err := strconv.Atoi(args[1].bulk)
+	n, err := strconv.ParseInt(args[1].bulk, 10, 64)
 	if err != nil {
 		return Value{typ: "error", str: "value is not an integer or out of range"}
 	}
 
+	var nx, xx, gt, lt bool
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg.bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return Value{typ: "error", str: "Unsupported option " + arg.bulk}
+		}
+	}
+
+	if nx && (xx || gt || lt) {
+		return Value{typ: "error", str: "NX and XX, GT or LT options at the same time are not compatible"}
+	}
+
+	if gt && lt {
+		return Value{typ: "error", str: "GT and LT options at the same time are not compatible"}
+	}
+
+	deadline, ok := expireDeadline(n, unit, absolute)
+	if !ok {
+		return Value{typ: "error", str: "invalid expire time in '" + name + "' command"}
+	}
+
 	dt.Mu.Lock()
 	defer dt.Mu.Unlock()
 
-	var key_exist bool
+	obj := dt.lookupWrite(key)
+	if obj == nil {
+		return Value{typ: "integer", num: 0}
+	}
 
-	if _, exist := dt.Strings[key]; exist {
-		key_exist = true
+	volatile := !obj.ExpireAt.IsZero()
+	if nx && volatile || xx && !volatile ||
+		gt && (!volatile || !deadline.After(obj.ExpireAt)) ||
+		lt && volatile && !deadline.Before(obj.ExpireAt) {
+		return Value{typ: "integer", num: 0}
 	}
 
-	if _, exist := dt.Lists[key]; exist {
-		key_exist = true
+	if !dt.loading && !deadline.After(time.Now()) {
+		dt.Keys.Delete(key)
+		return Value{typ: "integer", num: 1}
 	}
 
-	if _, exist := dt.Hashes[key]; exist {
-		key_exist = true
+	obj.ExpireAt = deadline
+
+	return Value{typ: "integer", num: 1}
+}
+
+func persist(dt *DataType, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'persist' command"}
 	}
 
-	if key_exist {
-		dt.ExpireTime[key] = time.Now().Add(time.Duration(n) * time.Second)
-		return Value{typ: "integer", num: 1}
+	key := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	obj := dt.lookupWrite(key)
+	if obj == nil || obj.ExpireAt.IsZero() {
+		return Value{typ: "integer", num: 0}
 	}
 
-	return Value{typ: "integer", num: 0}
+	obj.ExpireAt = time.Time{}
+
+	return Value{typ: "integer", num: 1}
 }
 
 func ttl(dt *DataType, args []Value) Value {
+	return ttlGeneric(dt, args, "ttl", false, false)
+}
+
+func pttl(dt *DataType, args []Value) Value {
+	return ttlGeneric(dt, args, "pttl", true, false)
+}
+
+func expiretime(dt *DataType, args []Value) Value {
+	return ttlGeneric(dt, args, "expiretime", false, true)
+}
+
+func pexpiretime(dt *DataType, args []Value) Value {
+	return ttlGeneric(dt, args, "pexpiretime", true, true)
+}
+
+// ttlGeneric implements TTL, PTTL, EXPIRETIME and PEXPIRETIME: the time left
+// before the deadline of a key, or the deadline itself as a Unix time if
+// absolute, in milliseconds or rounded to seconds. -2 means the key does not
+// exist and -1 that it has no deadline.
+func ttlGeneric(dt *DataType, args []Value, name string, millis bool, absolute bool) Value {
 	if len(args) != 1 {
-		return Value{typ: "error", str: "wrong number of arguments for 'ttl' command"}
+		return Value{typ: "error", str: "wrong number of arguments for '" + name + "' command"}
 	}
 
 	key := args[0].bulk
 
-	var key_exist bool
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
 
-	if _, exist := dt.Strings[key]; exist {
-		key_exist = true
+	obj := dt.lookup(key)
+	if obj == nil {
+		return Value{typ: "integer", num: -2}
 	}
 
-	if _, exist := dt.Lists[key]; exist {
-		key_exist = true
+	if obj.ExpireAt.IsZero() {
+		return Value{typ: "integer", num: -1}
 	}
 
-	if _, exist := dt.Hashes[key]; exist {
-		key_exist = true
+	ms := ttlMillis(obj.ExpireAt)
+	if absolute {
+		ms = obj.ExpireAt.UnixMilli()
 	}
 
-	if key_exist {
-		if expire_time, exist := dt.ExpireTime[key]; exist {
-			if time.Now().Before(expire_time) {
-				ttl := time.Until(expire_time).Seconds()
-				return Value{typ: "integer", num: int(ttl)}
-			}
+	if !millis {
+		ms = (ms + 500) / 1000
+	}
+
+	return Value{typ: "integer", num: int(ms)}
+}
+
+func dump(dt *DataType, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'dump' command"}
+	}
+
+	key := args[0].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	obj := dt.lookup(key)
+	if obj == nil {
+		return Value{typ: "null"}
+	}
+
+	return Value{typ: "bulk", bulk: dumpValue(obj)}
+}
+
+func restore(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'restore' command"}
+	}
+
+	key := args[0].bulk
+	ttl, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "value is not an integer or out of range"}
+	}
+	if ttl < 0 {
+		return Value{typ: "error", str: "Invalid TTL value, must be >= 0"}
+	}
+
+	var replace, absttl bool
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absttl = true
+		default:
+			return Value{typ: "error", str: "syntax error"}
 		}
+	}
 
-		return Value{typ: "integer", num: -1}
+	var deadline time.Time
+	if ttl > 0 {
+		var ok bool
+		deadline, ok = expireDeadline(ttl, time.Millisecond, absttl)
+		if !ok {
+			return Value{typ: "error", str: "invalid expire time in 'restore' command"}
+		}
+	}
+
+	obj, err := restoreValue(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	if dt.lookupWrite(key) != nil && !replace {
+		return Value{typ: "error", str: "BUSYKEY Target key name already exists."}
+	}
+
+	dt.Keys.Delete(key)
+
+	if ttl > 0 {
+		obj.ExpireAt = deadline
+
+		if !dt.loading && obj.expired(time.Now()) {
+			return Value{typ: "string", str: "OK"}
+		}
+	}
+
+	dt.Keys.Set(key, obj)
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// SET COMMANDS //
+func sadd(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'sadd' command"}
+	}
+
+	var n int
+	key := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeSet)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil {
+		obj = &Object{Type: TypeSet, Value: newSet()}
+		dt.Keys.Set(key, obj)
+	}
+	set := obj.Value.(*Set)
+
+	for i := 1; i < len(args); i++ {
+		if set.Add(args[i].bulk) {
+			n++
+		}
+	}
+
+	return Value{typ: "integer", num: n}
+}
+
+func srem(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'srem' command"}
 	}
 
-	return Value{typ: "integer", num: -2}
-}
\ No newline at end of file
+	var n int
+	key := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeSet)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	set := obj.Value.(*Set)
+
+	for i := 1; i < len(args); i++ {
+		if set.Remove(args[i].bulk) {
+			n++
+		}
+	}
+
+	dt.deleteIfEmpty(key, obj)
+
+	return Value{typ: "integer", num: n}
+}
+
+// lookupSet returns the set at key, nil if the key does not exist.
+func lookupSet(dt *DataType, key string) (*Set, *Value) {
+	obj, errVal := dt.lookupType(key, TypeSet)
+	if obj == nil {
+		return nil, errVal
+	}
+
+	return obj.Value.(*Set), nil
+}
+
+func smembers(dt *DataType, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'smembers' command"}
+	}
+
+	key := args[0].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	set, errVal := lookupSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if set == nil {
+		return Value{typ: "array", array: []Value{}}
+	}
+
+	return bulkArray(set.Members())
+}
+
+// sscan walks the members of a set like SCAN.
+func sscan(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'sscan' command"}
+	}
+
+	key := args[0].bulk
+
+	opts, err := parseScanOptions("SSCAN", args[1:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	set, errVal := lookupSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	res := []Value{}
+	if set == nil {
+		return scanReply(0, res)
+	}
+
+	cursor := set.Scan(opts.cursor, opts.count, func(member string) {
+		if globMatch(opts.pattern, member) {
+			res = append(res, Value{typ: "bulk", bulk: member})
+		}
+	})
+
+	return scanReply(cursor, res)
+}
+
+func sismember(dt *DataType, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'sismember' command"}
+	}
+
+	key := args[0].bulk
+	member := args[1].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	set, errVal := lookupSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if set == nil || !set.Has(member) {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+func smismember(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'smismember' command"}
+	}
+
+	var res []Value
+	key := args[0].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	set, errVal := lookupSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	for i := 1; i < len(args); i++ {
+		if set != nil && set.Has(args[i].bulk) {
+			res = append(res, Value{typ: "integer", num: 1})
+		} else {
+			res = append(res, Value{typ: "integer", num: 0})
+		}
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+func scard(dt *DataType, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'scard' command"}
+	}
+
+	key := args[0].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	set, errVal := lookupSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if set == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: set.Len()}
+}
+
+func spop(dt *DataType, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'spop' command"}
+	}
+
+	key := args[0].bulk
+
+	count := -1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeSet)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil {
+		if count < 0 {
+			return Value{typ: "null"}
+		}
+
+		return Value{typ: "array", array: []Value{}}
+	}
+	set := obj.Value.(*Set)
+
+	members := set.Random(max(count, 1))
+	if count == 0 {
+		members = nil
+	}
+
+	for _, member := range members {
+		set.Remove(member)
+	}
+
+	dt.deleteIfEmpty(key, obj)
+
+	if count < 0 {
+		return Value{typ: "bulk", bulk: members[0]}
+	}
+
+	return bulkArray(members)
+}
+
+func srandmember(dt *DataType, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'srandmember' command"}
+	}
+
+	key := args[0].bulk
+
+	var count int
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "value is not an integer or out of range"}
+		}
+		if n == math.MinInt {
+			return Value{typ: "error", str: "value is out of range"}
+		}
+		count = n
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	set, errVal := lookupSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if len(args) == 1 {
+		if set == nil {
+			return Value{typ: "null"}
+		}
+
+		return Value{typ: "bulk", bulk: set.RandomMember()}
+	}
+
+	if set == nil || count == 0 {
+		return Value{typ: "array", array: []Value{}}
+	}
+
+	if count > 0 {
+		return bulkArray(set.Random(count))
+	}
+
+	// a negative count may return the same member several times. The count
+	// comes from the client, so the reply grows as members are picked rather
+	// than being allocated up front.
+	var res []Value
+	for i := 0; i < -count; i++ {
+		res = append(res, Value{typ: "bulk", bulk: set.RandomMember()})
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+func smove(dt *DataType, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'smove' command"}
+	}
+
+	src := args[0].bulk
+	dst := args[1].bulk
+	member := args[2].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, src)
+	checkExpireTime(dt, dst)
+
+	srcObj, errVal := dt.lookupType(src, TypeSet)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dstObj, errVal := dt.lookupType(dst, TypeSet)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if srcObj == nil || !srcObj.Value.(*Set).Remove(member) {
+		return Value{typ: "integer", num: 0}
+	}
+	dt.deleteIfEmpty(src, srcObj)
+
+	if dstObj == nil {
+		dstObj = &Object{Type: TypeSet, Value: newSet()}
+		dt.Keys.Set(dst, dstObj)
+	}
+	dstObj.Value.(*Set).Add(member)
+
+	return Value{typ: "integer", num: 1}
+}
+
+// setAlgebra computes op ("inter", "union" or "diff") over the sets at keys.
+// Missing keys are empty sets. The caller must hold dt.Mu.
+func setAlgebra(dt *DataType, op string, keys []Value) (*Set, *Value) {
+	sets := make([]*Set, 0, len(keys))
+	for _, key := range keys {
+		set, errVal := lookupSet(dt, key.bulk)
+		if errVal != nil {
+			return nil, errVal
+		}
+		sets = append(sets, set)
+	}
+
+	switch op {
+	case "inter":
+		res := newSet()
+		setInter(sets, func(member string) bool {
+			res.Add(member)
+			return true
+		})
+
+		return res, nil
+	case "union":
+		return setUnion(sets), nil
+	}
+
+	return setDiff(sets), nil
+}
+
+func setAlgebraCommand(dt *DataType, op string, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 's" + op + "' command"}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	res, errVal := setAlgebra(dt, op, args)
+	if errVal != nil {
+		return *errVal
+	}
+
+	return bulkArray(res.Members())
+}
+
+// setAlgebraStore stores the result in the first key, replacing whatever it
+// held, and returns its size. An empty result deletes the key.
+func setAlgebraStore(dt *DataType, op string, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 's" + op + "store' command"}
+	}
+
+	dst := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	res, errVal := setAlgebra(dt, op, args[1:])
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Keys.Delete(dst)
+	if res.Len() > 0 {
+		dt.Keys.Set(dst, &Object{Type: TypeSet, Value: res})
+	}
+
+	return Value{typ: "integer", num: res.Len()}
+}
+
+func sinter(dt *DataType, args []Value) Value {
+	return setAlgebraCommand(dt, "inter", args)
+}
+
+func sunion(dt *DataType, args []Value) Value {
+	return setAlgebraCommand(dt, "union", args)
+}
+
+func sdiff(dt *DataType, args []Value) Value {
+	return setAlgebraCommand(dt, "diff", args)
+}
+
+func sinterstore(dt *DataType, args []Value) Value {
+	return setAlgebraStore(dt, "inter", args)
+}
+
+func sunionstore(dt *DataType, args []Value) Value {
+	return setAlgebraStore(dt, "union", args)
+}
+
+func sdiffstore(dt *DataType, args []Value) Value {
+	return setAlgebraStore(dt, "diff", args)
+}
+
+func sintercard(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'sintercard' command"}
+	}
+
+	numkeys, err := strconv.Atoi(args[0].bulk)
+	if err != nil || numkeys < 1 {
+		return Value{typ: "error", str: "numkeys should be greater than 0"}
+	}
+
+	if numkeys > len(args) - 1 {
+		return Value{typ: "error", str: "Number of keys can't be greater than number of args"}
+	}
+	keys := args[1:numkeys + 1]
+
+	limit := 0
+	for i := numkeys + 1; i < len(args); i += 2 {
+		if strings.ToUpper(args[i].bulk) != "LIMIT" || i + 1 == len(args) {
+			return Value{typ: "error", str: "syntax error"}
+		}
+
+		n, err := strconv.Atoi(args[i + 1].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "LIMIT can't be negative"}
+		}
+		limit = n
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	sets := make([]*Set, 0, len(keys))
+	for _, key := range keys {
+		set, errVal := lookupSet(dt, key.bulk)
+		if errVal != nil {
+			return *errVal
+		}
+		sets = append(sets, set)
+	}
+
+	n := 0
+	setInter(sets, func(string) bool {
+		n++
+		return limit == 0 || n < limit
+	})
+
+	return Value{typ: "integer", num: n}
+}
+
+// SORTED SET COMMANDS //
+
+// lookupZSet returns the sorted set at key, nil if the key does not exist.
+func lookupZSet(dt *DataType, key string) (*ZSet, *Value) {
+	obj, errVal := dt.lookupType(key, TypeZSet)
+	if obj == nil {
+		return nil, errVal
+	}
+
+	return obj.Value.(*ZSet), nil
+}
+
+// zsetReply returns the members of nodes, each followed by its score if
+// withScores is set.
+func zsetReply(nodes []*zskiplistNode, withScores bool) Value {
+	res := make([]Value, 0, len(nodes))
+	for _, node := range nodes {
+		res = append(res, Value{typ: "bulk", bulk: node.member})
+
+		if withScores {
+			res = append(res, Value{typ: "bulk", bulk: formatScore(node.score)})
+		}
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+func zadd(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zadd' command"}
+	}
+
+	key := args[0].bulk
+
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs) % 2 != 0 {
+		return Value{typ: "error", str: "syntax error"}
+	}
+
+	if nx && xx {
+		return Value{typ: "error", str: "XX and NX options at the same time are not compatible"}
+	}
+
+	if gt && lt || gt && nx || lt && nx {
+		return Value{typ: "error", str: "GT, LT, and/or NX options at the same time are not compatible"}
+	}
+
+	if incr && len(pairs) > 2 {
+		return Value{typ: "error", str: "INCR option supports a single increment-element pair"}
+	}
+
+	scores := make([]float64, 0, len(pairs) / 2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, err := parseScore(pairs[j].bulk)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		scores = append(scores, score)
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	zset, errVal := lookupZSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	var added, changed int
+	var result float64
+	done := false // false if INCR was skipped because of NX, XX, GT or LT
+
+	for j, score := range scores {
+		member := pairs[j * 2 + 1].bulk
+
+		var curScore float64
+		exist := false
+		if zset != nil {
+			curScore, exist = zset.Score(member)
+		}
+
+		if exist {
+			if nx {
+				continue
+			}
+
+			if incr {
+				score += curScore
+				if math.IsNaN(score) {
+					return Value{typ: "error", str: "resulting score is not a number (NaN)"}
+				}
+			}
+
+			if gt && score <= curScore || lt && score >= curScore {
+				continue
+			}
+
+			if score != curScore {
+				zset.Add(member, score)
+				changed++
+			}
+		} else {
+			if xx {
+				continue
+			}
+
+			if zset == nil {
+				zset = newZSet()
+				dt.Keys.Set(key, &Object{Type: TypeZSet, Value: zset})
+			}
+
+			zset.Add(member, score)
+			added++
+		}
+
+		result = score
+		done = true
+	}
+
+	if incr {
+		if !done {
+			return Value{typ: "null"}
+		}
+
+		return Value{typ: "bulk", bulk: formatScore(result)}
+	}
+
+	if ch {
+		return Value{typ: "integer", num: added + changed}
+	}
+
+	return Value{typ: "integer", num: added}
+}
+
+func zincrby(dt *DataType, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zincrby' command"}
+	}
+
+	return zadd(dt, []Value{args[0], {typ: "bulk", bulk: "INCR"}, args[1], args[2]})
+}
+
+func zrem(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zrem' command"}
+	}
+
+	var n int
+	key := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeZSet)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	zset := obj.Value.(*ZSet)
+
+	for i := 1; i < len(args); i++ {
+		if zset.Remove(args[i].bulk) {
+			n++
+		}
+	}
+
+	dt.deleteIfEmpty(key, obj)
+
+	return Value{typ: "integer", num: n}
+}
+
+func zscore(dt *DataType, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zscore' command"}
+	}
+
+	key := args[0].bulk
+	member := args[1].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if zset == nil {
+		return Value{typ: "null"}
+	}
+
+	score, exist := zset.Score(member)
+	if !exist {
+		return Value{typ: "null"}
+	}
+
+	return Value{typ: "bulk", bulk: formatScore(score)}
+}
+
+// zscan walks the members of a sorted set and their scores like SCAN.
+func zscan(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zscan' command"}
+	}
+
+	key := args[0].bulk
+
+	opts, err := parseScanOptions("ZSCAN", args[1:])
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	res := []Value{}
+	if zset == nil {
+		return scanReply(0, res)
+	}
+
+	cursor := zset.Scan(opts.cursor, opts.count, func(member string, score float64) {
+		if globMatch(opts.pattern, member) {
+			res = append(res, Value{typ: "bulk", bulk: member}, Value{typ: "bulk", bulk: formatScore(score)})
+		}
+	})
+
+	return scanReply(cursor, res)
+}
+
+func zcard(dt *DataType, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zcard' command"}
+	}
+
+	key := args[0].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if zset == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: zset.Len()}
+}
+
+func zrankCommand(dt *DataType, args []Value, rev bool) Value {
+	key := args[0].bulk
+	member := args[1].bulk
+
+	withScore := false
+	if len(args) == 3 {
+		if strings.ToUpper(args[2].bulk) != "WITHSCORE" {
+			return Value{typ: "error", str: "syntax error"}
+		}
+		withScore = true
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if zset == nil {
+		return Value{typ: "null"}
+	}
+
+	rank, exist := zset.Rank(member, rev)
+	if !exist {
+		return Value{typ: "null"}
+	}
+
+	if withScore {
+		score, _ := zset.Score(member)
+		return Value{typ: "array", array: []Value{
+			{typ: "integer", num: rank},
+			{typ: "bulk", bulk: formatScore(score)},
+		}}
+	}
+
+	return Value{typ: "integer", num: rank}
+}
+
+func zrank(dt *DataType, args []Value) Value {
+	if len(args) < 2 || len(args) > 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zrank' command"}
+	}
+
+	return zrankCommand(dt, args, false)
+}
+
+func zrevrank(dt *DataType, args []Value) Value {
+	if len(args) < 2 || len(args) > 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zrevrank' command"}
+	}
+
+	return zrankCommand(dt, args, true)
+}
+
+// zrangeArgs is a parsed ZRANGE: start and stop ranks, or a score or lex
+// range in spec.
+type zrangeArgs struct {
+	start, stop int
+	spec zrangeSpec
+	rev bool
+	offset, count int
+	withScores bool
+}
+
+// parseZrange parses "<min> <max> [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+// [WITHSCORES]".
+func parseZrange(args []Value) (*zrangeArgs, *Value) {
+	r := &zrangeArgs{count: -1}
+	syntaxErr := func(msg string) (*zrangeArgs, *Value) {
+		return nil, &Value{typ: "error", str: msg}
+	}
+
+	var by string
+	limit := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "BYSCORE":
+			by = "score"
+		case "BYLEX":
+			by = "lex"
+		case "REV":
+			r.rev = true
+		case "WITHSCORES":
+			r.withScores = true
+		case "LIMIT":
+			if i + 2 >= len(args) {
+				return syntaxErr("syntax error")
+			}
+
+			offset, err := strconv.Atoi(args[i + 1].bulk)
+			if err != nil {
+				return syntaxErr("value is not an integer or out of range")
+			}
+
+			count, err := strconv.Atoi(args[i + 2].bulk)
+			if err != nil {
+				return syntaxErr("value is not an integer or out of range")
+			}
+
+			r.offset, r.count = offset, count
+			limit = true
+			i += 2
+		default:
+			return syntaxErr("syntax error")
+		}
+	}
+
+	if limit && by == "" {
+		return syntaxErr("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+
+	if r.withScores && by == "lex" {
+		return syntaxErr("syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	// REV takes the bounds from the highest to the lowest
+	min, max := args[0].bulk, args[1].bulk
+	if r.rev && by != "" {
+		min, max = max, min
+	}
+
+	var err error
+	switch by {
+	case "score":
+		r.spec, err = parseScoreRange(min, max)
+	case "lex":
+		r.spec, err = parseLexRange(min, max)
+	default:
+		if r.start, err = strconv.Atoi(min); err == nil {
+			r.stop, err = strconv.Atoi(max)
+		}
+
+		if err != nil {
+			err = errors.New("value is not an integer or out of range")
+		}
+	}
+
+	if err != nil {
+		return syntaxErr(err.Error())
+	}
+
+	return r, nil
+}
+
+// nodes returns the members of zset selected by r.
+func (r *zrangeArgs) nodes(zset *ZSet) []*zskiplistNode {
+	if r.spec != nil {
+		return zset.RangeBySpec(r.spec, r.rev, r.offset, r.count)
+	}
+
+	start, stop := r.start, r.stop
+	length := zset.Len()
+
+	if start < 0 {
+		start = length + start
+	}
+
+	if stop < 0 {
+		stop = length + stop
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if stop >= length {
+		stop = length - 1
+	}
+
+	if start > stop {
+		return nil
+	}
+
+	return zset.RangeByRank(start, stop, r.rev)
+}
+
+func zrange(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zrange' command"}
+	}
+
+	key := args[0].bulk
+
+	r, errVal := parseZrange(args[1:])
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if zset == nil {
+		return Value{typ: "array", array: []Value{}}
+	}
+
+	return zsetReply(r.nodes(zset), r.withScores)
+}
+
+func zcount(dt *DataType, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zcount' command"}
+	}
+
+	key := args[0].bulk
+
+	spec, err := parseScoreRange(args[1].bulk, args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if zset == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: zset.Count(spec)}
+}
+
+// zpop removes and returns count members with the lowest scores, or the
+// highest if max is set.
+func zpop(dt *DataType, args []Value, max bool) Value {
+	key := args[0].bulk
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeZSet)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil || count == 0 {
+		return Value{typ: "array", array: []Value{}}
+	}
+	zset := obj.Value.(*ZSet)
+
+	nodes := zset.RangeByRank(0, min(count, zset.Len()) - 1, max)
+	for _, node := range nodes {
+		zset.Remove(node.member)
+	}
+
+	dt.deleteIfEmpty(key, obj)
+
+	return zsetReply(nodes, true)
+}
+
+func zpopmin(dt *DataType, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zpopmin' command"}
+	}
+
+	return zpop(dt, args, false)
+}
+
+func zpopmax(dt *DataType, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zpopmax' command"}
+	}
+
+	return zpop(dt, args, true)
+}
+
+func zremrangebyscore(dt *DataType, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zremrangebyscore' command"}
+	}
+
+	key := args[0].bulk
+
+	spec, err := parseScoreRange(args[1].bulk, args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeZSet)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	n := obj.Value.(*ZSet).RemoveRange(spec)
+	dt.deleteIfEmpty(key, obj)
+
+	return Value{typ: "integer", num: n}
+}
+
+// zsetOpArgs is a parsed ZUNION, ZINTER or ZDIFF:
+// "numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]".
+type zsetOpArgs struct {
+	keys []string
+	weights []float64
+	aggregate string
+	withScores bool
+}
+
+// parseZsetOp parses the arguments of op, a store variant takes no
+// WITHSCORES and ZDIFF neither WEIGHTS nor AGGREGATE.
+func parseZsetOp(name string, op string, args []Value, store bool) (*zsetOpArgs, *Value) {
+	errValue := func(msg string) (*zsetOpArgs, *Value) {
+		return nil, &Value{typ: "error", str: msg}
+	}
+
+	numkeys, err := strconv.Atoi(args[0].bulk)
+	if err != nil {
+		return errValue("value is not an integer or out of range")
+	}
+
+	if numkeys < 1 {
+		return errValue("at least 1 input key is needed for '" + name + "' command")
+	}
+
+	if numkeys > len(args) - 1 {
+		return errValue("syntax error")
+	}
+
+	z := &zsetOpArgs{aggregate: "SUM"}
+	for _, key := range args[1:numkeys + 1] {
+		z.keys = append(z.keys, key.bulk)
+		z.weights = append(z.weights, 1)
+	}
+
+	for i := numkeys + 1; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+
+		switch {
+		case option == "WEIGHTS" && op != "diff" && i + numkeys < len(args):
+			for j := range z.weights {
+				weight, err := parseScore(args[i + 1 + j].bulk)
+				if err != nil {
+					return errValue("weight value is not a float")
+				}
+				z.weights[j] = weight
+			}
+			i += numkeys
+		case option == "AGGREGATE" && op != "diff" && i + 1 < len(args):
+			z.aggregate = strings.ToUpper(args[i + 1].bulk)
+			if z.aggregate != "SUM" && z.aggregate != "MIN" && z.aggregate != "MAX" {
+				return errValue("syntax error")
+			}
+			i++
+		case option == "WITHSCORES" && !store:
+			z.withScores = true
+		default:
+			return errValue("syntax error")
+		}
+	}
+
+	return z, nil
+}
+
+// zsetOp computes the result of z. Sets are accepted as inputs with every
+// member scoring 1, missing keys are empty. The caller must hold dt.Mu.
+func zsetOp(dt *DataType, op string, z *zsetOpArgs) (*ZSet, *Value) {
+	ops := make([]*zsetOperand, 0, len(z.keys))
+	for i, key := range z.keys {
+		operand := &zsetOperand{weight: z.weights[i]}
+
+		if obj := dt.lookup(key); obj != nil {
+			switch obj.Type {
+			case TypeZSet:
+				operand.zset = obj.Value.(*ZSet)
+			case TypeSet:
+				operand.set = obj.Value.(*Set)
+			default:
+				errVal := wrongType()
+				return nil, &errVal
+			}
+		}
+
+		ops = append(ops, operand)
+	}
+
+	switch op {
+	case "union":
+		return zsetUnion(ops, z.aggregate), nil
+	case "inter":
+		return zsetInter(ops, z.aggregate), nil
+	}
+
+	return zsetDiff(ops), nil
+}
+
+func zsetOpCommand(dt *DataType, op string, args []Value) Value {
+	name := "z" + op
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for '" + name + "' command"}
+	}
+
+	z, errVal := parseZsetOp(name, op, args, false)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	res, errVal := zsetOp(dt, op, z)
+	if errVal != nil {
+		return *errVal
+	}
+
+	return zsetReply(res.All(), z.withScores)
+}
+
+// zsetStore replaces dst with res and returns its size, an empty result
+// deletes dst. The caller must hold the write lock.
+func zsetStore(dt *DataType, dst string, res *ZSet) Value {
+	dt.Keys.Delete(dst)
+	if res.Len() > 0 {
+		dt.Keys.Set(dst, &Object{Type: TypeZSet, Value: res})
+	}
+
+	return Value{typ: "integer", num: res.Len()}
+}
+
+func zsetOpStore(dt *DataType, op string, args []Value) Value {
+	name := "z" + op + "store"
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for '" + name + "' command"}
+	}
+
+	dst := args[0].bulk
+
+	z, errVal := parseZsetOp(name, op, args[1:], true)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	res, errVal := zsetOp(dt, op, z)
+	if errVal != nil {
+		return *errVal
+	}
+
+	return zsetStore(dt, dst, res)
+}
+
+func zunion(dt *DataType, args []Value) Value {
+	return zsetOpCommand(dt, "union", args)
+}
+
+func zinter(dt *DataType, args []Value) Value {
+	return zsetOpCommand(dt, "inter", args)
+}
+
+func zdiff(dt *DataType, args []Value) Value {
+	return zsetOpCommand(dt, "diff", args)
+}
+
+func zunionstore(dt *DataType, args []Value) Value {
+	return zsetOpStore(dt, "union", args)
+}
+
+func zinterstore(dt *DataType, args []Value) Value {
+	return zsetOpStore(dt, "inter", args)
+}
+
+func zdiffstore(dt *DataType, args []Value) Value {
+	return zsetOpStore(dt, "diff", args)
+}
+
+func zrangestore(dt *DataType, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "wrong number of arguments for 'zrangestore' command"}
+	}
+
+	dst := args[0].bulk
+	src := args[1].bulk
+
+	r, errVal := parseZrange(args[2:])
+	if errVal != nil {
+		return *errVal
+	}
+
+	if r.withScores {
+		return Value{typ: "error", str: "syntax error"}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	zset, errVal := lookupZSet(dt, src)
+	if errVal != nil {
+		return *errVal
+	}
+
+	res := newZSet()
+	if zset != nil {
+		for _, node := range r.nodes(zset) {
+			res.Add(node.member, node.score)
+		}
+	}
+
+	return zsetStore(dt, dst, res)
+}
+
+// STREAM COMMANDS //
+
+// lookupStream returns the stream at key, nil if the key does not exist.
+func lookupStream(dt *DataType, key string) (*Stream, *Value) {
+	obj, errVal := dt.lookupType(key, TypeStream)
+	if obj == nil {
+		return nil, errVal
+	}
+
+	return obj.Value.(*Stream), nil
+}
+
+func streamEntryValue(entry StreamEntry) Value {
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: entry.ID.String()},
+		bulkArray(entry.Fields),
+	}}
+}
+
+func streamEntriesValue(entries []StreamEntry) Value {
+	res := make([]Value, 0, len(entries))
+	for _, entry := range entries {
+		res = append(res, streamEntryValue(entry))
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+// parseStreamLimit parses the LIMIT option of XADD and XTRIM at args[i].
+func parseStreamLimit(args []Value, i int) (int, *Value) {
+	if i + 1 >= len(args) {
+		return 0, &Value{typ: "error", str: "syntax error"}
+	}
+
+	limit, err := strconv.Atoi(args[i + 1].bulk)
+	if err != nil || limit < 0 {
+		return 0, &Value{typ: "error", str: "The LIMIT argument must be >= 0."}
+	}
+
+	return limit, nil
+}
+
+// xaddArgs is a parsed XADD:
+// "key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] id field value ...".
+type xaddArgs struct {
+	noMkStream bool
+	trim *streamTrim
+	id int // index of the ID in args
+}
+
+func parseXadd(args []Value) (*xaddArgs, *Value) {
+	x := &xaddArgs{}
+	errValue := func(msg string) (*xaddArgs, *Value) {
+		return nil, &Value{typ: "error", str: msg}
+	}
+
+	limit, hasLimit := 0, false
+	i := 1
+options:
+	for i < len(args) {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NOMKSTREAM":
+			x.noMkStream = true
+			i++
+		case "MAXLEN", "MINID":
+			trim, next, err := parseStreamTrim(args, i)
+			if err != nil {
+				return errValue(err.Error())
+			}
+			x.trim, i = trim, next
+		case "LIMIT":
+			n, errVal := parseStreamLimit(args, i)
+			if errVal != nil {
+				return nil, errVal
+			}
+			limit, hasLimit = n, true
+			i += 2
+		default:
+			break options
+		}
+	}
+
+	if hasLimit {
+		if x.trim == nil {
+			return errValue("syntax error")
+		}
+
+		if !x.trim.approx {
+			return errValue("syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		x.trim.limit = limit
+	}
+
+	fields := len(args) - i - 1
+	if fields < 2 || fields % 2 != 0 {
+		return errValue("wrong number of arguments for 'xadd' command")
+	}
+	x.id = i
+
+	return x, nil
+}
+
+func xadd(dt *DataType, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xadd' command"}
+	}
+
+	key := args[0].bulk
+
+	x, errVal := parseXadd(args)
+	if errVal != nil {
+		return *errVal
+	}
+
+	idArg := args[x.id].bulk
+
+	fields := make([]string, 0, len(args) - x.id - 1)
+	for _, field := range args[x.id + 1:] {
+		fields = append(fields, field.bulk)
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	stream, errVal := lookupStream(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if stream == nil {
+		if x.noMkStream {
+			return Value{typ: "null"}
+		}
+
+		stream = newStream()
+	}
+
+	var id StreamID
+	var err error
+	switch {
+	case idArg == "*":
+		id, err = stream.NextID(time.Now())
+	case strings.HasSuffix(idArg, "-*"):
+		var ms uint64
+		if ms, err = strconv.ParseUint(strings.TrimSuffix(idArg, "-*"), 10, 64); err != nil {
+			err = errInvalidStreamID
+		} else {
+			id, err = stream.NextSeq(ms)
+		}
+	default:
+		if id, err = parseStreamID(idArg, 0); err == nil {
+			if id.IsZero() {
+				err = errors.New("The ID specified in XADD must be greater than 0-0")
+			} else if id.Compare(stream.LastID) <= 0 {
+				err = errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
+			}
+		}
+	}
+
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if _, exist := dt.Keys.Get(key); !exist {
+		dt.Keys.Set(key, &Object{Type: TypeStream, Value: stream})
+	}
+
+	stream.Append(id, fields)
+	if x.trim != nil {
+		x.trim.apply(stream)
+	}
+
+	dt.signalStreamAdded()
+
+	return Value{typ: "bulk", bulk: id.String()}
+}
+
+func xtrim(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xtrim' command"}
+	}
+
+	key := args[0].bulk
+
+	strategy := strings.ToUpper(args[1].bulk)
+	if strategy != "MAXLEN" && strategy != "MINID" {
+		return Value{typ: "error", str: "syntax error"}
+	}
+
+	trim, i, err := parseStreamTrim(args, 1)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if i < len(args) {
+		if strings.ToUpper(args[i].bulk) != "LIMIT" || i + 2 != len(args) {
+			return Value{typ: "error", str: "syntax error"}
+		}
+
+		limit, errVal := parseStreamLimit(args, i)
+		if errVal != nil {
+			return *errVal
+		}
+
+		if !trim.approx {
+			return Value{typ: "error", str: "syntax error, LIMIT cannot be used without the special ~ option"}
+		}
+		trim.limit = limit
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	stream, errVal := lookupStream(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if stream == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: trim.apply(stream)}
+}
+
+func xlen(dt *DataType, args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xlen' command"}
+	}
+
+	key := args[0].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	stream, errVal := lookupStream(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if stream == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: stream.Len()}
+}
+
+func xdel(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xdel' command"}
+	}
+
+	key := args[0].bulk
+
+	ids := make([]StreamID, 0, len(args) - 1)
+	for _, arg := range args[1:] {
+		id, err := parseStreamID(arg.bulk, 0)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		ids = append(ids, id)
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	stream, errVal := lookupStream(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if stream == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	n := 0
+	for _, id := range ids {
+		if stream.Delete(id) {
+			n++
+		}
+	}
+
+	return Value{typ: "integer", num: n}
+}
+
+func xrangeCommand(dt *DataType, args []Value, rev bool) Value {
+	key := args[0].bulk
+
+	startArg, endArg := args[1].bulk, args[2].bulk
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, err := parseStreamRangeID(startArg, false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	end, err := parseStreamRangeID(endArg, true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	count := 0
+	if len(args) > 3 {
+		if len(args) != 5 || strings.ToUpper(args[3].bulk) != "COUNT" {
+			return Value{typ: "error", str: "syntax error"}
+		}
+
+		n, err := strconv.Atoi(args[4].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "value is not an integer or out of range"}
+		}
+
+		if n <= 0 {
+			return Value{typ: "array", array: []Value{}}
+		}
+		count = n
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	stream, errVal := lookupStream(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if stream == nil {
+		return Value{typ: "array", array: []Value{}}
+	}
+
+	return streamEntriesValue(stream.Range(start, end, count, rev))
+}
+
+func xrange(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xrange' command"}
+	}
+
+	return xrangeCommand(dt, args, false)
+}
+
+func xrevrange(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xrevrange' command"}
+	}
+
+	return xrangeCommand(dt, args, true)
+}
+
+// xreadStreams returns the entries after ids[i] in each stream keys[i], only
+// for the streams that have some. The caller must hold dt.Mu.
+func xreadStreams(dt *DataType, keys []string, ids []StreamID, count int) ([]Value, *Value) {
+	var res []Value
+
+	for i, key := range keys {
+		stream, errVal := lookupStream(dt, key)
+		if errVal != nil {
+			return nil, errVal
+		}
+
+		if stream == nil {
+			continue
+		}
+
+		start, ok := ids[i].next()
+		if !ok {
+			continue
+		}
+
+		entries := stream.Range(start, maxStreamID, count, false)
+		if len(entries) == 0 {
+			continue
+		}
+
+		res = append(res, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: key},
+			streamEntriesValue(entries),
+		}})
+	}
+
+	return res, nil
+}
+
+// xread implements "XREAD [COUNT count] [BLOCK ms] STREAMS key ... id ...".
+// With BLOCK it waits, without holding the lock, until one of the streams
+// gets entries after the given IDs or the timeout expires. BLOCK 0 waits
+// forever.
+func xread(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xread' command"}
+	}
+
+	count, block := 0, -1
+	i := 0
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		if option == "STREAMS" {
+			break
+		}
+
+		if (option != "COUNT" && option != "BLOCK") || i + 1 == len(args) {
+			return Value{typ: "error", str: "syntax error"}
+		}
+
+		n, err := strconv.Atoi(args[i + 1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "value is not an integer or out of range"}
+		}
+
+		if option == "COUNT" {
+			count = max(n, 0)
+		} else {
+			if n < 0 {
+				return Value{typ: "error", str: "timeout is negative"}
+			}
+			block = n
+		}
+		i++
+	}
+
+	streams := args[min(i + 1, len(args)):]
+	if i == len(args) || len(streams) == 0 || len(streams) % 2 != 0 {
+		return Value{typ: "error", str: "Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."}
+	}
+
+	keys := make([]string, 0, len(streams) / 2)
+	for _, key := range streams[:len(streams) / 2] {
+		keys = append(keys, key.bulk)
+	}
+
+	ids := make([]StreamID, len(keys))
+
+	dt.Mu.RLock()
+	for j, arg := range streams[len(streams) / 2:] {
+		if arg.bulk != "$" {
+			id, err := parseStreamID(arg.bulk, 0)
+			if err != nil {
+				dt.Mu.RUnlock()
+				return Value{typ: "error", str: err.Error()}
+			}
+			ids[j] = id
+			continue
+		}
+
+		// "$" means only entries added from now on
+		stream, errVal := lookupStream(dt, keys[j])
+		if errVal != nil {
+			dt.Mu.RUnlock()
+			return *errVal
+		}
+
+		if stream != nil {
+			ids[j] = stream.LastID
+		}
+	}
+	dt.Mu.RUnlock()
+
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(time.Duration(block) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		dt.Mu.RLock()
+		res, errVal := xreadStreams(dt, keys, ids, count)
+		added := dt.streamAdded
+		dt.Mu.RUnlock()
+
+		if errVal != nil {
+			return *errVal
+		}
+
+		if len(res) > 0 {
+			return Value{typ: "array", array: res}
+		}
+
+		if block < 0 {
+			return Value{typ: "null"}
+		}
+
+		select {
+		case <-added:
+		case <-timeout:
+			return Value{typ: "null"}
+		}
+	}
+}
+
+// xsetid implements "XSETID key last-id [ENTRIESADDED n] [MAXDELETEDID id]",
+// which the AOF rewrite uses to restore the state of a stream.
+func xsetid(dt *DataType, args []Value) Value {
+	if len(args) != 2 && len(args) != 4 && len(args) != 6 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xsetid' command"}
+	}
+
+	key := args[0].bulk
+
+	lastID, err := parseStreamID(args[1].bulk, 0)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	entriesAdded, hasEntriesAdded := uint64(0), false
+	var maxDeletedID *StreamID
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i].bulk) {
+		case "ENTRIESADDED":
+			n, err := strconv.ParseUint(args[i + 1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: "value is not an integer or out of range"}
+			}
+			entriesAdded, hasEntriesAdded = n, true
+		case "MAXDELETEDID":
+			id, err := parseStreamID(args[i + 1].bulk, 0)
+			if err != nil {
+				return Value{typ: "error", str: err.Error()}
+			}
+
+			if lastID.Compare(id) < 0 {
+				return Value{typ: "error", str: "The ID specified in XSETID is smaller than the provided max_deleted_entry_id"}
+			}
+			maxDeletedID = &id
+		default:
+			return Value{typ: "error", str: "syntax error"}
+		}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	stream, errVal := lookupStream(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if stream == nil {
+		return Value{typ: "error", str: "no such key"}
+	}
+
+	if last, exist := stream.Last(); exist && lastID.Compare(last.ID) < 0 {
+		return Value{typ: "error", str: "The ID specified in XSETID is smaller than the target stream top item"}
+	}
+
+	if hasEntriesAdded && entriesAdded < uint64(stream.Len()) {
+		return Value{typ: "error", str: "The entries_added specified in XSETID is smaller than the target stream length"}
+	}
+
+	stream.LastID = lastID
+	if hasEntriesAdded {
+		stream.EntriesAdded = entriesAdded
+	}
+
+	if maxDeletedID != nil {
+		stream.MaxDeletedID = *maxDeletedID
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// lookupStreamGroup returns the stream at key and its group called name. The
+// group is nil if either does not exist, the error value is set if key holds
+// another type.
+func lookupStreamGroup(dt *DataType, key string, name string) (*Stream, *StreamGroup, *Value) {
+	stream, errVal := lookupStream(dt, key)
+	if stream == nil {
+		return nil, nil, errVal
+	}
+
+	return stream, stream.Group(name), nil
+}
+
+func noGroupError(key string, group string) Value {
+	return Value{typ: "error", str: "NOGROUP No such key '" + key + "' or consumer group '" + group + "'"}
+}
+
+// parseEntriesRead parses the ENTRIESREAD option of XGROUP.
+func parseEntriesRead(arg string) (int64, *Value) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, &Value{typ: "error", str: "value is not an integer or out of range"}
+	}
+
+	if n < 0 && n != streamEntriesReadUnknown {
+		return 0, &Value{typ: "error", str: "value for ENTRIESREAD must be positive or -1"}
+	}
+
+	return n, nil
+}
+
+// xgroup implements the XGROUP subcommands:
+//
+//	CREATE key group id|$ [MKSTREAM] [ENTRIESREAD n]
+//	SETID key group id|$ [ENTRIESREAD n]
+//	DESTROY key group
+//	CREATECONSUMER key group consumer
+//	DELCONSUMER key group consumer
+func xgroup(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xgroup' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+
+	arityOk := false
+	switch sub {
+	case "CREATE":
+		arityOk = len(args) >= 4 && len(args) <= 7
+	case "SETID":
+		arityOk = len(args) == 4 || len(args) == 6
+	case "DESTROY":
+		arityOk = len(args) == 3
+	case "CREATECONSUMER", "DELCONSUMER":
+		arityOk = len(args) == 4
+	default:
+		return Value{typ: "error", str: "unknown subcommand '" + args[0].bulk + "'. Try XGROUP HELP."}
+	}
+
+	if !arityOk {
+		return Value{typ: "error", str: "wrong number of arguments for 'xgroup|" + strings.ToLower(sub) + "' command"}
+	}
+
+	key, name := args[1].bulk, args[2].bulk
+
+	var id StreamID
+	mkStream := false
+	entriesRead, hasEntriesRead := int64(streamEntriesReadUnknown), false
+
+	if sub == "CREATE" || sub == "SETID" {
+		if args[3].bulk != "$" {
+			var err error
+			if id, err = parseStreamID(args[3].bulk, 0); err != nil {
+				return Value{typ: "error", str: err.Error()}
+			}
+		}
+
+		for i := 4; i < len(args); i++ {
+			switch option := strings.ToUpper(args[i].bulk); {
+			case option == "MKSTREAM" && sub == "CREATE":
+				mkStream = true
+			case option == "ENTRIESREAD" && i + 1 < len(args):
+				n, errVal := parseEntriesRead(args[i + 1].bulk)
+				if errVal != nil {
+					return *errVal
+				}
+				entriesRead, hasEntriesRead = n, true
+				i++
+			default:
+				return Value{typ: "error", str: "syntax error"}
+			}
+		}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	stream, group, errVal := lookupStreamGroup(dt, key, name)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if stream == nil {
+		if !mkStream {
+			return Value{typ: "error", str: "The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."}
+		}
+
+		stream = newStream()
+		dt.Keys.Set(key, &Object{Type: TypeStream, Value: stream})
+	}
+
+	if (sub == "CREATE" || sub == "SETID") && args[3].bulk == "$" {
+		id = stream.LastID
+		if !hasEntriesRead {
+			entriesRead = int64(stream.EntriesAdded)
+		}
+	}
+
+	if sub == "CREATE" {
+		if !stream.CreateGroup(newStreamGroup(name, id, entriesRead)) {
+			return Value{typ: "error", str: "BUSYGROUP Consumer Group name already exists"}
+		}
+
+		return Value{typ: "string", str: "OK"}
+	}
+
+	if sub == "DESTROY" {
+		if !stream.DestroyGroup(name) {
+			return Value{typ: "integer", num: 0}
+		}
+
+		return Value{typ: "integer", num: 1}
+	}
+
+	if group == nil {
+		return Value{typ: "error", str: "NOGROUP No such consumer group '" + name + "' for key name '" + key + "'"}
+	}
+
+	switch sub {
+	case "SETID":
+		group.LastID = id
+		group.EntriesRead = entriesRead
+
+		return Value{typ: "string", str: "OK"}
+	case "CREATECONSUMER":
+		if !group.CreateConsumer(args[3].bulk, time.Now()) {
+			return Value{typ: "integer", num: 0}
+		}
+
+		return Value{typ: "integer", num: 1}
+	}
+
+	return Value{typ: "integer", num: max(group.DeleteConsumer(args[3].bulk), 0)}
+}
+
+// xreadgroupArgs is a parsed XREADGROUP:
+// "GROUP group consumer [COUNT count] [BLOCK ms] [NOACK] STREAMS key ... id ...".
+// The ID ">", for entries never delivered to the group, is kept as
+// maxStreamID, after which there can't be any history.
+type xreadgroupArgs struct {
+	group string
+	consumer string
+	count int
+	block int // -1 without BLOCK
+	noAck bool
+	keys []string
+	ids []StreamID
+}
+
+func parseXreadgroup(args []Value) (*xreadgroupArgs, *Value) {
+	errValue := func(msg string) (*xreadgroupArgs, *Value) {
+		return nil, &Value{typ: "error", str: msg}
+	}
+
+	if len(args) < 6 {
+		return errValue("wrong number of arguments for 'xreadgroup' command")
+	}
+
+	x := &xreadgroupArgs{block: -1}
+	hasGroup := false
+
+	i := 0
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+		if option == "STREAMS" {
+			break
+		}
+
+		switch {
+		case option == "NOACK":
+			x.noAck = true
+		case option == "GROUP" && i + 2 < len(args):
+			x.group, x.consumer = args[i + 1].bulk, args[i + 2].bulk
+			hasGroup = true
+			i += 2
+		case (option == "COUNT" || option == "BLOCK") && i + 1 < len(args):
+			n, err := strconv.Atoi(args[i + 1].bulk)
+			if err != nil {
+				return errValue("value is not an integer or out of range")
+			}
+
+			if option == "COUNT" {
+				x.count = max(n, 0)
+			} else {
+				if n < 0 {
+					return errValue("timeout is negative")
+				}
+				x.block = n
+			}
+			i++
+		default:
+			return errValue("syntax error")
+		}
+	}
+
+	streams := args[min(i + 1, len(args)):]
+	if i == len(args) || len(streams) == 0 || len(streams) % 2 != 0 {
+		return errValue("Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+	}
+
+	if !hasGroup {
+		return errValue("Missing GROUP option for XREADGROUP")
+	}
+
+	for _, key := range streams[:len(streams) / 2] {
+		x.keys = append(x.keys, key.bulk)
+	}
+
+	for _, arg := range streams[len(streams) / 2:] {
+		switch arg.bulk {
+		case ">":
+			x.ids = append(x.ids, maxStreamID)
+		case "$":
+			return errValue("The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		default:
+			id, err := parseStreamID(arg.bulk, 0)
+			if err != nil {
+				return errValue(err.Error())
+			}
+			x.ids = append(x.ids, id)
+		}
+	}
+
+	return x, nil
+}
+
+// xreadgroupHistory returns the entries pending for consumer after id, an
+// entry deleted since it was delivered comes with null fields. The entries
+// returned count as delivered once more.
+func xreadgroupHistory(stream *Stream, consumer *StreamConsumer, id StreamID, count int, now time.Time) Value {
+	res := []Value{}
+
+	start, ok := id.next()
+	if !ok {
+		return Value{typ: "array", array: res}
+	}
+
+	for _, nack := range consumer.Pending.Range(start, maxStreamID, count) {
+		entry, exist := stream.Get(nack.ID)
+		if !exist {
+			res = append(res, Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: nack.ID.String()},
+				{typ: "null"},
+			}})
+			continue
+		}
+
+		nack.DeliveryTime = now
+		nack.DeliveryCount++
+		res = append(res, streamEntryValue(entry))
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+// xreadgroup reads from streams on behalf of a consumer of a group, creating
+// the consumer if needed. With ">" it gets entries never delivered to the
+// group, which become pending for the consumer unless NOACK is given, and
+// with an ID the consumer's own pending entries after it. It never blocks,
+// BLOCK is handled by the server since the handler runs under the AOF lock.
+func xreadgroup(dt *DataType, args []Value) Value {
+	x, errVal := parseXreadgroup(args)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	// every group has to exist before anything is read
+	streams := make([]*Stream, len(x.keys))
+	groups := make([]*StreamGroup, len(x.keys))
+	for i, key := range x.keys {
+		checkExpireTime(dt, key)
+
+		stream, group, errVal := lookupStreamGroup(dt, key, x.group)
+		if errVal != nil {
+			return *errVal
+		}
+
+		if group == nil {
+			return Value{typ: "error", str: "NOGROUP No such key '" + key + "' or consumer group '" + x.group + "' in XREADGROUP with GROUP option"}
+		}
+		streams[i], groups[i] = stream, group
+	}
+
+	now := time.Now()
+
+	var res []Value
+	for i, key := range x.keys {
+		stream, group := streams[i], groups[i]
+
+		// like in Redis, reading creates the consumer even if it gets
+		// nothing
+		consumer := group.Consumer(x.consumer, now)
+
+		var entries Value
+		if x.ids[i] == maxStreamID {
+			start, ok := group.LastID.next()
+			if !ok {
+				continue
+			}
+
+			found := stream.Range(start, maxStreamID, x.count, false)
+			if len(found) == 0 {
+				continue
+			}
+
+			group.Deliver(stream, found, consumer, x.noAck, now)
+			entries = streamEntriesValue(found)
+		} else {
+			entries = xreadgroupHistory(stream, consumer, x.ids[i], x.count, now)
+		}
+
+		res = append(res, Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, entries}})
+	}
+
+	if len(res) == 0 {
+		return Value{typ: "null"}
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+func xack(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xack' command"}
+	}
+
+	key, name := args[0].bulk, args[1].bulk
+
+	ids := make([]StreamID, 0, len(args) - 2)
+	for _, arg := range args[2:] {
+		id, err := parseStreamID(arg.bulk, 0)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		ids = append(ids, id)
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	_, group, errVal := lookupStreamGroup(dt, key, name)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if group == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	n := 0
+	for _, id := range ids {
+		if group.Ack(id) {
+			n++
+		}
+	}
+
+	return Value{typ: "integer", num: n}
+}
+
+// xpending implements "XPENDING key group" for a summary of the pending
+// entries and "XPENDING key group [IDLE ms] start end count [consumer]" for
+// the details of each of them.
+func xpending(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xpending' command"}
+	}
+
+	key, name := args[0].bulk, args[1].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	_, group, errVal := lookupStreamGroup(dt, key, name)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if len(args) == 2 {
+		if group == nil {
+			return noGroupError(key, name)
+		}
+
+		return xpendingSummary(group)
+	}
+
+	i := 2
+	var minIdle time.Duration
+	if strings.ToUpper(args[i].bulk) == "IDLE" {
+		if i + 1 == len(args) {
+			return Value{typ: "error", str: "syntax error"}
+		}
+
+		n, err := strconv.ParseInt(args[i + 1].bulk, 10, 64)
+		if err != nil {
+			return Value{typ: "error", str: "value is not an integer or out of range"}
+		}
+		minIdle = time.Duration(n) * time.Millisecond
+		i += 2
+	}
+
+	if len(args) - i != 3 && len(args) - i != 4 {
+		return Value{typ: "error", str: "syntax error"}
+	}
+
+	start, err := parseStreamRangeID(args[i].bulk, false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	end, err := parseStreamRangeID(args[i + 1].bulk, true)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	count, err := strconv.Atoi(args[i + 2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "value is not an integer or out of range"}
+	}
+
+	if group == nil {
+		return noGroupError(key, name)
+	}
+
+	pending := group.Pending
+	if len(args) - i == 4 {
+		consumer, exist := group.Consumers[args[i + 3].bulk]
+		if !exist {
+			return Value{typ: "array", array: []Value{}}
+		}
+		pending = consumer.Pending
+	}
+
+	now := time.Now()
+
+	res := []Value{}
+	for _, nack := range pending.Range(start, end, 0) {
+		if len(res) >= count {
+			break
+		}
+
+		idle := now.Sub(nack.DeliveryTime)
+		if idle < minIdle {
+			continue
+		}
+
+		res = append(res, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: nack.ID.String()},
+			{typ: "bulk", bulk: nack.Consumer.Name},
+			{typ: "integer", num: int(idle.Milliseconds())},
+			{typ: "integer", num: int(nack.DeliveryCount)},
+		}})
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+// xpendingSummary returns the number of pending entries, the smallest and
+// largest pending IDs and how many entries each consumer has pending.
+func xpendingSummary(group *StreamGroup) Value {
+	if len(group.Pending) == 0 {
+		return Value{typ: "array", array: []Value{
+			{typ: "integer", num: 0},
+			{typ: "null"},
+			{typ: "null"},
+			{typ: "null"},
+		}}
+	}
+
+	consumers := []Value{}
+	for _, consumer := range group.SortedConsumers() {
+		if len(consumer.Pending) == 0 {
+			continue
+		}
+
+		consumers = append(consumers, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: consumer.Name},
+			{typ: "bulk", bulk: strconv.Itoa(len(consumer.Pending))},
+		}})
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "integer", num: len(group.Pending)},
+		{typ: "bulk", bulk: group.Pending[0].ID.String()},
+		{typ: "bulk", bulk: group.Pending[len(group.Pending) - 1].ID.String()},
+		{typ: "array", array: consumers},
+	}}
+}
+
+// parseMinIdle parses the min-idle-time argument of XCLAIM and XAUTOCLAIM,
+// negative values count as 0.
+func parseMinIdle(arg string, command string) (time.Duration, *Value) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, &Value{typ: "error", str: "Invalid min-idle-time argument for " + command}
+	}
+
+	return time.Duration(max(n, 0)) * time.Millisecond, nil
+}
+
+// xclaim implements "XCLAIM key group consumer min-idle-time id ... [IDLE ms]
+// [TIME unix-ms] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id]". Entries
+// pending for at least min-idle-time move to consumer, those deleted from the
+// stream are dropped from the group.
+func xclaim(dt *DataType, args []Value) Value {
+	if len(args) < 5 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xclaim' command"}
+	}
+
+	key, name, consumerName := args[0].bulk, args[1].bulk, args[2].bulk
+
+	minIdle, errVal := parseMinIdle(args[3].bulk, "XCLAIM")
+	if errVal != nil {
+		return *errVal
+	}
+
+	i := 4
+	var ids []StreamID
+	for ; i < len(args); i++ {
+		id, err := parseStreamID(args[i].bulk, 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := time.Now()
+	deliveryTime := now
+	retryCount := int64(-1)
+	force, justID := false, false
+	var lastID *StreamID
+
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i].bulk)
+
+		switch {
+		case option == "FORCE":
+			force = true
+		case option == "JUSTID":
+			justID = true
+		case (option == "IDLE" || option == "TIME" || option == "RETRYCOUNT") && i + 1 < len(args):
+			n, err := strconv.ParseInt(args[i + 1].bulk, 10, 64)
+			if err != nil {
+				return Value{typ: "error", str: "Invalid " + option + " option argument for XCLAIM"}
+			}
+
+			switch option {
+			case "IDLE":
+				deliveryTime = now.Add(-time.Duration(n) * time.Millisecond)
+			case "TIME":
+				deliveryTime = time.UnixMilli(n)
+			default:
+				retryCount = n
+			}
+			i++
+		case option == "LASTID" && i + 1 < len(args):
+			id, err := parseStreamID(args[i + 1].bulk, 0)
+			if err != nil {
+				return Value{typ: "error", str: err.Error()}
+			}
+			lastID = &id
+			i++
+		default:
+			return Value{typ: "error", str: "Unrecognized XCLAIM option '" + args[i].bulk + "'"}
+		}
+	}
+
+	// a bogus delivery time, maybe from a client whose clock is ahead, is
+	// not worth an error
+	if deliveryTime.After(now) || deliveryTime.Before(time.UnixMilli(0)) {
+		deliveryTime = now
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	stream, group, errVal := lookupStreamGroup(dt, key, name)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if group == nil {
+		return noGroupError(key, name)
+	}
+
+	if lastID != nil && lastID.Compare(group.LastID) > 0 {
+		group.LastID = *lastID
+	}
+
+	var consumer *StreamConsumer
+
+	res := []Value{}
+	for _, id := range ids {
+		nack := group.Pending.get(id)
+		if nack == nil {
+			if _, exist := stream.Get(id); !force || !exist {
+				continue
+			}
+
+			// no delivery time, so that min-idle-time does not skip it
+			nack = &StreamNack{ID: id, DeliveryCount: 1}
+			group.Pending.insert(nack)
+		}
+
+		if minIdle > 0 && now.Sub(nack.DeliveryTime) < minIdle {
+			continue
+		}
+
+		entry, exist := stream.Get(id)
+		if !exist {
+			group.Drop(nack)
+			continue
+		}
+
+		if consumer == nil {
+			consumer = group.Consumer(consumerName, now)
+		}
+
+		group.Claim(nack, consumer)
+		nack.DeliveryTime = deliveryTime
+		if retryCount >= 0 {
+			nack.DeliveryCount = retryCount
+		} else if !justID {
+			nack.DeliveryCount++
+		}
+		consumer.ActiveTime = now
+
+		if justID {
+			res = append(res, Value{typ: "bulk", bulk: id.String()})
+		} else {
+			res = append(res, streamEntryValue(entry))
+		}
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+// xautoclaim implements "XAUTOCLAIM key group consumer min-idle-time start
+// [COUNT count] [JUSTID]", XCLAIM for up to count pending entries from start
+// on. It replies with the cursor to continue from, 0-0 once the end of the
+// pending entries is reached, the claimed entries and the IDs of entries no
+// longer in the stream, which are dropped from the group.
+func xautoclaim(dt *DataType, args []Value) Value {
+	if len(args) < 5 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xautoclaim' command"}
+	}
+
+	key, name, consumerName := args[0].bulk, args[1].bulk, args[2].bulk
+
+	minIdle, errVal := parseMinIdle(args[3].bulk, "XAUTOCLAIM")
+	if errVal != nil {
+		return *errVal
+	}
+
+	start, err := parseStreamRangeID(args[4].bulk, false)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	count, justID := 100, false
+	for i := 5; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i].bulk); {
+		case option == "JUSTID":
+			justID = true
+		case option == "COUNT" && i + 1 < len(args):
+			n, err := strconv.Atoi(args[i + 1].bulk)
+			if err != nil {
+				return Value{typ: "error", str: "value is not an integer or out of range"}
+			}
+
+			if n < 1 || n > math.MaxInt32 {
+				return Value{typ: "error", str: "COUNT must be > 0"}
+			}
+			count = n
+			i++
+		default:
+			return Value{typ: "error", str: "syntax error"}
+		}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	stream, group, errVal := lookupStreamGroup(dt, key, name)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if group == nil {
+		return noGroupError(key, name)
+	}
+
+	now := time.Now()
+	var consumer *StreamConsumer
+
+	claimed, deleted := []Value{}, []Value{}
+
+	// idle entries are skipped, so bound the work for a PEL full of them
+	attempts := count * 10
+	i, _ := group.Pending.find(start)
+	for ; attempts > 0 && count > 0 && i < len(group.Pending); attempts-- {
+		nack := group.Pending[i]
+
+		if minIdle > 0 && now.Sub(nack.DeliveryTime) < minIdle {
+			i++
+			continue
+		}
+
+		entry, exist := stream.Get(nack.ID)
+		if !exist {
+			deleted = append(deleted, Value{typ: "bulk", bulk: nack.ID.String()})
+			group.Drop(nack)
+			continue
+		}
+
+		if consumer == nil {
+			consumer = group.Consumer(consumerName, now)
+		}
+
+		group.Claim(nack, consumer)
+		nack.DeliveryTime = now
+		if !justID {
+			nack.DeliveryCount++
+		}
+		consumer.ActiveTime = now
+
+		if justID {
+			claimed = append(claimed, Value{typ: "bulk", bulk: nack.ID.String()})
+		} else {
+			claimed = append(claimed, streamEntryValue(entry))
+		}
+		count--
+		i++
+	}
+
+	cursor := StreamID{}
+	if i < len(group.Pending) {
+		cursor = group.Pending[i].ID
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: cursor.String()},
+		{typ: "array", array: claimed},
+		{typ: "array", array: deleted},
+	}}
+}
+
+// streamIDValue returns id as a bulk string.
+func streamIDValue(id StreamID) Value {
+	return Value{typ: "bulk", bulk: id.String()}
+}
+
+// xinfo implements "XINFO STREAM key", "XINFO GROUPS key" and
+// "XINFO CONSUMERS key group". Every reply is a flat list of field value
+// pairs, or a list of them.
+func xinfo(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'xinfo' command"}
+	}
+
+	sub := strings.ToUpper(args[0].bulk)
+
+	switch sub {
+	case "STREAM", "GROUPS":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "wrong number of arguments for 'xinfo|" + strings.ToLower(sub) + "' command"}
+		}
+	case "CONSUMERS":
+		if len(args) != 3 {
+			return Value{typ: "error", str: "wrong number of arguments for 'xinfo|consumers' command"}
+		}
+	default:
+		return Value{typ: "error", str: "unknown subcommand '" + args[0].bulk + "'. Try XINFO HELP."}
+	}
+
+	key := args[1].bulk
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	stream, errVal := lookupStream(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if stream == nil {
+		return Value{typ: "error", str: "no such key"}
+	}
+
+	now := time.Now()
+
+	switch sub {
+	case "STREAM":
+		first, last := Value{typ: "null"}, Value{typ: "null"}
+		firstID := StreamID{}
+		if entry, exist := stream.First(); exist {
+			first, firstID = streamEntryValue(entry), entry.ID
+		}
+		if entry, exist := stream.Last(); exist {
+			last = streamEntryValue(entry)
+		}
+
+		return Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "length"}, {typ: "integer", num: stream.Len()},
+			{typ: "bulk", bulk: "last-generated-id"}, streamIDValue(stream.LastID),
+			{typ: "bulk", bulk: "max-deleted-entry-id"}, streamIDValue(stream.MaxDeletedID),
+			{typ: "bulk", bulk: "entries-added"}, {typ: "integer", num: int(stream.EntriesAdded)},
+			{typ: "bulk", bulk: "recorded-first-entry-id"}, streamIDValue(firstID),
+			{typ: "bulk", bulk: "groups"}, {typ: "integer", num: len(stream.groups)},
+			{typ: "bulk", bulk: "first-entry"}, first,
+			{typ: "bulk", bulk: "last-entry"}, last,
+		}}
+	case "GROUPS":
+		res := []Value{}
+		for _, group := range stream.Groups() {
+			entriesRead := Value{typ: "null"}
+			if group.EntriesRead != streamEntriesReadUnknown {
+				entriesRead = Value{typ: "integer", num: int(group.EntriesRead)}
+			}
+
+			lag := Value{typ: "null"}
+			if n, ok := stream.Lag(group); ok {
+				lag = Value{typ: "integer", num: int(n)}
+			}
+
+			res = append(res, Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: group.Name},
+				{typ: "bulk", bulk: "consumers"}, {typ: "integer", num: len(group.Consumers)},
+				{typ: "bulk", bulk: "pending"}, {typ: "integer", num: len(group.Pending)},
+				{typ: "bulk", bulk: "last-delivered-id"}, streamIDValue(group.LastID),
+				{typ: "bulk", bulk: "entries-read"}, entriesRead,
+				{typ: "bulk", bulk: "lag"}, lag,
+			}})
+		}
+
+		return Value{typ: "array", array: res}
+	}
+
+	group := stream.Group(args[2].bulk)
+	if group == nil {
+		return Value{typ: "error", str: "NOGROUP No such consumer group '" + args[2].bulk + "' for key name '" + key + "'"}
+	}
+
+	res := []Value{}
+	for _, consumer := range group.SortedConsumers() {
+		inactive := -1
+		if !consumer.ActiveTime.IsZero() {
+			inactive = int(now.Sub(consumer.ActiveTime).Milliseconds())
+		}
+
+		res = append(res, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "name"}, {typ: "bulk", bulk: consumer.Name},
+			{typ: "bulk", bulk: "pending"}, {typ: "integer", num: len(consumer.Pending)},
+			{typ: "bulk", bulk: "idle"}, {typ: "integer", num: int(now.Sub(consumer.SeenTime).Milliseconds())},
+			{typ: "bulk", bulk: "inactive"}, {typ: "integer", num: inactive},
+		}})
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+// BITMAP COMMANDS //
+
+// storeBitmap stores buf at key, into obj if the key already exists.
+func storeBitmap(dt *DataType, key string, obj *Object, buf []byte) {
+	if obj == nil {
+		dt.Keys.Set(key, &Object{Type: TypeString, Value: string(buf)})
+		return
+	}
+
+	obj.Value = string(buf)
+}
+
+func setbit(dt *DataType, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'setbit' command"}
+	}
+
+	key := args[0].bulk
+
+	offset, err := parseBitOffset(args[1].bulk, 0)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	if args[2].bulk != "0" && args[2].bulk != "1" {
+		return Value{typ: "error", str: "bit is not an integer or out of range"}
+	}
+	bit := int(args[2].bulk[0] - '0')
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
+	}
+
+	data := ""
+	if obj != nil {
+		data = obj.Value.(string)
+	}
+
+	old := getBit(data, offset)
+	if old == bit && offset >> 3 < int64(len(data)) {
+		return Value{typ: "integer", num: old}
+	}
+
+	buf := growBitmap(data, offset + 1)
+	setBit(buf, offset, bit)
+	storeBitmap(dt, key, obj, buf)
+
+	return Value{typ: "integer", num: old}
+}
+
+func getbit(dt *DataType, args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'getbit' command"}
+	}
+
+	key := args[0].bulk
+
+	offset, err := parseBitOffset(args[1].bulk, 0)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: getBit(obj.Value.(string), offset)}
+}
+
+// parseBitRange parses the "start end [BYTE|BIT]" arguments of BITCOUNT and
+// BITPOS, which may stop after start or end.
+func parseBitRange(args []Value) (start int64, end int64, inBits bool, errVal *Value) {
+	nums := []*int64{&start, &end}
+	for i := 0; i < len(args) && i < 2; i++ {
+		n, err := strconv.ParseInt(args[i].bulk, 10, 64)
+		if err != nil {
+			return 0, 0, false, &Value{typ: "error", str: "value is not an integer or out of range"}
+		}
+		*nums[i] = n
+	}
+
+	if len(args) == 3 {
+		switch strings.ToUpper(args[2].bulk) {
+		case "BIT":
+			inBits = true
+		case "BYTE":
+		default:
+			return 0, 0, false, &Value{typ: "error", str: "syntax error"}
+		}
+	}
+
+	return start, end, inBits, nil
+}
+
+// bitcount implements "BITCOUNT key [start end [BYTE|BIT]]", the range is in
+// bytes unless BIT is given.
+func bitcount(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'bitcount' command"}
+	}
+
+	if len(args) != 1 && len(args) != 3 && len(args) != 4 {
+		return Value{typ: "error", str: "syntax error"}
+	}
+
+	key := args[0].bulk
+
+	start, end, inBits, errVal := parseBitRange(args[1:])
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if obj == nil {
+		return Value{typ: "integer", num: 0}
+	}
+	data := obj.Value.(string)
+
+	length := int64(len(data))
+	if inBits {
+		length *= 8
+	}
+
+	if len(args) == 1 {
+		start, end = 0, length - 1
+	}
+
+	start, end, ok := bitRange(start, end, length)
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	if !inBits {
+		start, end = start * 8, end * 8 + 7
+	}
+
+	return Value{typ: "integer", num: bitCount(data, start, end)}
+}
+
+// bitpos implements "BITPOS key bit [start [end [BYTE|BIT]]]". Looking for a
+// clear bit without an end treats the string as padded with zeros, so the
+// bit right after it is returned when all of it is set.
+func bitpos(dt *DataType, args []Value) Value {
+	if len(args) < 2 || len(args) > 5 {
+		return Value{typ: "error", str: "wrong number of arguments for 'bitpos' command"}
+	}
+
+	key := args[0].bulk
+
+	if args[1].bulk != "0" && args[1].bulk != "1" {
+		return Value{typ: "error", str: "The bit argument must be 1 or 0."}
+	}
+	bit := int(args[1].bulk[0] - '0')
+
+	start, end, inBits, errVal := parseBitRange(args[2:])
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
+	}
+
+	// a missing key is all clear bits
+	if obj == nil {
+		if bit == 1 {
+			return Value{typ: "integer", num: -1}
+		}
+		return Value{typ: "integer", num: 0}
+	}
+	data := obj.Value.(string)
+
+	length := int64(len(data))
+	if inBits {
+		length *= 8
+	}
+
+	endGiven := len(args) > 3
+	if !endGiven {
+		end = length - 1
+	}
+
+	start, end, ok := bitRange(start, end, length)
+	if !ok {
+		return Value{typ: "integer", num: -1}
+	}
+
+	if !inBits {
+		start, end = start * 8, end * 8 + 7
+	}
+
+	pos := bitPos(data, bit, start, end)
+	if pos == -1 && bit == 0 && !endGiven {
+		pos = end + 1
+	}
+
+	return Value{typ: "integer", num: int(pos)}
+}
+
+// bitopCommand implements "BITOP AND|OR|XOR|NOT destkey key ...". Missing keys count
+// as empty strings, an empty result deletes destkey.
+func bitopCommand(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'bitop' command"}
+	}
+
+	op := strings.ToUpper(args[0].bulk)
+	dest := args[1].bulk
+
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 3 {
+			return Value{typ: "error", str: "BITOP NOT must be called with a single source key."}
+		}
+	default:
+		return Value{typ: "error", str: "syntax error"}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	srcs := make([]string, 0, len(args) - 2)
+	for _, arg := range args[2:] {
+		obj, errVal := dt.lookupType(arg.bulk, TypeString)
+		if errVal != nil {
+			return *errVal
+		}
+
+		if obj == nil {
+			srcs = append(srcs, "")
+		} else {
+			srcs = append(srcs, obj.Value.(string))
+		}
+	}
+
+	res := bitop(op, srcs)
+	if len(res) == 0 {
+		dt.Keys.Delete(dest)
+		return Value{typ: "integer", num: 0}
+	}
+
+	dt.Keys.Set(dest, &Object{Type: TypeString, Value: res})
+
+	return Value{typ: "integer", num: len(res)}
+}
+
+// bitfieldOp is one GET, SET or INCRBY of a BITFIELD.
+type bitfieldOp struct {
+	op string
+	typ bitfieldType
+	offset int64
+	val int64
+	overflow string // the OVERFLOW in effect for SET and INCRBY
+}
+
+// parseBitfield parses the operations of "BITFIELD key [GET type offset]
+// [SET type offset value] [INCRBY type offset increment]
+// [OVERFLOW WRAP|SAT|FAIL] ...". OVERFLOW applies to the operations after it.
+func parseBitfield(args []Value) ([]bitfieldOp, *Value) {
+	var ops []bitfieldOp
+	overflow := bitfieldWrap
+
+	for i := 0; i < len(args); {
+		op := strings.ToUpper(args[i].bulk)
+
+		nargs := 0
+		switch op {
+		case "GET":
+			nargs = 2
+		case "SET", "INCRBY":
+			nargs = 3
+		case "OVERFLOW":
+			nargs = 1
+		default:
+			return nil, &Value{typ: "error", str: "syntax error"}
+		}
+
+		if i + nargs >= len(args) {
+			return nil, &Value{typ: "error", str: "syntax error"}
+		}
+
+		if op == "OVERFLOW" {
+			overflow = strings.ToUpper(args[i + 1].bulk)
+			if overflow != bitfieldWrap && overflow != bitfieldSat && overflow != bitfieldFail {
+				return nil, &Value{typ: "error", str: "Invalid OVERFLOW type specified"}
+			}
+
+			i += 2
+			continue
+		}
+
+		typ, err := parseBitfieldType(args[i + 1].bulk)
+		if err != nil {
+			return nil, &Value{typ: "error", str: err.Error()}
+		}
+
+		offset, err := parseBitOffset(args[i + 2].bulk, int64(typ.bits))
+		if err != nil || offset + int64(typ.bits) > bitmapMaxBits {
+			return nil, &Value{typ: "error", str: errBitOffset.Error()}
+		}
+
+		o := bitfieldOp{op: op, typ: typ, offset: offset, overflow: overflow}
+		if op != "GET" {
+			n, err := strconv.ParseInt(args[i + 3].bulk, 10, 64)
+			if err != nil {
+				return nil, &Value{typ: "error", str: "value is not an integer or out of range"}
+			}
+			o.val = n
+		}
+
+		ops = append(ops, o)
+		i += nargs + 1
+	}
+
+	return ops, nil
+}
+
+// bitfieldWrites reports whether a BITFIELD has any SET or INCRBY, one with
+// only GETs does not modify the key.
+func bitfieldWrites(ops []bitfieldOp) bool {
+	for _, op := range ops {
+		if op.op != "GET" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bitfield treats the string at key as an array of integers of arbitrary
+// width and replies with the result of each operation: the value for GET,
+// the previous value for SET and the new one for INCRBY, null if OVERFLOW
+// FAIL prevented the write. The string is grown first to hold every field
+// written.
+func bitfield(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'bitfield' command"}
+	}
+
+	key := args[0].bulk
+
+	ops, errVal := parseBitfield(args[1:])
+	if errVal != nil {
+		return *errVal
+	}
+
+	writes := bitfieldWrites(ops)
+
+	size := int64(0)
+	for _, op := range ops {
+		if op.op != "GET" {
+			size = max(size, op.offset + int64(op.typ.bits))
+		}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil {
+		return *errVal
+	}
+
+	data := ""
+	if obj != nil {
+		data = obj.Value.(string)
+	}
+	buf := growBitmap(data, size)
+
+	res := make([]Value, 0, len(ops))
+	for _, op := range ops {
+		old := op.typ.get(buf, op.offset)
+
+		if op.op == "GET" {
+			res = append(res, Value{typ: "integer", num: int(old)})
+			continue
+		}
+
+		val, incr, reply := op.val, int64(0), old
+		if op.op == "INCRBY" {
+			val, incr = old, op.val
+		}
+
+		val, ok := op.typ.add(val, incr, op.overflow)
+		if !ok {
+			res = append(res, Value{typ: "null"})
+			continue
+		}
+
+		if op.op == "INCRBY" {
+			reply = val
+		}
+
+		op.typ.set(buf, op.offset, val)
+		res = append(res, Value{typ: "integer", num: int(reply)})
+	}
+
+	if writes {
+		storeBitmap(dt, key, obj, buf)
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+// HYPERLOGLOG COMMANDS //
+
+// lookupHLL returns the HyperLogLog at key, nils if there is none.
+func lookupHLL(dt *DataType, key string) (*Object, *HLL, *Value) {
+	obj, errVal := dt.lookupType(key, TypeString)
+	if errVal != nil || obj == nil {
+		return nil, nil, errVal
+	}
+
+	h, err := parseHLL(obj.Value.(string))
+	if err != nil {
+		return nil, nil, &Value{typ: "error", str: err.Error()}
+	}
+
+	return obj, h, nil
+}
+
+func pfadd(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'pfadd' command"}
+	}
+
+	key := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	obj, h, errVal := lookupHLL(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	// creating the key counts as an update even without elements
+	updated := h == nil
+	if h == nil {
+		h = newHLL()
+	}
+
+	for _, arg := range args[1:] {
+		if h.Add(arg.bulk) {
+			updated = true
+		}
+	}
+
+	if !updated {
+		return Value{typ: "integer", num: 0}
+	}
+	h.InvalidateCache()
+
+	if obj == nil {
+		dt.Keys.Set(key, &Object{Type: TypeString, Value: h.String()})
+	} else {
+		obj.Value = h.String()
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+// pfcount estimates the cardinality of the union of the keys. With a single
+// key the estimate is cached in the value, which doesn't need to go to the
+// AOF since it is only a cache.
+func pfcount(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'pfcount' command"}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	if len(args) == 1 {
+		obj, h, errVal := lookupHLL(dt, args[0].bulk)
+		if errVal != nil {
+			return *errVal
+		}
+
+		if h == nil {
+			return Value{typ: "integer", num: 0}
+		}
+
+		n, ok := h.CachedCount()
+		if !ok {
+			n = h.Count()
+			h.SetCachedCount(n)
+
+			data := obj.Value.(string)
+			obj.Value = data[:8] + string(h.card[:]) + data[hllHdrSize:]
+			dt.hllCacheWritten = true
+		}
+
+		return Value{typ: "integer", num: int(n)}
+	}
+
+	regs := make([]uint8, hllRegisters)
+	for _, arg := range args {
+		_, h, errVal := lookupHLL(dt, arg.bulk)
+		if errVal != nil {
+			return *errVal
+		}
+
+		if h != nil {
+			h.Merge(regs)
+		}
+	}
+
+	return Value{typ: "integer", num: int(hllCount(regs))}
+}
+
+// pfmerge stores the union of destkey and the source keys at destkey, dense
+// if any of them is.
+func pfmerge(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'pfmerge' command"}
+	}
+
+	dest := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, dest)
+
+	regs := make([]uint8, hllRegisters)
+	dense := false
+	for _, arg := range args {
+		_, h, errVal := lookupHLL(dt, arg.bulk)
+		if errVal != nil {
+			return *errVal
+		}
+
+		if h != nil {
+			h.Merge(regs)
+			dense = dense || !h.sparse
+		}
+	}
+
+	h := hllFromRegisters(regs, dense)
+	h.InvalidateCache()
+
+	if obj, exist := dt.Keys.Get(dest); exist {
+		obj.Value = h.String()
+	} else {
+		dt.Keys.Set(dest, &Object{Type: TypeString, Value: h.String()})
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// GEO COMMANDS //
+
+// parseLongLat parses a longitude and a latitude which must be valid for a
+// geo index.
+func parseLongLat(lonArg string, latArg string) (float64, float64, *Value) {
+	lon, err := parseScore(lonArg)
+	if err != nil {
+		return 0, 0, &Value{typ: "error", str: err.Error()}
+	}
+
+	lat, err := parseScore(latArg)
+	if err != nil {
+		return 0, 0, &Value{typ: "error", str: err.Error()}
+	}
+
+	if !validLongLat(lon, lat) {
+		return 0, 0, &Value{typ: "error", str: fmt.Sprintf("invalid longitude,latitude pair %f,%f", lon, lat)}
+	}
+
+	return lon, lat, nil
+}
+
+// geoadd turns "GEOADD key [NX|XX] [CH] longitude latitude member ..." into
+// the ZADD that adds the members with their geohashes as scores.
+func geoadd(dt *DataType, args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "wrong number of arguments for 'geoadd' command"}
+	}
+
+	zargs := []Value{args[0]}
+
+	var nx, xx bool
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+		default:
+			break options
+		}
+		zargs = append(zargs, args[i])
+	}
+
+	triples := args[i:]
+	if len(triples) % 3 != 0 || nx && xx {
+		return Value{typ: "error", str: "syntax error"}
+	}
+
+	for j := 0; j < len(triples); j += 3 {
+		lon, lat, errVal := parseLongLat(triples[j].bulk, triples[j + 1].bulk)
+		if errVal != nil {
+			return *errVal
+		}
+
+		score := strconv.FormatFloat(geoScore(lon, lat), 'f', -1, 64)
+		zargs = append(zargs, Value{typ: "bulk", bulk: score}, triples[j + 2])
+	}
+
+	return zadd(dt, zargs)
+}
+
+func geodist(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'geodist' command"}
+	}
+
+	if len(args) > 4 {
+		return Value{typ: "error", str: "syntax error"}
+	}
+
+	toMeters := 1.0
+	if len(args) == 4 {
+		var err error
+		if toMeters, err = parseGeoUnit(args[3].bulk); err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, args[0].bulk)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if zset == nil {
+		return Value{typ: "null"}
+	}
+
+	score1, exist1 := zset.Score(args[1].bulk)
+	score2, exist2 := zset.Score(args[2].bulk)
+	if !exist1 || !exist2 {
+		return Value{typ: "null"}
+	}
+
+	lon1, lat1 := geoDecodeScore(score1)
+	lon2, lat2 := geoDecodeScore(score2)
+
+	return Value{typ: "bulk", bulk: formatGeoDistance(geoDistance(lon1, lat1, lon2, lat2) / toMeters)}
+}
+
+// geoMembers replies with fn applied to the score of each member of args[1:]
+// in the geo index at args[0], or a null for a missing member.
+func geoMembers(dt *DataType, args []Value, fn func(score float64) Value) Value {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, args[0].bulk)
+	if errVal != nil {
+		return *errVal
+	}
+
+	res := make([]Value, 0, len(args) - 1)
+	for _, arg := range args[1:] {
+		score, exist := 0.0, false
+		if zset != nil {
+			score, exist = zset.Score(arg.bulk)
+		}
+
+		if !exist {
+			res = append(res, Value{typ: "null"})
+			continue
+		}
+
+		res = append(res, fn(score))
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+func geohash(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'geohash' command"}
+	}
+
+	return geoMembers(dt, args, func(score float64) Value {
+		return Value{typ: "bulk", bulk: geohashString(score)}
+	})
+}
+
+func geoCoordValue(lon float64, lat float64) Value {
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: formatGeoCoord(lon)},
+		{typ: "bulk", bulk: formatGeoCoord(lat)},
+	}}
+}
+
+func geopos(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'geopos' command"}
+	}
+
+	return geoMembers(dt, args, func(score float64) Value {
+		return geoCoordValue(geoDecodeScore(score))
+	})
+}
+
+// geosearchArgs is a parsed GEOSEARCH or GEOSEARCHSTORE:
+// "<FROMMEMBER member|FROMLONLAT longitude latitude>
+// <BYRADIUS radius unit|BYBOX width height unit> [ASC|DESC] [COUNT count [ANY]]
+// [WITHCOORD] [WITHDIST] [WITHHASH]", with STOREDIST instead of the WITH
+// options for GEOSEARCHSTORE.
+type geosearchArgs struct {
+	shape geoShape
+	sort int // 1 for ASC, -1 for DESC, 0 for no sorting
+	count int // 0 for no limit
+	any bool
+	withCoord, withDist, withHash bool
+	storeDist bool
+}
+
+// parseGeosearch parses the options of the search named name in zset, which
+// FROMMEMBER needs.
+func parseGeosearch(name string, args []Value, zset *ZSet, store bool) (*geosearchArgs, *Value) {
+	g := &geosearchArgs{}
+	var fromMember, fromLonLat, byRadius, byBox bool
+
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+
+		switch arg := strings.ToUpper(args[i].bulk); {
+		case arg == "WITHCOORD":
+			g.withCoord = true
+		case arg == "WITHDIST":
+			g.withDist = true
+		case arg == "WITHHASH":
+			g.withHash = true
+		case arg == "ANY":
+			g.any = true
+		case arg == "ASC":
+			g.sort = 1
+		case arg == "DESC":
+			g.sort = -1
+		case arg == "COUNT" && remaining >= 1:
+			count, err := strconv.ParseInt(args[i + 1].bulk, 10, 64)
+			if err != nil {
+				return nil, &Value{typ: "error", str: "value is not an integer or out of range"}
+			}
+
+			if count <= 0 {
+				return nil, &Value{typ: "error", str: "COUNT must be > 0"}
+			}
+
+			g.count = int(min(count, math.MaxInt32))
+			i++
+		case arg == "STOREDIST" && store:
+			g.storeDist = true
+		case arg == "FROMMEMBER" && remaining >= 1 && !fromLonLat:
+			fromMember = true
+			i++
+
+			// a missing key only shows once the options are checked
+			if zset == nil {
+				continue
+			}
+
+			score, exist := zset.Score(args[i].bulk)
+			if !exist {
+				return nil, &Value{typ: "error", str: "could not decode requested zset member"}
+			}
+			g.shape.lon, g.shape.lat = geoDecodeScore(score)
+		case arg == "FROMLONLAT" && remaining >= 2 && !fromMember:
+			lon, lat, errVal := parseLongLat(args[i + 1].bulk, args[i + 2].bulk)
+			if errVal != nil {
+				return nil, errVal
+			}
+
+			g.shape.lon, g.shape.lat = lon, lat
+			fromLonLat = true
+			i += 2
+		case arg == "BYRADIUS" && remaining >= 2 && !byBox:
+			radius, err := parseScore(args[i + 1].bulk)
+			if err != nil {
+				return nil, &Value{typ: "error", str: "need numeric radius"}
+			}
+
+			if radius < 0 {
+				return nil, &Value{typ: "error", str: "radius cannot be negative"}
+			}
+
+			conversion, err := parseGeoUnit(args[i + 2].bulk)
+			if err != nil {
+				return nil, &Value{typ: "error", str: err.Error()}
+			}
+
+			g.shape.byBox, g.shape.radius, g.shape.conversion = false, radius, conversion
+			byRadius = true
+			i += 2
+		case arg == "BYBOX" && remaining >= 3 && !byRadius:
+			width, err := parseScore(args[i + 1].bulk)
+			if err != nil {
+				return nil, &Value{typ: "error", str: "need numeric width"}
+			}
+
+			height, err := parseScore(args[i + 2].bulk)
+			if err != nil {
+				return nil, &Value{typ: "error", str: "need numeric height"}
+			}
+
+			if width < 0 || height < 0 {
+				return nil, &Value{typ: "error", str: "height or width cannot be negative"}
+			}
+
+			conversion, err := parseGeoUnit(args[i + 3].bulk)
+			if err != nil {
+				return nil, &Value{typ: "error", str: err.Error()}
+			}
+
+			g.shape.byBox, g.shape.width, g.shape.height, g.shape.conversion = true, width, height, conversion
+			byBox = true
+			i += 3
+		default:
+			return nil, &Value{typ: "error", str: "syntax error"}
+		}
+	}
+
+	if store && (g.withCoord || g.withDist || g.withHash) {
+		return nil, &Value{typ: "error", str: "GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options"}
+	}
+
+	if !fromMember && !fromLonLat {
+		return nil, &Value{typ: "error", str: "exactly one of FROMMEMBER or FROMLONLAT can be specified for " + name}
+	}
+
+	if !byRadius && !byBox {
+		return nil, &Value{typ: "error", str: "exactly one of BYRADIUS and BYBOX can be specified for " + name}
+	}
+
+	if g.any && g.count == 0 {
+		return nil, &Value{typ: "error", str: "the ANY argument requires COUNT argument"}
+	}
+
+	// the closest members come first when only some of them are returned
+	if g.count > 0 && g.sort == 0 && !g.any {
+		g.sort = 1
+	}
+
+	return g, nil
+}
+
+// search returns the members of zset matching g, sorted and cut to COUNT.
+func (g *geosearchArgs) search(zset *ZSet) []geoPoint {
+	limit := 0
+	if g.any {
+		limit = g.count
+	}
+
+	points := geoSearch(zset, &g.shape, limit)
+
+	if g.sort != 0 {
+		sort.SliceStable(points, func(i, j int) bool {
+			if g.sort > 0 {
+				return points[i].dist < points[j].dist
+			}
+			return points[i].dist > points[j].dist
+		})
+	}
+
+	if g.count > 0 && len(points) > g.count {
+		points = points[:g.count]
+	}
+
+	return points
+}
+
+func geosearch(dt *DataType, args []Value) Value {
+	if len(args) < 6 {
+		return Value{typ: "error", str: "wrong number of arguments for 'geosearch' command"}
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	zset, errVal := lookupZSet(dt, args[0].bulk)
+	if errVal != nil {
+		return *errVal
+	}
+
+	g, errVal := parseGeosearch("geosearch", args[1:], zset, false)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if zset == nil {
+		return Value{typ: "array", array: []Value{}}
+	}
+
+	points := g.search(zset)
+
+	res := make([]Value, 0, len(points))
+	for _, p := range points {
+		member := Value{typ: "bulk", bulk: p.member}
+		if !g.withDist && !g.withHash && !g.withCoord {
+			res = append(res, member)
+			continue
+		}
+
+		item := []Value{member}
+		if g.withDist {
+			item = append(item, Value{typ: "bulk", bulk: formatGeoDistance(p.dist / g.shape.conversion)})
+		}
+		if g.withHash {
+			item = append(item, Value{typ: "integer", num: int(p.score)})
+		}
+		if g.withCoord {
+			item = append(item, geoCoordValue(p.lon, p.lat))
+		}
+		res = append(res, Value{typ: "array", array: item})
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+// geosearchstore stores the members found at destination, with their
+// geohashes as scores so that it is a geo index too, or their distances with
+// STOREDIST.
+func geosearchstore(dt *DataType, args []Value) Value {
+	if len(args) < 7 {
+		return Value{typ: "error", str: "wrong number of arguments for 'geosearchstore' command"}
+	}
+
+	dst := args[0].bulk
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	zset, errVal := lookupZSet(dt, args[1].bulk)
+	if errVal != nil {
+		return *errVal
+	}
+
+	g, errVal := parseGeosearch("geosearchstore", args[2:], zset, true)
+	if errVal != nil {
+		return *errVal
+	}
+
+	res := newZSet()
+	if zset != nil {
+		for _, p := range g.search(zset) {
+			if g.storeDist {
+				res.Add(p.member, p.dist / g.shape.conversion)
+			} else {
+				res.Add(p.member, p.score)
+			}
+		}
+	}
+
+	return zsetStore(dt, dst, res)
+}
+
+// JSON COMMANDS //
+
+// lookupJSON returns the document at key, nil if the key does not exist.
+func lookupJSON(dt *DataType, key string) (*JSONDoc, *Value) {
+	obj, errVal := dt.lookupType(key, TypeJSON)
+	if obj == nil {
+		return nil, errVal
+	}
+
+	return obj.Value.(*JSONDoc), nil
+}
+
+var errJSONNoKey = errors.New("could not perform this operation on a key that doesn't exist")
+
+func jsonPathError(path *jsonPath) Value {
+	return Value{typ: "error", str: "Path '" + path.text + "' does not exist"}
+}
+
+func jsonWrongType(expected string, v any) Value {
+	return Value{typ: "error", str: "wrong type of path value - expected " + expected + " but found " + jsonTypeName(v)}
+}
+
+// parseJSONPathArg parses the optional path at args[i], the legacy root if
+// there is none.
+func parseJSONPathArg(args []Value, i int) (*jsonPath, *Value) {
+	s := "."
+	if i < len(args) {
+		s = args[i].bulk
+	}
+
+	path, err := parseJSONPath(s)
+	if err != nil {
+		return nil, &Value{typ: "error", str: err.Error()}
+	}
+
+	return path, nil
+}
+
+// jsonReply replies with fn of the values matched by path: of the first
+// one for a legacy path, of each of them in an array for a JSONPath. fn
+// returns nil for a value of the wrong type, an error naming expected for a
+// legacy path and a null for a JSONPath.
+func jsonReply(path *jsonPath, nodes []jsonNode, expected string, fn func(v any) *Value) Value {
+	if path.legacy {
+		if len(nodes) == 0 {
+			return jsonPathError(path)
+		}
+
+		res := fn(nodes[0].value)
+		if res == nil {
+			return jsonWrongType(expected, nodes[0].value)
+		}
+
+		return *res
+	}
+
+	res := make([]Value, 0, len(nodes))
+	for _, n := range nodes {
+		if v := fn(n.value); v != nil {
+			res = append(res, *v)
+		} else {
+			res = append(res, Value{typ: "null"})
+		}
+	}
+
+	return Value{typ: "array", array: res}
+}
+
+// jsonSet implements "JSON.SET key path value [NX|XX]". A new key must be
+// created at the root, a null reply means nothing was set.
+func jsonSet(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.set' command"}
+	}
+
+	key := args[0].bulk
+
+	var nx, xx bool
+	if len(args) > 4 {
+		return Value{typ: "error", str: "syntax error"}
+	}
+	if len(args) == 4 {
+		switch strings.ToUpper(args[3].bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return Value{typ: "error", str: "syntax error"}
+		}
+	}
+
+	path, errVal := parseJSONPathArg(args, 1)
+	if errVal != nil {
+		return *errVal
+	}
+
+	v, err := parseJSON(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	doc, errVal := lookupJSON(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if doc == nil {
+		if len(path.segments) > 0 {
+			return Value{typ: "error", str: "new objects must be created at the root"}
+		}
+
+		if xx {
+			return Value{typ: "null"}
+		}
+
+		dt.Keys.Set(key, &Object{Type: TypeJSON, Value: &JSONDoc{Root: v}})
+		return Value{typ: "string", str: "OK"}
+	}
+
+	if path.Set(doc, v, nx, xx) == 0 {
+		return Value{typ: "null"}
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// jsonGet implements "JSON.GET key [INDENT s] [NEWLINE s] [SPACE s] [path ...]".
+// With several paths the reply is an object from each path to what it
+// matched.
+func jsonGet(dt *DataType, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.get' command"}
+	}
+
+	format := &jsonFormat{}
+	var paths []*jsonPath
+	legacy := true
+
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].bulk)
+		if (opt == "INDENT" || opt == "NEWLINE" || opt == "SPACE") && i + 1 < len(args) {
+			switch opt {
+			case "INDENT":
+				format.indent = args[i + 1].bulk
+			case "NEWLINE":
+				format.newline = args[i + 1].bulk
+			case "SPACE":
+				format.space = args[i + 1].bulk
+			}
+			i++
+			continue
+		}
+
+		path, errVal := parseJSONPathArg(args, i)
+		if errVal != nil {
+			return *errVal
+		}
+		paths = append(paths, path)
+		legacy = legacy && path.legacy
+	}
+
+	if len(paths) == 0 {
+		path, _ := parseJSONPath(".")
+		paths = append(paths, path)
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	doc, errVal := lookupJSON(dt, args[0].bulk)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if doc == nil {
+		return Value{typ: "null"}
+	}
+
+	// a legacy path gets its first match, a JSONPath every match, as do
+	// all the paths once one of them is a JSONPath
+	results := make([]any, 0, len(paths))
+	for _, path := range paths {
+		nodes := path.eval(doc.Root)
+
+		if legacy {
+			if len(nodes) == 0 {
+				return jsonPathError(path)
+			}
+			results = append(results, nodes[0].value)
+			continue
+		}
+
+		matches := &JSONArray{items: make([]any, 0, len(nodes))}
+		for _, n := range nodes {
+			matches.items = append(matches.items, n.value)
+		}
+		results = append(results, matches)
+	}
+
+	res := results[0]
+	if len(paths) > 1 {
+		obj := newJSONObject()
+		for i, path := range paths {
+			obj.Set(path.text, results[i])
+		}
+		res = obj
+	}
+
+	return Value{typ: "bulk", bulk: string(format.appendJSON(nil, res, 0))}
+}
+
+// jsonDel implements "JSON.DEL key [path]" and replies with the number of
+// values deleted. Deleting the root deletes the key.
+func jsonDel(dt *DataType, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.del' command"}
+	}
+
+	key := args[0].bulk
+
+	path, errVal := parseJSONPathArg(args, 1)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	doc, errVal := lookupJSON(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if doc == nil {
+		return Value{typ: "integer", num: 0}
+	}
+
+	if len(path.segments) == 0 {
+		dt.Keys.Delete(key)
+		return Value{typ: "integer", num: 1}
+	}
+
+	return Value{typ: "integer", num: deleteJSONNodes(path.eval(doc.Root))}
+}
+
+func jsonType(dt *DataType, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.type' command"}
+	}
+
+	path, errVal := parseJSONPathArg(args, 1)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	doc, errVal := lookupJSON(dt, args[0].bulk)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if doc == nil {
+		return Value{typ: "null"}
+	}
+
+	nodes := path.eval(doc.Root)
+	if path.legacy && len(nodes) == 0 {
+		return Value{typ: "null"}
+	}
+
+	return jsonReply(path, nodes, "", func(v any) *Value {
+		return &Value{typ: "bulk", bulk: jsonTypeName(v)}
+	})
+}
+
+// jsonNumincrby implements "JSON.NUMINCRBY key path value". The reply is
+// the new value for a legacy path and, for a JSONPath, an array with the new
+// value of each match or null for matches which aren't numbers, both
+// serialized.
+func jsonNumincrby(dt *DataType, args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.numincrby' command"}
+	}
+
+	key := args[0].bulk
+
+	path, errVal := parseJSONPathArg(args, 1)
+	if errVal != nil {
+		return *errVal
+	}
+
+	incr, err := parseJSON(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	switch incr.(type) {
+	case int64, float64:
+	default:
+		return Value{typ: "error", str: "value is not a number"}
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	doc, errVal := lookupJSON(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if doc == nil {
+		return Value{typ: "error", str: errJSONNoKey.Error()}
+	}
+
+	nodes := path.eval(doc.Root)
+	if path.legacy {
+		if len(nodes) == 0 {
+			return jsonPathError(path)
+		}
+		nodes = nodes[:1]
+	}
+
+	// every sum is checked before any of them is stored
+	sums := make([]any, len(nodes))
+	for i, n := range nodes {
+		sum, ok := jsonAdd(n.value, incr)
+		if !ok {
+			return Value{typ: "error", str: "result is not a number"}
+		}
+
+		if sum == nil && path.legacy {
+			return jsonWrongType("a number", n.value)
+		}
+		sums[i] = sum
+	}
+
+	res := &JSONArray{}
+	for i, n := range nodes {
+		if sums[i] != nil {
+			n.replace(doc, sums[i])
+		}
+		res.items = append(res.items, sums[i])
+	}
+
+	if path.legacy {
+		return Value{typ: "bulk", bulk: formatJSON(sums[0])}
+	}
+
+	return Value{typ: "bulk", bulk: formatJSON(res)}
+}
+
+// jsonAdd returns v + incr, an integer if both are and the sum doesn't
+// overflow. The sum is nil if v is not a number, ok is false if it is not
+// finite.
+func jsonAdd(v any, incr any) (sum any, ok bool) {
+	var f float64
+	switch val := v.(type) {
+	case int64:
+		if i, isInt := incr.(int64); isInt {
+			s := val + i
+			if (s > val) == (i > 0) {
+				return s, true
+			}
+		}
+		f = float64(val)
+	case float64:
+		f = val
+	default:
+		return nil, true
+	}
+
+	switch i := incr.(type) {
+	case int64:
+		f += float64(i)
+	case float64:
+		f += i
+	}
+
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, false
+	}
+
+	return f, true
+}
+
+// jsonArrappend implements "JSON.ARRAPPEND key path value ..." and replies
+// with the new lengths of the arrays.
+func jsonArrappend(dt *DataType, args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.arrappend' command"}
+	}
+
+	key := args[0].bulk
+
+	path, errVal := parseJSONPathArg(args, 1)
+	if errVal != nil {
+		return *errVal
+	}
+
+	values := make([]any, 0, len(args) - 2)
+	for _, arg := range args[2:] {
+		v, err := parseJSON(arg.bulk)
+		if err != nil {
+			return Value{typ: "error", str: err.Error()}
+		}
+		values = append(values, v)
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	checkExpireTime(dt, key)
+
+	doc, errVal := lookupJSON(dt, key)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if doc == nil {
+		return Value{typ: "error", str: errJSONNoKey.Error()}
+	}
+
+	return jsonReply(path, path.eval(doc.Root), "an array", func(v any) *Value {
+		arr, ok := v.(*JSONArray)
+		if !ok {
+			return nil
+		}
+
+		for _, item := range values {
+			arr.items = append(arr.items, jsonClone(item))
+		}
+
+		return &Value{typ: "integer", num: len(arr.items)}
+	})
+}
+
+func jsonArrlen(dt *DataType, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.arrlen' command"}
+	}
+
+	path, errVal := parseJSONPathArg(args, 1)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	doc, errVal := lookupJSON(dt, args[0].bulk)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if doc == nil {
+		return Value{typ: "null"}
+	}
+
+	return jsonReply(path, path.eval(doc.Root), "an array", func(v any) *Value {
+		arr, ok := v.(*JSONArray)
+		if !ok {
+			return nil
+		}
+
+		return &Value{typ: "integer", num: len(arr.items)}
+	})
+}
+
+func jsonObjkeys(dt *DataType, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.objkeys' command"}
+	}
+
+	path, errVal := parseJSONPathArg(args, 1)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	doc, errVal := lookupJSON(dt, args[0].bulk)
+	if errVal != nil {
+		return *errVal
+	}
+
+	if doc == nil {
+		return Value{typ: "null"}
+	}
+
+	return jsonReply(path, path.eval(doc.Root), "an object", func(v any) *Value {
+		obj, ok := v.(*JSONObject)
+		if !ok {
+			return nil
+		}
+
+		res := bulkArray(obj.keys)
+		return &res
+	})
+}
+
+// jsonMget implements "JSON.MGET key ... path". Each key gets what JSON.GET
+// would reply with the path, or a null if it is missing or not a document.
+func jsonMget(dt *DataType, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "wrong number of arguments for 'json.mget' command"}
+	}
+
+	path, errVal := parseJSONPathArg(args, len(args) - 1)
+	if errVal != nil {
+		return *errVal
+	}
+
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	res := make([]Value, 0, len(args) - 1)
+	for _, arg := range args[:len(args) - 1] {
+		obj := dt.lookup(arg.bulk)
+		if obj == nil || obj.Type != TypeJSON {
+			res = append(res, Value{typ: "null"})
+			continue
+		}
+
+		nodes := path.eval(obj.Value.(*JSONDoc).Root)
+		if path.legacy {
+			if len(nodes) == 0 {
+				res = append(res, Value{typ: "null"})
+			} else {
+				res = append(res, Value{typ: "bulk", bulk: formatJSON(nodes[0].value)})
+			}
+			continue
+		}
+
+		matches := &JSONArray{items: make([]any, 0, len(nodes))}
+		for _, n := range nodes {
+			matches.items = append(matches.items, n.value)
+		}
+		res = append(res, Value{typ: "bulk", bulk: formatJSON(matches)})
+	}
+
+	return Value{typ: "array", array: res}
+}
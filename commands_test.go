@@ -0,0 +1,253 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// run calls the handler of command with args as bulk strings.
+func run(t *testing.T, dt *DataType, command string, args ...string) Value {
+	t.Helper()
+
+	handler, ok := Handlers[command]
+	if !ok {
+		t.Fatalf("unknown command %s", command)
+	}
+
+	values := make([]Value, 0, len(args))
+	for _, arg := range args {
+		values = append(values, Value{typ: "bulk", bulk: arg})
+	}
+
+	return handler(dt, values)
+}
+
+// reply formats v for comparisons: bulk strings quoted, integers and
+// simple strings as they are, nil for null, errors after "error: " and
+// arrays in brackets.
+func reply(v Value) string {
+	switch v.typ {
+	case "bulk":
+		return strconv.Quote(v.bulk)
+	case "integer":
+		return strconv.Itoa(v.num)
+	case "string":
+		return v.str
+	case "null":
+		return "nil"
+	case "error":
+		return "error: " + v.str
+	}
+
+	items := make([]string, 0, len(v.array))
+	for _, item := range v.array {
+		items = append(items, reply(item))
+	}
+	return "[" + strings.Join(items, " ") + "]"
+}
+
+// step is a command, its arguments split on spaces, and its reply as
+// formatted by reply.
+type step struct {
+	command string
+	want string
+}
+
+// runSteps runs steps in order on dt and checks their replies.
+func runSteps(t *testing.T, dt *DataType, steps []step) {
+	t.Helper()
+
+	for _, s := range steps {
+		args := strings.Fields(s.command)
+		if got := reply(run(t, dt, strings.ToUpper(args[0]), args[1:]...)); got != s.want {
+			t.Errorf("%s = %s, want %s", s.command, got, s.want)
+		}
+	}
+}
+
+// typedKey creates the key k holding a value of type typ.
+var typedKey = map[string][]string{
+	TypeString: {"SET", "k", "v"},
+	TypeList: {"RPUSH", "k", "a"},
+	TypeHash: {"HSET", "k", "f", "v"},
+	TypeSet: {"SADD", "k", "a"},
+	TypeZSet: {"ZADD", "k", "1", "a"},
+	TypeStream: {"XADD", "k", "*", "f", "v"},
+	TypeJSON: {"JSON.SET", "k", "$", "{}"},
+}
+
+// typeChecks lists, for every command that works on a single type, a call
+// reading or writing the key k and the types of k it accepts. The
+// HyperLogLog commands accept no type here: the plain string "v" is not a
+// valid HyperLogLog either.
+var typeChecks = []struct {
+	args []string
+	types []string
+}{
+	{[]string{"GET", "k"}, []string{TypeString}},
+	{[]string{"SET", "k", "v", "GET"}, []string{TypeString}},
+	{[]string{"GETEX", "k"}, []string{TypeString}},
+	{[]string{"STRLEN", "k"}, []string{TypeString}},
+	{[]string{"GETRANGE", "k", "0", "1"}, []string{TypeString}},
+	{[]string{"INCR", "k"}, []string{TypeString}},
+	{[]string{"DECR", "k"}, []string{TypeString}},
+
+	{[]string{"HSET", "k", "f", "v"}, []string{TypeHash}},
+	{[]string{"HGET", "k", "f"}, []string{TypeHash}},
+	{[]string{"HDEL", "k", "f"}, []string{TypeHash}},
+	{[]string{"HEXISTS", "k", "f"}, []string{TypeHash}},
+	{[]string{"HMGET", "k", "f"}, []string{TypeHash}},
+	{[]string{"HGETALL", "k"}, []string{TypeHash}},
+	{[]string{"HLEN", "k"}, []string{TypeHash}},
+	{[]string{"HKEYS", "k"}, []string{TypeHash}},
+	{[]string{"HVALS", "k"}, []string{TypeHash}},
+	{[]string{"HSCAN", "k", "0"}, []string{TypeHash}},
+
+	{[]string{"RPUSH", "k", "a"}, []string{TypeList}},
+	{[]string{"LPUSH", "k", "a"}, []string{TypeList}},
+	{[]string{"RPOP", "k"}, []string{TypeList}},
+	{[]string{"LPOP", "k"}, []string{TypeList}},
+	{[]string{"LRANGE", "k", "0", "-1"}, []string{TypeList}},
+	{[]string{"LPUSHX", "k", "a"}, []string{TypeList}},
+	{[]string{"RPUSHX", "k", "a"}, []string{TypeList}},
+	{[]string{"LLEN", "k"}, []string{TypeList}},
+
+	{[]string{"SADD", "k", "a"}, []string{TypeSet}},
+	{[]string{"SREM", "k", "a"}, []string{TypeSet}},
+	{[]string{"SMEMBERS", "k"}, []string{TypeSet}},
+	{[]string{"SSCAN", "k", "0"}, []string{TypeSet}},
+	{[]string{"SISMEMBER", "k", "a"}, []string{TypeSet}},
+	{[]string{"SMISMEMBER", "k", "a"}, []string{TypeSet}},
+	{[]string{"SCARD", "k"}, []string{TypeSet}},
+	{[]string{"SPOP", "k"}, []string{TypeSet}},
+	{[]string{"SRANDMEMBER", "k"}, []string{TypeSet}},
+	{[]string{"SMOVE", "k", "d", "a"}, []string{TypeSet}},
+	{[]string{"SINTER", "k"}, []string{TypeSet}},
+	{[]string{"SUNION", "k"}, []string{TypeSet}},
+	{[]string{"SDIFF", "k"}, []string{TypeSet}},
+	{[]string{"SINTERSTORE", "d", "k"}, []string{TypeSet}},
+	{[]string{"SUNIONSTORE", "d", "k"}, []string{TypeSet}},
+	{[]string{"SDIFFSTORE", "d", "k"}, []string{TypeSet}},
+	{[]string{"SINTERCARD", "1", "k"}, []string{TypeSet}},
+
+	{[]string{"ZADD", "k", "1", "a"}, []string{TypeZSet}},
+	{[]string{"ZINCRBY", "k", "1", "a"}, []string{TypeZSet}},
+	{[]string{"ZREM", "k", "a"}, []string{TypeZSet}},
+	{[]string{"ZSCORE", "k", "a"}, []string{TypeZSet}},
+	{[]string{"ZSCAN", "k", "0"}, []string{TypeZSet}},
+	{[]string{"ZCARD", "k"}, []string{TypeZSet}},
+	{[]string{"ZRANK", "k", "a"}, []string{TypeZSet}},
+	{[]string{"ZREVRANK", "k", "a"}, []string{TypeZSet}},
+	{[]string{"ZRANGE", "k", "0", "-1"}, []string{TypeZSet}},
+	{[]string{"ZCOUNT", "k", "0", "1"}, []string{TypeZSet}},
+	{[]string{"ZPOPMIN", "k"}, []string{TypeZSet}},
+	{[]string{"ZPOPMAX", "k"}, []string{TypeZSet}},
+	{[]string{"ZREMRANGEBYSCORE", "k", "0", "1"}, []string{TypeZSet}},
+	{[]string{"ZUNION", "1", "k"}, []string{TypeZSet, TypeSet}},
+	{[]string{"ZINTER", "1", "k"}, []string{TypeZSet, TypeSet}},
+	{[]string{"ZDIFF", "1", "k"}, []string{TypeZSet, TypeSet}},
+	{[]string{"ZUNIONSTORE", "d", "1", "k"}, []string{TypeZSet, TypeSet}},
+	{[]string{"ZINTERSTORE", "d", "1", "k"}, []string{TypeZSet, TypeSet}},
+	{[]string{"ZDIFFSTORE", "d", "1", "k"}, []string{TypeZSet, TypeSet}},
+	{[]string{"ZRANGESTORE", "d", "k", "0", "-1"}, []string{TypeZSet}},
+
+	{[]string{"XADD", "k", "*", "f", "v"}, []string{TypeStream}},
+	{[]string{"XTRIM", "k", "MAXLEN", "1"}, []string{TypeStream}},
+	{[]string{"XLEN", "k"}, []string{TypeStream}},
+	{[]string{"XDEL", "k", "0-1"}, []string{TypeStream}},
+	{[]string{"XRANGE", "k", "-", "+"}, []string{TypeStream}},
+	{[]string{"XREVRANGE", "k", "+", "-"}, []string{TypeStream}},
+	{[]string{"XREAD", "STREAMS", "k", "0"}, []string{TypeStream}},
+	{[]string{"XSETID", "k", "0-1"}, []string{TypeStream}},
+	{[]string{"XGROUP", "CREATE", "k", "g", "$"}, []string{TypeStream}},
+	{[]string{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "k", ">"}, []string{TypeStream}},
+	{[]string{"XACK", "k", "g", "0-1"}, []string{TypeStream}},
+	{[]string{"XPENDING", "k", "g"}, []string{TypeStream}},
+	{[]string{"XCLAIM", "k", "g", "c", "0", "0-1"}, []string{TypeStream}},
+	{[]string{"XAUTOCLAIM", "k", "g", "c", "0", "0"}, []string{TypeStream}},
+	{[]string{"XINFO", "STREAM", "k"}, []string{TypeStream}},
+
+	{[]string{"SETBIT", "k", "0", "1"}, []string{TypeString}},
+	{[]string{"GETBIT", "k", "0"}, []string{TypeString}},
+	{[]string{"BITCOUNT", "k"}, []string{TypeString}},
+	{[]string{"BITPOS", "k", "1"}, []string{TypeString}},
+	{[]string{"BITOP", "AND", "d", "k"}, []string{TypeString}},
+	{[]string{"BITFIELD", "k", "GET", "u8", "0"}, []string{TypeString}},
+
+	{[]string{"PFADD", "k", "a"}, nil},
+	{[]string{"PFCOUNT", "k"}, nil},
+	{[]string{"PFMERGE", "d", "k"}, nil},
+
+	{[]string{"GEOADD", "k", "13", "38", "a"}, []string{TypeZSet}},
+	{[]string{"GEODIST", "k", "a", "b"}, []string{TypeZSet}},
+	{[]string{"GEOHASH", "k", "a"}, []string{TypeZSet}},
+	{[]string{"GEOPOS", "k", "a"}, []string{TypeZSet}},
+	{[]string{"GEOSEARCH", "k", "FROMLONLAT", "13", "38", "BYRADIUS", "10", "km"}, []string{TypeZSet}},
+	{[]string{"GEOSEARCHSTORE", "d", "k", "FROMLONLAT", "13", "38", "BYRADIUS", "10", "km"}, []string{TypeZSet}},
+
+	{[]string{"JSON.SET", "k", "$", "1"}, []string{TypeJSON}},
+	{[]string{"JSON.GET", "k"}, []string{TypeJSON}},
+	{[]string{"JSON.DEL", "k"}, []string{TypeJSON}},
+	{[]string{"JSON.TYPE", "k"}, []string{TypeJSON}},
+	{[]string{"JSON.NUMINCRBY", "k", "$", "1"}, []string{TypeJSON}},
+	{[]string{"JSON.ARRAPPEND", "k", "$", "1"}, []string{TypeJSON}},
+	{[]string{"JSON.ARRLEN", "k"}, []string{TypeJSON}},
+	{[]string{"JSON.OBJKEYS", "k"}, []string{TypeJSON}},
+}
+
+// anyType are the commands that work on keys of every type, or like MGET
+// treat a key of another type as missing.
+var anyType = []string{
+	"PING", "SET", "SETNX", "SETEX", "PSETEX", "MSET", "MGET", "JSON.MGET",
+	"DEL", "EXISTS", "TYPE", "KEYS", "RANDOMKEY", "DBSIZE", "SCAN",
+	"EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "PERSIST",
+	"TTL", "PTTL", "EXPIRETIME", "PEXPIRETIME", "DUMP", "RESTORE",
+}
+
+func TestEveryCommandChecksTypes(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, check := range typeChecks {
+		covered[check.args[0]] = true
+	}
+	for _, command := range anyType {
+		covered[command] = true
+	}
+
+	for command := range Handlers {
+		if !covered[command] {
+			t.Errorf("%s is neither in typeChecks nor in anyType", command)
+		}
+	}
+}
+
+func TestWrongType(t *testing.T) {
+	for _, check := range typeChecks {
+		for typ, create := range typedKey {
+			dt := createDT()
+			run(t, dt, create[0], create[1:]...)
+
+			res := run(t, dt, check.args[0], check.args[1:]...)
+
+			// on a type it accepts the call must at least get past the
+			// arguments, or the checks below would prove nothing
+			if slices.Contains(check.types, typ) {
+				if res.typ == "error" && (strings.HasPrefix(res.str, "WRONGTYPE") || strings.HasPrefix(res.str, "wrong number") || res.str == "syntax error") {
+					t.Errorf("%s on a %s: %s", strings.Join(check.args, " "), typ, res.str)
+				}
+				continue
+			}
+
+			if res.typ != "error" || !strings.HasPrefix(res.str, "WRONGTYPE") {
+				t.Errorf("%s on a %s: got %s %q %v, want WRONGTYPE", strings.Join(check.args, " "), typ, res.typ, res.str, res.array)
+				continue
+			}
+
+			// the key must be left as it was
+			if got := run(t, dt, "TYPE", "k"); got.str != typ {
+				t.Errorf("%s on a %s changed the key to %s", strings.Join(check.args, " "), typ, got.str)
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+)
+
+// ConfigParam is a parameter that can be set at startup with a command line
+// flag of the same name and read or changed at runtime with CONFIG GET/SET.
+type ConfigParam struct {
+	usage string
+	get func(srv *Server) string
+	set func(srv *Server, val string) error
+}
+
+var ConfigParams = map[string]ConfigParam {
+	"appendfsync": {
+		usage: "fsync policy of the AOF: always, everysec or no",
+		get: func(srv *Server) string {
+			return srv.aof.Fsync()
+		},
+		set: func(srv *Server, val string) error {
+			return srv.aof.SetFsync(strings.ToLower(val))
+		},
+	},
+	"aof-load-truncated": {
+		usage: "load an AOF whose last command is incomplete by truncating it: yes or no",
+		get: func(srv *Server) string {
+			return formatYesNo(srv.aof.LoadTruncated())
+		},
+		set: func(srv *Server, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+
+			srv.aof.SetLoadTruncated(on)
+
+			return nil
+		},
+	},
+	"save": {
+		usage: "snapshot rules as \"<seconds> <changes> ...\", an empty string disables them",
+		get: func(srv *Server) string {
+			return formatSaveRules(srv.rdb.Rules())
+		},
+		set: func(srv *Server, val string) error {
+			rules, err := parseSaveRules(val)
+			if err != nil {
+				return err
+			}
+
+			srv.rdb.SetRules(rules)
+
+			return nil
+		},
+	},
+	"aof-use-rdb-preamble": {
+		usage: "start rewritten AOFs with a snapshot of the data: yes or no",
+		get: func(srv *Server) string {
+			return formatYesNo(srv.aof.UsePreamble())
+		},
+		set: func(srv *Server, val string) error {
+			on, err := parseYesNo(val)
+			if err != nil {
+				return err
+			}
+
+			srv.aof.SetUsePreamble(on)
+
+			return nil
+		},
+	},
+	"auto-aof-rewrite-percentage": {
+		usage: "growth of the AOF since the last rewrite that triggers a new one, 0 disables it",
+		get: func(srv *Server) string {
+			percentage, _ := srv.aof.AutoRewrite()
+			return strconv.FormatInt(percentage, 10)
+		},
+		set: func(srv *Server, val string) error {
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative integer")
+			}
+
+			_, minSize := srv.aof.AutoRewrite()
+			srv.aof.SetAutoRewrite(n, minSize)
+
+			return nil
+		},
+	},
+	"hz": {
+		usage: "how many times per second background jobs such as expiring keys run, from 1 to 500",
+		get: func(srv *Server) string {
+			return strconv.FormatInt(srv.hz.Load(), 10)
+		},
+		set: func(srv *Server, val string) error {
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return errors.New("argument must be an integer")
+			}
+
+			srv.hz.Store(min(max(n, 1), 500))
+
+			return nil
+		},
+	},
+	"auto-aof-rewrite-min-size": {
+		usage: "minimum size in bytes of the AOF for an automatic rewrite",
+		get: func(srv *Server) string {
+			_, minSize := srv.aof.AutoRewrite()
+			return strconv.FormatInt(minSize, 10)
+		},
+		set: func(srv *Server, val string) error {
+			n, err := parseMemory(val)
+			if err != nil {
+				return err
+			}
+
+			percentage, _ := srv.aof.AutoRewrite()
+			srv.aof.SetAutoRewrite(percentage, n)
+
+			return nil
+		},
+	},
+}
+
+func parseYesNo(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(on bool) string {
+	if on {
+		return "yes"
+	}
+
+	return "no"
+}
+
+// parseMemory parses sizes such as 1024, 64mb or 1gb.
+func parseMemory(val string) (int64, error) {
+	val = strings.ToLower(val)
+	unit := int64(1)
+
+	for _, suffix := range []struct {
+		name string
+		unit int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}} {
+		if strings.HasSuffix(val, suffix.name) {
+			val = strings.TrimSuffix(val, suffix.name)
+			unit = suffix.unit
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+
+	return n * unit, nil
+}
+
+// configFlags registers a command line flag for every config parameter.
+func configFlags(fs *flag.FlagSet) map[string]*string {
+	flags := make(map[string]*string)
+	for name, param := range ConfigParams {
+		flags[name] = fs.String(name, "", param.usage)
+	}
+
+	return flags
+}
+
+// applyConfigFlags sets the parameters that were given on the command line.
+func applyConfigFlags(srv *Server, fs *flag.FlagSet, flags map[string]*string) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		if e := ConfigParams[f.Name].set(srv, *flags[f.Name]); e != nil {
+			err = errors.New(f.Name + ": " + e.Error())
+		}
+	})
+
+	return err
+}
+
+// SERVER COMMANDS //
+func config(srv *Server, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "wrong number of arguments for 'config' command"}
+	}
+
+	switch strings.ToUpper(args[0].bulk) {
+	case "GET":
+		if len(args) < 2 {
+			return Value{typ: "error", str: "wrong number of arguments for 'config|get' command"}
+		}
+
+		res := []Value{}
+		for _, arg := range args[1:] {
+			name := strings.ToLower(arg.bulk)
+
+			param, exist := ConfigParams[name]
+			if !exist {
+				continue
+			}
+
+			res = append(res, Value{typ: "bulk", bulk: name}, Value{typ: "bulk", bulk: param.get(srv)})
+		}
+
+		return Value{typ: "array", array: res}
+	case "SET":
+		if len(args) < 3 || len(args) % 2 != 1 {
+			return Value{typ: "error", str: "wrong number of arguments for 'config|set' command"}
+		}
+
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(args[i].bulk)
+
+			param, exist := ConfigParams[name]
+			if !exist {
+				return Value{typ: "error", str: "Unknown option or number of arguments for CONFIG SET - '" + name + "'"}
+			}
+
+			if err := param.set(srv, args[i + 1].bulk); err != nil {
+				return Value{typ: "error", str: "CONFIG SET failed (possibly related to argument '" + name + "') - " + err.Error()}
+			}
+		}
+
+		return Value{typ: "string", str: "OK"}
+	}
+
+	return Value{typ: "error", str: "unknown subcommand '" + args[0].bulk + "'"}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"hash/maphash"
+	"iter"
+	"math/bits"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Dict is a hash table from strings to V, modelled on the dict of Redis so
+// that it can be walked with a stateless cursor, which a Go map can't do.
+//
+// Keys are chained in power of two sized tables. Growing or shrinking
+// allocates a second table and moves the keys over incrementally, one bucket
+// per write, so no single command pays for a whole resize. While that
+// happens lookups check both tables and new keys go to the second one.
+//
+// Reads never change the table, so concurrent readers are fine as long as
+// writers are excluded, like everything else under DataType.Mu. A nil Dict
+// is empty and can be read but not written, like a nil map.
+type Dict[V any] struct {
+	tables [2][]*dictEntry[V]
+	used [2]int
+	rehashIdx int // next bucket of tables[0] to move, -1 if not rehashing
+	seed maphash.Seed
+
+	// iterators counts the running All loops, rehashing waits for them so
+	// that entries don't move under them
+	iterators atomic.Int32
+}
+
+type dictEntry[V any] struct {
+	key string
+	val V
+	next *dictEntry[V]
+}
+
+const (
+	dictInitialSize = 4
+	dictMinFill = 8 // shrink once less than 1/dictMinFill of the buckets are used
+	dictEmptyVisits = 10 // empty buckets a rehash step may skip
+)
+
+func NewDict[V any]() *Dict[V] {
+	return &Dict[V]{rehashIdx: -1, seed: maphash.MakeSeed()}
+}
+
+func (d *Dict[V]) Len() int {
+	if d == nil {
+		return 0
+	}
+
+	return d.used[0] + d.used[1]
+}
+
+func (d *Dict[V]) rehashing() bool {
+	return d.rehashIdx != -1
+}
+
+func (d *Dict[V]) hash(key string) uint64 {
+	return maphash.String(d.seed, key)
+}
+
+func (d *Dict[V]) find(key string) *dictEntry[V] {
+	if d.Len() == 0 {
+		return nil
+	}
+
+	h := d.hash(key)
+	for t := 0; t <= 1; t++ {
+		table := d.tables[t]
+		if len(table) == 0 {
+			break
+		}
+
+		for e := table[h & uint64(len(table) - 1)]; e != nil; e = e.next {
+			if e.key == key {
+				return e
+			}
+		}
+
+		if !d.rehashing() {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (d *Dict[V]) Get(key string) (V, bool) {
+	if e := d.find(key); e != nil {
+		return e.val, true
+	}
+
+	var zero V
+	return zero, false
+}
+
+// Set stores val at key and reports whether key is new.
+func (d *Dict[V]) Set(key string, val V) bool {
+	d.rehashStep()
+
+	if e := d.find(key); e != nil {
+		e.val = val
+		return false
+	}
+
+	d.expand()
+
+	t := 0
+	if d.rehashing() {
+		t = 1
+	}
+
+	table := d.tables[t]
+	i := d.hash(key) & uint64(len(table) - 1)
+	table[i] = &dictEntry[V]{key: key, val: val, next: table[i]}
+	d.used[t]++
+
+	return true
+}
+
+// Delete removes key and reports whether it was there.
+func (d *Dict[V]) Delete(key string) bool {
+	if d.Len() == 0 {
+		return false
+	}
+
+	d.rehashStep()
+
+	h := d.hash(key)
+	for t := 0; t <= 1; t++ {
+		table := d.tables[t]
+		if len(table) == 0 {
+			break
+		}
+
+		for p := &table[h & uint64(len(table) - 1)]; *p != nil; p = &(*p).next {
+			if (*p).key == key {
+				*p = (*p).next
+				d.used[t]--
+				d.shrink()
+				return true
+			}
+		}
+
+		if !d.rehashing() {
+			break
+		}
+	}
+
+	return false
+}
+
+// expand makes room for one more key, starting to rehash into a table
+// twice as large once there are as many keys as buckets.
+func (d *Dict[V]) expand() {
+	if d.rehashing() {
+		return
+	}
+
+	if len(d.tables[0]) == 0 {
+		d.tables[0] = make([]*dictEntry[V], dictInitialSize)
+		return
+	}
+
+	if d.used[0] >= len(d.tables[0]) {
+		d.resize(d.used[0] + 1)
+	}
+}
+
+// shrink starts rehashing into a smaller table once few buckets are used.
+func (d *Dict[V]) shrink() {
+	if d.rehashing() || len(d.tables[0]) <= dictInitialSize {
+		return
+	}
+
+	if d.used[0] * dictMinFill < len(d.tables[0]) {
+		d.resize(d.used[0])
+	}
+}
+
+// resize starts rehashing into a table of the smallest power of two that
+// holds size keys.
+func (d *Dict[V]) resize(size int) {
+	n := dictInitialSize
+	for n < size {
+		n *= 2
+	}
+
+	if n == len(d.tables[0]) {
+		return
+	}
+
+	d.tables[1] = make([]*dictEntry[V], n)
+	d.rehashIdx = 0
+}
+
+// rehashStep moves the keys of one bucket to the new table, unless an All
+// loop is running.
+func (d *Dict[V]) rehashStep() {
+	if !d.rehashing() || d.iterators.Load() > 0 {
+		return
+	}
+
+	from, to := d.tables[0], d.tables[1]
+
+	for visits := 0; d.used[0] > 0; visits++ {
+		if visits == dictEmptyVisits {
+			return
+		}
+
+		e := from[d.rehashIdx]
+		from[d.rehashIdx] = nil
+		d.rehashIdx++
+
+		if e == nil {
+			continue
+		}
+
+		for e != nil {
+			next := e.next
+			i := d.hash(e.key) & uint64(len(to) - 1)
+			e.next = to[i]
+			to[i] = e
+			d.used[0]--
+			d.used[1]++
+			e = next
+		}
+
+		break
+	}
+
+	if d.used[0] == 0 {
+		d.tables[0], d.used[0] = to, d.used[1]
+		d.tables[1], d.used[1] = nil, 0
+		d.rehashIdx = -1
+	}
+}
+
+// All iterates over every key in no particular order. The loop body may
+// delete the current key; keys added during the loop may or may not be seen.
+func (d *Dict[V]) All() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		if d == nil {
+			return
+		}
+
+		d.iterators.Add(1)
+		defer d.iterators.Add(-1)
+
+		for t := 0; t <= 1; t++ {
+			for _, e := range d.tables[t] {
+				for e != nil {
+					next := e.next
+					if !yield(e.key, e.val) {
+						return
+					}
+					e = next
+				}
+			}
+
+			if !d.rehashing() {
+				return
+			}
+		}
+	}
+}
+
+// Random returns a random key, false if d is empty. Keys in short chains are
+// a little more likely than others, like in Redis.
+func (d *Dict[V]) Random() (string, V, bool) {
+	if d.Len() == 0 {
+		var zero V
+		return "", zero, false
+	}
+
+	var e *dictEntry[V]
+	for e == nil {
+		if d.rehashing() {
+			// buckets of tables[0] below rehashIdx are empty
+			n := len(d.tables[0]) + len(d.tables[1]) - d.rehashIdx
+			i := d.rehashIdx + rand.Intn(n)
+			if i < len(d.tables[0]) {
+				e = d.tables[0][i]
+			} else {
+				e = d.tables[1][i - len(d.tables[0])]
+			}
+		} else {
+			e = d.tables[0][rand.Intn(len(d.tables[0]))]
+		}
+	}
+
+	n := 0
+	for x := e; x != nil; x = x.next {
+		n++
+	}
+	for i := rand.Intn(n); i > 0; i-- {
+		e = e.next
+	}
+
+	return e.key, e.val, true
+}
+
+// Scan calls fn for the keys of the next few buckets after cursor and
+// returns the cursor to continue from, 0 once the whole table was walked.
+// A walk started with cursor 0 returns every key that is there from start
+// to end at least once, even if the table is resized in between, though
+// some keys may come more than once.
+//
+// The cursor is a bucket index whose bits are incremented from the most
+// significant one down. Growing a table splits bucket i into buckets i and
+// i + size, which share the low bits of i, so counting in reverse they come
+// right after each other and buckets already visited stay visited.
+// Shrinking merges buckets the same way, so at worst a few are visited
+// twice.
+func (d *Dict[V]) Scan(cursor uint64, fn func(key string, val V)) uint64 {
+	if d.Len() == 0 {
+		return 0
+	}
+
+	emit := func(e *dictEntry[V]) {
+		for ; e != nil; e = e.next {
+			fn(e.key, e.val)
+		}
+	}
+
+	next := func(v uint64, mask uint64) uint64 {
+		v |= ^mask
+		return bits.Reverse64(bits.Reverse64(v) + 1)
+	}
+
+	if !d.rehashing() {
+		t0 := d.tables[0]
+		m0 := uint64(len(t0) - 1)
+		emit(t0[cursor & m0])
+
+		return next(cursor, m0)
+	}
+
+	t0, t1 := d.tables[0], d.tables[1]
+	if len(t0) > len(t1) {
+		t0, t1 = t1, t0
+	}
+	m0, m1 := uint64(len(t0) - 1), uint64(len(t1) - 1)
+
+	// the bucket of the small table, then all the buckets of the large
+	// one it expands to
+	emit(t0[cursor & m0])
+	for {
+		emit(t1[cursor & m1])
+		cursor = next(cursor, m1)
+		if cursor & (m0 ^ m1) == 0 {
+			break
+		}
+	}
+
+	return cursor
+}
+
+func (d *Dict[V]) clone() *Dict[V] {
+	c := NewDict[V]()
+	for key, val := range d.All() {
+		c.Set(key, val)
+	}
+
+	return c
+}
+
+// ScanCount calls Scan from cursor until it got about count keys, went
+// through count*10 buckets or reached the end, which is how SCAN and its
+// variants walk a table.
+func (d *Dict[V]) ScanCount(cursor uint64, count int, fn func(key string, val V)) uint64 {
+	n := 0
+	for i := 0; i < count * 10; i++ {
+		cursor = d.Scan(cursor, func(key string, val V) {
+			n++
+			fn(key, val)
+		})
+
+		if cursor == 0 || n >= count {
+			break
+		}
+	}
+
+	return cursor
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// TestDictMatchesMap runs random writes on a Dict and on a map and checks
+// that they always hold the same keys, through several resizes.
+func TestDictMatchesMap(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	d := NewDict[int]()
+	m := map[string]int{}
+
+	for i := 0; i < 200000; i++ {
+		// the key range drifts up and down so that the table grows and
+		// shrinks
+		span := 10 + i / 1000 % 100 * 50
+		key := strconv.Itoa(rnd.Intn(span))
+
+		switch rnd.Intn(3) {
+		case 0, 1:
+			if i / 50000 % 2 == 1 {
+				_, had := m[key]
+				delete(m, key)
+				if got := d.Delete(key); got != had {
+					t.Fatalf("Delete(%s) = %v, want %v", key, got, had)
+				}
+				continue
+			}
+
+			_, had := m[key]
+			m[key] = i
+			if got := d.Set(key, i); got != !had {
+				t.Fatalf("Set(%s) = %v, want %v", key, got, !had)
+			}
+		case 2:
+			want, had := m[key]
+			if got, ok := d.Get(key); ok != had || got != want {
+				t.Fatalf("Get(%s) = %v, %v, want %v, %v", key, got, ok, want, had)
+			}
+		}
+
+		if d.Len() != len(m) {
+			t.Fatalf("Len() = %d, want %d", d.Len(), len(m))
+		}
+	}
+
+	seen := map[string]bool{}
+	for key, val := range d.All() {
+		if seen[key] {
+			t.Fatalf("All returned %s twice", key)
+		}
+		seen[key] = true
+
+		if m[key] != val {
+			t.Fatalf("All returned %s = %d, want %d", key, val, m[key])
+		}
+	}
+	if len(seen) != len(m) {
+		t.Fatalf("All returned %d keys, want %d", len(seen), len(m))
+	}
+
+	for i := 0; i < 1000 && len(m) > 0; i++ {
+		key, val, ok := d.Random()
+		if !ok || m[key] != val {
+			t.Fatalf("Random() = %s, %d, %v, not in the dict", key, val, ok)
+		}
+	}
+}
+
+// TestDictScanResize adds and deletes keys between the calls of a scan, so
+// that the table grows and shrinks under it, and checks that every key which
+// was there from start to end is returned.
+func TestDictScanResize(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for round := 0; round < 300; round++ {
+		d := NewDict[int]()
+
+		// the first half of the keys stays, the rest comes and goes
+		n := rnd.Intn(2000) + 2
+		for i := 0; i < n; i++ {
+			d.Set(strconv.Itoa(i), i)
+		}
+
+		var extra []string
+		for i := n / 2; i < n; i++ {
+			extra = append(extra, strconv.Itoa(i))
+		}
+		next := n
+
+		seen := map[string]bool{}
+		cursor := uint64(0)
+		for calls := 0; ; calls++ {
+			if calls > 1000000 {
+				t.Fatalf("round %d: scan doesn't end", round)
+			}
+
+			cursor = d.Scan(cursor, func(key string, _ int) {
+				seen[key] = true
+			})
+			if cursor == 0 {
+				break
+			}
+
+			// a few keys per call, or the table grows faster than the
+			// scan moves on
+			for i := rnd.Intn(8); i > 0; i-- {
+				if rnd.Intn(2) == 0 || len(extra) == 0 {
+					d.Set(strconv.Itoa(next), next)
+					extra = append(extra, strconv.Itoa(next))
+					next++
+				} else {
+					j := rnd.Intn(len(extra))
+					d.Delete(extra[j])
+					extra[j] = extra[len(extra) - 1]
+					extra = extra[:len(extra) - 1]
+				}
+			}
+
+			// now and then delete all of them, which shrinks the table
+			if rnd.Intn(5) == 0 {
+				for _, key := range extra {
+					d.Delete(key)
+				}
+				extra = extra[:0]
+			}
+		}
+
+		for i := 0; i < n / 2; i++ {
+			if !seen[strconv.Itoa(i)] {
+				t.Fatalf("round %d: scan missed %d", round, i)
+			}
+		}
+
+		count := 0
+		for range d.All() {
+			count++
+		}
+		if count != d.Len() {
+			t.Fatalf("round %d: All returned %d keys, Len() = %d", round, count, d.Len())
+		}
+	}
+}
+
+// TestDictAllDelete deletes every key from within an All loop, which
+// must not skip any of them even while the table is being rehashed.
+func TestDictAllDelete(t *testing.T) {
+	d := NewDict[int]()
+	for i := 0; i < 1000; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+
+	// a few more keys start a rehash
+	for i := 1000; i < 1030; i++ {
+		d.Set(strconv.Itoa(i), i)
+	}
+
+	for key := range d.All() {
+		d.Delete(key)
+	}
+
+	if d.Len() != 0 {
+		t.Fatalf("Len() = %d after deleting every key", d.Len())
+	}
+}
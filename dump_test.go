@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	dt := createDT()
+	run(t, dt, "RPUSH", "src", "a", "b", "c")
+	payload := run(t, dt, "DUMP", "src").bulk
+
+	run(t, dt, "SET", "k", "old")
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"k", "0", payload}, "BUSYKEY Target key name already exists."},
+		{[]string{"k", "-1", payload, "REPLACE"}, "Invalid TTL value, must be >= 0"},
+		{[]string{"k", "x", payload, "REPLACE"}, "value is not an integer or out of range"},
+		{[]string{"k", "0", payload, "NOW"}, "syntax error"},
+		{[]string{"k", "0", "garbage", "REPLACE"}, "DUMP payload version or checksum are wrong"},
+		{[]string{"k", "0", payload[:len(payload) - 1] + "x", "REPLACE"}, "DUMP payload version or checksum are wrong"},
+
+		// a deadline past what fits in a time must not delete the key
+		{[]string{"k", "9223372036854775807", payload, "REPLACE"}, "invalid expire time in 'restore' command"},
+		{[]string{"k", strconv.FormatInt(math.MaxInt64 - time.Now().UnixMilli() + 1000, 10), payload, "REPLACE"}, "invalid expire time in 'restore' command"},
+	} {
+		res := run(t, dt, "RESTORE", tc.args...)
+		if res.typ != "error" || res.str != tc.want {
+			t.Errorf("RESTORE %v = %s %q, want %q", tc.args[:2], res.typ, res.str, tc.want)
+		}
+
+		if got := run(t, dt, "GET", "k"); got.bulk != "old" {
+			t.Fatalf("RESTORE %v changed the key to %s %q", tc.args[:2], got.typ, got.bulk)
+		}
+	}
+
+	if res := run(t, dt, "RESTORE", "k", "0", payload, "REPLACE"); res.str != "OK" {
+		t.Fatalf("RESTORE REPLACE = %s %q", res.typ, res.str)
+	}
+	if got := run(t, dt, "LRANGE", "k", "0", "-1"); len(got.array) != 3 || got.array[2].bulk != "c" {
+		t.Errorf("LRANGE of the restored key = %v", got.array)
+	}
+	if got := run(t, dt, "PTTL", "k"); got.num != -1 {
+		t.Errorf("PTTL with a ttl of 0 = %d, want -1", got.num)
+	}
+
+	run(t, dt, "RESTORE", "ttl", "10000", payload)
+	if got := run(t, dt, "PTTL", "ttl"); got.num <= 9000 || got.num > 10000 {
+		t.Errorf("PTTL after RESTORE with 10000 = %d", got.num)
+	}
+
+	// the largest absolute deadline fits
+	if res := run(t, dt, "RESTORE", "abs", "9223372036854775807", payload, "ABSTTL"); res.str != "OK" {
+		t.Errorf("RESTORE ABSTTL with the largest deadline = %s %q", res.typ, res.str)
+	}
+
+	// a deadline that passed already restores nothing
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	if res := run(t, dt, "RESTORE", "gone", past, payload, "ABSTTL"); res.str != "OK" {
+		t.Errorf("RESTORE ABSTTL in the past = %s %q", res.typ, res.str)
+	}
+	if got := run(t, dt, "EXISTS", "gone"); got.num != 0 {
+		t.Errorf("EXISTS of a key restored with a past deadline = %d", got.num)
+	}
+}
+
+// TestRestoreReplay restores with a deadline and checks that the AOF keeps
+// both the value and the deadline.
+func TestRestoreReplay(t *testing.T) {
+	dir := t.TempDir()
+	srv := openServer(t, dir)
+
+	exec(t, srv, "HSET", "src", "f", "v", "g", "w")
+	payload := exec(t, srv, "DUMP", "src").bulk
+	exec(t, srv, "RESTORE", "copy", "100000", payload)
+	exec(t, srv, "RESTORE", "abs", "9223372036854775807", payload, "ABSTTL")
+
+	srv = restart(t, srv, dir,
+		[]string{"HGET", "copy", "g"},
+		[]string{"PEXPIRETIME", "copy"},
+		[]string{"PEXPIRETIME", "abs"},
+	)
+	srv.aof.AofClose()
+}
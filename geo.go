@@ -0,0 +1,458 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Geo indexes are sorted sets whose scores are 52 bit geohashes: longitude
+// and latitude become 26 bit integers which are interleaved, the latitude in
+// the even bits. Places close to each other have close scores, so a search
+// only scans the scores of the geohash box of the center and of the 8 boxes
+// around it. Everything here follows Redis, down to the float operations, so
+// that scores, distances and search results are the same.
+
+const (
+	geoLongMin = -180.0
+	geoLongMax = 180.0
+	geoLatMin = -85.05112878
+	geoLatMax = 85.05112878
+
+	geoStepMax = 26 // steps of the scores, 2 bits each
+
+	earthRadiusInMeters = 6372797.560856
+	mercatorMax = 20037726.37
+)
+
+var errGeoUnit = errors.New("unsupported unit provided. please use M, KM, FT, MI")
+
+// parseGeoUnit returns the number of meters in unit.
+func parseGeoUnit(unit string) (float64, error) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+
+	return 0, errGeoUnit
+}
+
+// geoHashBits is a geohash of step steps, the box of a geohash of n steps
+// contains the 4 boxes of the geohashes of n + 1 steps starting with it.
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+// align52 returns h as a score, the smallest of the scores inside its box.
+func (h geoHashBits) align52() uint64 {
+	return h.bits << (52 - h.step * 2)
+}
+
+type geoRange struct {
+	min, max float64
+}
+
+// geoArea is the box of a geohash.
+type geoArea struct {
+	longitude, latitude geoRange
+}
+
+var (
+	geoLongRange = geoRange{geoLongMin, geoLongMax}
+	geoLatRange = geoRange{geoLatMin, geoLatMax}
+)
+
+func validLongLat(lon float64, lat float64) bool {
+	return lon >= geoLongMin && lon <= geoLongMax && lat >= geoLatMin && lat <= geoLatMax
+}
+
+// interleave64 spreads the bits of x over the even bits of the result and the
+// bits of y over the odd ones.
+func interleave64(x uint32, y uint32) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0f0f0f0f0f0f0f0f, 0x00ff00ff00ff00ff, 0x0000ffff0000ffff}
+	s := [...]uint{1, 2, 4, 8, 16}
+
+	xx, yy := uint64(x), uint64(y)
+	for i := len(b) - 1; i >= 0; i-- {
+		xx = (xx | xx << s[i]) & b[i]
+		yy = (yy | yy << s[i]) & b[i]
+	}
+
+	return xx | yy << 1
+}
+
+// deinterleave64 undoes interleave64, x ends up in the low 32 bits.
+func deinterleave64(interleaved uint64) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0f0f0f0f0f0f0f0f, 0x00ff00ff00ff00ff, 0x0000ffff0000ffff, 0x00000000ffffffff}
+	s := [...]uint{0, 1, 2, 4, 8, 16}
+
+	x, y := interleaved, interleaved >> 1
+	for i := range b {
+		x = (x | x >> s[i]) & b[i]
+		y = (y | y >> s[i]) & b[i]
+	}
+
+	return x | y << 32
+}
+
+// geohashEncode returns the geohash of step steps of a place within the
+// ranges, false if the place is outside of them.
+func geohashEncode(longRange geoRange, latRange geoRange, lon float64, lat float64, step uint) (geoHashBits, bool) {
+	if !validLongLat(lon, lat) || lat < latRange.min || lat > latRange.max || lon < longRange.min || lon > longRange.max {
+		return geoHashBits{}, false
+	}
+
+	latOffset := (lat - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (lon - longRange.min) / (longRange.max - longRange.min)
+
+	// to fixed point
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+
+	return geoHashBits{interleave64(uint32(latOffset), uint32(longOffset)), step}, true
+}
+
+func geohashDecode(longRange geoRange, latRange geoRange, h geoHashBits) geoArea {
+	sep := deinterleave64(h.bits)
+	ilat, ilong := float64(uint32(sep)), float64(sep >> 32)
+	div := float64(uint64(1) << h.step)
+
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+
+	return geoArea{
+		latitude: geoRange{
+			latRange.min + ilat / div * latScale,
+			latRange.min + (ilat + 1) / div * latScale,
+		},
+		longitude: geoRange{
+			longRange.min + ilong / div * longScale,
+			longRange.min + (ilong + 1) / div * longScale,
+		},
+	}
+}
+
+// center returns the longitude and latitude of the center of the box.
+func (a geoArea) center() (float64, float64) {
+	lon := min(max((a.longitude.min + a.longitude.max) / 2, geoLongMin), geoLongMax)
+	lat := min(max((a.latitude.min + a.latitude.max) / 2, geoLatMin), geoLatMax)
+
+	return lon, lat
+}
+
+// geoScore returns the score of a place, which must be valid.
+func geoScore(lon float64, lat float64) float64 {
+	h, _ := geohashEncode(geoLongRange, geoLatRange, lon, lat, geoStepMax)
+	return float64(h.align52())
+}
+
+// geoDecodeScore returns the longitude and latitude of the center of the box
+// of a score, which is where Redis places members.
+func geoDecodeScore(score float64) (float64, float64) {
+	h := geoHashBits{uint64(score), geoStepMax}
+	return geohashDecode(geoLongRange, geoLatRange, h).center()
+}
+
+// geohashString returns the standard 11 characters geohash of a score, the
+// last character is always 0 as scores only have 52 bits.
+func geohashString(score float64) string {
+	const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	lon, lat := geoDecodeScore(score)
+	h, _ := geohashEncode(geoLongRange, geoRange{-90, 90}, lon, lat, geoStepMax)
+
+	var buf [11]byte
+	for i := range buf {
+		idx := uint64(0)
+		if i < 10 {
+			idx = h.bits >> (52 - (i + 1) * 5) & 0x1f
+		}
+		buf[i] = alphabet[idx]
+	}
+
+	return string(buf[:])
+}
+
+// move returns the geohash of the box dx boxes east and dy boxes north,
+// each -1, 0 or 1, wrapping around at the edges.
+func (h geoHashBits) move(dx int, dy int) geoHashBits {
+	x := h.bits & 0xaaaaaaaaaaaaaaaa
+	y := h.bits & 0x5555555555555555
+
+	if dx != 0 {
+		zz := uint64(0x5555555555555555) >> (64 - h.step * 2)
+		if dx > 0 {
+			x = x + (zz + 1)
+		} else {
+			x = x | zz
+			x = x - (zz + 1)
+		}
+		x &= 0xaaaaaaaaaaaaaaaa >> (64 - h.step * 2)
+	}
+
+	if dy != 0 {
+		zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - h.step * 2)
+		if dy > 0 {
+			y = y + (zz + 1)
+		} else {
+			y = y | zz
+			y = y - (zz + 1)
+		}
+		y &= 0x5555555555555555 >> (64 - h.step * 2)
+	}
+
+	return geoHashBits{x | y, h.step}
+}
+
+// geohashEstimateSteps returns the steps of the smallest boxes that, with
+// their neighbors, cover a range of rangeMeters around lat.
+func geohashEstimateSteps(rangeMeters float64, lat float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 // so that the range is covered in most cases
+
+	// boxes get narrower towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	return uint(min(max(step, 1), geoStepMax))
+}
+
+// geoShape is the area of a search: a circle of radius or a box of width by
+// height around lon, lat. Lengths are in the unit of the search, conversion
+// is the number of meters in one.
+type geoShape struct {
+	lon, lat float64
+	byBox bool
+	radius float64
+	width, height float64
+	conversion float64
+}
+
+// boundingBox returns the smallest and largest longitudes and latitudes of
+// the shape.
+func (s *geoShape) boundingBox() (minLon float64, minLat float64, maxLon float64, maxLat float64) {
+	height, width := s.radius, s.radius
+	if s.byBox {
+		height, width = s.height / 2, s.width / 2
+	}
+	height *= s.conversion
+	width *= s.conversion
+
+	latDelta := radDeg(height / earthRadiusInMeters)
+	longDeltaTop := radDeg(width / earthRadiusInMeters / math.Cos(degRad(s.lat + latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusInMeters / math.Cos(degRad(s.lat - latDelta)))
+
+	// the widest edge is the one closer to the equator
+	longDelta := longDeltaTop
+	if s.lat < 0 {
+		longDelta = longDeltaBottom
+	}
+
+	return s.lon - longDelta, s.lat - latDelta, s.lon + longDelta, s.lat + latDelta
+}
+
+// areas returns the geohash boxes to scan for the shape: its center and
+// north, south, east, west, north east, north west, south east and south
+// west, zeroed when they can't contain a match.
+func (s *geoShape) areas() [9]geoHashBits {
+	minLon, minLat, maxLon, maxLat := s.boundingBox()
+
+	// the distance from the center to the farthest point of the shape
+	radiusMeters := s.radius
+	if s.byBox {
+		radiusMeters = math.Sqrt(s.width / 2 * (s.width / 2) + s.height / 2 * (s.height / 2))
+	}
+	radiusMeters *= s.conversion
+
+	steps := geohashEstimateSteps(radiusMeters, s.lat)
+
+	neighbors := func(steps uint) ([9]geoHashBits, geoArea) {
+		h, _ := geohashEncode(geoLongRange, geoLatRange, s.lon, s.lat, steps)
+		return [9]geoHashBits{
+			h,
+			h.move(0, 1),
+			h.move(0, -1),
+			h.move(1, 0),
+			h.move(-1, 0),
+			h.move(1, 1),
+			h.move(-1, 1),
+			h.move(1, -1),
+			h.move(-1, -1),
+		}, geohashDecode(geoLongRange, geoLatRange, h)
+	}
+
+	boxes, area := neighbors(steps)
+
+	// near the edge of its box, the neighbors might not cover the shape
+	north := geohashDecode(geoLongRange, geoLatRange, boxes[1])
+	south := geohashDecode(geoLongRange, geoLatRange, boxes[2])
+	east := geohashDecode(geoLongRange, geoLatRange, boxes[3])
+	west := geohashDecode(geoLongRange, geoLatRange, boxes[4])
+
+	if steps > 1 && (north.latitude.max < maxLat || south.latitude.min > minLat ||
+		east.longitude.max < maxLon || west.longitude.min > minLon) {
+		steps--
+		boxes, area = neighbors(steps)
+	}
+
+	if steps >= 2 {
+		zero := func(i ...int) {
+			for _, j := range i {
+				boxes[j] = geoHashBits{}
+			}
+		}
+
+		if area.latitude.min < minLat {
+			zero(2, 7, 8)
+		}
+		if area.latitude.max > maxLat {
+			zero(1, 5, 6)
+		}
+		if area.longitude.min < minLon {
+			zero(4, 6, 8)
+		}
+		if area.longitude.max > maxLon {
+			zero(3, 5, 7)
+		}
+	}
+
+	return boxes
+}
+
+// contains returns the distance in meters to a place if it is inside the
+// shape.
+func (s *geoShape) contains(lon float64, lat float64) (float64, bool) {
+	if !s.byBox {
+		dist := geoDistance(s.lon, s.lat, lon, lat)
+		return dist, dist <= s.radius * s.conversion
+	}
+
+	// the latitude distance is cheaper, so it goes first
+	if geoLatDistance(lat, s.lat) > s.height * s.conversion / 2 {
+		return 0, false
+	}
+
+	if geoDistance(lon, lat, s.lon, lat) > s.width * s.conversion / 2 {
+		return 0, false
+	}
+
+	return geoDistance(s.lon, s.lat, lon, lat), true
+}
+
+// geoPoint is a member found by a search, dist is in meters.
+type geoPoint struct {
+	member string
+	score float64
+	lon, lat float64
+	dist float64
+}
+
+// geoSearch returns the members of z inside shape, stopping after limit of
+// them unless limit is 0.
+func geoSearch(z *ZSet, shape *geoShape, limit int) []geoPoint {
+	var points []geoPoint
+
+	boxes := shape.areas()
+	last := 0
+	for i, box := range boxes {
+		if box.isZero() {
+			continue
+		}
+
+		// with huge shapes neighbors can be the same box
+		if last != 0 && box == boxes[last] {
+			continue
+		}
+
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+
+		next := box
+		next.bits++
+		spec := &zscoreRange{min: float64(box.align52()), max: float64(next.align52()), maxex: true}
+
+		for _, node := range z.RangeBySpec(spec, false, 0, -1) {
+			lon, lat := geoDecodeScore(node.score)
+			if dist, ok := shape.contains(lon, lat); ok {
+				points = append(points, geoPoint{node.member, node.score, lon, lat, dist})
+				if limit > 0 && len(points) >= limit {
+					break
+				}
+			}
+		}
+
+		last = i
+	}
+
+	return points
+}
+
+func degRad(deg float64) float64 {
+	return deg * (math.Pi / 180)
+}
+
+func radDeg(rad float64) float64 {
+	return rad / (math.Pi / 180)
+}
+
+// geoLatDistance returns the distance in meters between two latitudes on a
+// meridian.
+func geoLatDistance(lat1 float64, lat2 float64) float64 {
+	return earthRadiusInMeters * math.Abs(degRad(lat2) - degRad(lat1))
+}
+
+// geoDistance returns the distance in meters between two places with the
+// haversine formula.
+func geoDistance(lon1 float64, lat1 float64, lon2 float64, lat2 float64) float64 {
+	v := math.Sin((degRad(lon2) - degRad(lon1)) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u * u + math.Cos(lat1r) * math.Cos(lat2r) * v * v
+
+	return 2 * earthRadiusInMeters * math.Asin(math.Sqrt(a))
+}
+
+// formatGeoDistance formats a distance with 4 decimals like Redis.
+func formatGeoDistance(dist float64) string {
+	return strconv.FormatFloat(dist, 'f', 4, 64)
+}
+
+// formatGeoCoord formats a coordinate with up to 17 decimals like Redis.
+func formatGeoCoord(coord float64) string {
+	s := strings.TrimRight(strconv.FormatFloat(coord, 'f', 17, 64), "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+
+	return s
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// sicily is the example of the Redis documentation of the geo commands.
+func sicily(t *testing.T) *DataType {
+	t.Helper()
+
+	dt := createDT()
+	run(t, dt, "GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+
+	return dt
+}
+
+func TestGeoDocumentedValues(t *testing.T) {
+	dt := sicily(t)
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"Palermo", "Catania"}, "166274.1516"},
+		{[]string{"Palermo", "Catania", "km"}, "166.2742"},
+		{[]string{"Palermo", "Catania", "mi"}, "103.3182"},
+	} {
+		args := append([]string{"Sicily"}, tc.args...)
+		if got := run(t, dt, "GEODIST", args...); got.bulk != tc.want {
+			t.Errorf("GEODIST %v = %q, want %q", tc.args, got.bulk, tc.want)
+		}
+	}
+
+	if got := run(t, dt, "GEODIST", "Sicily", "Palermo", "Agrigento"); got.typ != "null" {
+		t.Errorf("GEODIST with a missing member = %s, want null", got.typ)
+	}
+
+	hashes := run(t, dt, "GEOHASH", "Sicily", "Palermo", "Catania")
+	for i, want := range []string{"sqc8b49rny0", "sqdtr74hyu0"} {
+		if got := hashes.array[i].bulk; got != want {
+			t.Errorf("GEOHASH %d = %q, want %q", i, got, want)
+		}
+	}
+
+	pos := run(t, dt, "GEOPOS", "Sicily", "Palermo", "Catania", "NonExisting")
+	for i, want := range [][2]float64{
+		{13.36138933897018433, 38.11555639549629859},
+		{15.08726745843887329, 37.50266842333162032},
+	} {
+		lon, lat := geoTestCoord(t, pos.array[i])
+		if math.Abs(lon - want[0]) > 1e-12 || math.Abs(lat - want[1]) > 1e-12 {
+			t.Errorf("GEOPOS %d = %v, %v, want %v", i, lon, lat, want)
+		}
+	}
+	if pos.array[2].typ != "null" {
+		t.Errorf("GEOPOS of a missing member = %s, want null", pos.array[2].typ)
+	}
+}
+
+func TestGeoSearchDocumentedValues(t *testing.T) {
+	dt := sicily(t)
+	run(t, dt, "GEOADD", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2")
+
+	for _, tc := range []struct {
+		args []string
+		want [][2]string
+	}{
+		{
+			[]string{"FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC", "WITHDIST"},
+			[][2]string{{"Catania", "56.4413"}, {"Palermo", "190.4424"}},
+		},
+		{
+			[]string{"FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHDIST"},
+			[][2]string{{"Catania", "56.4413"}, {"Palermo", "190.4424"}, {"edge2", "279.7403"}, {"edge1", "279.7405"}},
+		},
+	} {
+		res := run(t, dt, "GEOSEARCH", append([]string{"Sicily"}, tc.args...)...)
+
+		var got [][2]string
+		for _, item := range res.array {
+			got = append(got, [2]string{item.array[0].bulk, item.array[1].bulk})
+		}
+
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("GEOSEARCH %v = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
+
+// TestGeoSearchBruteForce checks that the geohash boxes searched never miss a
+// member, by comparing GEOSEARCH with a filter going through every member.
+func TestGeoSearchBruteForce(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for round := 0; round < 200; round++ {
+		dt := createDT()
+
+		// members scattered around a center, some of them far away. A
+		// longitude of exactly 180 makes a score past 52 bits, in Redis too,
+		// so they stay just short of it.
+		lon := rnd.Float64() * 360 - 180
+		lat := rnd.Float64() * 160 - 80
+		spread := []float64{0.1, 1, 10, 60}[rnd.Intn(4)]
+
+		for i := 0; i < 200; i++ {
+			mlon := math.Max(-179.99, math.Min(179.99, lon + (rnd.Float64() * 2 - 1) * spread))
+			mlat := math.Max(-85, math.Min(85, lat + (rnd.Float64() * 2 - 1) * spread))
+			run(t, dt, "GEOADD", "k", geoTestFloat(mlon), geoTestFloat(mlat), "m" + strconv.Itoa(i))
+		}
+
+		members := map[string][2]float64{}
+		for i := 0; i < 200; i++ {
+			member := "m" + strconv.Itoa(i)
+			pos := run(t, dt, "GEOPOS", "k", member)
+			mlon, mlat := geoTestCoord(t, pos.array[0])
+			members[member] = [2]float64{mlon, mlat}
+		}
+
+		// meters from the spread in degrees, so that searches find some
+		// members but not all of them
+		size := spread * 111000 * (rnd.Float64() + 0.1)
+
+		byBox := rnd.Intn(2) == 0
+		var args []string
+		var inside func(mlon, mlat float64) (bool, float64)
+		if byBox {
+			width, height := size * (rnd.Float64() + 0.5), size * (rnd.Float64() + 0.5)
+			args = []string{"BYBOX", geoTestFloat(width), geoTestFloat(height), "m"}
+			inside = func(mlon, mlat float64) (bool, float64) {
+				dy := geoTestHaversine(lon, lat, lon, mlat) - height / 2
+				dx := geoTestHaversine(lon, mlat, mlon, mlat) - width / 2
+				return dx <= 0 && dy <= 0, math.Max(dx, dy)
+			}
+		} else {
+			args = []string{"BYRADIUS", geoTestFloat(size), "m"}
+			inside = func(mlon, mlat float64) (bool, float64) {
+				d := geoTestHaversine(lon, lat, mlon, mlat) - size
+				return d <= 0, d
+			}
+		}
+
+		res := run(t, dt, "GEOSEARCH", append([]string{"k", "FROMLONLAT", geoTestFloat(lon), geoTestFloat(lat)}, args...)...)
+		if res.typ != "array" {
+			t.Fatalf("GEOSEARCH %v %v %v: %s %s", lon, lat, args, res.typ, res.str)
+		}
+
+		found := map[string]bool{}
+		for _, v := range res.array {
+			found[v.bulk] = true
+		}
+
+		for member, pos := range members {
+			want, margin := inside(pos[0], pos[1])
+
+			// a few millimeters from the edge rounding may go either way
+			if math.Abs(margin) < 0.01 {
+				continue
+			}
+
+			if found[member] != want {
+				t.Errorf("GEOSEARCH FROMLONLAT %v %v %v: %s at %v, %v found %v, want %v",
+					lon, lat, args, member, pos[0], pos[1], found[member], want)
+			}
+		}
+	}
+}
+
+// geoTestHaversine is the distance in meters between two places, written
+// out again so that the searches are not checked against themselves.
+func geoTestHaversine(lon1, lat1, lon2, lat2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat / 2) * math.Sin(dlat / 2) +
+		math.Cos(lat1 * rad) * math.Cos(lat2 * rad) * math.Sin(dlon / 2) * math.Sin(dlon / 2)
+
+	return 2 * 6372797.560856 * math.Asin(math.Sqrt(a))
+}
+
+func geoTestFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func geoTestCoord(t *testing.T, v Value) (float64, float64) {
+	t.Helper()
+
+	if len(v.array) != 2 {
+		t.Fatalf("not a position: %s %v", v.typ, v.array)
+	}
+
+	lon, err1 := strconv.ParseFloat(v.array[0].bulk, 64)
+	lat, err2 := strconv.ParseFloat(v.array[1].bulk, 64)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("not a position: %q %q", v.array[0].bulk, v.array[1].bulk)
+	}
+
+	return lon, lat
+}
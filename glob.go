@@ -0,0 +1,113 @@
+package main
+
+// globMatch reports whether str matches pattern, a glob-style pattern with
+// the syntax of Redis:
+//
+//	*        any sequence of characters, including none
+//	?        any single character
+//	[abc]    one of the characters in the brackets
+//	[^abc]   any character but those in the brackets
+//	[a-z]    a character in a range, which can be mixed with the above
+//	\x       the character x itself
+//
+// Patterns work on bytes, like keys do. A bracket missing its closing ]
+// ends with the pattern.
+//
+// On a mismatch the matcher only goes back to the last *, which then takes
+// one more character: whatever an earlier * would match instead, the last
+// one can match too. That keeps it at len(pattern) * len(str) steps at worst
+// rather than exponential in the number of *.
+func globMatch(pattern string, str string) bool {
+	// where to resume after the last *, none yet if starPattern is -1
+	starPattern, starStr := -1, 0
+
+	p, s := 0, 0
+	for s < len(str) || p < len(pattern) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+
+				if p == len(pattern) {
+					return true
+				}
+
+				starPattern, starStr = p, s
+				continue
+			case '?':
+				if s < len(str) {
+					p++
+					s++
+					continue
+				}
+			case '[':
+				if s < len(str) {
+					ok, rest := globBracket(pattern[p + 1:], str[s])
+					if ok {
+						p = len(pattern) - len(rest)
+						s++
+						continue
+					}
+				}
+			default:
+				c := p
+				if pattern[c] == '\\' && c + 1 < len(pattern) {
+					c++
+				}
+
+				if s < len(str) && pattern[c] == str[s] {
+					p = c + 1
+					s++
+					continue
+				}
+			}
+		}
+
+		// mismatch, let the last * take one more character
+		if starPattern == -1 || starStr == len(str) {
+			return false
+		}
+
+		starStr++
+		p, s = starPattern, starStr
+	}
+
+	return true
+}
+
+// globBracket matches c against the bracket expression at the start of
+// pattern, right after the [, and returns the pattern past its ].
+func globBracket(pattern string, c byte) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			pattern = pattern[1:]
+			match = match || pattern[0] == c
+		case len(pattern) > 2 && pattern[1] == '-':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || c >= lo && c <= hi
+			pattern = pattern[2:]
+		default:
+			match = match || pattern[0] == c
+		}
+
+		pattern = pattern[1:]
+	}
+
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+
+	return match != not, pattern
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, str string
+		want bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello!", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"[\\]]", "]", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYcZ", false},
+		{"*a", "ba", true},
+		{"*a", "ab", false},
+		{"a**", "abc", true},
+		{"user:*:name", "user:1:2:name", true},
+		{"[abc", "a", true},
+		{"\\", "\\", true},
+	} {
+		if got := globMatch(tc.pattern, tc.str); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tc.pattern, tc.str, got, tc.want)
+		}
+	}
+}
+
+// TestGlobMatchManyStars would take hours if each * tried every split of
+// the rest of the string.
+func TestGlobMatchManyStars(t *testing.T) {
+	start := time.Now()
+
+	pattern := strings.Repeat("*a", 20) + "*b"
+	if globMatch(pattern, strings.Repeat("a", 40)) {
+		t.Error("matched a string without b")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+}
+
+// globMatchSlow is the obvious recursive matcher, exponential but simple
+// enough to check globMatch against.
+func globMatchSlow(pattern string, str string) bool {
+	if pattern == "" {
+		return str == ""
+	}
+
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(str); i++ {
+			if globMatchSlow(pattern[1:], str[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return str != "" && globMatchSlow(pattern[1:], str[1:])
+	case '[':
+		if str == "" {
+			return false
+		}
+		ok, rest := globBracket(pattern[1:], str[0])
+		return ok && globMatchSlow(rest, str[1:])
+	}
+
+	if pattern[0] == '\\' && len(pattern) > 1 {
+		pattern = pattern[1:]
+	}
+
+	return str != "" && pattern[0] == str[0] && globMatchSlow(pattern[1:], str[1:])
+}
+
+func TestGlobMatchRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	random := func(alphabet string, n int) string {
+		b := make([]byte, rnd.Intn(n + 1))
+		for i := range b {
+			b[i] = alphabet[rnd.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 100000; i++ {
+		pattern := random("ab*?[]^-\\", 8)
+		str := random("ab-]", 8)
+
+		if got, want := globMatch(pattern, str), globMatchSlow(pattern, str); got != want {
+			t.Fatalf("globMatch(%q, %q) = %v, want %v", pattern, str, got, want)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/Z1TK/redis-golang
+
+go 1.23
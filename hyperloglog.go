@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+)
+
+// HyperLogLogs are strings laid out like in Redis:
+//
+//	"HYLL" | encoding (1 byte) | unused (3 bytes) | cardinality (8 bytes) | registers
+//
+// The cardinality is a cache of the last estimate, little endian, invalid
+// while the most significant bit of its last byte is set. The registers are
+// either dense, 6 bits each packed least significant bit first, or sparse, a
+// run length encoding of them made of three opcodes:
+//
+//	00xxxxxx           xxxxxx+1 registers set to 0
+//	01xxxxxx yyyyyyyy  xxxxxxyyyyyyyy+1 registers set to 0
+//	1vvvvvxx           xx+1 registers set to vvvvv+1
+//
+// A sparse HyperLogLog becomes dense once a register doesn't fit in an
+// opcode or its encoding grows past hllSparseMaxBytes.
+const (
+	hllP = 14 // bits of the hash used to pick a register
+	hllQ = 64 - hllP
+	hllRegisters = 1 << hllP
+	hllPMask = hllRegisters - 1
+	hllBits = 6
+	hllRegisterMax = 1 << hllBits - 1
+
+	hllHdrSize = 16
+	hllDenseSize = hllHdrSize + (hllRegisters * hllBits + 7) / 8
+
+	hllDense = 0
+	hllSparse = 1
+
+	hllSparseMaxBytes = 3000
+	hllSparseValMaxValue = 32
+	hllSparseValMaxLen = 4
+	hllSparseZeroMaxLen = 64
+	hllSparseXZeroMaxLen = 16384
+
+	hllAlphaInf = 0.721347520444481703680 // 0.5 / ln(2)
+)
+
+var (
+	errHLLInvalid = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	errHLLCorrupted = errors.New("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// hllRun is a run of n registers set to val.
+type hllRun struct {
+	val uint8
+	n int
+}
+
+// HLL is a decoded HyperLogLog, sparse ones are kept as runs of registers.
+type HLL struct {
+	sparse bool
+	runs []hllRun // if sparse
+	regs []uint8 // hllRegisters of them if dense
+	card [8]byte // the cardinality cache as stored
+}
+
+func newHLL() *HLL {
+	return &HLL{sparse: true, runs: []hllRun{{0, hllRegisters}}}
+}
+
+// parseHLL decodes a HyperLogLog string.
+func parseHLL(data string) (*HLL, error) {
+	if len(data) < hllHdrSize || data[:4] != "HYLL" || data[4] > hllSparse {
+		return nil, errHLLInvalid
+	}
+
+	h := &HLL{sparse: data[4] == hllSparse}
+	copy(h.card[:], data[8:hllHdrSize])
+
+	if !h.sparse {
+		if len(data) != hllDenseSize {
+			return nil, errHLLInvalid
+		}
+
+		h.regs = make([]uint8, hllRegisters)
+		for i := range h.regs {
+			h.regs[i] = denseRegister(data[hllHdrSize:], i)
+		}
+
+		return h, nil
+	}
+
+	total := 0
+	for p := hllHdrSize; p < len(data); {
+		run := hllRun{}
+
+		switch op := data[p]; op & 0xc0 {
+		case 0x00: // ZERO
+			run.n = int(op & 0x3f) + 1
+			p++
+		case 0x40: // XZERO
+			if p + 1 == len(data) {
+				return nil, errHLLCorrupted
+			}
+			run.n = (int(op & 0x3f) << 8 | int(data[p + 1])) + 1
+			p += 2
+		default: // VAL
+			run.val = (op >> 2 & 0x1f) + 1
+			run.n = int(op & 0x3) + 1
+			p++
+		}
+
+		total += run.n
+		if total > hllRegisters {
+			return nil, errHLLCorrupted
+		}
+		h.runs = append(h.runs, run)
+	}
+
+	if total != hllRegisters {
+		return nil, errHLLCorrupted
+	}
+
+	return h, nil
+}
+
+func denseRegister(regs string, i int) uint8 {
+	b, fb := i * hllBits / 8, uint(i * hllBits & 7)
+
+	b0, b1 := regs[b], byte(0)
+	if b + 1 < len(regs) {
+		b1 = regs[b + 1]
+	}
+
+	return (b0 >> fb | b1 << (8 - fb)) & hllRegisterMax
+}
+
+func setDenseRegister(regs []byte, i int, val uint8) {
+	b, fb := i * hllBits / 8, uint(i * hllBits & 7)
+
+	regs[b] &^= hllRegisterMax << fb
+	regs[b] |= val << fb
+
+	if b + 1 < len(regs) {
+		regs[b + 1] &^= hllRegisterMax >> (8 - fb)
+		regs[b + 1] |= val >> (8 - fb)
+	}
+}
+
+// String encodes h, turning it dense first if the sparse encoding is too
+// large.
+func (h *HLL) String() string {
+	buf := make([]byte, hllHdrSize, hllDenseSize)
+	copy(buf, "HYLL")
+	copy(buf[8:], h.card[:])
+
+	if h.sparse {
+		buf[4] = hllSparse
+		buf = appendSparse(buf, h.runs)
+		if len(buf) - hllHdrSize <= hllSparseMaxBytes {
+			return string(buf)
+		}
+
+		h.toDense()
+		buf = buf[:hllHdrSize]
+	}
+
+	buf[4] = hllDense
+	buf = buf[:hllDenseSize]
+	for i, val := range h.regs {
+		setDenseRegister(buf[hllHdrSize:], i, val)
+	}
+
+	return string(buf)
+}
+
+// appendSparse appends the opcodes for runs, merging runs of the same value.
+func appendSparse(buf []byte, runs []hllRun) []byte {
+	for i := 0; i < len(runs); {
+		val, n := runs[i].val, runs[i].n
+		for i++; i < len(runs) && runs[i].val == val; i++ {
+			n += runs[i].n
+		}
+
+		for n > 0 {
+			switch {
+			case val > 0:
+				l := min(n, hllSparseValMaxLen)
+				buf = append(buf, 0x80 | (val - 1) << 2 | byte(l - 1))
+				n -= l
+			case n > hllSparseZeroMaxLen:
+				l := min(n, hllSparseXZeroMaxLen)
+				buf = append(buf, 0x40 | byte((l - 1) >> 8), byte(l - 1))
+				n -= l
+			default:
+				buf = append(buf, byte(n - 1))
+				n = 0
+			}
+		}
+	}
+
+	return buf
+}
+
+func (h *HLL) toDense() {
+	h.regs = h.registers()
+	h.sparse, h.runs = false, nil
+}
+
+// registers returns the value of every register.
+func (h *HLL) registers() []uint8 {
+	if !h.sparse {
+		return h.regs
+	}
+
+	regs := make([]uint8, 0, hllRegisters)
+	for _, run := range h.runs {
+		for i := 0; i < run.n; i++ {
+			regs = append(regs, run.val)
+		}
+	}
+
+	return regs
+}
+
+// hllFromRegisters returns a HyperLogLog with registers regs, sparse unless
+// dense is set or a register is too large for the sparse encoding.
+func hllFromRegisters(regs []uint8, dense bool) *HLL {
+	h := &HLL{regs: regs}
+
+	if dense || slices.Max(regs) > hllSparseValMaxValue {
+		return h
+	}
+
+	h.sparse, h.regs = true, nil
+	for i := 0; i < len(regs); {
+		j := i + 1
+		for j < len(regs) && regs[j] == regs[i] {
+			j++
+		}
+
+		h.runs = append(h.runs, hllRun{regs[i], j - i})
+		i = j
+	}
+
+	return h
+}
+
+// Add adds element and reports whether a register changed.
+func (h *HLL) Add(element string) bool {
+	hash := murmurHash64A([]byte(element), 0xadc83b19)
+
+	index := int(hash & hllPMask)
+
+	// the position of the first set bit after the index bits, the bit set
+	// past hllQ makes sure there is one
+	hash >>= hllP
+	hash |= 1 << hllQ
+	count := uint8(1)
+	for bit := uint64(1); hash & bit == 0; bit <<= 1 {
+		count++
+	}
+
+	return h.set(index, count)
+}
+
+// set raises register index to count and reports whether it was lower.
+func (h *HLL) set(index int, count uint8) bool {
+	if h.sparse && count > hllSparseValMaxValue {
+		h.toDense()
+	}
+
+	if !h.sparse {
+		if h.regs[index] >= count {
+			return false
+		}
+
+		h.regs[index] = count
+		return true
+	}
+
+	first := 0
+	for i, run := range h.runs {
+		if index >= first + run.n {
+			first += run.n
+			continue
+		}
+
+		if run.val >= count {
+			return false
+		}
+
+		// split the run around the register
+		var repl []hllRun
+		if index > first {
+			repl = append(repl, hllRun{run.val, index - first})
+		}
+		repl = append(repl, hllRun{count, 1})
+		if after := first + run.n - index - 1; after > 0 {
+			repl = append(repl, hllRun{run.val, after})
+		}
+
+		h.runs = slices.Replace(h.runs, i, i + 1, repl...)
+		return true
+	}
+
+	return false
+}
+
+// Merge raises every register of regs to the one of h where it is lower.
+func (h *HLL) Merge(regs []uint8) {
+	for i, val := range h.registers() {
+		regs[i] = max(regs[i], val)
+	}
+}
+
+// CachedCount returns the cached cardinality, false if it is not valid.
+func (h *HLL) CachedCount() (uint64, bool) {
+	if h.card[7] & 0x80 != 0 {
+		return 0, false
+	}
+
+	return binary.LittleEndian.Uint64(h.card[:]), true
+}
+
+func (h *HLL) SetCachedCount(n uint64) {
+	binary.LittleEndian.PutUint64(h.card[:], n)
+}
+
+func (h *HLL) InvalidateCache() {
+	h.card[7] |= 0x80
+}
+
+// Count estimates the cardinality.
+func (h *HLL) Count() uint64 {
+	return hllCount(h.registers())
+}
+
+// hllCount estimates the cardinality from the registers with the method of
+// "New cardinality estimation algorithms for HyperLogLog sketches" by Otmar
+// Ertl, like Redis does.
+func hllCount(regs []uint8) uint64 {
+	var histo [hllQ + 2]int
+	for _, val := range regs {
+		histo[val]++
+	}
+
+	m := float64(hllRegisters)
+
+	z := m * hllTau((m - float64(histo[hllQ + 1])) / m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0]) / m)
+
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y, z := 1.0, 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+// murmurHash64A is the 64 bit MurmurHash2 by Austin Appleby, which Redis
+// uses to hash HyperLogLog elements.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(key)) * m
+
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// JSON documents are trees of these values, like in RedisJSON objects keep
+// the order of their keys and integers are kept apart from other numbers:
+//
+//	null     nil
+//	boolean  bool
+//	integer  int64
+//	number   float64
+//	string   string
+//	object   *JSONObject
+//	array    *JSONArray
+type JSONDoc struct {
+	Root any
+}
+
+type JSONObject struct {
+	keys []string
+	values map[string]any
+}
+
+type JSONArray struct {
+	items []any
+}
+
+func newJSONObject() *JSONObject {
+	return &JSONObject{values: make(map[string]any)}
+}
+
+func (o *JSONObject) Get(key string) (any, bool) {
+	v, exist := o.values[key]
+	return v, exist
+}
+
+// Set sets the value of key, a new key goes after the others.
+func (o *JSONObject) Set(key string, v any) {
+	if _, exist := o.values[key]; !exist {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+func (o *JSONObject) Delete(key string) bool {
+	if _, exist := o.values[key]; !exist {
+		return false
+	}
+
+	delete(o.values, key)
+	o.keys = slices.DeleteFunc(o.keys, func(k string) bool {
+		return k == key
+	})
+
+	return true
+}
+
+// jsonMaxDepth is how deep containers can be nested, same as RedisJSON.
+const jsonMaxDepth = 128
+
+// parseJSON parses a document.
+func parseJSON(data string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+
+	v, err := decodeJSON(dec, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing characters after the JSON value")
+	}
+
+	return v, nil
+}
+
+func decodeJSON(dec *json.Decoder, depth int) (any, error) {
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil, errors.New("unexpected end of JSON input")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		if depth == jsonMaxDepth {
+			return nil, errors.New("JSON nesting too deep")
+		}
+
+		var v any
+		if t == '{' {
+			obj := newJSONObject()
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+
+				val, err := decodeJSON(dec, depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				obj.Set(key.(string), val)
+			}
+			v = obj
+		} else {
+			arr := &JSONArray{}
+			for dec.More() {
+				val, err := decodeJSON(dec, depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				arr.items = append(arr.items, val)
+			}
+			v = arr
+		}
+
+		// the closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+
+		return v, nil
+	case json.Number:
+		return parseJSONNumber(t.String())
+	}
+
+	// string, bool or nil
+	return tok, nil
+}
+
+// parseJSONNumber returns an int64 for an integer that fits, a float64
+// otherwise.
+func parseJSONNumber(s string) (any, error) {
+	if !strings.ContainsAny(s, ".eE") {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("number out of range: %s", s)
+	}
+
+	return f, nil
+}
+
+// jsonFormat is how JSON.GET lays out a document, compact when empty.
+type jsonFormat struct {
+	indent, newline, space string
+}
+
+func (f *jsonFormat) appendJSON(buf []byte, v any, level int) []byte {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, "null"...)
+	case bool:
+		return strconv.AppendBool(buf, val)
+	case int64:
+		return strconv.AppendInt(buf, val, 10)
+	case float64:
+		return append(buf, formatJSONFloat(val)...)
+	case string:
+		return appendJSONString(buf, val)
+	case *JSONObject:
+		if len(val.keys) == 0 {
+			return append(buf, "{}"...)
+		}
+
+		buf = append(buf, '{')
+		for i, key := range val.keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = f.appendLine(buf, level + 1)
+			buf = appendJSONString(buf, key)
+			buf = append(buf, ':')
+			buf = append(buf, f.space...)
+			buf = f.appendJSON(buf, val.values[key], level + 1)
+		}
+		buf = f.appendLine(buf, level)
+
+		return append(buf, '}')
+	case *JSONArray:
+		if len(val.items) == 0 {
+			return append(buf, "[]"...)
+		}
+
+		buf = append(buf, '[')
+		for i, item := range val.items {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = f.appendLine(buf, level + 1)
+			buf = f.appendJSON(buf, item, level + 1)
+		}
+		buf = f.appendLine(buf, level)
+
+		return append(buf, ']')
+	}
+
+	return buf
+}
+
+func (f *jsonFormat) appendLine(buf []byte, level int) []byte {
+	buf = append(buf, f.newline...)
+	for i := 0; i < level; i++ {
+		buf = append(buf, f.indent...)
+	}
+
+	return buf
+}
+
+func formatJSON(v any) string {
+	return string((&jsonFormat{}).appendJSON(nil, v, 0))
+}
+
+// appendJSONString quotes s, escaping only what JSON requires.
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			buf = append(buf, '\\', c)
+		case '\b':
+			buf = append(buf, '\\', 'b')
+		case '\f':
+			buf = append(buf, '\\', 'f')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default:
+			if c < 0x20 {
+				buf = append(buf, '\\', 'u', '0', '0', hex[c >> 4], hex[c & 0xf])
+			} else {
+				buf = append(buf, c)
+			}
+		}
+	}
+
+	return append(buf, '"')
+}
+
+// formatJSONFloat formats f in its shortest form the way RedisJSON does:
+// always with a fraction or an exponent so that it reads back as a float,
+// and with an exponent only for very large or small numbers.
+func formatJSONFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'e', -1, 64)
+
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+
+	mantissa, exp, _ := strings.Cut(s, "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	e, _ := strconv.Atoi(exp)
+
+	// f is digits * 10^k, with 10^(kk - 1) <= f < 10^kk
+	length := len(digits)
+	k := e - length + 1
+	kk := length + k
+
+	switch {
+	case k >= 0 && kk <= 16:
+		return sign + digits + strings.Repeat("0", k) + ".0"
+	case kk > 0 && kk <= 16:
+		return sign + digits[:kk] + "." + digits[kk:]
+	case kk > -5 && kk <= 0:
+		return sign + "0." + strings.Repeat("0", -kk) + digits
+	case length == 1:
+		return sign + digits + "e" + strconv.Itoa(kk - 1)
+	}
+
+	return sign + digits[:1] + "." + digits[1:] + "e" + strconv.Itoa(kk - 1)
+}
+
+// jsonTypeName returns the type of v as reported by JSON.TYPE.
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *JSONObject:
+		return "object"
+	}
+
+	return "array"
+}
+
+func jsonClone(v any) any {
+	switch val := v.(type) {
+	case *JSONObject:
+		c := &JSONObject{keys: slices.Clone(val.keys), values: make(map[string]any, len(val.values))}
+		for key, item := range val.values {
+			c.values[key] = jsonClone(item)
+		}
+		return c
+	case *JSONArray:
+		c := &JSONArray{items: make([]any, len(val.items))}
+		for i, item := range val.items {
+			c.items[i] = jsonClone(item)
+		}
+		return c
+	}
+
+	return v
+}
+
+func (d *JSONDoc) clone() *JSONDoc {
+	return &JSONDoc{Root: jsonClone(d.Root)}
+}
+
+// jsonPath is a parsed path. JSONPaths start with "$" and match any number
+// of values. Legacy paths, "." or anything else, stand for the first value
+// they match. The supported subset is made of these segments:
+//
+//	.name ['name'] ["name"]  a member of an object
+//	[n]                      an element of an array, from the end if negative
+//	[a,b,...]                several of the above
+//	.* [*]                   every member or element
+//	..                       before any of the above, searches every level
+type jsonPath struct {
+	text string
+	legacy bool
+	segments []jsonSegment
+}
+
+type jsonSegment struct {
+	recursive bool
+	wildcard bool
+	keys []string
+	indexes []int
+}
+
+func parseJSONPath(s string) (*jsonPath, error) {
+	p := &jsonPath{text: s}
+	errPath := fmt.Errorf("invalid JSON path '%s'", s)
+
+	rest := s
+	switch {
+	case strings.HasPrefix(s, "$"):
+		rest = s[1:]
+	case s == ".":
+		p.legacy = true
+		return p, nil
+	default:
+		p.legacy = true
+		if !strings.HasPrefix(s, ".") && !strings.HasPrefix(s, "[") {
+			rest = "." + s
+		}
+	}
+
+	for rest != "" {
+		seg := jsonSegment{}
+
+		dotted := false
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			seg.recursive = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			dotted = true
+			rest = rest[1:]
+		case rest[0] != '[':
+			return nil, errPath
+		}
+
+		if rest == "" || dotted && rest[0] == '[' {
+			return nil, errPath
+		}
+
+		if rest[0] == '[' {
+			end, err := parseJSONBracket(rest, &seg)
+			if err != nil {
+				return nil, errPath
+			}
+			rest = rest[end:]
+		} else if rest[0] == '*' {
+			seg.wildcard = true
+			rest = rest[1:]
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			seg.keys = []string{rest[:end]}
+			rest = rest[end:]
+		}
+
+		p.segments = append(p.segments, seg)
+	}
+
+	return p, nil
+}
+
+// parseJSONBracket parses the "[...]" selector at the start of s into seg and
+// returns its length.
+func parseJSONBracket(s string, seg *jsonSegment) (int, error) {
+	errSelector := errors.New("invalid selector")
+
+	i := 1
+	for {
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i == len(s) {
+			return 0, errSelector
+		}
+
+		switch c := s[i]; {
+		case c == '*' && !seg.wildcard && len(seg.keys) == 0 && len(seg.indexes) == 0:
+			seg.wildcard = true
+			i++
+		case c == '\'' || c == '"':
+			key, n, err := parseJSONPathString(s[i:])
+			if err != nil {
+				return 0, err
+			}
+			seg.keys = append(seg.keys, key)
+			i += n
+		default:
+			j := i
+			for j < len(s) && (s[j] == '-' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+
+			index, err := strconv.Atoi(s[i:j])
+			if err != nil {
+				return 0, errSelector
+			}
+			seg.indexes = append(seg.indexes, index)
+			i = j
+		}
+
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i == len(s) {
+			return 0, errSelector
+		}
+
+		if s[i] == ']' {
+			if seg.wildcard && (len(seg.keys) > 0 || len(seg.indexes) > 0) {
+				return 0, errSelector
+			}
+			return i + 1, nil
+		}
+
+		if s[i] != ',' {
+			return 0, errSelector
+		}
+		i++
+	}
+}
+
+// parseJSONPathString parses the quoted key at the start of s, in which a
+// backslash escapes the next character, and returns it with its length.
+func parseJSONPathString(s string) (string, int, error) {
+	quote := s[0]
+
+	var key []byte
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i + 1 == len(s) {
+				return "", 0, errors.New("unterminated string")
+			}
+			i++
+			key = append(key, s[i])
+		case quote:
+			return string(key), i + 1, nil
+		default:
+			key = append(key, s[i])
+		}
+	}
+
+	return "", 0, errors.New("unterminated string")
+}
+
+// jsonNode is a value matched by a path and where it is, so that it can be
+// replaced or deleted. The root has no parent.
+type jsonNode struct {
+	value any
+	parent any // *JSONObject or *JSONArray
+	key string
+	index int
+}
+
+// children returns the members or elements of n selected by seg.
+func (seg *jsonSegment) children(n jsonNode) []jsonNode {
+	var res []jsonNode
+
+	switch val := n.value.(type) {
+	case *JSONObject:
+		if seg.wildcard {
+			for _, key := range val.keys {
+				res = append(res, jsonNode{value: val.values[key], parent: val, key: key})
+			}
+		}
+
+		for _, key := range seg.keys {
+			if v, exist := val.values[key]; exist {
+				res = append(res, jsonNode{value: v, parent: val, key: key})
+			}
+		}
+	case *JSONArray:
+		if seg.wildcard {
+			for i, item := range val.items {
+				res = append(res, jsonNode{value: item, parent: val, index: i})
+			}
+		}
+
+		for _, i := range seg.indexes {
+			if i < 0 {
+				i += len(val.items)
+			}
+
+			if i >= 0 && i < len(val.items) {
+				res = append(res, jsonNode{value: val.items[i], parent: val, index: i})
+			}
+		}
+	}
+
+	return res
+}
+
+// descendants appends n and every value below it, parents first.
+func (n jsonNode) descendants(res []jsonNode) []jsonNode {
+	res = append(res, n)
+
+	switch val := n.value.(type) {
+	case *JSONObject:
+		for _, key := range val.keys {
+			res = jsonNode{value: val.values[key], parent: val, key: key}.descendants(res)
+		}
+	case *JSONArray:
+		for i, item := range val.items {
+			res = jsonNode{value: item, parent: val, index: i}.descendants(res)
+		}
+	}
+
+	return res
+}
+
+// eval returns the values matched by segments in root, in document order.
+func evalJSONPath(root any, segments []jsonSegment) []jsonNode {
+	nodes := []jsonNode{{value: root}}
+
+	for _, seg := range segments {
+		var next []jsonNode
+		for _, n := range nodes {
+			if !seg.recursive {
+				next = append(next, seg.children(n)...)
+				continue
+			}
+
+			for _, d := range n.descendants(nil) {
+				next = append(next, seg.children(d)...)
+			}
+		}
+		nodes = next
+	}
+
+	return nodes
+}
+
+func (p *jsonPath) eval(root any) []jsonNode {
+	return evalJSONPath(root, p.segments)
+}
+
+// replace puts v where n is, the root of doc if n has no parent.
+func (n jsonNode) replace(doc *JSONDoc, v any) {
+	switch parent := n.parent.(type) {
+	case *JSONObject:
+		parent.Set(n.key, v)
+	case *JSONArray:
+		parent.items[n.index] = v
+	default:
+		doc.Root = v
+	}
+}
+
+// Set puts a copy of v at every value matched by p and returns how many were
+// set. If p ends with a single key, it is also added to the objects matched
+// by the rest of the path which don't have it. With nx only new keys are
+// added, with xx only existing values are replaced.
+func (p *jsonPath) Set(doc *JSONDoc, v any, nx bool, xx bool) int {
+	n := 0
+
+	last := jsonSegment{}
+	if len(p.segments) > 0 {
+		last = p.segments[len(p.segments) - 1]
+	}
+
+	if !last.recursive && !last.wildcard && len(last.keys) == 1 && len(last.indexes) == 0 {
+		key := last.keys[0]
+		for _, parent := range evalJSONPath(doc.Root, p.segments[:len(p.segments) - 1]) {
+			obj, ok := parent.value.(*JSONObject)
+			if !ok {
+				continue
+			}
+
+			if _, exist := obj.Get(key); exist && nx || !exist && xx {
+				continue
+			}
+
+			obj.Set(key, jsonClone(v))
+			n++
+		}
+
+		return n
+	}
+
+	if nx {
+		return 0
+	}
+
+	for _, node := range p.eval(doc.Root) {
+		node.replace(doc, jsonClone(v))
+		n++
+	}
+
+	return n
+}
+
+// deleteJSONNodes removes nodes from their parents and returns how many were
+// removed. Nodes must have parents.
+func deleteJSONNodes(nodes []jsonNode) int {
+	n := 0
+
+	// elements are removed from the end so that indexes stay valid
+	arrays := make(map[*JSONArray][]int)
+	var order []*JSONArray
+
+	for _, node := range nodes {
+		switch parent := node.parent.(type) {
+		case *JSONObject:
+			if parent.Delete(node.key) {
+				n++
+			}
+		case *JSONArray:
+			if _, seen := arrays[parent]; !seen {
+				order = append(order, parent)
+			}
+			arrays[parent] = append(arrays[parent], node.index)
+		}
+	}
+
+	for _, arr := range order {
+		indexes := arrays[arr]
+		slices.Sort(indexes)
+		indexes = slices.Compact(indexes)
+
+		for i := len(indexes) - 1; i >= 0; i-- {
+			arr.items = slices.Delete(arr.items, indexes[i], indexes[i] + 1)
+			n++
+		}
+	}
+
+	return n
+}
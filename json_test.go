@@ -0,0 +1,173 @@
+package main
+
+import "testing"
+
+func TestJSONSetGet(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{`JSON.SET doc $ {"a":1,"b":[1,2],"c":{"d":"x"}}`, "OK"},
+		{"JSON.GET doc", `"{\"a\":1,\"b\":[1,2],\"c\":{\"d\":\"x\"}}"`},
+		{"JSON.GET doc .a", `"1"`},
+		{"JSON.GET doc $.a", `"[1]"`},
+		{"JSON.GET doc $..d", `"[\"x\"]"`},
+		{"JSON.GET doc $.b[1]", `"[2]"`},
+		{"JSON.GET doc $.missing", `"[]"`},
+		{"JSON.GET doc .missing", "error: Path '.missing' does not exist"},
+		{"JSON.GET missing", "nil"},
+
+		// several paths give an object keyed by path
+		{"JSON.GET doc .a .c", `"{\".a\":1,\".c\":{\"d\":\"x\"}}"`},
+		{"JSON.GET doc $.a .c", `"{\"$.a\":[1],\".c\":[{\"d\":\"x\"}]}"`},
+		{"JSON.GET doc INDENT > NEWLINE | SPACE _ $.c", `"[|>{|>>\"d\":_\"x\"|>}|]"`},
+
+		{"JSON.SET doc $.a 2", "OK"},
+		{"JSON.SET doc $.new true", "OK"},
+		{"JSON.SET doc $.a 3 NX", "nil"},
+		{"JSON.SET doc $.z 3 XX", "nil"},
+		{"JSON.SET doc $.z 3 NX", "OK"},
+		{"JSON.SET doc $.x.y 1", "nil"},
+		{`JSON.SET doc .c.d "y"`, "OK"},
+		{"JSON.GET doc", `"{\"a\":2,\"b\":[1,2],\"c\":{\"d\":\"y\"},\"new\":true,\"z\":3}"`},
+
+		{"JSON.SET new $.a 1", "error: new objects must be created at the root"},
+		{"JSON.SET new $ 1 XX", "nil"},
+		{"EXISTS new", "0"},
+		{"JSON.SET new $ 1 NX", "OK"},
+		{"JSON.SET new $ 2 NX", "nil"},
+		{"JSON.SET new . [] XX", "OK"},
+		{"JSON.GET new", `"[]"`},
+
+		{"JSON.SET doc $ {", "error: unexpected end of JSON input"},
+		{"JSON.SET doc $ 1x", "error: trailing characters after the JSON value"},
+		{"JSON.SET doc $ 1 FOO", "error: syntax error"},
+		{"JSON.SET doc $ 1 NX XX", "error: syntax error"},
+		{"JSON.SET doc $", "error: wrong number of arguments for 'json.set' command"},
+		{"JSON.GET", "error: wrong number of arguments for 'json.get' command"},
+
+		{"SET str x", "OK"},
+		{"JSON.GET str", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"JSON.SET str $ 1", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"GET doc", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"TYPE doc", "ReJSON-RL"},
+	})
+}
+
+func TestJSONDelType(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{`JSON.SET doc $ {"a":1,"b":[1,2.5,"s",null,false],"c":{"d":{"e":1}}}`, "OK"},
+
+		{"JSON.TYPE doc", `"object"`},
+		{"JSON.TYPE doc .a", `"integer"`},
+		{"JSON.TYPE doc $.b[*]", `["integer" "number" "string" "null" "boolean"]`},
+		{"JSON.TYPE doc $.nope", "[]"},
+		{"JSON.TYPE doc .nope", "nil"},
+		{"JSON.TYPE missing", "nil"},
+
+		{"JSON.DEL doc $..e", "1"},
+		{"JSON.DEL doc $..e", "0"},
+		{"JSON.DEL doc $.b[0]", "1"},
+		{"JSON.DEL doc .nope", "0"},
+		{"JSON.GET doc", `"{\"a\":1,\"b\":[2.5,\"s\",null,false],\"c\":{\"d\":{}}}"`},
+		{"JSON.DEL doc", "1"},
+		{"EXISTS doc", "0"},
+		{"JSON.DEL missing", "0"},
+
+		{"JSON.DEL doc $ x", "error: wrong number of arguments for 'json.del' command"},
+		{"JSON.TYPE", "error: wrong number of arguments for 'json.type' command"},
+		{"LPUSH l a", "1"},
+		{"JSON.DEL l", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+
+func TestJSONNumincrby(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{`JSON.SET doc $ {"a":1,"b":{"a":2.5},"s":"x","big":1e308}`, "OK"},
+
+		{"JSON.NUMINCRBY doc .a 2", `"3"`},
+		{"JSON.NUMINCRBY doc $..a 1", `"[4,3.5]"`},
+		{"JSON.NUMINCRBY doc .a 0.5", `"4.5"`},
+		{"JSON.NUMINCRBY doc $.s 1", `"[null]"`},
+		{"JSON.NUMINCRBY doc $.nope 1", `"[]"`},
+		{"JSON.GET doc", `"{\"a\":4.5,\"b\":{\"a\":3.5},\"s\":\"x\",\"big\":1e308}"`},
+
+		// the integer sum overflows into a float
+		{"JSON.SET doc $.i 9223372036854775807", "OK"},
+		{"JSON.NUMINCRBY doc .i 1", `"9.223372036854776e18"`},
+
+		{"JSON.NUMINCRBY doc .s 1", "error: wrong type of path value - expected a number but found string"},
+		{"JSON.NUMINCRBY doc .big 1e308", "error: result is not a number"},
+		{"JSON.GET doc .big", `"1e308"`},
+		{"JSON.NUMINCRBY doc .a \"1\"", "error: value is not a number"},
+		{"JSON.NUMINCRBY doc .a x", "error: invalid character 'x' looking for beginning of value"},
+		{"JSON.NUMINCRBY doc .nope 1", "error: Path '.nope' does not exist"},
+		{"JSON.NUMINCRBY missing .a 1", "error: could not perform this operation on a key that doesn't exist"},
+		{"JSON.NUMINCRBY doc .a", "error: wrong number of arguments for 'json.numincrby' command"},
+	})
+}
+
+func TestJSONArraysObjects(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{`JSON.SET doc $ {"a":[1],"b":{"a":"x"},"c":{"k1":1,"k2":{"a":[]}}}`, "OK"},
+
+		{`JSON.ARRAPPEND doc .a 2 "s" {"o":null}`, "4"},
+		{"JSON.ARRAPPEND doc $..a true", "[5 nil 1]"},
+		{"JSON.GET doc $..a", `"[[1,2,\"s\",{\"o\":null},true],\"x\",[true]]"`},
+		{"JSON.ARRAPPEND doc .b 1", "error: wrong type of path value - expected an array but found object"},
+		{"JSON.ARRAPPEND doc .nope 1", "error: Path '.nope' does not exist"},
+		{"JSON.ARRAPPEND doc .a x", "error: invalid character 'x' looking for beginning of value"},
+		{"JSON.ARRAPPEND missing . 1", "error: could not perform this operation on a key that doesn't exist"},
+		{"JSON.ARRAPPEND doc .a", "error: wrong number of arguments for 'json.arrappend' command"},
+
+		{"JSON.ARRLEN doc .a", "5"},
+		{"JSON.ARRLEN doc $..a", "[5 nil 1]"},
+		{"JSON.ARRLEN doc .b", "error: wrong type of path value - expected an array but found object"},
+		{"JSON.ARRLEN missing", "nil"},
+		{"JSON.ARRLEN doc $ x", "error: wrong number of arguments for 'json.arrlen' command"},
+
+		{"JSON.OBJKEYS doc", `["a" "b" "c"]`},
+		{"JSON.OBJKEYS doc .c", `["k1" "k2"]`},
+		{"JSON.OBJKEYS doc $..*", `[nil ["a"] ["k1" "k2"] nil nil nil ["o"] nil nil nil nil ["a"] nil nil]`},
+		{"JSON.OBJKEYS doc .a", "error: wrong type of path value - expected an object but found array"},
+		{"JSON.OBJKEYS missing", "nil"},
+		{"JSON.OBJKEYS", "error: wrong number of arguments for 'json.objkeys' command"},
+	})
+}
+
+func TestJSONMget(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{`JSON.SET a $ {"n":1,"m":{"n":2}}`, "OK"},
+		{`JSON.SET b $ {"n":"x"}`, "OK"},
+		{`JSON.SET c $ {}`, "OK"},
+		{"SET str x", "OK"},
+
+		{"JSON.MGET a b c str missing .n", `["1" "\"x\"" nil nil nil]`},
+		{"JSON.MGET a b c str missing $..n", `["[1,2]" "[\"x\"]" "[]" nil nil]`},
+		{"JSON.MGET a $", `["[{\"n\":1,\"m\":{\"n\":2}}]"]`},
+		{"JSON.MGET a", "error: wrong number of arguments for 'json.mget' command"},
+	})
+}
+
+func TestJSONReplay(t *testing.T) {
+	checkReplay(t, []string{
+		`JSON.SET doc $ {"a":1,"b":[1,2],"c":{"d":"x"},"f":0.1}`,
+		"JSON.SET doc $.a 2",
+		"JSON.SET doc $.a 3 NX",
+		`JSON.SET doc $.e {"k":[]}`,
+		"JSON.NUMINCRBY doc $..a 5",
+		"JSON.NUMINCRBY doc .f 0.2",
+		`JSON.ARRAPPEND doc .b 3 "s" null`,
+		"JSON.ARRAPPEND doc $.e.k {}",
+		"JSON.DEL doc $.c.d",
+		"JSON.SET gone $ 1",
+		"JSON.DEL gone",
+		`JSON.SET str $ "aé\n"`,
+		"JSON.SET big $ 9223372036854775807",
+		"JSON.NUMINCRBY big $ 1",
+	}, []string{
+		"JSON.GET doc",
+		"JSON.TYPE doc .f",
+		"EXISTS gone",
+		"JSON.GET str",
+		"JSON.GET big",
+		"JSON.TYPE big",
+	})
+}
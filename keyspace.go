@@ -0,0 +1,294 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Value types stored in the keyspace, as reported by TYPE.
+const (
+	TypeString = "string"
+	TypeList = "list"
+	TypeHash = "hash"
+	TypeSet = "set"
+	TypeZSet = "zset"
+	TypeStream = "stream"
+	TypeJSON = "ReJSON-RL"
+)
+
+// Object is the value of a key: its type, the value itself and the deadline
+// after which the key no longer exists.
+//
+//	TypeString  string
+//	TypeList    []string
+//	TypeHash    *Dict[string]
+//	TypeSet     *Set
+//	TypeZSet    *ZSet
+//	TypeStream  *Stream
+//	TypeJSON    *JSONDoc
+type Object struct {
+	Type string
+	Value any
+	ExpireAt time.Time // zero if the key does not expire
+}
+
+func (obj *Object) expired(now time.Time) bool {
+	return !obj.ExpireAt.IsZero() && now.After(obj.ExpireAt)
+}
+
+// DataType is the keyspace. Every key maps to exactly one Object, so a key
+// can only hold one type at a time.
+type DataType struct {
+	Keys *Dict[*Object]
+	Mu sync.RWMutex
+
+	// streamAdded is closed and replaced, under the write lock, every time a
+	// stream gets new entries. Blocked XREADs wait on it.
+	streamAdded chan struct{}
+
+	// loading is set while the AOF is replayed. Keys don't expire then: the
+	// file may set a deadline that passed since and later move it, and the
+	// key must still be there when it does. The DELs written for keys that
+	// expired under write commands make up for it.
+	loading bool
+
+	// lazyExpired holds the keys lookups found past their deadline since
+	// takeLazyExpired last ran. Readers add to it too, so it has a lock of
+	// its own.
+	lazyExpiredMu sync.Mutex
+	lazyExpired map[string]struct{}
+
+	// hllCacheWritten is set by PFCOUNT when it stored the count it
+	// computed in the key, which makes it a write the AOF has to log
+	hllCacheWritten bool
+
+	// expireCursor is where the active expire cycle goes on scanning Keys
+	expireCursor uint64
+}
+
+func createDT() *DataType {
+	return &DataType{
+		Keys: NewDict[*Object](),
+		streamAdded: make(chan struct{}),
+	}
+}
+
+// signalStreamAdded wakes up the clients blocked on streams, the caller
+// must hold the write lock.
+func (dt *DataType) signalStreamAdded() {
+	close(dt.streamAdded)
+	dt.streamAdded = make(chan struct{})
+}
+
+// flush removes every key.
+func (dt *DataType) flush() {
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	dt.Keys = NewDict[*Object]()
+}
+
+// size returns the number of keys.
+func (dt *DataType) size() int {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	return dt.Keys.Len()
+}
+
+// clone returns a deep copy of dt, used to persist a consistent view of the
+// data while clients keep modifying the original.
+func (dt *DataType) clone() *DataType {
+	dt.Mu.RLock()
+	defer dt.Mu.RUnlock()
+
+	c := createDT()
+	for key, obj := range dt.Keys.All() {
+		c.Keys.Set(key, obj.clone())
+	}
+
+	return c
+}
+
+func (obj *Object) clone() *Object {
+	c := *obj
+
+	switch val := obj.Value.(type) {
+	case []string:
+		c.Value = append([]string(nil), val...)
+	case *Dict[string]:
+		c.Value = val.clone()
+	case *Set:
+		c.Value = val.clone()
+	case *ZSet:
+		c.Value = val.clone()
+	case *Stream:
+		c.Value = val.clone()
+	case *JSONDoc:
+		c.Value = val.clone()
+	}
+
+	return &c
+}
+
+// lookup returns the live object at key, nil if it does not exist or has
+// expired. It never modifies dt, so a read lock is enough.
+func (dt *DataType) lookup(key string) *Object {
+	obj, exist := dt.Keys.Get(key)
+	if !exist {
+		return nil
+	}
+
+	if !dt.loading && obj.expired(time.Now()) {
+		dt.noteLazyExpired(key)
+		return nil
+	}
+
+	return obj
+}
+
+// lookupWrite is lookup for callers holding the write lock, an expired key
+// is deleted on the way.
+func (dt *DataType) lookupWrite(key string) *Object {
+	if checkExpireTime(dt, key) {
+		return nil
+	}
+
+	obj, _ := dt.Keys.Get(key)
+	return obj
+}
+
+// lookupType is lookup for commands that only work on values of type typ.
+// The error value is set if the key holds another type.
+func (dt *DataType) lookupType(key string, typ string) (*Object, *Value) {
+	obj := dt.lookup(key)
+	if obj == nil {
+		return nil, nil
+	}
+
+	if obj.Type != typ {
+		err := wrongType()
+		return nil, &err
+	}
+
+	return obj, nil
+}
+
+// deleteIfEmpty removes key once the collection in obj has no elements
+// left, empty collections are never visible to clients. Streams are the
+// exception, they keep their last ID and stay until deleted.
+func (dt *DataType) deleteIfEmpty(key string, obj *Object) {
+	switch val := obj.Value.(type) {
+	case []string:
+		if len(val) == 0 {
+			dt.Keys.Delete(key)
+		}
+	case *Dict[string]:
+		if val.Len() == 0 {
+			dt.Keys.Delete(key)
+		}
+	case *Set:
+		if val.Len() == 0 {
+			dt.Keys.Delete(key)
+		}
+	case *ZSet:
+		if val.Len() == 0 {
+			dt.Keys.Delete(key)
+		}
+	}
+}
+
+// checkExpireTime deletes key if its deadline passed and reports whether it
+// did. The caller must hold the write lock.
+func checkExpireTime(dt *DataType, key string) bool {
+	obj, exist := dt.Keys.Get(key)
+	if !exist || dt.loading || !obj.expired(time.Now()) {
+		return false
+	}
+
+	dt.Keys.Delete(key)
+	dt.noteLazyExpired(key)
+
+	return true
+}
+
+func (dt *DataType) noteLazyExpired(key string) {
+	dt.lazyExpiredMu.Lock()
+	defer dt.lazyExpiredMu.Unlock()
+
+	if dt.lazyExpired == nil {
+		dt.lazyExpired = make(map[string]struct{})
+	}
+	dt.lazyExpired[key] = struct{}{}
+}
+
+// takeLazyExpired returns and forgets the keys lookups found expired. The
+// ones still there are deleted, so that the data matches a DEL of each of
+// them.
+func (dt *DataType) takeLazyExpired() []string {
+	dt.lazyExpiredMu.Lock()
+	noted := dt.lazyExpired
+	dt.lazyExpired = nil
+	dt.lazyExpiredMu.Unlock()
+
+	if len(noted) == 0 {
+		return nil
+	}
+
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(noted))
+	for key := range noted {
+		// expired keys don't come back to life, unless a command set them
+		// again since
+		if obj, exist := dt.Keys.Get(key); exist && obj.expired(now) {
+			dt.Keys.Delete(key)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// expireSample looks at about count keys with a deadline, deletes the ones
+// that expired and returns how many it looked at and the deleted keys. Each
+// call carries on scanning the keyspace where the last one stopped. Keys
+// without a deadline are skipped, about count*20 of them at most, so a
+// keyspace with few volatile keys doesn't make a call scan all of it.
+func (dt *DataType) expireSample(count int) (sampled int, expired []string) {
+	dt.Mu.Lock()
+	defer dt.Mu.Unlock()
+
+	now := time.Now()
+	scanned := 0
+	for sampled < count && scanned < count * 20 {
+		dt.expireCursor = dt.Keys.Scan(dt.expireCursor, func(key string, obj *Object) {
+			scanned++
+
+			if obj.ExpireAt.IsZero() {
+				return
+			}
+			sampled++
+
+			if obj.expired(now) {
+				expired = append(expired, key)
+			}
+		})
+
+		if dt.expireCursor == 0 {
+			break
+		}
+	}
+
+	for _, key := range expired {
+		dt.Keys.Delete(key)
+	}
+
+	return sampled, expired
+}
+
+func wrongType() Value {
+	return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+}
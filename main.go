@@ -1,29 +1,33 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
-func connection(conn net.Conn, dt *DataType, aof *Aof, l *Log) {
+func connection(conn net.Conn, srv *Server) {
 	defer conn.Close()
 
 	for {
 		reader := NewRespReader(conn)
 			value, err := reader.Read()
 			if err != nil {
-				l.Error(err)
+				srv.l.Error(err)
 				return
 			}
 
 			if value.typ != "array" {
-				l.Info("Invalid request, expected array")
+				srv.l.Info("Invalid request, expected array")
 				continue
 			}
 			
 			if len(value.array) == 0 {
-				l.Info("Invalid request, expected array length > 0")
+				srv.l.Info("Invalid request, expected array length > 0")
 				continue
 			}
 
@@ -32,23 +36,26 @@ func connection(conn net.Conn, dt *DataType, aof *Aof, l *Log) {
 
 			writer := NewRespWriter(conn)
 
-			handler, ok := Handlers[command]
+			result, ok := srv.execute(command, args)
 			if !ok {
-				l.Info("Invalid command: " + command)
+				srv.l.Info("Invalid command: " + command)
 				writer.Write(Value{typ: "string", str: ""})
 				continue
 			}
 
-			if command == "SET" || command == "HSET" {
-				aof.AofWrite(value)
-			}
-
-			result := handler(dt, args)
 			writer.Write(result)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" {
+		os.Exit(checkAof(os.Args[2:]))
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags := configFlags(fs)
+	fs.Parse(os.Args[1:])
+
 	l, err := NewLogger("logs.log", "logger ")
 	if err != nil {
 		fmt.Println(err)
@@ -66,23 +73,38 @@ func main() {
 
 	dt := createDT()
 
-	aof, err := NewAof("database.aof")
+	aof, err := NewAof("appendonlydir", "database.aof", l)
 	if err != nil {
 		l.Error(err)
 		return
 	}
+	defer aof.AofClose()
 
-	aof.AofRead(func(value Value) {
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
+	srv := &Server{dt: dt, aof: aof, rdb: NewRdb("dump.rdb", l), l: l}
+	srv.hz.Store(10)
 
-		handler, ok := Handlers[command]
-		if !ok {
-			l.Info("Invalid command: " + command)
-		}
+	if err := applyConfigFlags(srv, fs, flags); err != nil {
+		fmt.Println(err)
+		l.Error(err)
+		return
+	}
+
+	if err := srv.load(); err != nil {
+		fmt.Println(err)
+		l.Error(err)
+		return
+	}
+
+	go srv.cron()
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
 
-		handler(dt, args)
-	})
+		l.Info("Shutting down")
+		server.Close()
+	}()
 
 	for {
 		conn, err := server.Accept()
@@ -91,6 +113,6 @@ func main() {
 		return
 		}
 		
-		go connection(conn, dt, aof, l)
+		go connection(conn, srv)
 	}
 }
\ No newline at end of file
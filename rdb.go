@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot file layout:
+//
+//	"REDISGO" | version (uint16) | aux fields | keys | EOF | CRC64
+//
+// Every key is an optional expire opcode followed by the value type, the key
+// and the value. Strings are a uvarint length and the bytes, the checksum is
+// CRC64 (ECMA) of everything before it, stored little endian.
+const (
+	rdbMagic = "REDISGO"
+	rdbVersion = 1
+
+	rdbTypeString = 0
+	rdbTypeList = 1
+	rdbTypeSet = 2
+	rdbTypeHash = 4
+	rdbTypeZSet = 5
+	rdbTypeStream = 15 // without consumer groups, only read
+	rdbTypeStreamGroups = 21
+	rdbTypeJSON = 7 // the serialized document, where Redis puts module values
+
+	rdbOpAux = 0xFA
+	rdbOpExpireMs = 0xFC
+	rdbOpEOF = 0xFF
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+var errRdbChecksum = errors.New("snapshot checksum mismatch")
+
+type rdbWriter struct {
+	w *bufio.Writer
+	crc uint64
+}
+
+func newRdbWriter(w io.Writer) *rdbWriter {
+	return &rdbWriter{w: bufio.NewWriter(w)}
+}
+
+// Write never fails on its own, bufio keeps the first error for Flush.
+func (w *rdbWriter) Write(p []byte) (int, error) {
+	w.crc = crc64.Update(w.crc, crcTable, p)
+	return w.w.Write(p)
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.Write([]byte{b})
+}
+
+func (w *rdbWriter) writeUvarint(n uint64) {
+	w.Write(binary.AppendUvarint(nil, n))
+}
+
+func (w *rdbWriter) writeInt64(n int64) {
+	w.Write(binary.LittleEndian.AppendUint64(nil, uint64(n)))
+}
+
+func (w *rdbWriter) writeString(s string) {
+	w.writeUvarint(uint64(len(s)))
+	w.Write([]byte(s))
+}
+
+func (w *rdbWriter) writeList(list []string) {
+	w.writeUvarint(uint64(len(list)))
+	for _, item := range list {
+		w.writeString(item)
+	}
+}
+
+func (w *rdbWriter) writeHash(hash *Dict[string]) {
+	w.writeUvarint(uint64(hash.Len()))
+	for field, val := range hash.All() {
+		w.writeString(field)
+		w.writeString(val)
+	}
+}
+
+// writeZSet writes the members in ascending order, each followed by its
+// score as the bits of a float64.
+func (w *rdbWriter) writeZSet(zset *ZSet) {
+	w.writeUvarint(uint64(zset.Len()))
+	for _, node := range zset.All() {
+		w.writeString(node.member)
+		w.writeInt64(int64(math.Float64bits(node.score)))
+	}
+}
+
+func (w *rdbWriter) writeStreamID(id StreamID) {
+	w.writeUvarint(id.Ms)
+	w.writeUvarint(id.Seq)
+}
+
+// writeStream writes the last ID, the number of entries ever added and the
+// largest deleted ID, then the entries.
+func (w *rdbWriter) writeStream(stream *Stream) {
+	w.writeStreamID(stream.LastID)
+	w.writeUvarint(stream.EntriesAdded)
+	w.writeStreamID(stream.MaxDeletedID)
+
+	w.writeUvarint(uint64(stream.Len()))
+	for _, entry := range stream.Entries() {
+		w.writeStreamID(entry.ID)
+		w.writeList(entry.Fields)
+	}
+}
+
+// writeStreamGroups writes the consumer groups of stream. Each has its name,
+// last ID and read counter, the pending entries with their delivery time and
+// count, then the consumers with the IDs of the entries pending for them.
+func (w *rdbWriter) writeStreamGroups(stream *Stream) {
+	groups := stream.Groups()
+
+	w.writeUvarint(uint64(len(groups)))
+	for _, group := range groups {
+		w.writeString(group.Name)
+		w.writeStreamID(group.LastID)
+		w.writeInt64(group.EntriesRead)
+
+		w.writeUvarint(uint64(len(group.Pending)))
+		for _, nack := range group.Pending {
+			w.writeStreamID(nack.ID)
+			w.writeInt64(nack.DeliveryTime.UnixMilli())
+			w.writeInt64(nack.DeliveryCount)
+		}
+
+		consumers := group.SortedConsumers()
+		w.writeUvarint(uint64(len(consumers)))
+		for _, consumer := range consumers {
+			active := int64(-1)
+			if !consumer.ActiveTime.IsZero() {
+				active = consumer.ActiveTime.UnixMilli()
+			}
+
+			w.writeString(consumer.Name)
+			w.writeInt64(consumer.SeenTime.UnixMilli())
+			w.writeInt64(active)
+
+			w.writeUvarint(uint64(len(consumer.Pending)))
+			for _, nack := range consumer.Pending {
+				w.writeStreamID(nack.ID)
+			}
+		}
+	}
+}
+
+// writeObject writes the value of obj, without its type.
+func (w *rdbWriter) writeObject(obj *Object) {
+	switch obj.Type {
+	case TypeString:
+		w.writeString(obj.Value.(string))
+	case TypeList:
+		w.writeList(obj.Value.([]string))
+	case TypeHash:
+		w.writeHash(obj.Value.(*Dict[string]))
+	case TypeSet:
+		w.writeList(obj.Value.(*Set).Members())
+	case TypeZSet:
+		w.writeZSet(obj.Value.(*ZSet))
+	case TypeStream:
+		w.writeStream(obj.Value.(*Stream))
+		w.writeStreamGroups(obj.Value.(*Stream))
+	case TypeJSON:
+		w.writeString(formatJSON(obj.Value.(*JSONDoc).Root))
+	}
+}
+
+func rdbType(obj *Object) byte {
+	switch obj.Type {
+	case TypeList:
+		return rdbTypeList
+	case TypeHash:
+		return rdbTypeHash
+	case TypeSet:
+		return rdbTypeSet
+	case TypeZSet:
+		return rdbTypeZSet
+	case TypeStream:
+		return rdbTypeStreamGroups
+	case TypeJSON:
+		return rdbTypeJSON
+	}
+
+	return rdbTypeString
+}
+
+// finish writes the checksum and flushes everything to the underlying writer.
+func (w *rdbWriter) finish() error {
+	w.w.Write(binary.LittleEndian.AppendUint64(nil, w.crc))
+	return w.w.Flush()
+}
+
+type rdbReader struct {
+	r *bufio.Reader
+	crc uint64
+	n int64 // bytes consumed
+}
+
+func newRdbReader(r io.Reader) *rdbReader {
+	return &rdbReader{r: bufio.NewReader(r)}
+}
+
+func (r *rdbReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(r.r, p)
+	r.crc = crc64.Update(r.crc, crcTable, p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *rdbReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	r.crc = crc64.Update(r.crc, crcTable, []byte{b})
+	r.n++
+
+	return b, nil
+}
+
+func (r *rdbReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(r)
+}
+
+func (r *rdbReader) readInt64() (int64, error) {
+	var buf [8]byte
+	if _, err := r.Read(buf[:]); err != nil {
+		return 0, err
+	}
+
+	return int64(binary.LittleEndian.Uint64(buf[:])), nil
+}
+
+func (r *rdbReader) readStreamID() (StreamID, error) {
+	ms, err := r.readUvarint()
+	if err != nil {
+		return StreamID{}, err
+	}
+
+	seq, err := r.readUvarint()
+	if err != nil {
+		return StreamID{}, err
+	}
+
+	return StreamID{ms, seq}, nil
+}
+
+func (r *rdbReader) readList() ([]string, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]string, 0, min(n, 1024))
+	for i := uint64(0); i < n; i++ {
+		item, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+
+	return list, nil
+}
+
+func (r *rdbReader) readStream() (*Stream, error) {
+	lastID, err := r.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	entriesAdded, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	maxDeletedID, err := r.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	stream := newStream()
+	for i := uint64(0); i < n; i++ {
+		id, err := r.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+
+		fields, err := r.readList()
+		if err != nil {
+			return nil, err
+		}
+
+		if id.Compare(stream.LastID) <= 0 || len(fields) % 2 != 0 {
+			return nil, fmt.Errorf("invalid stream entry %s", id)
+		}
+		stream.Append(id, fields)
+	}
+
+	if stream.Len() > 0 && lastID.Compare(stream.LastID) < 0 {
+		return nil, fmt.Errorf("invalid stream last id %s", lastID)
+	}
+
+	stream.LastID = lastID
+	stream.EntriesAdded = entriesAdded
+	stream.MaxDeletedID = maxDeletedID
+
+	return stream, nil
+}
+
+// readStreamGroups reads the consumer groups of stream, every pending entry
+// must belong to exactly one consumer.
+func (r *rdbReader) readStreamGroups(stream *Stream) error {
+	n, err := r.readUvarint()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		group, err := r.readStreamGroup()
+		if err != nil {
+			return err
+		}
+
+		if !stream.CreateGroup(group) {
+			return fmt.Errorf("duplicate consumer group '%s'", group.Name)
+		}
+	}
+
+	return nil
+}
+
+func (r *rdbReader) readStreamGroup() (*StreamGroup, error) {
+	name, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	lastID, err := r.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	entriesRead, err := r.readInt64()
+	if err != nil {
+		return nil, err
+	}
+
+	group := newStreamGroup(name, lastID, entriesRead)
+
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		id, err := r.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+
+		deliveryTime, err := r.readInt64()
+		if err != nil {
+			return nil, err
+		}
+
+		deliveryCount, err := r.readInt64()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(group.Pending) > 0 && id.Compare(group.Pending[len(group.Pending) - 1].ID) <= 0 {
+			return nil, fmt.Errorf("invalid pending entry %s", id)
+		}
+
+		group.Pending = append(group.Pending, &StreamNack{
+			ID: id,
+			DeliveryTime: time.UnixMilli(deliveryTime),
+			DeliveryCount: deliveryCount,
+		})
+	}
+
+	n, err = r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		consumerName, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		seen, err := r.readInt64()
+		if err != nil {
+			return nil, err
+		}
+
+		active, err := r.readInt64()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exist := group.Consumers[consumerName]; exist {
+			return nil, fmt.Errorf("duplicate consumer '%s'", consumerName)
+		}
+
+		consumer := &StreamConsumer{Name: consumerName, SeenTime: time.UnixMilli(seen)}
+		if active >= 0 {
+			consumer.ActiveTime = time.UnixMilli(active)
+		}
+		group.Consumers[consumerName] = consumer
+
+		pending, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		for j := uint64(0); j < pending; j++ {
+			id, err := r.readStreamID()
+			if err != nil {
+				return nil, err
+			}
+
+			nack := group.Pending.get(id)
+			if nack == nil || nack.Consumer != nil || len(consumer.Pending) > 0 && id.Compare(consumer.Pending[len(consumer.Pending) - 1].ID) <= 0 {
+				return nil, fmt.Errorf("invalid pending entry %s for consumer '%s'", id, consumerName)
+			}
+
+			nack.Consumer = consumer
+			consumer.Pending = append(consumer.Pending, nack)
+		}
+	}
+
+	for _, nack := range group.Pending {
+		if nack.Consumer == nil {
+			return nil, fmt.Errorf("pending entry %s has no consumer", nack.ID)
+		}
+	}
+
+	return group, nil
+}
+
+func (r *rdbReader) readString() (string, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return "", err
+	}
+
+	if n > maxBulkLen {
+		return "", fmt.Errorf("invalid string length %d", n)
+	}
+
+	buf := make([]byte, n)
+	if _, err := r.Read(buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// checkCRC reads the trailer and compares it with the checksum of
+// everything read so far.
+func (r *rdbReader) checkCRC() error {
+	sum := r.crc
+
+	var buf [8]byte
+	n, err := io.ReadFull(r.r, buf[:])
+	r.n += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if binary.LittleEndian.Uint64(buf[:]) != sum {
+		return errRdbChecksum
+	}
+
+	return nil
+}
+
+// writeSnapshot writes dt with the given aux fields. dt must not be
+// modified while it runs, callers pass a clone.
+func writeSnapshot(out io.Writer, dt *DataType, aux map[string]string) error {
+	w := newRdbWriter(out)
+
+	w.Write([]byte(rdbMagic))
+	w.Write(binary.BigEndian.AppendUint16(nil, rdbVersion))
+
+	for key, val := range aux {
+		w.writeByte(rdbOpAux)
+		w.writeString(key)
+		w.writeString(val)
+	}
+
+	now := time.Now()
+
+	for key, obj := range dt.Keys.All() {
+		if obj.expired(now) {
+			continue
+		}
+
+		if !obj.ExpireAt.IsZero() {
+			w.writeByte(rdbOpExpireMs)
+			w.writeInt64(obj.ExpireAt.UnixMilli())
+		}
+
+		w.writeByte(rdbType(obj))
+		w.writeString(key)
+		w.writeObject(obj)
+	}
+
+	w.writeByte(rdbOpEOF)
+
+	return w.finish()
+}
+
+// readSnapshot loads a snapshot into dt and returns its aux fields and its
+// size, in may go on after the snapshot.
+func readSnapshot(in io.Reader, dt *DataType) (map[string]string, int64, error) {
+	r := newRdbReader(in)
+	aux, err := readSnapshotFrom(r, dt)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return aux, r.n, err
+}
+
+func readSnapshotFrom(r *rdbReader, dt *DataType) (map[string]string, error) {
+	header := make([]byte, len(rdbMagic) + 2)
+	if _, err := r.Read(header); err != nil {
+		return nil, err
+	}
+
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return nil, errors.New("not a snapshot file")
+	}
+
+	if version := binary.BigEndian.Uint16(header[len(rdbMagic):]); version > rdbVersion {
+		return nil, fmt.Errorf("can't load snapshot version %d", version)
+	}
+
+	aux := make(map[string]string)
+	now := time.Now()
+	var deadline time.Time
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case rdbOpEOF:
+			if err := r.checkCRC(); err != nil {
+				return nil, err
+			}
+
+			return aux, nil
+		case rdbOpAux:
+			key, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			val, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			aux[key] = val
+			continue
+		case rdbOpExpireMs:
+			ms, err := r.readInt64()
+			if err != nil {
+				return nil, err
+			}
+
+			deadline = time.UnixMilli(ms)
+			continue
+		}
+
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		obj, err := readSnapshotValue(r, op)
+		if err != nil {
+			return nil, err
+		}
+
+		obj.ExpireAt = deadline
+		deadline = time.Time{}
+
+		if dt.loading || !obj.expired(now) {
+			dt.Keys.Set(key, obj)
+		}
+	}
+}
+
+// readSnapshotValue reads a value of type typ.
+func readSnapshotValue(r *rdbReader, typ byte) (*Object, error) {
+	switch typ {
+	case rdbTypeString:
+		val, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Object{Type: TypeString, Value: val}, nil
+	case rdbTypeList:
+		list, err := r.readList()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Object{Type: TypeList, Value: list}, nil
+	case rdbTypeSet:
+		n, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		set := newSet()
+		for i := uint64(0); i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			set.Add(member)
+		}
+
+		return &Object{Type: TypeSet, Value: set}, nil
+	case rdbTypeZSet:
+		n, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		zset := newZSet()
+		for i := uint64(0); i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			bits, err := r.readInt64()
+			if err != nil {
+				return nil, err
+			}
+
+			score := math.Float64frombits(uint64(bits))
+			if math.IsNaN(score) {
+				return nil, fmt.Errorf("invalid score for member '%s'", member)
+			}
+			zset.Add(member, score)
+		}
+
+		return &Object{Type: TypeZSet, Value: zset}, nil
+	case rdbTypeStream, rdbTypeStreamGroups:
+		stream, err := r.readStream()
+		if err != nil {
+			return nil, err
+		}
+
+		if typ == rdbTypeStreamGroups {
+			if err := r.readStreamGroups(stream); err != nil {
+				return nil, err
+			}
+		}
+
+		return &Object{Type: TypeStream, Value: stream}, nil
+	case rdbTypeHash:
+		n, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		hash := NewDict[string]()
+		for i := uint64(0); i < n; i++ {
+			field, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+
+			val, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			hash.Set(field, val)
+		}
+
+		return &Object{Type: TypeHash, Value: hash}, nil
+	case rdbTypeJSON:
+		data, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		root, err := parseJSON(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Object{Type: TypeJSON, Value: &JSONDoc{Root: root}}, nil
+	}
+
+	return nil, fmt.Errorf("unknown value type %d", typ)
+}
+
+// saveSnapshot atomically replaces the file at path with a snapshot of dt.
+func saveSnapshot(path string, dt *DataType, aux map[string]string) error {
+	tmp := filepath.Join(filepath.Dir(path), "temp-" + strconv.Itoa(os.Getpid()) + ".rdb")
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := writeSnapshot(f, dt, aux); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(path)
+
+	return nil
+}
+
+// loadSnapshot loads the snapshot at path into dt. A missing file is not an
+// error, it returns nil aux fields.
+func loadSnapshot(path string, dt *DataType) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	aux, _, err := readSnapshot(f, dt)
+
+	return aux, err
+}
+
+// DUMP payload layout:
+//
+//	type | value | version (uint16) | CRC64
+//
+// The value is encoded as in a snapshot, version and checksum are little
+// endian, the checksum covers everything before it.
+
+// dumpValue serializes the value of obj, its deadline is not included.
+func dumpValue(obj *Object) string {
+	var buf bytes.Buffer
+	w := newRdbWriter(&buf)
+
+	w.writeByte(rdbType(obj))
+	w.writeObject(obj)
+
+	w.Write(binary.LittleEndian.AppendUint16(nil, rdbVersion))
+	w.finish()
+
+	return buf.String()
+}
+
+var errBadPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// restoreValue decodes a DUMP payload.
+func restoreValue(payload string) (*Object, error) {
+	if len(payload) < 10 {
+		return nil, errBadPayload
+	}
+
+	body := payload[:len(payload) - 10]
+	version := binary.LittleEndian.Uint16([]byte(payload[len(payload) - 10:]))
+	sum := binary.LittleEndian.Uint64([]byte(payload[len(payload) - 8:]))
+
+	if version > rdbVersion || crc64.Checksum([]byte(payload[:len(payload) - 8]), crcTable) != sum {
+		return nil, errBadPayload
+	}
+
+	r := newRdbReader(strings.NewReader(body))
+
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, errBadPayload
+	}
+
+	obj, err := readSnapshotValue(r, typ)
+	if err != nil {
+		return nil, errors.New("Bad data format")
+	}
+
+	if r.n != int64(len(body)) {
+		return nil, errors.New("Bad data format")
+	}
+
+	return obj, nil
+}
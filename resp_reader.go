@@ -1,10 +1,11 @@
 package main
 
 import (
-	"fmt"
 	"bufio"
-	"strconv"
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
 )
 
 const (
@@ -15,8 +16,12 @@ const (
 	ARRAY = '*'
 )
 
+// largest bulk string accepted, same as proto-max-bulk-len of Redis
+const maxBulkLen = 512 * 1024 * 1024
+
 type respReader struct {
 	reader *bufio.Reader
+	offset int64 // bytes consumed so far
 }
 
 type Value struct {
@@ -31,30 +36,57 @@ func NewRespReader(rd io.Reader) *respReader {
 	return &respReader{reader: bufio.NewReader(rd)}
 }
 
+// Read reads the next value. io.EOF is only returned when the input ends
+// cleanly before a value, a value cut short returns io.ErrUnexpectedEOF.
 func (r *respReader) Read() (Value, error) {
-	typ, err := r.reader.ReadByte()
+	typ, err := r.readByte()
 	if err != nil {
 		return Value{}, err
 	}
+
+	v, err := r.readValue(typ)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return v, err
+}
+
+// Offset returns the number of bytes consumed, after a successful Read it is
+// the position right behind the value.
+func (r *respReader) Offset() int64 {
+	return r.offset
+}
+
+func (r *respReader) readValue(typ byte) (Value, error) {
 	switch typ {
 	case ARRAY:
 		return r.readArray()
 	case BULK:
 		return r.readBulk()
 	default:
-		fmt.Printf("unknow type: %v", typ)
-		return Value{}, err
+		return Value{}, fmt.Errorf("unknown type: %q", typ)
 	}
 }
 
+func (r *respReader) readByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	r.offset++
+
+	return b, nil
+}
+
 func (r *respReader) readLine() (line []byte, err error) {
 	for {
-		v, err := r.reader.ReadByte()
+		v, err := r.readByte()
 		if err != nil {
 			return nil, err
 		}
 		line = append(line, v)
-		if len(line) >= 2 && line[len(line) - 2] == '\r' {
+		if len(line) >= 2 && line[len(line) - 2] == '\r' && line[len(line) - 1] == '\n' {
 			break
 		}
 	}
@@ -69,7 +101,7 @@ func (r *respReader) readLength() (n int, err error) {
 	}
 	i64, err := strconv.ParseInt(string(length), 10, 64)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("invalid length %q", length)
 	}
 
 	return int(i64), nil
@@ -84,16 +116,25 @@ func (r *respReader) readArray() (Value, error) {
 		return v, err
 	}
 
-	v.array = make([]Value, 0, length)
+	if length < 0 {
+		return v, fmt.Errorf("invalid array length %d", length)
+	}
+
+	v.array = make([]Value, 0, min(length, 1024))
 	for i := 0; i < length; i++ {
-		val, err := r.Read()
+		typ, err := r.readByte()
+		if err != nil {
+			return v, err
+		}
+
+		val, err := r.readValue(typ)
 		if err != nil {
 			return val, err
 		}
 		v.array = append(v.array, val)
 	}
 
-	return v, err
+	return v, nil
 }
 
 func (r *respReader) readBulk() (Value, error) {
@@ -105,16 +146,26 @@ func (r *respReader) readBulk() (Value, error) {
 		return v, err
 	}
 
-	bulk := make([]byte, length)
+	if length < 0 || length > maxBulkLen {
+		return v, fmt.Errorf("invalid bulk length %d", length)
+	}
+
+	bulk := make([]byte, length + 2)
 
-	_, err = r.reader.Read(bulk)
+	n, err := io.ReadFull(r.reader, bulk)
+	r.offset += int64(n)
 	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
 		return v, err
 	}
 
-	v.bulk = string(bulk) 
+	if bulk[length] != '\r' || bulk[length + 1] != '\n' {
+		return v, errors.New("bulk string is not terminated by CRLF")
+	}
 
-	r.readLine()
+	v.bulk = string(bulk[:length]) 
 
 	return v, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The active expire cycle samples activeExpireKeysPerLoop keys with a
+// deadline at a time and goes on while more than
+// activeExpireAcceptableStale percent of them had expired, for at most
+// activeExpireCycleTimePerc percent of the time between two cycles.
+const (
+	activeExpireKeysPerLoop = 20
+	activeExpireAcceptableStale = 10
+	activeExpireCycleTimePerc = 25
+)
+
+// Server holds the state shared by every connection. Data commands only see
+// the DataType, server commands get the whole Server.
+type Server struct {
+	dt *DataType
+	aof *Aof
+	rdb *Rdb
+	l *Log
+
+	hz atomic.Int64 // how many times per second cron runs
+}
+
+var ServerHandlers = map[string]func(*Server, []Value) Value {
+	"BGREWRITEAOF": bgrewriteaof, // persistence commands //
+	"SAVE": save,
+	"BGSAVE": bgsave,
+	"LASTSAVE": lastsave,
+	"CONFIG": config, // server commands //
+	"XREADGROUP": xreadgroupBlock, // stream commands //
+}
+
+// execute runs a single command. ok is false if the command does not exist.
+func (srv *Server) execute(command string, args []Value) (result Value, ok bool) {
+	if handler, exist := ServerHandlers[command]; exist {
+		return handler(srv, args), true
+	}
+
+	handler, exist := Handlers[command]
+	if !exist {
+		return Value{}, false
+	}
+
+	if Commands[command].Write {
+		result := srv.aof.AofExec(srv.dt, handler, command, args)
+		if result.typ != "error" {
+			srv.rdb.Changed(1)
+		}
+
+		return result, true
+	}
+
+	return handler(srv.dt, args), true
+}
+
+// load restores the data from the snapshot and the AOF. The snapshot is only
+// a shortcut: if the AOF still starts with the commands the snapshot covers,
+// just the rest of the AOF is replayed on top of it. Otherwise the AOF, which
+// has every write, is replayed from the start.
+func (srv *Server) load() error {
+	srv.dt.loading = true
+	defer func() { srv.dt.loading = false }()
+
+	aofSize, aofCRC, ok, err := srv.rdb.Load(srv.dt)
+	if err != nil {
+		return errors.New("can't load snapshot: " + err.Error())
+	}
+
+	var from int64
+	var fromCRC uint64
+	var rewrite bool
+
+	if ok {
+		switch {
+		case srv.aof.Size() == 0:
+			srv.l.Info("AOF is empty, data loaded from the snapshot only")
+			rewrite = true
+		case srv.aof.HasPrefix(aofSize, aofCRC):
+			srv.l.Info(fmt.Sprintf("Data loaded from the snapshot, replaying the AOF from offset %d", aofSize))
+			from, fromCRC = aofSize, aofCRC
+		default:
+			srv.l.Info("Snapshot does not match the AOF, replaying the whole AOF")
+			srv.dt.flush()
+		}
+	}
+
+	err = srv.aof.AofRead(srv.dt, from, fromCRC, func(value Value) {
+		command := strings.ToUpper(value.array[0].bulk)
+		args := value.array[1:]
+
+		handler, ok := Handlers[command]
+		if !ok {
+			srv.l.Info("Invalid command: " + command)
+			return
+		}
+
+		handler(srv.dt, args)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the snapshot has data the AOF doesn't, write it out as the new AOF
+	if rewrite && srv.dt.size() > 0 {
+		return srv.aof.BgRewrite(srv.dt)
+	}
+
+	return nil
+}
+
+// cron runs the periodic background jobs of the server: the active expire
+// cycle hz times per second and the snapshot rules once per second.
+func (srv *Server) cron() {
+	lastSaveCheck := time.Now()
+
+	for {
+		time.Sleep(time.Second / time.Duration(srv.hz.Load()))
+
+		srv.activeExpireCycle()
+
+		if time.Since(lastSaveCheck) < time.Second {
+			continue
+		}
+		lastSaveCheck = time.Now()
+
+		if srv.rdb.needsSave() {
+			if err := srv.rdb.BgSave(srv.dt, srv.aof); err != nil {
+				srv.l.Error(err)
+			}
+		}
+	}
+}
+
+// activeExpireCycle deletes expired keys that nobody accesses, which would
+// otherwise stay in memory forever. The deletions are appended to the AOF
+// as DEL so that replaying it doesn't bring the keys back.
+func (srv *Server) activeExpireCycle() {
+	budget := time.Second / time.Duration(srv.hz.Load()) * activeExpireCycleTimePerc / 100
+	start := time.Now()
+
+	for {
+		var sampled int
+		var expired []string
+
+		err := srv.aof.AofPropagate(func() []Value {
+			sampled, expired = srv.dt.expireSample(activeExpireKeysPerLoop)
+
+			values := make([]Value, 0, len(expired))
+			for _, key := range expired {
+				values = append(values, commandValue("DEL", key))
+			}
+
+			return values
+		})
+		if err != nil {
+			srv.l.Error(err)
+			return
+		}
+
+		if len(expired) > 0 {
+			srv.rdb.Changed(int64(len(expired)))
+		}
+
+		if sampled == 0 || len(expired) * 100 <= sampled * activeExpireAcceptableStale {
+			return
+		}
+
+		if time.Since(start) > budget {
+			return
+		}
+	}
+}
+
+// PERSISTENCE COMMANDS //
+func bgrewriteaof(srv *Server, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "wrong number of arguments for 'bgrewriteaof' command"}
+	}
+
+	if err := srv.aof.BgRewrite(srv.dt); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	return Value{typ: "string", str: "Background append only file rewriting started"}
+}
+
+func save(srv *Server, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "wrong number of arguments for 'save' command"}
+	}
+
+	if err := srv.rdb.Save(srv.dt, srv.aof); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
+func bgsave(srv *Server, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "wrong number of arguments for 'bgsave' command"}
+	}
+
+	if err := srv.rdb.BgSave(srv.dt, srv.aof); err != nil {
+		return Value{typ: "error", str: err.Error()}
+	}
+
+	return Value{typ: "string", str: "Background saving started"}
+}
+
+func lastsave(srv *Server, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "wrong number of arguments for 'lastsave' command"}
+	}
+
+	return Value{typ: "integer", num: int(srv.rdb.LastSave().Unix())}
+}
+
+// STREAM COMMANDS //
+
+// xreadgroupBlock runs XREADGROUP, a write since it changes the group, under
+// the AOF lock like other writes. With BLOCK the wait for new entries happens
+// here, out of the lock, so that writes including the XADD it waits for can
+// go on, and XREADGROUP is tried again after each one.
+func xreadgroupBlock(srv *Server, args []Value) Value {
+	x, errVal := parseXreadgroup(args)
+	if errVal != nil {
+		return *errVal
+	}
+
+	var timeout <-chan time.Time
+	if x.block > 0 {
+		timer := time.NewTimer(time.Duration(x.block) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		srv.dt.Mu.RLock()
+		added := srv.dt.streamAdded
+		srv.dt.Mu.RUnlock()
+
+		result := srv.aof.AofExec(srv.dt, xreadgroup, "XREADGROUP", args)
+		if result.typ == "error" {
+			return result
+		}
+		srv.rdb.Changed(1)
+
+		if result.typ != "null" || x.block < 0 {
+			return result
+		}
+
+		select {
+		case <-added:
+		case <-timeout:
+			return result
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+)
+
+// setMaxIntsetEntries is the largest set kept in the compact encoding.
+const setMaxIntsetEntries = 512
+
+// Set is an unordered set of strings. While a set only holds integers and
+// has at most setMaxIntsetEntries members it is stored as a sorted slice of
+// int64 (an intset), which takes a fraction of the memory of a map. Adding
+// anything else converts it to a map for good.
+type Set struct {
+	ints []int64
+	members *Dict[struct{}] // nil while the set is an intset
+}
+
+func newSet() *Set {
+	return &Set{}
+}
+
+// setInt parses member as an integer stored by an intset. Only the canonical
+// form counts, "007" has to stay a string to be returned as it was added.
+func setInt(member string) (int64, bool) {
+	n, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != member {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func (s *Set) isIntset() bool {
+	return s.members == nil
+}
+
+func (s *Set) convert() {
+	s.members = NewDict[struct{}]()
+	for _, n := range s.ints {
+		s.members.Set(strconv.FormatInt(n, 10), struct{}{})
+	}
+	s.ints = nil
+}
+
+// Add adds member and reports whether it was new.
+func (s *Set) Add(member string) bool {
+	if s.isIntset() {
+		if n, ok := setInt(member); ok {
+			i, found := slices.BinarySearch(s.ints, n)
+			if found {
+				return false
+			}
+
+			if len(s.ints) < setMaxIntsetEntries {
+				s.ints = slices.Insert(s.ints, i, n)
+				return true
+			}
+		}
+
+		s.convert()
+	}
+
+	return s.members.Set(member, struct{}{})
+}
+
+// Remove removes member and reports whether it was there.
+func (s *Set) Remove(member string) bool {
+	if s.isIntset() {
+		n, ok := setInt(member)
+		if !ok {
+			return false
+		}
+
+		i, found := slices.BinarySearch(s.ints, n)
+		if found {
+			s.ints = slices.Delete(s.ints, i, i + 1)
+		}
+
+		return found
+	}
+
+	return s.members.Delete(member)
+}
+
+func (s *Set) Has(member string) bool {
+	if s.isIntset() {
+		n, ok := setInt(member)
+		if !ok {
+			return false
+		}
+
+		_, found := slices.BinarySearch(s.ints, n)
+		return found
+	}
+
+	_, exist := s.members.Get(member)
+	return exist
+}
+
+func (s *Set) Len() int {
+	if s.isIntset() {
+		return len(s.ints)
+	}
+
+	return s.members.Len()
+}
+
+// Members returns every member, integers in ascending order for an intset
+// and in no particular order otherwise.
+func (s *Set) Members() []string {
+	res := make([]string, 0, s.Len())
+
+	if s.isIntset() {
+		for _, n := range s.ints {
+			res = append(res, strconv.FormatInt(n, 10))
+		}
+
+		return res
+	}
+
+	for member := range s.members.All() {
+		res = append(res, member)
+	}
+
+	return res
+}
+
+// Scan walks the members like Dict.ScanCount. An intset is small, so it
+// returns all of its members at once.
+func (s *Set) Scan(cursor uint64, count int, fn func(member string)) uint64 {
+	if s.isIntset() {
+		for _, n := range s.ints {
+			fn(strconv.FormatInt(n, 10))
+		}
+
+		return 0
+	}
+
+	return s.members.ScanCount(cursor, count, func(member string, _ struct{}) {
+		fn(member)
+	})
+}
+
+// RandomMember returns a random member of a set that isn't empty.
+func (s *Set) RandomMember() string {
+	if s.isIntset() {
+		return strconv.FormatInt(s.ints[rand.Intn(len(s.ints))], 10)
+	}
+
+	member, _, _ := s.members.Random()
+	return member
+}
+
+// Random returns count distinct random members, or all of them if the set
+// is smaller. Like Redis it picks members one at a time while count is small
+// next to the set, and only shuffles a copy of the set when it asks for a
+// good part of it anyway.
+func (s *Set) Random(count int) []string {
+	if count * 3 >= s.Len() {
+		members := s.Members()
+		rand.Shuffle(len(members), func(i, j int) {
+			members[i], members[j] = members[j], members[i]
+		})
+
+		return members[:min(count, len(members))]
+	}
+
+	seen := make(map[string]bool, count)
+	res := make([]string, 0, count)
+	for len(res) < count {
+		member := s.RandomMember()
+		if !seen[member] {
+			seen[member] = true
+			res = append(res, member)
+		}
+	}
+
+	return res
+}
+
+func (s *Set) clone() *Set {
+	c := &Set{ints: slices.Clone(s.ints)}
+
+	if !s.isIntset() {
+		c.members = s.members.clone()
+	}
+
+	return c
+}
+
+// setInter calls fn for each member of the intersection of sets until it
+// returns false. A nil set is empty. Members are taken from the smallest
+// set, so the cost depends on it and not on the largest one.
+func setInter(sets []*Set, fn func(member string) bool) {
+	for _, s := range sets {
+		if s == nil || s.Len() == 0 {
+			return
+		}
+	}
+
+	sorted := slices.Clone(sets)
+	slices.SortFunc(sorted, func(a, b *Set) int {
+		return a.Len() - b.Len()
+	})
+
+	for _, member := range sorted[0].Members() {
+		found := true
+		for _, s := range sorted[1:] {
+			if !s.Has(member) {
+				found = false
+				break
+			}
+		}
+
+		if found && !fn(member) {
+			return
+		}
+	}
+}
+
+// setUnion returns the union of sets, nil sets are empty.
+func setUnion(sets []*Set) *Set {
+	res := newSet()
+	for _, s := range sets {
+		if s == nil {
+			continue
+		}
+
+		for _, member := range s.Members() {
+			res.Add(member)
+		}
+	}
+
+	return res
+}
+
+// setDiff returns the members of the first set that are in none of the
+// others.
+func setDiff(sets []*Set) *Set {
+	res := newSet()
+	if sets[0] == nil {
+		return res
+	}
+
+	for _, member := range sets[0].Members() {
+		found := false
+		for _, s := range sets[1:] {
+			if s != nil && s.Has(member) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			res.Add(member)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SaveRule triggers a background save once Changes writes happened and
+// Seconds passed since the last save.
+type SaveRule struct {
+	Seconds int64
+	Changes int64
+}
+
+// Rdb keeps the state of the snapshot file: when it was last saved, how many
+// writes happened since and whether a save is running.
+type Rdb struct {
+	path string
+	l *Log
+	mu sync.Mutex
+
+	saving bool
+	dirty int64 // writes since the last successful save
+	lastSave time.Time
+	lastErr error
+	rules []SaveRule
+}
+
+func NewRdb(path string, l *Log) *Rdb {
+	return &Rdb{
+		path: path,
+		l: l,
+		lastSave: time.Now(),
+		rules: []SaveRule{{3600, 1}, {300, 100}, {60, 10000}},
+	}
+}
+
+// Changed records n writes since the last save.
+func (rdb *Rdb) Changed(n int64) {
+	rdb.mu.Lock()
+	defer rdb.mu.Unlock()
+
+	rdb.dirty += n
+}
+
+// Save writes a snapshot of dt and waits for it to finish. The snapshot
+// remembers how far the AOF was at that moment so startup can replay only
+// the commands after it.
+func (rdb *Rdb) Save(dt *DataType, aof *Aof) error {
+	dirty, err := rdb.begin()
+	if err != nil {
+		return err
+	}
+
+	clone, size, crc := aof.CloneAt(dt)
+
+	return rdb.finish(rdb.write(clone, size, crc), dirty)
+}
+
+// BgSave is like Save but writes the file in the background.
+func (rdb *Rdb) BgSave(dt *DataType, aof *Aof) error {
+	dirty, err := rdb.begin()
+	if err != nil {
+		return err
+	}
+
+	clone, size, crc := aof.CloneAt(dt)
+
+	go func() {
+		if err := rdb.finish(rdb.write(clone, size, crc), dirty); err != nil {
+			rdb.l.Error(err)
+			return
+		}
+
+		rdb.l.Info("Background saving terminated with success")
+	}()
+
+	return nil
+}
+
+func (rdb *Rdb) begin() (dirty int64, err error) {
+	rdb.mu.Lock()
+	defer rdb.mu.Unlock()
+
+	if rdb.saving {
+		return 0, errors.New("Background save already in progress")
+	}
+	rdb.saving = true
+
+	return rdb.dirty, nil
+}
+
+func (rdb *Rdb) write(clone *DataType, aofSize int64, aofCRC uint64) error {
+	return saveSnapshot(rdb.path, clone, map[string]string{
+		"ctime": strconv.FormatInt(time.Now().Unix(), 10),
+		"aof-size": strconv.FormatInt(aofSize, 10),
+		"aof-crc": strconv.FormatUint(aofCRC, 10),
+	})
+}
+
+func (rdb *Rdb) finish(err error, dirty int64) error {
+	rdb.mu.Lock()
+	defer rdb.mu.Unlock()
+
+	rdb.saving = false
+	rdb.lastErr = err
+
+	if err == nil {
+		rdb.dirty -= dirty
+		rdb.lastSave = time.Now()
+	}
+
+	return err
+}
+
+// Load reads the snapshot into dt. ok is false if there is no snapshot, the
+// AOF size and checksum are zero if it was not saved along with an AOF.
+func (rdb *Rdb) Load(dt *DataType) (aofSize int64, aofCRC uint64, ok bool, err error) {
+	aux, err := loadSnapshot(rdb.path, dt)
+	if err != nil || aux == nil {
+		return 0, 0, false, err
+	}
+
+	aofSize, _ = strconv.ParseInt(aux["aof-size"], 10, 64)
+	aofCRC, _ = strconv.ParseUint(aux["aof-crc"], 10, 64)
+
+	return aofSize, aofCRC, true, nil
+}
+
+func (rdb *Rdb) LastSave() time.Time {
+	rdb.mu.Lock()
+	defer rdb.mu.Unlock()
+
+	return rdb.lastSave
+}
+
+// needsSave reports whether one of the save rules is due.
+func (rdb *Rdb) needsSave() bool {
+	rdb.mu.Lock()
+	defer rdb.mu.Unlock()
+
+	if rdb.saving {
+		return false
+	}
+
+	elapsed := int64(time.Since(rdb.lastSave).Seconds())
+	for _, rule := range rdb.rules {
+		if rdb.dirty >= rule.Changes && elapsed >= rule.Seconds {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rdb *Rdb) Rules() []SaveRule {
+	rdb.mu.Lock()
+	defer rdb.mu.Unlock()
+
+	return rdb.rules
+}
+
+func (rdb *Rdb) SetRules(rules []SaveRule) {
+	rdb.mu.Lock()
+	defer rdb.mu.Unlock()
+
+	rdb.rules = rules
+}
+
+// parseSaveRules parses "<seconds> <changes> ..." pairs, an empty string
+// disables automatic saving.
+func parseSaveRules(val string) ([]SaveRule, error) {
+	fields := strings.Fields(val)
+	if len(fields) % 2 != 0 {
+		return nil, errors.New("save rules must be pairs of <seconds> <changes>")
+	}
+
+	rules := []SaveRule{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 1 {
+			return nil, errors.New("invalid save seconds '" + fields[i] + "'")
+		}
+
+		changes, err := strconv.ParseInt(fields[i + 1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, errors.New("invalid save changes '" + fields[i + 1] + "'")
+		}
+
+		rules = append(rules, SaveRule{Seconds: seconds, Changes: changes})
+	}
+
+	return rules, nil
+}
+
+func formatSaveRules(rules []SaveRule) string {
+	parts := make([]string, 0, len(rules) * 2)
+	for _, rule := range rules {
+		parts = append(parts, strconv.FormatInt(rule.Seconds, 10), strconv.FormatInt(rule.Changes, 10))
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamID identifies a stream entry, written "<ms>-<seq>".
+type StreamID struct {
+	Ms uint64
+	Seq uint64
+}
+
+var maxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+
+var errInvalidStreamID = errors.New("Invalid stream ID specified as stream command argument")
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.Ms != other.Ms:
+		if id.Ms < other.Ms {
+			return -1
+		}
+		return 1
+	case id.Seq != other.Seq:
+		if id.Seq < other.Seq {
+			return -1
+		}
+		return 1
+	}
+
+	return 0
+}
+
+func (id StreamID) IsZero() bool {
+	return id == StreamID{}
+}
+
+// next returns the smallest ID after id, false if there is none.
+func (id StreamID) next() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{id.Ms, id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{id.Ms + 1, 0}, true
+	}
+
+	return id, false
+}
+
+// prev returns the largest ID before id, false if there is none.
+func (id StreamID) prev() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{id.Ms, id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	}
+
+	return id, false
+}
+
+// parseStreamID parses "<ms>-<seq>" or "<ms>", which takes missingSeq as
+// its sequence number.
+func parseStreamID(s string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, errInvalidStreamID
+	}
+
+	if !hasSeq {
+		return StreamID{ms, missingSeq}, nil
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, errInvalidStreamID
+	}
+
+	return StreamID{ms, seq}, nil
+}
+
+// parseStreamRangeID parses a range bound: "-" and "+" are the smallest and
+// largest IDs, "(" makes the bound exclusive and a missing sequence number
+// is 0 for a start and the largest one for an end.
+func parseStreamRangeID(s string, end bool) (StreamID, error) {
+	switch s {
+	case "-":
+		return StreamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+
+	var missingSeq uint64
+	if end {
+		missingSeq = math.MaxUint64
+	}
+
+	id, err := parseStreamID(s, missingSeq)
+	if err != nil || !exclusive {
+		return id, err
+	}
+
+	ok := false
+	if end {
+		id, ok = id.prev()
+	} else {
+		id, ok = id.next()
+	}
+
+	if !ok {
+		return id, errors.New("invalid start or end ID, the range is empty")
+	}
+
+	return id, nil
+}
+
+type StreamEntry struct {
+	ID StreamID
+	Fields []string // field value pairs
+}
+
+// streamChunkSize is the largest number of entries in a chunk.
+const streamChunkSize = 100
+
+// Stream is an append only log of entries ordered by ID. Entries are kept in
+// chunks of up to streamChunkSize entries, so an ID is found with a binary
+// search over the chunks and then inside one chunk, and trimming the head
+// drops whole chunks at once.
+type Stream struct {
+	chunks [][]StreamEntry
+	length int
+
+	LastID StreamID // the largest ID ever added, deleted or not
+	EntriesAdded uint64
+	MaxDeletedID StreamID
+
+	groups map[string]*StreamGroup // nil until the first group is created
+}
+
+func newStream() *Stream {
+	return &Stream{}
+}
+
+func (s *Stream) Len() int {
+	return s.length
+}
+
+// NextID returns the ID for "*": the current time, or one more than the
+// last ID if the clock is behind it.
+func (s *Stream) NextID(now time.Time) (StreamID, error) {
+	ms := uint64(now.UnixMilli())
+	if ms > s.LastID.Ms {
+		return StreamID{ms, 0}, nil
+	}
+
+	id, ok := s.LastID.next()
+	if !ok {
+		return id, errors.New("The stream has exhausted the last possible ID, unable to add more items")
+	}
+
+	return id, nil
+}
+
+// NextSeq returns the ID for "<ms>-*".
+func (s *Stream) NextSeq(ms uint64) (StreamID, error) {
+	switch {
+	case ms > s.LastID.Ms:
+		if ms == 0 {
+			return StreamID{0, 1}, nil
+		}
+
+		return StreamID{ms, 0}, nil
+	case ms == s.LastID.Ms && s.LastID.Seq < math.MaxUint64:
+		return StreamID{ms, s.LastID.Seq + 1}, nil
+	}
+
+	return StreamID{}, errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
+}
+
+// Append adds an entry, id must be larger than LastID.
+func (s *Stream) Append(id StreamID, fields []string) {
+	last := len(s.chunks) - 1
+	if last < 0 || len(s.chunks[last]) == streamChunkSize {
+		s.chunks = append(s.chunks, make([]StreamEntry, 0, streamChunkSize))
+		last++
+	}
+
+	s.chunks[last] = append(s.chunks[last], StreamEntry{ID: id, Fields: fields})
+	s.length++
+	s.LastID = id
+	s.EntriesAdded++
+}
+
+// find returns the position of the first entry with an ID not smaller than
+// id, which is past the end if there is none.
+func (s *Stream) find(id StreamID) (chunk int, i int) {
+	chunk = sort.Search(len(s.chunks), func(c int) bool {
+		entries := s.chunks[c]
+		return entries[len(entries) - 1].ID.Compare(id) >= 0
+	})
+
+	if chunk == len(s.chunks) {
+		return chunk, 0
+	}
+
+	i = sort.Search(len(s.chunks[chunk]), func(e int) bool {
+		return s.chunks[chunk][e].ID.Compare(id) >= 0
+	})
+
+	return chunk, i
+}
+
+func (s *Stream) Get(id StreamID) (StreamEntry, bool) {
+	chunk, i := s.find(id)
+	if chunk == len(s.chunks) || s.chunks[chunk][i].ID != id {
+		return StreamEntry{}, false
+	}
+
+	return s.chunks[chunk][i], true
+}
+
+// Delete removes the entry with id and reports whether it existed.
+func (s *Stream) Delete(id StreamID) bool {
+	chunk, i := s.find(id)
+	if chunk == len(s.chunks) || s.chunks[chunk][i].ID != id {
+		return false
+	}
+
+	s.chunks[chunk] = slices.Delete(s.chunks[chunk], i, i + 1)
+	if len(s.chunks[chunk]) == 0 {
+		s.chunks = slices.Delete(s.chunks, chunk, chunk + 1)
+	}
+	s.length--
+
+	if id.Compare(s.MaxDeletedID) > 0 {
+		s.MaxDeletedID = id
+	}
+
+	return true
+}
+
+// Range returns up to count entries with IDs from start to end, both
+// included, from the end backwards if rev is set. A count of 0 or less
+// returns every entry in the range.
+func (s *Stream) Range(start StreamID, end StreamID, count int, rev bool) []StreamEntry {
+	var res []StreamEntry
+	if start.Compare(end) > 0 {
+		return res
+	}
+
+	full := func() bool {
+		return count > 0 && len(res) == count
+	}
+
+	if !rev {
+		chunk, i := s.find(start)
+		for ; chunk < len(s.chunks); chunk, i = chunk + 1, 0 {
+			for ; i < len(s.chunks[chunk]); i++ {
+				entry := s.chunks[chunk][i]
+				if entry.ID.Compare(end) > 0 || full() {
+					return res
+				}
+				res = append(res, entry)
+			}
+		}
+
+		return res
+	}
+
+	// the first entry after end, then walk back from the one before it
+	chunk, i := len(s.chunks), 0
+	if next, ok := end.next(); ok {
+		chunk, i = s.find(next)
+	}
+
+	for {
+		if i == 0 {
+			if chunk == 0 {
+				return res
+			}
+			chunk--
+			i = len(s.chunks[chunk])
+		}
+		i--
+
+		entry := s.chunks[chunk][i]
+		if entry.ID.Compare(start) < 0 || full() {
+			return res
+		}
+		res = append(res, entry)
+	}
+}
+
+func (s *Stream) First() (StreamEntry, bool) {
+	if s.length == 0 {
+		return StreamEntry{}, false
+	}
+
+	return s.chunks[0][0], true
+}
+
+func (s *Stream) Last() (StreamEntry, bool) {
+	if s.length == 0 {
+		return StreamEntry{}, false
+	}
+
+	last := s.chunks[len(s.chunks) - 1]
+	return last[len(last) - 1], true
+}
+
+// streamTrim is the MAXLEN or MINID option of XADD and XTRIM. An
+// approximate trim only drops whole chunks, so the stream can end up a
+// little longer than asked. limit caps how many entries an approximate trim
+// removes, 0 means no cap.
+type streamTrim struct {
+	maxLen int // used unless minID is set
+	minID *StreamID
+	approx bool
+	limit int
+}
+
+// removable reports whether the entries of the first chunk up to n may all
+// be trimmed.
+func (t *streamTrim) removable(s *Stream, n int) bool {
+	if t.minID != nil {
+		return s.chunks[0][n - 1].ID.Compare(*t.minID) < 0
+	}
+
+	return s.length - n >= t.maxLen
+}
+
+// apply trims s and returns how many entries were removed.
+func (t *streamTrim) apply(s *Stream) int {
+	removed := 0
+
+	for len(s.chunks) > 0 {
+		n := len(s.chunks[0])
+		if t.approx && t.limit > 0 && removed + n > t.limit {
+			break
+		}
+
+		if !t.removable(s, n) {
+			break
+		}
+
+		s.chunks = s.chunks[1:]
+		s.length -= n
+		removed += n
+	}
+
+	if t.approx || len(s.chunks) == 0 {
+		return removed
+	}
+
+	n := 0
+	for n < len(s.chunks[0]) && t.removable(s, n + 1) {
+		n++
+	}
+
+	s.chunks[0] = slices.Delete(s.chunks[0], 0, n)
+	s.length -= n
+
+	return removed + n
+}
+
+// parseStreamTrim parses "MAXLEN|MINID [=|~] threshold" at args[i] and
+// returns the index of the argument after it. LIMIT is parsed separately by
+// the callers since it may come in any order.
+func parseStreamTrim(args []Value, i int) (*streamTrim, int, error) {
+	strategy := strings.ToUpper(args[i].bulk)
+	i++
+
+	t := &streamTrim{}
+	if i < len(args) && (args[i].bulk == "=" || args[i].bulk == "~") {
+		t.approx = args[i].bulk == "~"
+		i++
+	}
+
+	if i >= len(args) {
+		return nil, i, errors.New("syntax error")
+	}
+
+	if strategy == "MINID" {
+		id, err := parseStreamID(args[i].bulk, 0)
+		if err != nil {
+			return nil, i, err
+		}
+		t.minID = &id
+	} else {
+		n, err := strconv.Atoi(args[i].bulk)
+		if err != nil {
+			return nil, i, errors.New("value is not an integer or out of range")
+		}
+		if n < 0 {
+			return nil, i, errors.New("The MAXLEN argument must be >= 0.")
+		}
+		t.maxLen = n
+	}
+
+	return t, i + 1, nil
+}
+
+func (s *Stream) clone() *Stream {
+	c := *s
+	c.chunks = make([][]StreamEntry, 0, len(s.chunks))
+	for _, chunk := range s.chunks {
+		c.chunks = append(c.chunks, slices.Clone(chunk))
+	}
+
+	c.groups = nil
+	for _, group := range s.groups {
+		c.CreateGroup(group.clone())
+	}
+
+	return &c
+}
+
+// Entries returns every entry in order.
+func (s *Stream) Entries() []StreamEntry {
+	return s.Range(StreamID{}, maxStreamID, 0, false)
+}
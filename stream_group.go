@@ -0,0 +1,346 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// StreamNack is an entry delivered to a consumer of a group and not
+// acknowledged yet.
+type StreamNack struct {
+	ID StreamID
+	Consumer *StreamConsumer
+	DeliveryTime time.Time
+	DeliveryCount int64
+}
+
+// pendingList is a pending entries list (PEL), kept sorted by ID. Entries are
+// delivered in ID order, so inserting mostly appends.
+type pendingList []*StreamNack
+
+// find returns the position of the first nack with an ID not smaller than id
+// and whether its ID is id.
+func (p pendingList) find(id StreamID) (int, bool) {
+	return slices.BinarySearchFunc(p, id, func(nack *StreamNack, id StreamID) int {
+		return nack.ID.Compare(id)
+	})
+}
+
+func (p pendingList) get(id StreamID) *StreamNack {
+	i, found := p.find(id)
+	if !found {
+		return nil
+	}
+
+	return p[i]
+}
+
+func (p *pendingList) insert(nack *StreamNack) {
+	i, found := p.find(nack.ID)
+	if found {
+		(*p)[i] = nack
+		return
+	}
+
+	*p = slices.Insert(*p, i, nack)
+}
+
+func (p *pendingList) remove(id StreamID) {
+	if i, found := p.find(id); found {
+		*p = slices.Delete(*p, i, i + 1)
+	}
+}
+
+// Range returns up to count nacks with IDs from start to end, both included.
+// A count of 0 or less returns all of them.
+func (p pendingList) Range(start StreamID, end StreamID, count int) []*StreamNack {
+	i, _ := p.find(start)
+
+	var res []*StreamNack
+	for ; i < len(p) && p[i].ID.Compare(end) <= 0; i++ {
+		if count > 0 && len(res) == count {
+			break
+		}
+		res = append(res, p[i])
+	}
+
+	return res
+}
+
+type StreamConsumer struct {
+	Name string
+	SeenTime time.Time // last time it read or claimed, successfully or not
+	ActiveTime time.Time // last time it got entries, zero if it never did
+	Pending pendingList
+}
+
+// StreamGroup is a consumer group. Every entry delivered to one of its
+// consumers stays in Pending, and in the PEL of that consumer, until it is
+// acknowledged.
+type StreamGroup struct {
+	Name string
+	LastID StreamID // the last entry delivered with ">"
+	EntriesRead int64 // entries delivered so far, -1 if unknown
+	Pending pendingList
+	Consumers map[string]*StreamConsumer
+}
+
+// streamEntriesReadUnknown is EntriesRead of a group whose position can't be
+// told from its last ID, after a SETID to an arbitrary ID for instance.
+const streamEntriesReadUnknown = -1
+
+func newStreamGroup(name string, lastID StreamID, entriesRead int64) *StreamGroup {
+	return &StreamGroup{
+		Name: name,
+		LastID: lastID,
+		EntriesRead: entriesRead,
+		Consumers: make(map[string]*StreamConsumer),
+	}
+}
+
+// Group returns the group called name, nil if there is none.
+func (s *Stream) Group(name string) *StreamGroup {
+	return s.groups[name]
+}
+
+// CreateGroup adds a group and reports whether the name was free.
+func (s *Stream) CreateGroup(group *StreamGroup) bool {
+	if _, exist := s.groups[group.Name]; exist {
+		return false
+	}
+
+	if s.groups == nil {
+		s.groups = make(map[string]*StreamGroup)
+	}
+	s.groups[group.Name] = group
+
+	return true
+}
+
+func (s *Stream) DestroyGroup(name string) bool {
+	if _, exist := s.groups[name]; !exist {
+		return false
+	}
+	delete(s.groups, name)
+
+	return true
+}
+
+// Groups returns every group sorted by name.
+func (s *Stream) Groups() []*StreamGroup {
+	groups := make([]*StreamGroup, 0, len(s.groups))
+	for _, group := range s.groups {
+		groups = append(groups, group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+
+	return groups
+}
+
+// Consumer returns the consumer called name, creating it if needed, and
+// marks it as seen.
+func (g *StreamGroup) Consumer(name string, now time.Time) *StreamConsumer {
+	consumer, exist := g.Consumers[name]
+	if !exist {
+		consumer = &StreamConsumer{Name: name}
+		g.Consumers[name] = consumer
+	}
+	consumer.SeenTime = now
+
+	return consumer
+}
+
+// CreateConsumer adds a consumer and reports whether it was new.
+func (g *StreamGroup) CreateConsumer(name string, now time.Time) bool {
+	if _, exist := g.Consumers[name]; exist {
+		return false
+	}
+	g.Consumers[name] = &StreamConsumer{Name: name, SeenTime: now}
+
+	return true
+}
+
+// DeleteConsumer removes a consumer with its pending entries and returns how
+// many it had, -1 if there is no such consumer.
+func (g *StreamGroup) DeleteConsumer(name string) int {
+	consumer, exist := g.Consumers[name]
+	if !exist {
+		return -1
+	}
+
+	for _, nack := range consumer.Pending {
+		g.Pending.remove(nack.ID)
+	}
+	delete(g.Consumers, name)
+
+	return len(consumer.Pending)
+}
+
+// SortedConsumers returns every consumer sorted by name.
+func (g *StreamGroup) SortedConsumers() []*StreamConsumer {
+	consumers := make([]*StreamConsumer, 0, len(g.Consumers))
+	for _, consumer := range g.Consumers {
+		consumers = append(consumers, consumer)
+	}
+
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].Name < consumers[j].Name
+	})
+
+	return consumers
+}
+
+// Ack removes id from the pending entries and reports whether it was there.
+func (g *StreamGroup) Ack(id StreamID) bool {
+	nack := g.Pending.get(id)
+	if nack == nil {
+		return false
+	}
+
+	g.Pending.remove(id)
+	nack.Consumer.Pending.remove(id)
+
+	return true
+}
+
+// Deliver records entries read by consumer with ">": the group moves past
+// them and, unless noAck is set, they become pending for the consumer.
+func (g *StreamGroup) Deliver(s *Stream, entries []StreamEntry, consumer *StreamConsumer, noAck bool, now time.Time) {
+	for _, entry := range entries {
+		if entry.ID.Compare(g.LastID) > 0 {
+			if g.EntriesRead != streamEntriesReadUnknown && !s.hasTombstones(entry.ID) {
+				g.EntriesRead++
+			} else if s.EntriesAdded > 0 {
+				g.EntriesRead = s.entriesReadAt(entry.ID)
+			}
+			g.LastID = entry.ID
+		}
+
+		if noAck {
+			continue
+		}
+
+		// a SETID back in time can deliver an entry that is still pending
+		if nack := g.Pending.get(entry.ID); nack != nil {
+			nack.Consumer.Pending.remove(entry.ID)
+		}
+
+		nack := &StreamNack{ID: entry.ID, Consumer: consumer, DeliveryTime: now, DeliveryCount: 1}
+		g.Pending.insert(nack)
+		consumer.Pending.insert(nack)
+	}
+
+	if len(entries) > 0 {
+		consumer.ActiveTime = now
+	}
+}
+
+// Claim moves nack to consumer.
+func (g *StreamGroup) Claim(nack *StreamNack, consumer *StreamConsumer) {
+	if nack.Consumer == consumer {
+		return
+	}
+
+	if nack.Consumer != nil {
+		nack.Consumer.Pending.remove(nack.ID)
+	}
+
+	nack.Consumer = consumer
+	consumer.Pending.insert(nack)
+}
+
+// Drop removes nack from the group and its consumer, used when the entry it
+// refers to no longer exists.
+func (g *StreamGroup) Drop(nack *StreamNack) {
+	g.Pending.remove(nack.ID)
+	if nack.Consumer != nil {
+		nack.Consumer.Pending.remove(nack.ID)
+	}
+}
+
+// hasTombstones reports whether entries after start, start included, might
+// have been deleted, which makes counting entries between IDs impossible.
+func (s *Stream) hasTombstones(start StreamID) bool {
+	if s.length == 0 || s.MaxDeletedID.IsZero() {
+		return false
+	}
+
+	return start.Compare(s.MaxDeletedID) <= 0
+}
+
+// entriesReadAt returns how many entries were added up to id, or
+// streamEntriesReadUnknown if deletions make it impossible to tell.
+func (s *Stream) entriesReadAt(id StreamID) int64 {
+	added := int64(s.EntriesAdded)
+	if added == 0 {
+		return 0
+	}
+
+	cmpLast := id.Compare(s.LastID)
+	if s.length == 0 && cmpLast <= 0 || cmpLast == 0 {
+		return added
+	}
+
+	if cmpLast > 0 {
+		return streamEntriesReadUnknown
+	}
+
+	first, _ := s.First()
+	if s.MaxDeletedID.IsZero() || s.MaxDeletedID.Compare(first.ID) < 0 {
+		// nothing was deleted after the first entry
+		switch id.Compare(first.ID) {
+		case -1:
+			return added - int64(s.length)
+		case 0:
+			return added - int64(s.length) + 1
+		}
+	}
+
+	return streamEntriesReadUnknown
+}
+
+// Lag returns how many entries the group has yet to read, false if that is
+// unknown.
+func (s *Stream) Lag(g *StreamGroup) (int64, bool) {
+	added := int64(s.EntriesAdded)
+	if added == 0 {
+		return 0, true
+	}
+
+	if g.EntriesRead != streamEntriesReadUnknown && !s.hasTombstones(g.LastID) {
+		return added - g.EntriesRead, true
+	}
+
+	read := s.entriesReadAt(g.LastID)
+	if read == streamEntriesReadUnknown {
+		return 0, false
+	}
+
+	return added - read, true
+}
+
+func (g *StreamGroup) clone() *StreamGroup {
+	c := newStreamGroup(g.Name, g.LastID, g.EntriesRead)
+
+	for name, consumer := range g.Consumers {
+		c.Consumers[name] = &StreamConsumer{
+			Name: name,
+			SeenTime: consumer.SeenTime,
+			ActiveTime: consumer.ActiveTime,
+		}
+	}
+
+	c.Pending = make(pendingList, 0, len(g.Pending))
+	for _, nack := range g.Pending {
+		n := *nack
+		n.Consumer = c.Consumers[nack.Consumer.Name]
+		c.Pending = append(c.Pending, &n)
+		n.Consumer.Pending = append(n.Consumer.Pending, &n)
+	}
+
+	return c
+}
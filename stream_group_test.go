@@ -0,0 +1,328 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withoutIdle formats an XPENDING or XINFO CONSUMERS reply like reply but
+// leaves out the idle times, which depend on how long the test took.
+func withoutIdle(v Value) string {
+	var items []string
+	for _, item := range v.array {
+		var fields []string
+		for i := 0; i < len(item.array); i++ {
+			switch {
+			case i % 2 == 0 && (item.array[i].bulk == "idle" || item.array[i].bulk == "inactive"):
+				i++
+			case item.array[i].typ == "integer" && i == 2 && len(item.array) == 4:
+				// the idle time of an XPENDING entry
+			default:
+				fields = append(fields, reply(item.array[i]))
+			}
+		}
+		items = append(items, "[" + strings.Join(fields, " ") + "]")
+	}
+
+	return "[" + strings.Join(items, " ") + "]"
+}
+
+func TestXgroup(t *testing.T) {
+	dt := createDT()
+	for _, id := range []string{"1-1", "2-1", "3-1"} {
+		run(t, dt, "XADD", "s", id, "f", id)
+	}
+
+	runSteps(t, dt, []step{
+		{"XGROUP CREATE s g 0", "OK"},
+		{"XGROUP CREATE s g $", "error: BUSYGROUP Consumer Group name already exists"},
+		{"XGROUP CREATE s late $", "OK"},
+		{"XINFO GROUPS s", `[["name" "g" "consumers" 0 "pending" 0 "last-delivered-id" "0-0" "entries-read" nil "lag" 3] ["name" "late" "consumers" 0 "pending" 0 "last-delivered-id" "3-1" "entries-read" 3 "lag" 0]]`},
+
+		{"XGROUP CREATE missing g $", "error: The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."},
+		{"XGROUP CREATE new g $ MKSTREAM", "OK"},
+		{"XLEN new", "0"},
+		{"XINFO GROUPS new", `[["name" "g" "consumers" 0 "pending" 0 "last-delivered-id" "0-0" "entries-read" 0 "lag" 0]]`},
+
+		{"XGROUP SETID s g 2-1 ENTRIESREAD 2", "OK"},
+		{"XGROUP SETID s late 0", "OK"},
+		{"XINFO GROUPS s", `[["name" "g" "consumers" 0 "pending" 0 "last-delivered-id" "2-1" "entries-read" 2 "lag" 1] ["name" "late" "consumers" 0 "pending" 0 "last-delivered-id" "0-0" "entries-read" nil "lag" 3]]`},
+
+		{"XGROUP CREATECONSUMER s g c1", "1"},
+		{"XGROUP CREATECONSUMER s g c1", "0"},
+		{"XGROUP CREATECONSUMER s g c2", "1"},
+		{"XREADGROUP GROUP g c2 STREAMS s >", `[["s" [["3-1" ["f" "3-1"]]]]]`},
+		{"XGROUP DELCONSUMER s g c1", "0"},
+		{"XGROUP DELCONSUMER s g c2", "1"},
+		{"XGROUP DELCONSUMER s g nobody", "0"},
+		{"XINFO GROUPS s", `[["name" "g" "consumers" 0 "pending" 0 "last-delivered-id" "3-1" "entries-read" 3 "lag" 0] ["name" "late" "consumers" 0 "pending" 0 "last-delivered-id" "0-0" "entries-read" nil "lag" 3]]`},
+
+		{"XGROUP DESTROY s late", "1"},
+		{"XGROUP DESTROY s late", "0"},
+		{"XINFO STREAM s", `["length" 3 "last-generated-id" "3-1" "max-deleted-entry-id" "0-0" "entries-added" 3 "recorded-first-entry-id" "1-1" "groups" 1 "first-entry" ["1-1" ["f" "1-1"]] "last-entry" ["3-1" ["f" "3-1"]]]`},
+
+		{"XGROUP SETID s nope 0", "error: NOGROUP No such consumer group 'nope' for key name 's'"},
+		{"XGROUP CREATECONSUMER s nope c", "error: NOGROUP No such consumer group 'nope' for key name 's'"},
+		{"XGROUP CREATECONSUMER missing g c", "error: The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."},
+		{"XGROUP CREATE s g2 x", "error: Invalid stream ID specified as stream command argument"},
+		{"XGROUP CREATE s g2 0 FOO", "error: syntax error"},
+		{"XGROUP SETID s g 0 MKSTREAM 1", "error: syntax error"},
+		{"XGROUP SETID s g 0 MKSTREAM", "error: wrong number of arguments for 'xgroup|setid' command"},
+		{"XGROUP CREATE s g2 0 ENTRIESREAD -2", "error: value for ENTRIESREAD must be positive or -1"},
+		{"XGROUP CREATE s g2 0 ENTRIESREAD x", "error: value is not an integer or out of range"},
+		{"XGROUP CREATE s", "error: wrong number of arguments for 'xgroup|create' command"},
+		{"XGROUP DESTROY s g x", "error: wrong number of arguments for 'xgroup|destroy' command"},
+		{"XGROUP FOO s", "error: unknown subcommand 'FOO'. Try XGROUP HELP."},
+		{"XGROUP", "error: wrong number of arguments for 'xgroup' command"},
+
+		{"SET str x", "OK"},
+		{"XGROUP CREATE str g $", "error: WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+
+func TestXreadgroupXack(t *testing.T) {
+	dt := createDT()
+	for _, id := range []string{"1-1", "2-1", "3-1"} {
+		run(t, dt, "XADD", "s", id, "f", id)
+	}
+	run(t, dt, "XGROUP", "CREATE", "s", "g", "0")
+
+	runSteps(t, dt, []step{
+		{"XREADGROUP GROUP g c1 COUNT 2 STREAMS s >", `[["s" [["1-1" ["f" "1-1"]] ["2-1" ["f" "2-1"]]]]]`},
+		{"XREADGROUP GROUP g c2 STREAMS s >", `[["s" [["3-1" ["f" "3-1"]]]]]`},
+		{"XREADGROUP GROUP g c2 STREAMS s >", "nil"},
+
+		// history is the consumer's own pending entries
+		{"XREADGROUP GROUP g c1 STREAMS s 0", `[["s" [["1-1" ["f" "1-1"]] ["2-1" ["f" "2-1"]]]]]`},
+		{"XREADGROUP GROUP g c1 COUNT 1 STREAMS s 1-1", `[["s" [["2-1" ["f" "2-1"]]]]]`},
+		{"XREADGROUP GROUP g c3 STREAMS s 0", `[["s" []]]`},
+		{"XPENDING s g", `[3 "1-1" "3-1" [["c1" "2"] ["c2" "1"]]]`},
+
+		{"XACK s g 1-1 9-9", "1"},
+		{"XACK s g 1-1", "0"},
+		{"XACK s nope 1-1", "0"},
+		{"XACK missing g 1-1", "0"},
+		{"XPENDING s g", `[2 "2-1" "3-1" [["c1" "1"] ["c2" "1"]]]`},
+
+		// an entry deleted after it was delivered comes back without fields
+		{"XDEL s 2-1", "1"},
+		{"XREADGROUP GROUP g c1 STREAMS s 0", `[["s" [["2-1" nil]]]]`},
+
+		{"XADD s 4-1 f 4-1", `"4-1"`},
+		{"XREADGROUP GROUP g c3 NOACK STREAMS s >", `[["s" [["4-1" ["f" "4-1"]]]]]`},
+		{"XPENDING s g", `[2 "2-1" "3-1" [["c1" "1"] ["c2" "1"]]]`},
+		{"XACK s g 2-1 3-1", "2"},
+		{"XPENDING s g", "[0 nil nil nil]"},
+
+		{"XACK s g x", "error: Invalid stream ID specified as stream command argument"},
+		{"XACK s g", "error: wrong number of arguments for 'xack' command"},
+		{"XREADGROUP GROUP g c STREAMS missing >", "error: NOGROUP No such key 'missing' or consumer group 'g' in XREADGROUP with GROUP option"},
+		{"XREADGROUP GROUP nope c STREAMS s >", "error: NOGROUP No such key 's' or consumer group 'nope' in XREADGROUP with GROUP option"},
+		{"XREADGROUP GROUP g c STREAMS s $", "error: The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set."},
+		{"XREADGROUP GROUP g c STREAMS s x", "error: Invalid stream ID specified as stream command argument"},
+		{"XREADGROUP GROUP g c STREAMS s s >", "error: Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified."},
+		{"XREADGROUP COUNT 1 NOACK STREAMS s >", "error: Missing GROUP option for XREADGROUP"},
+		{"XREADGROUP GROUP g c COUNT x STREAMS s >", "error: value is not an integer or out of range"},
+		{"XREADGROUP GROUP g c FOO STREAMS s >", "error: syntax error"},
+		{"XREADGROUP GROUP g c", "error: wrong number of arguments for 'xreadgroup' command"},
+	})
+}
+
+func TestXpendingXclaim(t *testing.T) {
+	dt := createDT()
+	for _, id := range []string{"1-1", "2-1", "3-1"} {
+		run(t, dt, "XADD", "s", id, "f", id)
+	}
+	run(t, dt, "XGROUP", "CREATE", "s", "g", "0")
+	run(t, dt, "XREADGROUP", "GROUP", "g", "c1", "STREAMS", "s", ">")
+
+	pending := func(want string, args ...string) {
+		t.Helper()
+		if got := withoutIdle(run(t, dt, "XPENDING", args...)); got != want {
+			t.Errorf("XPENDING %s = %s, want %s", strings.Join(args, " "), got, want)
+		}
+	}
+
+	pending(`[["1-1" "c1" 1] ["2-1" "c1" 1] ["3-1" "c1" 1]]`, "s", "g", "-", "+", "10")
+	pending(`[["2-1" "c1" 1]]`, "s", "g", "(1-1", "+", "1")
+	pending(`[["3-1" "c1" 1]]`, "s", "g", "3", "+", "10", "c1")
+	pending("[]", "s", "g", "-", "+", "10", "c2")
+	pending("[]", "s", "g", "IDLE", "100000", "-", "+", "10")
+
+	runSteps(t, dt, []step{
+		{"XCLAIM s g c2 0 1-1 2-1", `[["1-1" ["f" "1-1"]] ["2-1" ["f" "2-1"]]]`},
+		{"XCLAIM s g c3 100000 1-1", "[]"},
+		{"XCLAIM s g c3 0 3-1 JUSTID", `["3-1"]`},
+		{"XCLAIM s g c3 0 1-1 IDLE 500000 RETRYCOUNT 7 JUSTID", `["1-1"]`},
+	})
+
+	pending(`[["1-1" "c3" 7] ["2-1" "c2" 2] ["3-1" "c3" 1]]`, "s", "g", "-", "+", "10")
+	pending(`[["1-1" "c3" 7]]`, "s", "g", "IDLE", "400000", "-", "+", "10")
+
+	runSteps(t, dt, []step{
+		// a deleted entry is dropped from the group instead of claimed
+		{"XDEL s 2-1", "1"},
+		{"XCLAIM s g c3 0 2-1", "[]"},
+		{"XPENDING s g", `[2 "1-1" "3-1" [["c3" "2"]]]`},
+
+		// FORCE claims entries never delivered, if they are in the stream
+		{"XCLAIM s g c4 0 9-9 FORCE", "[]"},
+		{"XADD s 4-1 f 4-1", `"4-1"`},
+		{"XCLAIM s g c4 0 4-1 FORCE JUSTID", `["4-1"]`},
+		{"XCLAIM s g c4 0 4-1 LASTID 4-1 JUSTID", `["4-1"]`},
+		{"XINFO GROUPS s", `[["name" "g" "consumers" 4 "pending" 3 "last-delivered-id" "4-1" "entries-read" 3 "lag" 1]]`},
+
+		{"XCLAIM s g c4 x 1-1", "error: Invalid min-idle-time argument for XCLAIM"},
+		{"XCLAIM s g c4 0 1-1 IDLE x", "error: Invalid IDLE option argument for XCLAIM"},
+		{"XCLAIM s g c4 0 1-1 FOO", "error: Unrecognized XCLAIM option 'FOO'"},
+		{"XCLAIM s g c4 0 1-1 LASTID x", "error: Invalid stream ID specified as stream command argument"},
+		{"XCLAIM s nope c 0 1-1", "error: NOGROUP No such key 's' or consumer group 'nope'"},
+		{"XCLAIM missing g c 0 1-1", "error: NOGROUP No such key 'missing' or consumer group 'g'"},
+		{"XCLAIM s g c 0", "error: wrong number of arguments for 'xclaim' command"},
+
+		{"XPENDING s nope", "error: NOGROUP No such key 's' or consumer group 'nope'"},
+		{"XPENDING missing g - + 10", "error: NOGROUP No such key 'missing' or consumer group 'g'"},
+		{"XPENDING s g - + x", "error: value is not an integer or out of range"},
+		{"XPENDING s g x + 10", "error: Invalid stream ID specified as stream command argument"},
+		{"XPENDING s g IDLE x - + 10", "error: value is not an integer or out of range"},
+		{"XPENDING s g - +", "error: syntax error"},
+		{"XPENDING s", "error: wrong number of arguments for 'xpending' command"},
+	})
+}
+
+func TestXautoclaim(t *testing.T) {
+	dt := createDT()
+	for _, id := range []string{"1-1", "2-1", "3-1", "4-1", "5-1"} {
+		run(t, dt, "XADD", "s", id, "f", id)
+	}
+	run(t, dt, "XGROUP", "CREATE", "s", "g", "0")
+	run(t, dt, "XREADGROUP", "GROUP", "g", "c1", "STREAMS", "s", ">")
+
+	runSteps(t, dt, []step{
+		{"XDEL s 3-1", "1"},
+		{"XAUTOCLAIM s g c2 0 0 COUNT 2", `["3-1" [["1-1" ["f" "1-1"]] ["2-1" ["f" "2-1"]]] []]`},
+		{"XAUTOCLAIM s g c2 0 3-1 COUNT 2 JUSTID", `["0-0" ["4-1" "5-1"] ["3-1"]]`},
+		{"XPENDING s g", `[4 "1-1" "5-1" [["c2" "4"]]]`},
+		{"XAUTOCLAIM s g c3 100000 0", `["0-0" [] []]`},
+		{"XAUTOCLAIM s g c3 0 (4-1", `["0-0" [["5-1" ["f" "5-1"]]] []]`},
+		{"XPENDING s g", `[4 "1-1" "5-1" [["c2" "3"] ["c3" "1"]]]`},
+
+		{"XAUTOCLAIM s g c3 0 0 COUNT 0", "error: COUNT must be > 0"},
+		{"XAUTOCLAIM s g c3 0 0 COUNT x", "error: value is not an integer or out of range"},
+		{"XAUTOCLAIM s g c3 x 0", "error: Invalid min-idle-time argument for XAUTOCLAIM"},
+		{"XAUTOCLAIM s g c3 0 x", "error: Invalid stream ID specified as stream command argument"},
+		{"XAUTOCLAIM s g c3 0 0 FOO", "error: syntax error"},
+		{"XAUTOCLAIM s nope c 0 0", "error: NOGROUP No such key 's' or consumer group 'nope'"},
+		{"XAUTOCLAIM s g c 0", "error: wrong number of arguments for 'xautoclaim' command"},
+	})
+
+	pending := withoutIdle(run(t, dt, "XPENDING", "s", "g", "-", "+", "10"))
+	if want := `[["1-1" "c2" 2] ["2-1" "c2" 2] ["4-1" "c2" 1] ["5-1" "c3" 2]]`; pending != want {
+		t.Errorf("XPENDING s g - + 10 = %s, want %s", pending, want)
+	}
+}
+
+func TestXinfo(t *testing.T) {
+	dt := createDT()
+	run(t, dt, "XADD", "s", "1-1", "f", "v")
+	run(t, dt, "XADD", "s", "2-1", "f", "v")
+	run(t, dt, "XGROUP", "CREATE", "s", "g", "0")
+	run(t, dt, "XGROUP", "CREATECONSUMER", "s", "g", "idle")
+	run(t, dt, "XREADGROUP", "GROUP", "g", "reader", "COUNT", "1", "STREAMS", "s", ">")
+
+	consumers := withoutIdle(run(t, dt, "XINFO", "CONSUMERS", "s", "g"))
+	if want := `[["name" "idle" "pending" 0] ["name" "reader" "pending" 1]]`; consumers != want {
+		t.Errorf("XINFO CONSUMERS s g = %s, want %s", consumers, want)
+	}
+
+	// a consumer that never read anything was never active
+	if res := run(t, dt, "XINFO", "CONSUMERS", "s", "g"); reply(res.array[0].array[7]) != "-1" {
+		t.Errorf("inactive of a new consumer = %s, want -1", reply(res.array[0].array[7]))
+	}
+
+	runSteps(t, dt, []step{
+		{"XDEL s 2-1", "1"},
+		{"XINFO STREAM s", `["length" 1 "last-generated-id" "2-1" "max-deleted-entry-id" "2-1" "entries-added" 2 "recorded-first-entry-id" "1-1" "groups" 1 "first-entry" ["1-1" ["f" "v"]] "last-entry" ["1-1" ["f" "v"]]]`},
+		{"XINFO GROUPS s", `[["name" "g" "consumers" 2 "pending" 1 "last-delivered-id" "1-1" "entries-read" 1 "lag" nil]]`},
+
+		{"XINFO STREAM missing", "error: no such key"},
+		{"XINFO GROUPS missing", "error: no such key"},
+		{"XINFO CONSUMERS s nope", "error: NOGROUP No such consumer group 'nope' for key name 's'"},
+		{"XINFO STREAM", "error: wrong number of arguments for 'xinfo|stream' command"},
+		{"XINFO CONSUMERS s", "error: wrong number of arguments for 'xinfo|consumers' command"},
+		{"XINFO FOO s", "error: unknown subcommand 'FOO'. Try XINFO HELP."},
+		{"XINFO", "error: wrong number of arguments for 'xinfo' command"},
+	})
+}
+
+func TestStreamGroupReplay(t *testing.T) {
+	commands := []string{
+		"XADD s 1-1 f 1",
+		"XADD s 2-1 f 2",
+		"XADD s 3-1 f 3",
+		"XADD s 4-1 f 4",
+		"XGROUP CREATE s g 0",
+		"XGROUP CREATE s other $ ENTRIESREAD 2",
+		"XGROUP CREATE s gone 0",
+		"XGROUP DESTROY s gone",
+		"XGROUP CREATE empty g $ MKSTREAM",
+		"XREADGROUP GROUP g c1 COUNT 2 STREAMS s >",
+		"XREADGROUP GROUP g c2 STREAMS s >",
+		"XACK s g 1-1",
+		"XCLAIM s g c3 0 2-1 IDLE 500000 RETRYCOUNT 5",
+		"XAUTOCLAIM s g c3 0 4-1 JUSTID",
+		"XGROUP CREATECONSUMER s g idle",
+		"XGROUP CREATECONSUMER s g dropped",
+		"XGROUP DELCONSUMER s g dropped",
+		"XGROUP SETID s other 3-1",
+		"XADD s 5-1 f 5",
+		"XREADGROUP GROUP other c NOACK STREAMS s >",
+		"XDEL s 3-1",
+	}
+
+	checkReplay(t, commands, []string{
+		"XINFO STREAM s",
+		"XINFO GROUPS s",
+		"XINFO GROUPS empty",
+		"XPENDING s g",
+		"XPENDING s other",
+	})
+
+	// the pending entries keep their consumers, delivery counts and
+	// delivery times
+	dir := t.TempDir()
+	srv := openServer(t, dir)
+	for _, command := range commands {
+		if res := exec(t, srv, strings.Fields(command)...); res.typ == "error" {
+			t.Fatalf("%s: %s", command, res.str)
+		}
+	}
+
+	state := func(srv *Server) string {
+		return strings.Join([]string{
+			withoutIdle(exec(t, srv, "XPENDING", "s", "g", "-", "+", "10")),
+			withoutIdle(exec(t, srv, "XPENDING", "s", "g", "IDLE", "400000", "-", "+", "10")),
+			withoutIdle(exec(t, srv, "XINFO", "CONSUMERS", "s", "g")),
+		}, " ")
+	}
+
+	want := state(srv)
+	if w := `[["2-1" "c3" 5] ["3-1" "c2" 1] ["4-1" "c3" 1]] [["2-1" "c3" 5]] [["name" "c1" "pending" 0] ["name" "c2" "pending" 1] ["name" "c3" "pending" 2] ["name" "idle" "pending" 0]]`; want != w {
+		t.Fatalf("state before a restart = %s, want %s", want, w)
+	}
+
+	srv = restart(t, srv, dir)
+	if got := state(srv); got != want {
+		t.Errorf("state after a restart = %s, want %s", got, want)
+	}
+
+	if res := exec(t, srv, "BGREWRITEAOF"); res.typ == "error" {
+		t.Fatal(res.str)
+	}
+	srv = restart(t, srv, dir)
+	defer srv.aof.AofClose()
+
+	if got := state(srv); got != want {
+		t.Errorf("state after a rewrite = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXadd(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"XADD s 1-1 f v", `"1-1"`},
+		{"XADD s 1-* f v", `"1-2"`},
+		{"XADD s 5-* f v", `"5-0"`},
+		{"XADD s 5 f v", "error: The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD s 5-1 f v", `"5-1"`},
+		{"XADD s 4-9 f v", "error: The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD e 0-0 f v", "error: The ID specified in XADD must be greater than 0-0"},
+		{"XADD s x-1 f v", "error: Invalid stream ID specified as stream command argument"},
+		{"XADD s 6-1 f", "error: wrong number of arguments for 'xadd' command"},
+		{"XADD s 6-1 f v g", "error: wrong number of arguments for 'xadd' command"},
+		{"XADD s", "error: wrong number of arguments for 'xadd' command"},
+		{"XLEN s", "4"},
+
+		{"XADD missing NOMKSTREAM * f v", "nil"},
+		{"EXISTS missing", "0"},
+
+		{"XADD s MAXLEN 2 6-1 f v", `"6-1"`},
+		{"XLEN s", "2"},
+		{"XRANGE s - +", `[["5-1" ["f" "v"]] ["6-1" ["f" "v"]]]`},
+		{"XADD s MINID 6 7-1 f v", `"7-1"`},
+		{"XRANGE s - + COUNT 1", `[["6-1" ["f" "v"]]]`},
+		{"XADD s MAXLEN -1 8-1 f v", "error: The MAXLEN argument must be >= 0."},
+		{"XADD s MAXLEN x 8-1 f v", "error: value is not an integer or out of range"},
+		{"XADD s 18446744073709551615-18446744073709551615 f v", `"18446744073709551615-18446744073709551615"`},
+		{"XADD s * f v", "error: The stream has exhausted the last possible ID, unable to add more items"},
+	})
+}
+
+func TestXaddAutoID(t *testing.T) {
+	dt := createDT()
+
+	before := time.Now().UnixMilli()
+	first := run(t, dt, "XADD", "s", "*", "f", "v").bulk
+	second := run(t, dt, "XADD", "s", "*", "f", "v").bulk
+
+	id1, err1 := parseStreamID(first, 0)
+	id2, err2 := parseStreamID(second, 0)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("XADD * returned %q and %q", first, second)
+	}
+
+	if id1.Ms < uint64(before) || id1.Compare(id2) >= 0 {
+		t.Errorf("XADD * returned %s then %s, want increasing IDs from %d", id1, id2, before)
+	}
+}
+
+func TestXrange(t *testing.T) {
+	dt := createDT()
+	for _, id := range []string{"1-1", "1-2", "2-1", "3-1", "3-2"} {
+		run(t, dt, "XADD", "s", id, "id", id)
+	}
+
+	entry := func(ids ...string) string {
+		items := make([]string, 0, len(ids))
+		for _, id := range ids {
+			items = append(items, `["` + id + `" ["id" "` + id + `"]]`)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+
+	runSteps(t, dt, []step{
+		{"XRANGE s - +", entry("1-1", "1-2", "2-1", "3-1", "3-2")},
+		{"XRANGE s 1 2", entry("1-1", "1-2", "2-1")},
+		{"XRANGE s 1-2 3-1", entry("1-2", "2-1", "3-1")},
+		{"XRANGE s (1-2 (3-2", entry("2-1", "3-1")},
+		{"XRANGE s - + COUNT 2", entry("1-1", "1-2")},
+		{"XRANGE s - + COUNT 0", "[]"},
+		{"XRANGE s 4 +", "[]"},
+		{"XRANGE s 3 1", "[]"},
+		{"XRANGE missing - +", "[]"},
+
+		{"XREVRANGE s + -", entry("3-2", "3-1", "2-1", "1-2", "1-1")},
+		{"XREVRANGE s 2 1", entry("2-1", "1-2", "1-1")},
+		{"XREVRANGE s + - COUNT 1", entry("3-2")},
+		{"XREVRANGE s (3-2 (1-1", entry("3-1", "2-1", "1-2")},
+
+		{"XRANGE s x +", "error: Invalid stream ID specified as stream command argument"},
+		{"XRANGE s - + COUNT x", "error: value is not an integer or out of range"},
+		{"XRANGE s - + LIMIT 1", "error: syntax error"},
+		{"XRANGE s (+ +", "error: Invalid stream ID specified as stream command argument"},
+		{"XRANGE s (18446744073709551615-18446744073709551615 +", "error: invalid start or end ID, the range is empty"},
+		{"XRANGE s -", "error: wrong number of arguments for 'xrange' command"},
+		{"XREVRANGE s +", "error: wrong number of arguments for 'xrevrange' command"},
+	})
+}
+
+func TestXdelXtrim(t *testing.T) {
+	dt := createDT()
+	for _, id := range []string{"1-1", "2-1", "3-1", "4-1", "5-1"} {
+		run(t, dt, "XADD", "s", id, "f", "v")
+	}
+
+	runSteps(t, dt, []step{
+		{"XDEL s 2-1 9-9", "1"},
+		{"XDEL s 2-1", "0"},
+		{"XDEL missing 1-1", "0"},
+		{"XDEL s x", "error: Invalid stream ID specified as stream command argument"},
+		{"XDEL s", "error: wrong number of arguments for 'xdel' command"},
+		{"XLEN s", "4"},
+
+		{"XTRIM s MAXLEN 3", "1"},
+		{"XRANGE s - +", `[["3-1" ["f" "v"]] ["4-1" ["f" "v"]] ["5-1" ["f" "v"]]]`},
+		{"XTRIM s MINID 4", "1"},
+		{"XTRIM s MAXLEN = 5", "0"},
+		{"XTRIM s MAXLEN 0", "2"},
+		{"XLEN s", "0"},
+
+		// an emptied stream stays, and so does its last ID
+		{"EXISTS s", "1"},
+		{"XADD s 5-1 f v", "error: The ID specified in XADD is equal or smaller than the target stream top item"},
+
+		{"XTRIM missing MAXLEN 1", "0"},
+		{"XTRIM s MAXLEN -1", "error: The MAXLEN argument must be >= 0."},
+		{"XTRIM s SIZE 1", "error: syntax error"},
+		{"XTRIM s MAXLEN", "error: wrong number of arguments for 'xtrim' command"},
+		{"XLEN missing", "0"},
+	})
+}
+
+func TestXread(t *testing.T) {
+	dt := createDT()
+	run(t, dt, "XADD", "a", "1-1", "f", "1")
+	run(t, dt, "XADD", "a", "2-1", "f", "2")
+	run(t, dt, "XADD", "b", "1-1", "f", "3")
+
+	runSteps(t, dt, []step{
+		{"XREAD STREAMS a 0", `[["a" [["1-1" ["f" "1"]] ["2-1" ["f" "2"]]]]]`},
+		{"XREAD COUNT 1 STREAMS a b 1-1 0", `[["a" [["2-1" ["f" "2"]]]] ["b" [["1-1" ["f" "3"]]]]]`},
+		{"XREAD STREAMS a missing 0 0", `[["a" [["1-1" ["f" "1"]] ["2-1" ["f" "2"]]]]]`},
+		{"XREAD STREAMS a $", "nil"},
+		{"XREAD STREAMS a 2-1", "nil"},
+		{"XREAD BLOCK 10 STREAMS a $", "nil"},
+
+		{"XREAD STREAMS a b 0", "error: Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."},
+		{"XREAD COUNT x STREAMS a 0", "error: value is not an integer or out of range"},
+		{"XREAD BLOCK -1 STREAMS a 0", "error: timeout is negative"},
+		{"XREAD STREAMS a x", "error: Invalid stream ID specified as stream command argument"},
+		{"XREAD a b 0", "error: syntax error"},
+		{"XREAD STREAMS a", "error: wrong number of arguments for 'xread' command"},
+	})
+}
+
+// TestXreadBlock blocks an XREAD on a stream and adds an entry to it.
+func TestXreadBlock(t *testing.T) {
+	dt := createDT()
+	run(t, dt, "XADD", "s", "1-1", "f", "old")
+
+	done := make(chan Value)
+	go func() {
+		done <- run(t, dt, "XREAD", "BLOCK", "5000", "STREAMS", "s", "$")
+	}()
+
+	// an entry added to another stream doesn't wake it up for good
+	time.Sleep(50 * time.Millisecond)
+	run(t, dt, "XADD", "other", "1-1", "f", "v")
+	time.Sleep(50 * time.Millisecond)
+	run(t, dt, "XADD", "s", "2-1", "f", "new")
+
+	select {
+	case res := <-done:
+		if got, want := reply(res), `[["s" [["2-1" ["f" "new"]]]]]`; got != want {
+			t.Errorf("blocked XREAD = %s, want %s", got, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("blocked XREAD didn't return after XADD")
+	}
+
+	start := time.Now()
+	if res := run(t, dt, "XREAD", "BLOCK", "100", "STREAMS", "s", "$"); res.typ != "null" {
+		t.Errorf("XREAD BLOCK 100 with nothing new = %s", reply(res))
+	}
+	if elapsed := time.Since(start); elapsed < 100 * time.Millisecond {
+		t.Errorf("XREAD BLOCK 100 returned after %v", elapsed)
+	}
+}
+
+func TestStreamReplay(t *testing.T) {
+	checkReplay(t, []string{
+		"XADD s 1-1 f v",
+		"XADD s 1-* f v g w",
+		"XADD s 5-* f v",
+		"XADD s MAXLEN 3 6-1 f v",
+		"XDEL s 5-0",
+		"XADD trimmed 1-1 f v",
+		"XADD trimmed 2-1 f v",
+		"XTRIM trimmed MAXLEN 0",
+		"XADD min 1-1 f v",
+		"XADD min 2-1 f v",
+		"XTRIM min MINID 2",
+	}, []string{
+		"XRANGE s - +",
+		"XLEN s",
+		"XINFO STREAM s",
+		"XINFO STREAM trimmed",
+		"XRANGE min - +",
+	})
+
+	// XADD * has to log the ID it generated
+	dir := t.TempDir()
+	srv := openServer(t, dir)
+	exec(t, srv, "XADD", "auto", "*", "f", "v")
+	exec(t, srv, "XADD", "auto", "*", "f", "v")
+	srv = restart(t, srv, dir, []string{"XRANGE", "auto", "-", "+"})
+	srv.aof.AofClose()
+}
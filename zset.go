@@ -0,0 +1,694 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+)
+
+// A sorted set keeps its members twice: a map from member to score for
+// O(1) lookups, and a skip list ordered by score, then member, for ranks and
+// ranges. Every link of the skip list stores its span, the number of nodes
+// it skips, so the rank of a node is the sum of the spans walked to reach it.
+const (
+	zskiplistMaxLevel = 32
+	zskiplistP = 0.25
+)
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span int
+}
+
+type zskiplistNode struct {
+	member string
+	score float64
+	backward *zskiplistNode
+	level []zskiplistLevel
+}
+
+type zskiplist struct {
+	header *zskiplistNode
+	tail *zskiplistNode
+	length int
+	level int
+}
+
+func newZskiplist() *zskiplist {
+	return &zskiplist{
+		header: &zskiplistNode{level: make([]zskiplistLevel, zskiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+// zslRandomLevel returns a level between 1 and zskiplistMaxLevel, each level
+// being zskiplistP times as likely as the one below.
+func zslRandomLevel() int {
+	level := 1
+	for level < zskiplistMaxLevel && rand.Float64() < zskiplistP {
+		level++
+	}
+
+	return level
+}
+
+// before reports whether n sorts before the element (score, member).
+func (n *zskiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds an element that must not be in the list yet.
+func (zsl *zskiplist) insert(score float64, member string) *zskiplistNode {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	var rank [zskiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level - 1 {
+			rank[i] = rank[i + 1]
+		}
+
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &zskiplistNode{member: member, score: score, level: make([]zskiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+
+	// the new node sits under the links of the higher levels
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+
+	return x
+}
+
+// delete removes the element (score, member) and reports whether it was
+// there.
+func (zsl *zskiplist) delete(score float64, member string) bool {
+	var update [zskiplistMaxLevel]*zskiplistNode
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+
+	for zsl.level > 1 && zsl.header.level[zsl.level - 1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+
+	return true
+}
+
+// rank returns the 1 based rank of the element (score, member), 0 if it is
+// not in the list.
+func (zsl *zskiplist) rank(score float64, member string) int {
+	rank := 0
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for next := x.level[i].forward; next != nil && (next.before(score, member) || (next.score == score && next.member == member)); next = x.level[i].forward {
+			rank += x.level[i].span
+			x = next
+		}
+
+		if x != zsl.header && x.score == score && x.member == member {
+			return rank
+		}
+	}
+
+	return 0
+}
+
+// byRank returns the node at the 1 based rank, nil if out of range.
+func (zsl *zskiplist) byRank(rank int) *zskiplistNode {
+	traversed := 0
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed + x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+
+		if traversed == rank && x != zsl.header {
+			return x
+		}
+	}
+
+	return nil
+}
+
+// zrangeSpec is a range of scores or of members, as given to ZRANGE BYSCORE
+// and BYLEX.
+type zrangeSpec interface {
+	gteMin(n *zskiplistNode) bool
+	lteMax(n *zskiplistNode) bool
+}
+
+// firstInRange returns the first node inside spec, nil if there is none.
+func (zsl *zskiplist) firstInRange(spec zrangeSpec) *zskiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !spec.gteMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+
+	x = x.level[0].forward
+	if x == nil || !spec.lteMax(x) {
+		return nil
+	}
+
+	return x
+}
+
+// lastInRange returns the last node inside spec, nil if there is none.
+func (zsl *zskiplist) lastInRange(spec zrangeSpec) *zskiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && spec.lteMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+
+	if x == zsl.header || !spec.gteMin(x) {
+		return nil
+	}
+
+	return x
+}
+
+// zscoreRange is a score range, min and max are excluded if minex or maxex
+// are set.
+type zscoreRange struct {
+	min, max float64
+	minex, maxex bool
+}
+
+func (r *zscoreRange) gteMin(n *zskiplistNode) bool {
+	if r.minex {
+		return n.score > r.min
+	}
+
+	return n.score >= r.min
+}
+
+func (r *zscoreRange) lteMax(n *zskiplistNode) bool {
+	if r.maxex {
+		return n.score < r.max
+	}
+
+	return n.score <= r.max
+}
+
+// zlexBound is one end of a lex range: "-" and "+" (inf -1 and 1) are below
+// and above every member, "[x" includes x and "(x" excludes it.
+type zlexBound struct {
+	val string
+	ex bool
+	inf int
+}
+
+type zlexRange struct {
+	min, max zlexBound
+}
+
+func (r *zlexRange) gteMin(n *zskiplistNode) bool {
+	switch {
+	case r.min.inf != 0:
+		return r.min.inf < 0
+	case r.min.ex:
+		return n.member > r.min.val
+	}
+
+	return n.member >= r.min.val
+}
+
+func (r *zlexRange) lteMax(n *zskiplistNode) bool {
+	switch {
+	case r.max.inf != 0:
+		return r.max.inf > 0
+	case r.max.ex:
+		return n.member < r.max.val
+	}
+
+	return n.member <= r.max.val
+}
+
+var errScoreRange = errors.New("min or max is not a float")
+var errLexRange = errors.New("min or max not valid string range item")
+
+// parseScoreRange parses ZRANGE BYSCORE bounds such as "1", "(1" or "-inf".
+func parseScoreRange(min string, max string) (*zscoreRange, error) {
+	r := &zscoreRange{}
+
+	var err error
+	if r.min, r.minex, err = parseScoreBound(min); err != nil {
+		return nil, err
+	}
+
+	if r.max, r.maxex, err = parseScoreBound(max); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func parseScoreBound(s string) (float64, bool, error) {
+	ex := len(s) > 0 && s[0] == '('
+	if ex {
+		s = s[1:]
+	}
+
+	score, err := parseScore(s)
+	if err != nil {
+		return 0, false, errScoreRange
+	}
+
+	return score, ex, nil
+}
+
+// parseLexRange parses ZRANGE BYLEX bounds such as "[a", "(a", "-" or "+".
+func parseLexRange(min string, max string) (*zlexRange, error) {
+	r := &zlexRange{}
+
+	var err error
+	if r.min, err = parseLexBound(min); err != nil {
+		return nil, err
+	}
+
+	if r.max, err = parseLexBound(max); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func parseLexBound(s string) (zlexBound, error) {
+	switch {
+	case s == "-":
+		return zlexBound{inf: -1}, nil
+	case s == "+":
+		return zlexBound{inf: 1}, nil
+	case len(s) > 0 && s[0] == '[':
+		return zlexBound{val: s[1:]}, nil
+	case len(s) > 0 && s[0] == '(':
+		return zlexBound{val: s[1:], ex: true}, nil
+	}
+
+	return zlexBound{}, errLexRange
+}
+
+// parseScore parses a score, "inf", "+inf" and "-inf" included. NaN is not
+// a valid score.
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("value is not a valid float")
+	}
+
+	return score, nil
+}
+
+// formatScore formats a score the way Redis replies with it: integers
+// without a fraction, infinities as "inf" and "-inf", anything else in the
+// shortest form that parses back to the same value.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case score == math.Trunc(score) && math.Abs(score) < 1e17:
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	}
+
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// ZSet is a sorted set.
+type ZSet struct {
+	dict *Dict[float64]
+	zsl *zskiplist
+}
+
+func newZSet() *ZSet {
+	return &ZSet{dict: NewDict[float64](), zsl: newZskiplist()}
+}
+
+func (z *ZSet) Len() int {
+	return z.dict.Len()
+}
+
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, exist := z.dict.Get(member)
+	return score, exist
+}
+
+// Add sets the score of member and reports whether it is a new member.
+func (z *ZSet) Add(member string, score float64) bool {
+	cur, exist := z.dict.Get(member)
+	if exist {
+		if cur == score {
+			return false
+		}
+
+		z.zsl.delete(cur, member)
+	}
+
+	z.zsl.insert(score, member)
+	z.dict.Set(member, score)
+
+	return !exist
+}
+
+// Remove removes member and reports whether it was there.
+func (z *ZSet) Remove(member string) bool {
+	score, exist := z.dict.Get(member)
+	if !exist {
+		return false
+	}
+
+	z.zsl.delete(score, member)
+	z.dict.Delete(member)
+
+	return true
+}
+
+// Rank returns the 0 based rank of member, counted from the highest score
+// if rev is set.
+func (z *ZSet) Rank(member string, rev bool) (int, bool) {
+	score, exist := z.dict.Get(member)
+	if !exist {
+		return 0, false
+	}
+
+	rank := z.zsl.rank(score, member)
+	if rev {
+		return z.zsl.length - rank, true
+	}
+
+	return rank - 1, true
+}
+
+// RangeByRank returns the nodes from rank start to stop, both included and
+// already clamped to the size of the set.
+func (z *ZSet) RangeByRank(start int, stop int, rev bool) []*zskiplistNode {
+	nodes := make([]*zskiplistNode, 0, stop - start + 1)
+
+	var x *zskiplistNode
+	if rev {
+		x = z.zsl.byRank(z.zsl.length - start)
+	} else {
+		x = z.zsl.byRank(start + 1)
+	}
+
+	for i := start; i <= stop && x != nil; i++ {
+		nodes = append(nodes, x)
+
+		if rev {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+
+	return nodes
+}
+
+// RangeBySpec returns the nodes inside spec, skipping offset of them and
+// returning at most count, all of them if count is negative.
+func (z *ZSet) RangeBySpec(spec zrangeSpec, rev bool, offset int, count int) []*zskiplistNode {
+	if offset < 0 {
+		return nil
+	}
+
+	var nodes []*zskiplistNode
+
+	var x *zskiplistNode
+	if rev {
+		x = z.zsl.lastInRange(spec)
+	} else {
+		x = z.zsl.firstInRange(spec)
+	}
+
+	for x != nil && count != 0 {
+		if rev && !spec.gteMin(x) || !rev && !spec.lteMax(x) {
+			break
+		}
+
+		if offset > 0 {
+			offset--
+		} else {
+			nodes = append(nodes, x)
+			count--
+		}
+
+		if rev {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+
+	return nodes
+}
+
+// Count returns the number of members inside spec.
+func (z *ZSet) Count(spec zrangeSpec) int {
+	first := z.zsl.firstInRange(spec)
+	if first == nil {
+		return 0
+	}
+
+	last := z.zsl.lastInRange(spec)
+	if last == nil {
+		return 0
+	}
+
+	return z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+}
+
+// RemoveRange removes the members inside spec and returns how many there
+// were.
+func (z *ZSet) RemoveRange(spec zrangeSpec) int {
+	nodes := z.RangeBySpec(spec, false, 0, -1)
+	for _, node := range nodes {
+		z.Remove(node.member)
+	}
+
+	return len(nodes)
+}
+
+// All returns every node in ascending order.
+func (z *ZSet) All() []*zskiplistNode {
+	return z.RangeByRank(0, z.Len() - 1, false)
+}
+
+// Scan walks the members and their scores like Dict.ScanCount.
+func (z *ZSet) Scan(cursor uint64, count int, fn func(member string, score float64)) uint64 {
+	return z.dict.ScanCount(cursor, count, fn)
+}
+
+func (z *ZSet) clone() *ZSet {
+	c := newZSet()
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		c.Add(x.member, x.score)
+	}
+
+	return c
+}
+
+// zsetOperand is an input of ZUNION, ZINTER and ZDIFF: a sorted set, or a
+// plain set whose members all score 1. Both are nil for a missing key.
+type zsetOperand struct {
+	zset *ZSet
+	set *Set
+	weight float64
+}
+
+func (o *zsetOperand) Len() int {
+	switch {
+	case o.zset != nil:
+		return o.zset.Len()
+	case o.set != nil:
+		return o.set.Len()
+	}
+
+	return 0
+}
+
+func (o *zsetOperand) Score(member string) (float64, bool) {
+	switch {
+	case o.zset != nil:
+		return o.zset.Score(member)
+	case o.set != nil:
+		return 1, o.set.Has(member)
+	}
+
+	return 0, false
+}
+
+func (o *zsetOperand) each(fn func(member string, score float64)) {
+	switch {
+	case o.zset != nil:
+		for member, score := range o.zset.dict.All() {
+			fn(member, score)
+		}
+	case o.set != nil:
+		for _, member := range o.set.Members() {
+			fn(member, 1)
+		}
+	}
+}
+
+// weighted returns score times the weight of o, 0 for the NaN of inf * 0.
+func (o *zsetOperand) weighted(score float64) float64 {
+	score *= o.weight
+	if math.IsNaN(score) {
+		return 0
+	}
+
+	return score
+}
+
+// zsetAggregate combines the scores of a member found in several inputs, it
+// is one of "SUM", "MIN" and "MAX".
+func zsetAggregate(aggregate string, a float64, b float64) float64 {
+	switch aggregate {
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+
+	// inf + -inf
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+
+	return 0
+}
+
+func zsetFromScores(scores map[string]float64) *ZSet {
+	res := newZSet()
+	for member, score := range scores {
+		res.Add(member, score)
+	}
+
+	return res
+}
+
+func zsetUnion(ops []*zsetOperand, aggregate string) *ZSet {
+	scores := make(map[string]float64)
+	for _, op := range ops {
+		op.each(func(member string, score float64) {
+			score = op.weighted(score)
+			if cur, exist := scores[member]; exist {
+				score = zsetAggregate(aggregate, cur, score)
+			}
+			scores[member] = score
+		})
+	}
+
+	return zsetFromScores(scores)
+}
+
+// zsetInter walks the smallest input and looks its members up in the
+// others.
+func zsetInter(ops []*zsetOperand, aggregate string) *ZSet {
+	sorted := slices.Clone(ops)
+	slices.SortFunc(sorted, func(a, b *zsetOperand) int {
+		return a.Len() - b.Len()
+	})
+
+	scores := make(map[string]float64)
+	sorted[0].each(func(member string, score float64) {
+		score = sorted[0].weighted(score)
+
+		for _, op := range sorted[1:] {
+			other, exist := op.Score(member)
+			if !exist {
+				return
+			}
+			score = zsetAggregate(aggregate, score, op.weighted(other))
+		}
+
+		scores[member] = score
+	})
+
+	return zsetFromScores(scores)
+}
+
+// zsetDiff returns the members of the first input that are in none of the
+// others, with their original scores.
+func zsetDiff(ops []*zsetOperand) *ZSet {
+	scores := make(map[string]float64)
+	ops[0].each(func(member string, score float64) {
+		for _, op := range ops[1:] {
+			if _, exist := op.Score(member); exist {
+				return
+			}
+		}
+
+		scores[member] = score
+	})
+
+	return zsetFromScores(scores)
+}
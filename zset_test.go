@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestZadd(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"ZADD z 1 a 2 b 3 c", "3"},
+		{"ZADD z 1 a", "0"},
+		{"ZADD z CH 5 a 2 b 4 d", "2"},
+		{"ZRANGE z 0 -1 WITHSCORES", `["b" "2" "c" "3" "d" "4" "a" "5"]`},
+
+		{"ZADD z NX 10 a 6 e", "1"},
+		{"ZSCORE z a", `"5"`},
+		{"ZADD z XX 7 e 8 f", "0"},
+		{"ZSCORE z e", `"7"`},
+		{"ZSCORE z f", "nil"},
+
+		{"ZADD z GT CH 1 a 9 a", "1"},
+		{"ZSCORE z a", `"9"`},
+		{"ZADD z LT CH 1 b", "1"},
+		{"ZSCORE z b", `"1"`},
+		{"ZADD z GT 1 new", "1"},
+
+		{"ZADD z INCR 2 a", `"11"`},
+		{"ZADD z NX INCR 2 a", "nil"},
+		{"ZADD z XX INCR 2 missing", "nil"},
+		{"ZADD z -inf low +inf high", "2"},
+		{"ZRANGE z 0 0", `["low"]`},
+		{"ZRANGE z -1 -1", `["high"]`},
+
+		{"ZADD z", "error: wrong number of arguments for 'zadd' command"},
+		{"ZADD z 1", "error: wrong number of arguments for 'zadd' command"},
+		{"ZADD z 1 a 2", "error: syntax error"},
+		{"ZADD z x a", "error: value is not a valid float"},
+		{"ZADD z nan a", "error: value is not a valid float"},
+		{"ZADD z NX XX 1 a", "error: XX and NX options at the same time are not compatible"},
+		{"ZADD z GT LT 1 a", "error: GT, LT, and/or NX options at the same time are not compatible"},
+		{"ZADD z NX GT 1 a", "error: GT, LT, and/or NX options at the same time are not compatible"},
+		{"ZADD z INCR 1 a 2 b", "error: INCR option supports a single increment-element pair"},
+		{"ZADD z INCR +inf high2", `"inf"`},
+		{"ZADD z INCR -inf high", "error: resulting score is not a number (NaN)"},
+	})
+}
+
+func TestZsetBasics(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"ZADD z 1 a 2 b 3 c", "3"},
+		{"ZCARD z", "3"},
+		{"ZCARD missing", "0"},
+		{"ZSCORE z b", `"2"`},
+		{"ZSCORE z x", "nil"},
+		{"ZSCORE missing x", "nil"},
+
+		{"ZINCRBY z 1.5 a", `"2.5"`},
+		{"ZINCRBY z 1 new", `"1"`},
+		{"ZINCRBY z x a", "error: value is not a valid float"},
+		{"ZINCRBY z 1", "error: wrong number of arguments for 'zincrby' command"},
+
+		{"ZRANK z new", "0"},
+		{"ZRANK z c", "3"},
+		{"ZRANK z x", "nil"},
+		{"ZRANK missing x", "nil"},
+		{"ZREVRANK z c", "0"},
+		{"ZREVRANK z new", "3"},
+		{"ZRANK z c WITHSCORE", `[3 "3"]`},
+		{"ZREVRANK z c WITHSCORE", `[0 "3"]`},
+
+		{"ZREM z a x", "1"},
+		{"ZREM z x", "0"},
+		{"ZREM z", "error: wrong number of arguments for 'zrem' command"},
+		{"ZREM z new b c", "3"},
+		{"EXISTS z", "0"},
+	})
+}
+
+func TestZrange(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"ZADD z 1 a 2 b 3 c 4 d 5 e", "5"},
+		{"ZADD lex 0 a 0 b 0 c 0 d 0 e", "5"},
+
+		{"ZRANGE z 0 -1", `["a" "b" "c" "d" "e"]`},
+		{"ZRANGE z 1 2 WITHSCORES", `["b" "2" "c" "3"]`},
+		{"ZRANGE z -2 100", `["d" "e"]`},
+		{"ZRANGE z 3 1", "[]"},
+		{"ZRANGE z 0 -1 REV", `["e" "d" "c" "b" "a"]`},
+		{"ZRANGE missing 0 -1", "[]"},
+
+		{"ZRANGE z 2 4 BYSCORE", `["b" "c" "d"]`},
+		{"ZRANGE z (2 4 BYSCORE", `["c" "d"]`},
+		{"ZRANGE z (2 (4 BYSCORE", `["c"]`},
+		{"ZRANGE z -inf +inf BYSCORE LIMIT 1 2", `["b" "c"]`},
+		{"ZRANGE z -inf +inf BYSCORE LIMIT 4 -1", `["e"]`},
+		{"ZRANGE z 4 2 BYSCORE REV", `["d" "c" "b"]`},
+		{"ZRANGE z +inf -inf BYSCORE REV LIMIT 0 2 WITHSCORES", `["e" "5" "d" "4"]`},
+		{"ZRANGE z 4 2 BYSCORE", "[]"},
+
+		{"ZRANGE lex [b [d BYLEX", `["b" "c" "d"]`},
+		{"ZRANGE lex (b (d BYLEX", `["c"]`},
+		{"ZRANGE lex - + BYLEX LIMIT 1 2", `["b" "c"]`},
+		{"ZRANGE lex + - BYLEX REV", `["e" "d" "c" "b" "a"]`},
+		{"ZRANGE lex [c - BYLEX REV", `["c" "b" "a"]`},
+
+		{"ZRANGE z 0", "error: wrong number of arguments for 'zrange' command"},
+		{"ZRANGE z a b", "error: value is not an integer or out of range"},
+		{"ZRANGE z x 1 BYSCORE", "error: min or max is not a float"},
+		{"ZRANGE lex b d BYLEX", "error: min or max not valid string range item"},
+		{"ZRANGE z 0 1 LIMIT 0 1", "error: syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"},
+		{"ZRANGE lex - + BYLEX WITHSCORES", "error: syntax error, WITHSCORES not supported in combination with BYLEX"},
+		{"ZRANGE z 0 1 BYSCORE BYLEX", "error: min or max not valid string range item"},
+		{"ZRANGE z 0 1 FOO", "error: syntax error"},
+	})
+}
+
+func TestZcountPopRemrange(t *testing.T) {
+	runSteps(t, createDT(), []step{
+		{"ZADD z 1 a 2 b 3 c 4 d 5 e", "5"},
+
+		{"ZCOUNT z 2 4", "3"},
+		{"ZCOUNT z (2 4", "2"},
+		{"ZCOUNT z -inf +inf", "5"},
+		{"ZCOUNT z 4 2", "0"},
+		{"ZCOUNT missing 0 1", "0"},
+		{"ZCOUNT z x 1", "error: min or max is not a float"},
+
+		{"ZPOPMIN z", `["a" "1"]`},
+		{"ZPOPMAX z 2", `["e" "5" "d" "4"]`},
+		{"ZPOPMIN z 0", "[]"},
+		{"ZPOPMIN missing", "[]"},
+		{"ZPOPMIN z -1", "error: value is out of range, must be positive"},
+		{"ZPOPMIN z x", "error: value is out of range, must be positive"},
+		{"ZCARD z", "2"},
+		{"ZPOPMAX z 10", `["c" "3" "b" "2"]`},
+		{"EXISTS z", "0"},
+
+		{"ZADD z 1 a 2 b 3 c 4 d 5 e", "5"},
+		{"ZREMRANGEBYSCORE z (1 3", "2"},
+		{"ZRANGE z 0 -1", `["a" "d" "e"]`},
+		{"ZREMRANGEBYSCORE z 10 20", "0"},
+		{"ZREMRANGEBYSCORE z x 1", "error: min or max is not a float"},
+		{"ZREMRANGEBYSCORE z -inf +inf", "3"},
+		{"EXISTS z", "0"},
+	})
+}
+
+// TestZsetManyMembers puts enough members in a sorted set to give the skip
+// list many levels and checks ranks and ranges against their order.
+func TestZsetManyMembers(t *testing.T) {
+	dt := createDT()
+
+	for i := 0; i < 1000; i++ {
+		// scores out of order, ties broken by member
+		run(t, dt, "ZADD", "z", strconv.Itoa(i * 7 % 1000 / 2), fmt.Sprintf("m%04d", i * 7 % 1000))
+	}
+
+	for i := 0; i < 1000; i++ {
+		member := fmt.Sprintf("m%04d", i)
+		if got := run(t, dt, "ZRANK", "z", member); got.num != i {
+			t.Fatalf("ZRANK z %s = %d, want %d", member, got.num, i)
+		}
+	}
+
+	got := run(t, dt, "ZRANGE", "z", "100", "102", "BYSCORE")
+	if want := `["m0200" "m0201" "m0202" "m0203" "m0204" "m0205"]`; reply(got) != want {
+		t.Errorf("ZRANGE z 100 102 BYSCORE = %s, want %s", reply(got), want)
+	}
+
+	if got := run(t, dt, "ZREMRANGEBYSCORE", "z", "0", "249"); got.num != 500 {
+		t.Errorf("ZREMRANGEBYSCORE z 0 249 = %d, want 500", got.num)
+	}
+	if got := run(t, dt, "ZRANK", "z", "m0500"); got.num != 0 {
+		t.Errorf("ZRANK z m0500 after removing the first half = %d, want 0", got.num)
+	}
+}
+
+func TestZsetReplay(t *testing.T) {
+	checkReplay(t, []string{
+		"ZADD z 1 a 2 b 3 c 4 d 5 e",
+		"ZADD z INCR 10 a",
+		"ZINCRBY z -1.5 b",
+		"ZADD z XX GT 1 c 9 d",
+		"ZADD z -inf low +inf high",
+		"ZREM z e",
+		"ZPOPMIN z",
+		"ZPOPMAX z",
+		"ZADD gone 1 x",
+		"ZPOPMIN gone",
+		"ZADD r 1 a 2 b 3 c",
+		"ZREMRANGEBYSCORE r (1 2",
+		"ZADD ttl 1 a",
+		"PEXPIRE ttl 100000",
+	}, []string{
+		"ZRANGE z 0 -1 WITHSCORES",
+		"ZRANGE r 0 -1 WITHSCORES",
+		"EXISTS gone",
+		"PEXPIRETIME ttl",
+	})
+}